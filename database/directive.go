@@ -0,0 +1,81 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// DirectivePrefix starts the directives in the leading comments of
+// migrations, lines like `-- migrate:no-lock`
+const DirectivePrefix = "migrate:"
+
+// Directive is a directive in a leading comment line of a migration, e.g.
+// `-- migrate:isolation-level serializable`
+type Directive struct {
+	// Name is the directive's first word, e.g. `migrate:isolation-level`
+	Name string
+	// Arg is the rest of the line, trimmed, e.g. `serializable`
+	Arg string
+}
+
+// ParseDirectives returns the directives in the leading comment lines of
+// migration, in order. commentsOnly is true if migration has nothing but
+// blank and comment lines.
+func ParseDirectives(migration []byte) (directives []Directive, commentsOnly bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(migration))
+	scanner.Buffer(nil, len(migration)+1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "--") {
+			return directives, false
+		}
+		comment := strings.TrimSpace(strings.TrimPrefix(line, "--"))
+		if !strings.HasPrefix(comment, DirectivePrefix) {
+			continue
+		}
+		name := strings.Fields(comment)[0]
+		directives = append(directives, Directive{
+			Name: name,
+			Arg:  strings.TrimSpace(strings.TrimPrefix(comment, name)),
+		})
+	}
+	return directives, true
+}
+
+// LookupDirective returns the first directive named name
+func LookupDirective(directives []Directive, name string) (Directive, bool) {
+	for _, d := range directives {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return Directive{}, false
+}
+
+// isolationLevels are the names of the standard isolation levels
+var isolationLevels = map[string]sql.IsolationLevel{
+	"read uncommitted": sql.LevelReadUncommitted,
+	"read committed":   sql.LevelReadCommitted,
+	"repeatable read":  sql.LevelRepeatableRead,
+	"serializable":     sql.LevelSerializable,
+}
+
+// ParseIsolationLevel parses the name of an isolation level, e.g.
+// `serializable` or `read committed`, case insensitively and with `-` or `_`
+// between words
+func ParseIsolationLevel(name string) (sql.IsolationLevel, error) {
+	normalized := strings.Join(strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == ' ' || r == '-' || r == '_'
+	}), " ")
+	level, ok := isolationLevels[normalized]
+	if !ok {
+		return sql.LevelDefault, fmt.Errorf("unknown isolation level %q", name)
+	}
+	return level, nil
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestParseDirectives(t *testing.T) {
+	testcases := []struct {
+		name         string
+		migration    string
+		expected     []Directive
+		commentsOnly bool
+	}{
+		{
+			name: "directives",
+			migration: "-- @author: jane\n-- migrate:no-lock\n\n" +
+				"--migrate:verify   SELECT count(*) > 0 FROM users  \nCREATE TABLE users (id int);",
+			expected: []Directive{
+				{Name: "migrate:no-lock"},
+				{Name: "migrate:verify", Arg: "SELECT count(*) > 0 FROM users"},
+			},
+		},
+		{
+			name:      "after the first statement",
+			migration: "CREATE TABLE users (id int);\n-- migrate:no-lock",
+		},
+		{
+			name:         "comments only",
+			migration:    "-- migrate:noop\n-- moved to another service\n",
+			expected:     []Directive{{Name: "migrate:noop"}},
+			commentsOnly: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			directives, commentsOnly := ParseDirectives([]byte(tc.migration))
+			if !reflect.DeepEqual(directives, tc.expected) || commentsOnly != tc.commentsOnly {
+				t.Errorf("expected %v %v, got %v %v", tc.expected, tc.commentsOnly, directives, commentsOnly)
+			}
+		})
+	}
+}
+
+func TestParseIsolationLevel(t *testing.T) {
+	testcases := []struct {
+		name     string
+		expected sql.IsolationLevel
+		wantErr  bool
+	}{
+		{name: "serializable", expected: sql.LevelSerializable},
+		{name: "READ-COMMITTED", expected: sql.LevelReadCommitted},
+		{name: "repeatable_read", expected: sql.LevelRepeatableRead},
+		{name: "snapshot", expected: sql.LevelDefault, wantErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			level, err := ParseIsolationLevel(tc.name)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if level != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, level)
+			}
+		})
+	}
+}
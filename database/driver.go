@@ -5,6 +5,8 @@
 package database
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"io"
 	"sync"
@@ -104,6 +106,109 @@ type Driver interface {
 	Rollback() error
 }
 
+// Scripter is implemented by drivers that can render the statement SetVersion
+// executes, so migrations can be bundled into a standalone script.
+type Scripter interface {
+	// SetVersionStatement returns a statement recording version and dirty
+	// state, equivalent to calling SetVersion.
+	SetVersionStatement(version int, dirty bool) string
+}
+
+// History is implemented by drivers that keep a record of every version
+// applied, not only the current one.
+type History interface {
+	// AppliedVersions returns the versions recorded as applied, in ascending
+	// order. Dirty versions and NilVersion aren't included.
+	AppliedVersions() ([]uint, error)
+}
+
+// MetadataHistory is implemented by drivers that record the metadata headers
+// of migrations, see ParseMetadata, along with the versions they applied.
+type MetadataHistory interface {
+	// Metadata returns the metadata headers of the migration that applied
+	// version, nil if it had none.
+	Metadata(version uint) (map[string]string, error)
+}
+
+// ActorHistory is implemented by drivers that record who applied each version,
+// e.g. for audits.
+type ActorHistory interface {
+	// Actor returns who applied version, empty if it wasn't recorded.
+	Actor(version uint) (string, error)
+}
+
+// StatementHistory is implemented by drivers that record the digests of the
+// statements each migration executed, see multistmt.HashStatements, e.g. to
+// detect migrations edited after they were applied.
+type StatementHistory interface {
+	// StatementHashes returns the digests of the statements of the migration
+	// that applied version, in order, nil if they weren't recorded.
+	StatementHashes(version uint) ([]string, error)
+}
+
+// FailureHistory is implemented by drivers recording the direction of the
+// migrations that fail, see migrate.RetryCurrent.
+type FailureHistory interface {
+	// FailedDirection returns the direction, up or down, of the last
+	// migration that failed leaving the database dirty at version, empty if
+	// it isn't known.
+	FailedDirection(version int) (string, error)
+}
+
+// Cataloger is implemented by drivers that can describe the objects in the
+// schema, so schemas can be compared, e.g. before and after migrating.
+type Cataloger interface {
+	// Catalog returns a sorted description of the objects in the schema, one
+	// per object, leaving out the objects the driver keeps track of versions
+	// with.
+	Catalog() ([]string, error)
+}
+
+// ContextRunner is implemented by drivers that can abort a migration in
+// progress, e.g. when a deadline for migrating passes.
+type ContextRunner interface {
+	// RunContext is Run, aborting the migration when ctx is done.
+	RunContext(ctx context.Context, migration io.Reader) error
+}
+
+// IsolationBeginner is implemented by drivers that can begin the transaction
+// of a migration at the isolation level its `-- migrate:isolation-level`
+// directive sets.
+type IsolationBeginner interface {
+	// BeginIsolation is Begin, at level instead of the driver's default.
+	BeginIsolation(level sql.IsolationLevel) error
+}
+
+// ConditionalApplier is implemented by drivers that may decline to apply
+// migrations, e.g. on conditions only the database knows about. It's
+// consulted in each migration's transaction before its version is recorded
+// as dirty.
+type ConditionalApplier interface {
+	// ShouldApply reports whether the migration migrating to version runs. A
+	// migration it declines isn't run, its version is recorded as if it had
+	// been unless the driver leaves it out.
+	ShouldApply(version int) (bool, error)
+}
+
+// ResumeTokenStore is implemented by drivers persisting the resume token of
+// the run of migrations in progress, see migrate.Resume. Drivers not
+// configured to persist them return migrate.ErrNoResume from both methods.
+type ResumeTokenStore interface {
+	// SetResumeToken records token, replacing the one recorded before, in
+	// the transaction of the migration in progress if there's one. A nil
+	// token clears it.
+	SetResumeToken(token []byte) error
+	// ResumeToken returns the token recorded last, nil if there's none.
+	ResumeToken() ([]byte, error)
+}
+
+// RunIdentifier is implemented by drivers identifying each run of
+// migrations, from Lock to Unlock, e.g. to correlate them across logs.
+type RunIdentifier interface {
+	// RunID returns the id of the run in progress or of the last one.
+	RunID() string
+}
+
 // Open returns a new driver instance.
 func Open(url string) (Driver, error) {
 	scheme, err := iurl.SchemeFromURL(url)
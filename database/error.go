@@ -1,7 +1,9 @@
 package database
 
 import (
+	"errors"
 	"fmt"
+	"time"
 )
 
 // Error should be used for errors involving queries ran against the database
@@ -25,3 +27,39 @@ func (e Error) Error() string {
 	}
 	return fmt.Sprintf("%v in line %v: %s (details: %v)", e.Err, e.Line, e.Query, e.OrigErr)
 }
+
+// Code returns the SQLSTATE of the underlying error, e.g. 42501 for
+// insufficient privileges, so callers can branch on it instead of on the
+// error message. It's empty if the underlying error doesn't have one.
+func (e Error) Code() string {
+	// *pgconn.PgError of pgx
+	var stater interface{ SQLState() string }
+	if errors.As(e.OrigErr, &stater) {
+		return stater.SQLState()
+	}
+	// *pq.Error of lib/pq, whose fields are keyed by their protocol byte, 'C'
+	// being the SQLSTATE
+	var getter interface{ Get(k byte) string }
+	if errors.As(e.OrigErr, &getter) {
+		return getter.Get('C')
+	}
+	return ""
+}
+
+// RetryError is returned by Run when a migration failed transiently, e.g. to
+// acquire a lock, and may succeed if it's run again in a new transaction
+// after waiting After. Migration is the migration to run again, as Run read
+// it.
+type RetryError struct {
+	Err       error
+	After     time.Duration
+	Migration []byte
+}
+
+func (e *RetryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
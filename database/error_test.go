@@ -0,0 +1,36 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// pgError is an error with a SQLState method, like *pgconn.PgError
+type pgError struct{ code string }
+
+func (e *pgError) Error() string    { return "pg error " + e.code }
+func (e *pgError) SQLState() string { return e.code }
+
+func TestErrorCode(t *testing.T) {
+	testcases := []struct {
+		name string
+		err  error
+		code string
+	}{
+		{name: "pq", err: &pq.Error{Code: "42501", Message: "permission denied"}, code: "42501"},
+		{name: "wrapped pq", err: fmt.Errorf("creating table: %w", &pq.Error{Code: "42P07"}), code: "42P07"},
+		{name: "pgx", err: &pgError{code: "55P03"}, code: "55P03"},
+		{name: "other", err: errors.New("connection refused"), code: ""},
+		{name: "nil", err: nil, code: ""},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := (Error{OrigErr: tc.err}).Code(); code != tc.code {
+				t.Errorf("expected code %q, got %q", tc.code, code)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+)
+
+// metadataPrefix starts metadata headers in the leading comments of
+// migrations
+const metadataPrefix = "@"
+
+// ParseMetadata returns the metadata headers in the leading comment lines of
+// migration, lines like `-- @author: jane`, e.g. for change management audits.
+// Keys are the text between the `@` and the first `:`, values are trimmed.
+// It returns nil if there are none.
+func ParseMetadata(migration []byte) map[string]string {
+	var metadata map[string]string
+	scanner := bufio.NewScanner(bytes.NewReader(migration))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+		comment := strings.TrimSpace(strings.TrimPrefix(line, "--"))
+		if !strings.HasPrefix(comment, metadataPrefix) {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(comment, metadataPrefix), ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			continue
+		}
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[key] = strings.TrimSpace(value)
+	}
+	return metadata
+}
@@ -0,0 +1,38 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMetadata(t *testing.T) {
+	testcases := []struct {
+		name      string
+		migration string
+		expected  map[string]string
+	}{
+		{
+			name: "headers",
+			migration: "-- @author: jane\n--@ticket:  OPS-123 \n-- adds users\n\n" +
+				"-- @description: users table\nCREATE TABLE users (id int);",
+			expected: map[string]string{"author": "jane", "ticket": "OPS-123", "description": "users table"},
+		},
+		{
+			name:      "after the first statement",
+			migration: "CREATE TABLE users (id int);\n-- @author: jane",
+			expected:  nil,
+		},
+		{
+			name:      "not headers",
+			migration: "-- @ author\n-- @two words: x\n-- email me@example.com: x\nSELECT 1;",
+			expected:  nil,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if metadata := ParseMetadata([]byte(tc.migration)); !reflect.DeepEqual(metadata, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, metadata)
+			}
+		})
+	}
+}
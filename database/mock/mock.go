@@ -0,0 +1,210 @@
+// Package mock provides an in-memory database driver recording the calls made
+// to it, to test the migrate core without a database.
+package mock
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/getoutreach/migrate/v4/database"
+)
+
+func init() {
+	database.Register("mock", &Mock{})
+}
+
+// Mock is an in-memory database.Driver. It records every call made to it in
+// Calls and, unlike the stub driver, rolls back the versions recorded and the
+// migrations run in a transaction that's rolled back. Like in Postgres, a
+// failing migration aborts its transaction, which then fails every call but
+// Rollback.
+type Mock struct {
+	mu sync.Mutex
+
+	// Calls are the calls made to the driver in order, e.g. "Lock",
+	// "SetVersion(3, true)" or "Run(CREATE 3)"
+	Calls []string
+	// CurrentVersion and Dirty are the version recorded last
+	CurrentVersion int
+	Dirty          bool
+	// Applied are the bodies of the migrations run in committed transactions,
+	// in order
+	Applied []string
+	// Failed are the errors recorded by SetFailed by version
+	Failed map[int]error
+	// RunErr, if set, is called with the body of each migration run, the error
+	// it returns fails the migration
+	RunErr func(migration string) error
+
+	locked  bool
+	inTx    bool
+	aborted bool
+	// the state the transaction in progress rolls back to
+	txVersion int
+	txDirty   bool
+	txApplied int
+}
+
+// New returns a mock of an empty database
+func New() *Mock {
+	return &Mock{CurrentVersion: database.NilVersion, Failed: map[int]error{}}
+}
+
+// Open returns a mock of an empty database for any URL
+func (m *Mock) Open(url string) (database.Driver, error) {
+	return New(), nil
+}
+
+// record appends the call to Calls, m.mu must be held
+func (m *Mock) record(format string, a ...interface{}) {
+	m.Calls = append(m.Calls, fmt.Sprintf(format, a...))
+}
+
+func (m *Mock) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("Close")
+	return nil
+}
+
+func (m *Mock) Lock() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("Lock")
+	if m.locked {
+		return database.ErrLocked
+	}
+	m.locked = true
+	return nil
+}
+
+func (m *Mock) Unlock() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("Unlock")
+	if !m.locked {
+		return database.ErrNotLocked
+	}
+	m.locked = false
+	return nil
+}
+
+func (m *Mock) Run(migration io.Reader) error {
+	body, err := io.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("Run(%s)", body)
+	if err := m.checkAborted(); err != nil {
+		return err
+	}
+	if m.RunErr != nil {
+		if err := m.RunErr(string(body)); err != nil {
+			m.aborted = m.inTx
+			return err
+		}
+	}
+	m.Applied = append(m.Applied, string(body))
+	return nil
+}
+
+func (m *Mock) SetFailed(version int, err error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("SetFailed(%d)", version)
+	if m.Failed == nil {
+		m.Failed = map[int]error{}
+	}
+	m.Failed[version] = err
+	return m.checkAborted()
+}
+
+func (m *Mock) SetVersion(version int, dirty bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("SetVersion(%d, %v)", version, dirty)
+	if err := m.checkAborted(); err != nil {
+		return err
+	}
+	m.CurrentVersion, m.Dirty = version, dirty
+	return nil
+}
+
+func (m *Mock) Version() (*database.Version, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("Version")
+	return &database.Version{Version: m.CurrentVersion, Dirty: m.Dirty}, nil
+}
+
+func (m *Mock) Drop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("Drop")
+	m.CurrentVersion, m.Dirty, m.Applied = database.NilVersion, false, nil
+	return nil
+}
+
+func (m *Mock) Begin() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("Begin")
+	return m.begin()
+}
+
+// BeginIsolation begins a transaction like Begin, recording level
+func (m *Mock) BeginIsolation(level sql.IsolationLevel) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("BeginIsolation(%v)", level)
+	return m.begin()
+}
+
+// begin begins a transaction, m.mu must be held
+func (m *Mock) begin() error {
+	if m.inTx {
+		return fmt.Errorf("transaction already started")
+	}
+	m.inTx = true
+	m.txVersion, m.txDirty, m.txApplied = m.CurrentVersion, m.Dirty, len(m.Applied)
+	return nil
+}
+
+func (m *Mock) Commit() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("Commit")
+	if !m.inTx {
+		return fmt.Errorf("no transaction in progress")
+	}
+	if err := m.checkAborted(); err != nil {
+		return err
+	}
+	m.inTx = false
+	return nil
+}
+
+func (m *Mock) Rollback() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record("Rollback")
+	if !m.inTx {
+		return fmt.Errorf("no transaction in progress")
+	}
+	m.inTx, m.aborted = false, false
+	m.CurrentVersion, m.Dirty, m.Applied = m.txVersion, m.txDirty, m.Applied[:m.txApplied]
+	return nil
+}
+
+// checkAborted returns an error if the transaction in progress was aborted by
+// a failing migration, m.mu must be held
+func (m *Mock) checkAborted() error {
+	if m.aborted {
+		return fmt.Errorf("current transaction is aborted")
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package mock_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/getoutreach/migrate/v4"
+	"github.com/getoutreach/migrate/v4/database/mock"
+	"github.com/getoutreach/migrate/v4/source"
+	sStub "github.com/getoutreach/migrate/v4/source/stub"
+)
+
+func newMigrate(t *testing.T, db *mock.Mock) *migrate.Migrate {
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "DROP 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Down, Identifier: "DROP 2"})
+	src, _ := sStub.WithInstance(nil, &sStub.Config{})
+	src.(*sStub.Stub).Migrations = migrations
+
+	m, err := migrate.NewWithInstance("stub", src, "mock", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestUp(t *testing.T) {
+	db := mock.New()
+	m := newMigrate(t, db)
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the version is read before locking to find out if there's anything to do
+	want := []string{
+		"Version", "Lock", "Version",
+		"Begin", "SetVersion(1, true)", "Run(CREATE 1)", "SetVersion(1, false)", "Commit",
+		"Begin", "SetVersion(2, true)", "Run(CREATE 2)", "SetVersion(2, false)", "Commit",
+		"Unlock",
+	}
+	if !reflect.DeepEqual(db.Calls, want) {
+		t.Fatalf("expected calls %v, got %v", want, db.Calls)
+	}
+	if db.CurrentVersion != 2 || db.Dirty {
+		t.Fatalf("expected clean version 2, got %v dirty %v", db.CurrentVersion, db.Dirty)
+	}
+
+	// up to date, the lock isn't taken
+	db.Calls = nil
+	if err := m.Up(); !errors.Is(err, migrate.ErrNoChange) {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+	if want := []string{"Version"}; !reflect.DeepEqual(db.Calls, want) {
+		t.Fatalf("expected calls %v, got %v", want, db.Calls)
+	}
+}
+
+func TestDown(t *testing.T) {
+	db := mock.New()
+	m := newMigrate(t, db)
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"CREATE 1", "CREATE 2", "DROP 2", "DROP 1"}
+	if !reflect.DeepEqual(db.Applied, want) {
+		t.Fatalf("expected migrations %v, got %v", want, db.Applied)
+	}
+	if db.CurrentVersion != -1 || db.Dirty {
+		t.Fatalf("expected clean nil version, got %v dirty %v", db.CurrentVersion, db.Dirty)
+	}
+}
+
+func TestFailure(t *testing.T) {
+	db := mock.New()
+	failure := errors.New("syntax error")
+	db.RunErr = func(migration string) error {
+		if migration == "CREATE 2" {
+			return failure
+		}
+		return nil
+	}
+	m := newMigrate(t, db)
+	if err := m.Up(); !errors.Is(err, failure) {
+		t.Fatalf("expected the migration's error, got %v", err)
+	}
+
+	// the failed migration's transaction is rolled back, the one before stays applied
+	if db.CurrentVersion != 1 || db.Dirty {
+		t.Fatalf("expected clean version 1, got %v dirty %v", db.CurrentVersion, db.Dirty)
+	}
+	if !reflect.DeepEqual(db.Applied, []string{"CREATE 1"}) {
+		t.Fatalf("expected only the first migration applied, got %v", db.Applied)
+	}
+	if !errors.Is(db.Failed[2], failure) {
+		t.Fatalf("expected the failure of version 2 to be recorded, got %v", db.Failed)
+	}
+	if last := db.Calls[len(db.Calls)-1]; last != "Unlock" {
+		t.Fatalf("expected the lock to be released, got %v", db.Calls)
+	}
+}
@@ -0,0 +1,363 @@
+package multistmt
+
+import (
+	"bytes"
+	"strings"
+)
+
+// StatementKind is the broad category of the command a statement executes.
+type StatementKind int
+
+const (
+	// StatementUnknown is returned for empty statements and unrecognized commands
+	StatementUnknown StatementKind = iota
+	// StatementQuery is a read-only query like SELECT, VALUES, SHOW or EXPLAIN
+	StatementQuery
+	// StatementDML modifies data, e.g. INSERT, UPDATE, DELETE, MERGE or COPY
+	StatementDML
+	// StatementDDL modifies the schema, e.g. CREATE, ALTER, DROP or GRANT
+	StatementDDL
+	// StatementTransaction controls the transaction, e.g. BEGIN or COMMIT
+	StatementTransaction
+	// StatementUtility is any other recognized command, e.g. SET, VACUUM or DO
+	StatementUtility
+)
+
+// String implements fmt.Stringer
+func (k StatementKind) String() string {
+	switch k {
+	case StatementQuery:
+		return "query"
+	case StatementDML:
+		return "dml"
+	case StatementDDL:
+		return "ddl"
+	case StatementTransaction:
+		return "transaction"
+	case StatementUtility:
+		return "utility"
+	default:
+		return "unknown"
+	}
+}
+
+// statementKinds maps the leading keyword of a statement to its kind
+var statementKinds = map[string]StatementKind{
+	"SELECT":  StatementQuery,
+	"VALUES":  StatementQuery,
+	"TABLE":   StatementQuery,
+	"SHOW":    StatementQuery,
+	"EXPLAIN": StatementQuery,
+	"FETCH":   StatementQuery,
+
+	"INSERT": StatementDML,
+	"UPDATE": StatementDML,
+	"DELETE": StatementDML,
+	"MERGE":  StatementDML,
+	"COPY":   StatementDML,
+
+	"CREATE":   StatementDDL,
+	"ALTER":    StatementDDL,
+	"DROP":     StatementDDL,
+	"TRUNCATE": StatementDDL,
+	"COMMENT":  StatementDDL,
+	"GRANT":    StatementDDL,
+	"REVOKE":   StatementDDL,
+	"SECURITY": StatementDDL,
+
+	"BEGIN":     StatementTransaction,
+	"START":     StatementTransaction,
+	"COMMIT":    StatementTransaction,
+	"END":       StatementTransaction,
+	"ROLLBACK":  StatementTransaction,
+	"ABORT":     StatementTransaction,
+	"SAVEPOINT": StatementTransaction,
+	"RELEASE":   StatementTransaction,
+
+	"SET":        StatementUtility,
+	"RESET":      StatementUtility,
+	"VACUUM":     StatementUtility,
+	"ANALYZE":    StatementUtility,
+	"CLUSTER":    StatementUtility,
+	"REINDEX":    StatementUtility,
+	"REFRESH":    StatementUtility,
+	"LOCK":       StatementUtility,
+	"DO":         StatementUtility,
+	"CALL":       StatementUtility,
+	"NOTIFY":     StatementUtility,
+	"LISTEN":     StatementUtility,
+	"UNLISTEN":   StatementUtility,
+	"DISCARD":    StatementUtility,
+	"CHECKPOINT": StatementUtility,
+	"LOAD":       StatementUtility,
+	"PREPARE":    StatementUtility,
+	"EXECUTE":    StatementUtility,
+	"DEALLOCATE": StatementUtility,
+	"DECLARE":    StatementUtility,
+	"CLOSE":      StatementUtility,
+	"MOVE":       StatementUtility,
+}
+
+// ClassifyStatement returns the kind of the command executed by stmt.
+// Leading whitespace, `--` and `/* */` comments and opening parentheses are
+// skipped, and statements starting with a `WITH` clause are classified by the
+// command following the common table expressions, so
+// `WITH x AS (...) UPDATE ...` is StatementDML.
+func ClassifyStatement(stmt []byte) StatementKind {
+	kind, ok := statementKinds[StatementCommand(stmt)]
+	if !ok {
+		return StatementUnknown
+	}
+	return kind
+}
+
+// StatementCommand returns the upper cased keyword of the command executed by
+// stmt, e.g. "UPDATE" for `WITH x AS (...) UPDATE ...`. It returns an empty
+// string if no command could be found.
+func StatementCommand(stmt []byte) string {
+	word, _ := statementCommand(stmt)
+	return word
+}
+
+// StatementTable returns the table modified by the DML statement stmt as
+// written, possibly schema qualified and quoted, e.g. `"Foo"` for
+// `INSERT INTO "Foo" ...` or `public.foo` for `WITH x AS (...) UPDATE ONLY
+// public.foo ...`. It returns an empty string for statements that aren't DML
+// or whose table couldn't be found, like `COPY (query) TO ...`.
+func StatementTable(stmt []byte) string {
+	word, i := statementCommand(stmt)
+	var skip []string
+	switch word {
+	case "INSERT", "MERGE":
+		skip = []string{"INTO"}
+	case "UPDATE", "COPY":
+		skip = []string{"ONLY"}
+	case "DELETE":
+		skip = []string{"FROM", "ONLY"}
+	default:
+		return ""
+	}
+	i = skipSpaceAndComments(stmt, i)
+	for _, s := range skip {
+		if next, j := readWord(stmt, i); next == s {
+			i = skipSpaceAndComments(stmt, j)
+		}
+	}
+	start := i
+	for i < len(stmt) {
+		if stmt[i] == '"' {
+			i = skipQuoted(stmt, i, '"')
+		} else if _, j := readWord(stmt, i); j > i {
+			i = j
+		} else {
+			break
+		}
+		if i >= len(stmt) || stmt[i] != '.' {
+			break
+		}
+		i++
+	}
+	return string(stmt[start:i])
+}
+
+// StatementKeywords returns the upper cased words stmt starts with, up to n of
+// them, e.g. ["CREATE", "UNIQUE", "INDEX", "IF"] for
+// `CREATE UNIQUE INDEX IF NOT EXISTS ...` and n = 4. Comments between words
+// are skipped, the words end at the first token that isn't one, like a quoted
+// identifier or a parenthesis.
+func StatementKeywords(stmt []byte, n int) []string {
+	var words []string
+	i := 0
+	for len(words) < n {
+		word, j := readWord(stmt, skipSpaceAndComments(stmt, i))
+		if word == "" {
+			break
+		}
+		words = append(words, word)
+		i = j
+	}
+	return words
+}
+
+// statementCommand returns the upper cased keyword of the command executed by
+// stmt and the index following it
+func statementCommand(stmt []byte) (string, int) {
+	i := skipSpaceAndComments(stmt, 0)
+	for i < len(stmt) && stmt[i] == '(' {
+		i = skipSpaceAndComments(stmt, i+1)
+	}
+	word, i := readWord(stmt, i)
+	if word != "WITH" {
+		return word, i
+	}
+
+	// WITH [RECURSIVE] name [(columns)] AS [[NOT] MATERIALIZED] (query) [, ...] command
+	next, j := readWord(stmt, skipSpaceAndComments(stmt, i))
+	if next == "RECURSIVE" {
+		i = j
+	}
+	for {
+		// cte name, possibly quoted
+		i = skipSpaceAndComments(stmt, i)
+		if i < len(stmt) && stmt[i] == '"' {
+			i = skipQuoted(stmt, i, '"')
+		} else {
+			_, i = readWord(stmt, i)
+		}
+		// optional column list
+		i = skipSpaceAndComments(stmt, i)
+		if i < len(stmt) && stmt[i] == '(' {
+			i = skipParens(stmt, i)
+		}
+		if word, i = readWord(stmt, skipSpaceAndComments(stmt, i)); word != "AS" {
+			return "", i
+		}
+		// skip everything up to the body of the common table expression
+		for {
+			i = skipSpaceAndComments(stmt, i)
+			if i >= len(stmt) || stmt[i] == '(' {
+				break
+			}
+			if word, i = readWord(stmt, i); word == "" {
+				return "", i
+			}
+		}
+		if i >= len(stmt) {
+			return "", i
+		}
+		i = skipSpaceAndComments(stmt, skipParens(stmt, i))
+		if i < len(stmt) && stmt[i] == ',' {
+			i++
+			continue
+		}
+		return readWord(stmt, i)
+	}
+}
+
+// skipSpaceAndComments returns the index of the first byte at or after i that
+// is neither whitespace nor part of a comment
+func skipSpaceAndComments(b []byte, i int) int {
+	for i < len(b) {
+		switch {
+		case b[i] == ' ' || b[i] == '\t' || b[i] == '\n' || b[i] == '\r' || b[i] == '\f':
+			i++
+		case bytes.HasPrefix(b[i:], []byte("--")):
+			end := bytes.IndexByte(b[i:], '\n')
+			if end < 0 {
+				return len(b)
+			}
+			i += end + 1
+		case bytes.HasPrefix(b[i:], []byte("/*")):
+			// postgres block comments nest
+			depth := 0
+			for i < len(b) {
+				if bytes.HasPrefix(b[i:], []byte("/*")) {
+					depth++
+					i += 2
+				} else if bytes.HasPrefix(b[i:], []byte("*/")) {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// readWord reads an unquoted identifier or keyword starting at i and returns
+// it upper cased along with the index following it
+func readWord(b []byte, i int) (string, int) {
+	start := i
+	for i < len(b) && isIdentByte(b[i]) {
+		i++
+	}
+	return strings.ToUpper(string(b[start:i])), i
+}
+
+// isIdentByte reports whether c can be part of an unquoted identifier
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// skipQuoted skips a quoted string or identifier starting at i, where b[i] is
+// the quote character. A doubled quote character is an escaped quote.
+func skipQuoted(b []byte, i int, quote byte) int {
+	for i++; i < len(b); i++ {
+		if b[i] == quote {
+			if i+1 < len(b) && b[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return i
+}
+
+// skipParens skips the balanced parentheses starting at i, where b[i] is '('.
+// Parentheses inside strings, quoted identifiers, dollar quoted strings and
+// comments are ignored.
+func skipParens(b []byte, i int) int {
+	depth := 0
+	for i < len(b) {
+		switch c := b[i]; {
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			depth--
+			i++
+			if depth == 0 {
+				return i
+			}
+		case c == '\'' || c == '"':
+			i = skipQuoted(b, i, c)
+		case c == '$':
+			if tag := dollarTag(b[i:]); tag != nil {
+				end := bytes.Index(b[i+len(tag):], tag)
+				if end < 0 {
+					return len(b)
+				}
+				i += 2*len(tag) + end
+			} else {
+				i++
+			}
+		case c == '-' || c == '/':
+			if j := skipSpaceAndComments(b, i); j > i {
+				i = j
+			} else {
+				i++
+			}
+		default:
+			i++
+		}
+	}
+	return i
+}
+
+// dollarTag returns the dollar quote tag (e.g. `$$` or `$body$`) at the start
+// of b, or nil if b doesn't start with one
+func dollarTag(b []byte) []byte {
+	if len(b) == 0 || b[0] != '$' {
+		return nil
+	}
+	for i := 1; i < len(b); i++ {
+		switch c := b[i]; {
+		case c == '$':
+			return b[:i+1]
+		case c == '_' || c >= 0x80 || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z'):
+		case '0' <= c && c <= '9' && i > 1:
+		default:
+			return nil
+		}
+	}
+	return nil
+}
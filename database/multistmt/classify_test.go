@@ -0,0 +1,121 @@
+package multistmt_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getoutreach/migrate/v4/database/multistmt"
+)
+
+func TestClassifyStatement(t *testing.T) {
+	testCases := []struct {
+		name        string
+		stmt        string
+		wantCommand string
+		wantKind    multistmt.StatementKind
+	}{
+		{name: "plain select",
+			stmt:        "SELECT 1;",
+			wantCommand: "SELECT",
+			wantKind:    multistmt.StatementQuery},
+		{name: "lower case with leading whitespace",
+			stmt:        " \n\tinsert into foo values (1);",
+			wantCommand: "INSERT",
+			wantKind:    multistmt.StatementDML},
+		{name: "cte update",
+			stmt:        "WITH x AS (SELECT id FROM foo WHERE bar = ')') UPDATE foo SET baz = 1 FROM x WHERE foo.id = x.id;",
+			wantCommand: "UPDATE",
+			wantKind:    multistmt.StatementDML},
+		{name: "recursive cte with columns and multiple expressions",
+			stmt:        "WITH RECURSIVE t(n) AS (VALUES (1) UNION ALL SELECT n+1 FROM t WHERE n < 10), \"u\" AS MATERIALIZED (SELECT 2) SELECT * FROM t, u;",
+			wantCommand: "SELECT",
+			wantKind:    multistmt.StatementQuery},
+		{name: "cte delete",
+			stmt:        "with old as not materialized (select id from foo) delete from foo using old where foo.id = old.id;",
+			wantCommand: "DELETE",
+			wantKind:    multistmt.StatementDML},
+		{name: "block comment hint",
+			stmt:        "/* c */ DROP TABLE foo;",
+			wantCommand: "DROP",
+			wantKind:    multistmt.StatementDDL},
+		{name: "nested block comment and line comment",
+			stmt:        "/* outer /* inner */ still comment */\n-- line comment\nCREATE TABLE foo (id int);",
+			wantCommand: "CREATE",
+			wantKind:    multistmt.StatementDDL},
+		{name: "parenthesized query",
+			stmt:        "(SELECT 1) UNION (SELECT 2);",
+			wantCommand: "SELECT",
+			wantKind:    multistmt.StatementQuery},
+		{name: "transaction control",
+			stmt:        "COMMIT;",
+			wantCommand: "COMMIT",
+			wantKind:    multistmt.StatementTransaction},
+		{name: "utility",
+			stmt:        "SET LOCAL work_mem = '64MB';",
+			wantCommand: "SET",
+			wantKind:    multistmt.StatementUtility},
+		{name: "only comments",
+			stmt:        "-- nothing to see here",
+			wantCommand: "",
+			wantKind:    multistmt.StatementUnknown},
+		{name: "unknown command",
+			stmt:        "FROBNICATE foo;",
+			wantCommand: "FROBNICATE",
+			wantKind:    multistmt.StatementUnknown},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wantCommand, multistmt.StatementCommand([]byte(tc.stmt)))
+			assert.Equal(t, tc.wantKind, multistmt.ClassifyStatement([]byte(tc.stmt)))
+		})
+	}
+}
+
+func TestStatementTable(t *testing.T) {
+	testCases := []struct {
+		name      string
+		stmt      string
+		wantTable string
+	}{
+		{name: "insert", stmt: "INSERT INTO foo (id) VALUES (1);", wantTable: "foo"},
+		{name: "schema qualified quoted insert", stmt: "insert into public.\"Foo\" select * from bar;", wantTable: "public.\"Foo\""},
+		{name: "update only", stmt: "UPDATE ONLY foo SET bar = 1;", wantTable: "foo"},
+		{name: "cte delete", stmt: "WITH x AS (SELECT 1) DELETE FROM foo USING x;", wantTable: "foo"},
+		{name: "comment before table", stmt: "DELETE FROM /* c */ foo;", wantTable: "foo"},
+		{name: "copy from", stmt: "COPY foo (id) FROM STDIN;", wantTable: "foo"},
+		{name: "copy query", stmt: "COPY (SELECT 1) TO STDOUT;", wantTable: ""},
+		{name: "merge", stmt: "MERGE INTO foo USING bar ON foo.id = bar.id WHEN MATCHED THEN DO NOTHING;", wantTable: "foo"},
+		{name: "not dml", stmt: "CREATE TABLE foo (id int);", wantTable: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wantTable, multistmt.StatementTable([]byte(tc.stmt)))
+		})
+	}
+}
+
+func TestStatementKeywords(t *testing.T) {
+	testCases := []struct {
+		name      string
+		stmt      string
+		n         int
+		wantWords []string
+	}{
+		{name: "limited", stmt: "create unique index if not exists foo on bar (id);", n: 4,
+			wantWords: []string{"CREATE", "UNIQUE", "INDEX", "IF"}},
+		{name: "comments", stmt: "-- drop it\nDROP /* c */ TABLE foo;", n: 5,
+			wantWords: []string{"DROP", "TABLE", "FOO"}},
+		{name: "quoted identifier", stmt: "DROP TABLE \"Foo\";", n: 5,
+			wantWords: []string{"DROP", "TABLE"}},
+		{name: "empty", stmt: " ;", n: 5, wantWords: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wantWords, multistmt.StatementKeywords([]byte(tc.stmt), tc.n))
+		})
+	}
+}
@@ -3,8 +3,13 @@ package multistmt
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
 // ParseBufSize is the buffer size for the multi-statement reader
@@ -13,54 +18,292 @@ var ParseBufSize = 1024
 // ParseTrace is a flag that enables tracing during parsing
 var ParseTrace bool
 
+// ErrUnterminated is returned when a migration ends in a quoted string, a
+// dollar-quoted body or a block comment, which would otherwise swallow the
+// statements after its opening quietly.
+var ErrUnterminated = errors.New("unterminated quote, dollar-quoted body or block comment")
+
+// ErrStopParsing can be returned by a Handler to stop parsing without failing,
+// Parse returns nil in that case.
+var ErrStopParsing = errors.New("stop parsing")
+
 // Handler handles a single migration parsed from a multi-statement migration.
-// It's given the single migration to handle and returns whether or not further statements
-// from the multi-statement migration should be parsed and handled.
+// It's given the single migration to handle and returns an error to stop
+// parsing. Returning ErrStopParsing stops parsing further statements from the
+// multi-statement migration without Parse failing.
 type Handler func(migration []byte) error
 
+// OffsetHandler handles a statement parsed by ParseWithOffsets, like Handler.
+// startOffset is the byte offset in the input of the statement's first
+// character other than whitespace, endOffset the offset right after its
+// terminator, so input[startOffset:endOffset] is the statement as written,
+// including the comments in it.
+type OffsetHandler func(stmt []byte, startOffset, endOffset int) error
+
+// Dialect is the syntax a Parser splits statements by, selected by drivers
+// for the SQL of their database.
+type Dialect struct {
+	// Name identifies the dialect, e.g. in ParserConfig
+	Name string
+	// Terminator ends statements, it may be several characters long
+	Terminator string
+	// Comments are the markers of comments running to the end of the line,
+	// one or two characters long
+	Comments []string
+	// Quotes are the characters quoting strings and identifiers, terminators
+	// and comment markers in them aren't special
+	Quotes string
+	// DollarQuotes enables bodies quoted with $$ or tagged like $body$, e.g.
+	// of functions, terminators and comment markers in them aren't special
+	DollarQuotes bool
+	// BlockComments enables /* ... */ comments, NestedBlockComments nesting
+	// them like Postgres does
+	BlockComments       bool
+	NestedBlockComments bool
+	// EscapeStrings enables E'...' strings, in which a backslash escapes the
+	// character after it, e.g. a quote
+	EscapeStrings bool
+	// DelimiterCommand enables lines like `DELIMITER //`, as of the mysql
+	// client, changing the terminator of the statements following them. The
+	// lines themselves aren't emitted.
+	DelimiterCommand bool
+}
+
+// DialectPostgres is the dialect of Postgres, the default of Parser
+var DialectPostgres = Dialect{
+	Name:                "postgres",
+	Terminator:          ";",
+	Comments:            []string{"--", "//"},
+	Quotes:              `'"`,
+	DollarQuotes:        true,
+	BlockComments:       true,
+	NestedBlockComments: true,
+	EscapeStrings:       true,
+}
+
+// DialectMySQL is the dialect of MySQL
+var DialectMySQL = Dialect{
+	Name:             "mysql",
+	Terminator:       ";",
+	Comments:         []string{"--", "#"},
+	Quotes:           "'\"`",
+	DelimiterCommand: true,
+	BlockComments:    true,
+}
+
+// Parser parses multi-statement migrations. The zero value is ready to use and
+// emits statements including their terminating ';', like Parse.
+type Parser struct {
+	// Dialect is the syntax statements are split by, DialectPostgres if it's
+	// the zero value
+	Dialect Dialect
+	// StripTerminator leaves the terminating ';' out of emitted statements,
+	// for execution paths that reject it, e.g. prepared statements.
+	// Semicolons in function bodies and quoted strings are kept.
+	StripTerminator bool
+	// NormalizeWhitespace collapses runs of whitespace in emitted statements
+	// to single spaces and trims them, e.g. for logging statements or hashing
+	// them independently of their formatting. Whitespace in quoted strings
+	// and function bodies is kept.
+	NormalizeWhitespace bool
+	// SkipPsqlMeta drops lines starting with a backslash, outside of quoted
+	// strings and function bodies, as psql meta-commands like `\timing` or
+	// `\connect` that only psql understands. The data of COPY ... FROM stdin,
+	// ended by `\.`, isn't supported in migrations either way.
+	SkipPsqlMeta bool
+	// DeferForeignKeys holds back the statements adding foreign keys that are
+	// preceded by a DeferDirective comment line, e.g.
+	//  -- migrate:defer
+	//  ALTER TABLE orders ADD CONSTRAINT orders_user_fk FOREIGN KEY (user_id) REFERENCES users (id);
+	// and emits them after all other statements, so tables are loaded before
+	// the constraints are checked. The directive on other statements fails
+	// parsing.
+	DeferForeignKeys bool
+}
+
+// DeferDirective is the comment flagging a statement adding a foreign key to
+// be deferred to the end of the migration, see Parser.DeferForeignKeys
+const DeferDirective = "migrate:defer"
+
+// ParserConfig is the effective configuration of a Parser, e.g. to log it when
+// comparing how migrations parse in different environments.
+type ParserConfig struct {
+	// BufSize is ParseBufSize, the size of the reads from the migration
+	BufSize int `json:"buf_size"`
+	// Dialect is the name of the dialect
+	Dialect string `json:"dialect"`
+	// Terminator ends statements, until a DELIMITER command changes it
+	Terminator string `json:"terminator"`
+	// Comments are the markers of comments running to the end of the line
+	Comments            []string `json:"comments"`
+	StripTerminator     bool     `json:"strip_terminator"`
+	NormalizeWhitespace bool     `json:"normalize_whitespace"`
+	SkipPsqlMeta        bool     `json:"skip_psql_meta"`
+	DeferForeignKeys    bool     `json:"defer_foreign_keys"`
+}
+
+// Config returns the configuration the parser parses with, including the
+// package level settings like ParseBufSize.
+func (p *Parser) Config() ParserConfig {
+	d := p.dialect()
+	return ParserConfig{
+		BufSize:             ParseBufSize,
+		Dialect:             d.Name,
+		Terminator:          d.Terminator,
+		Comments:            d.Comments,
+		StripTerminator:     p.StripTerminator,
+		NormalizeWhitespace: p.NormalizeWhitespace,
+		SkipPsqlMeta:        p.SkipPsqlMeta,
+		DeferForeignKeys:    p.DeferForeignKeys,
+	}
+}
+
+// String returns the configuration as JSON
+func (c ParserConfig) String() string {
+	// the fields are all encodable, marshaling can't fail
+	b, _ := json.Marshal(c)
+	return string(b)
+}
+
+// dialect returns the dialect of the parser
+func (p *Parser) dialect() Dialect {
+	if p.Dialect.Terminator == "" {
+		return DialectPostgres
+	}
+	return p.Dialect
+}
+
+// Parse parses the given multi-statement migration with the default options
+func Parse(reader io.Reader, delimiter []byte, maxMigrationSize int, replacementStatement string, h Handler) error {
+	return (&Parser{}).Parse(reader, delimiter, maxMigrationSize, replacementStatement, h)
+}
+
+// ParseWithOffsets parses the given multi-statement migration with the default
+// options, passing the offsets of each statement in it to h
+func ParseWithOffsets(reader io.Reader, h OffsetHandler) error {
+	return (&Parser{}).ParseWithOffsets(reader, h)
+}
+
 // Parse parses the given multi-statement migration
-func Parse(reader io.Reader, _ []byte, _ int, replacementStatement string, h Handler) error {
+func (p *Parser) Parse(reader io.Reader, _ []byte, _ int, replacementStatement string, h Handler) error {
+	return p.parse(reader, replacementStatement, func(stmt []byte, _, _ int) error {
+		return h(stmt)
+	})
+}
+
+// ParseWithOffsets parses the given multi-statement migration like Parse,
+// passing the offsets of each statement in it to h, e.g. to highlight the
+// statements of a migration file.
+func (p *Parser) ParseWithOffsets(reader io.Reader, h OffsetHandler) error {
+	return p.parse(reader, "", h)
+}
+
+// HashStatements returns the hex encoded SHA-256 digest of each statement of
+// the migration, in order. Statements are parsed with NormalizeWhitespace, so
+// reformatting them or editing comments between them doesn't change their
+// digests, e.g. to record what a migration executed and detect edits later.
+func HashStatements(reader io.Reader) ([]string, error) {
+	hashes := []string{}
+	// the parser only emits terminated statements, terminate the last one in
+	// case the migration doesn't
+	reader = io.MultiReader(reader, strings.NewReader("\n;"))
+	err := (&Parser{NormalizeWhitespace: true}).Parse(reader, nil, 0, "", func(stmt []byte) error {
+		if string(bytes.TrimSpace(stmt)) == ";" {
+			return nil
+		}
+		sum := sha256.Sum256(stmt)
+		hashes = append(hashes, hex.EncodeToString(sum[:]))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// parse splits the statements of reader, see Parse
+func (p *Parser) parse(reader io.Reader, replacementStatement string, h OffsetHandler) error {
 	// notes:
 	// 1. comment chars will be detected anywhere, a '--' in the middle of a
 	//    line will start comment mode(good and bad)
 	// 2. input can be arbitrarily large, but the internal buffers will be
 	//    problems(like statements)
 	// 3. could be converted to work with logger, for now fmt is still used
-	// 4. doesn't support /* */ c-style comments (future)
-	// 5. doesn't support nested comments (future)
-	// 6. now supports plpgsql trigger bodies
+	// 4. /* */ c-style comments are left out like line comments, they
+	//    separate the tokens around them
+	// 5. supports nested c-style comments
+	// 6. now supports plpgsql trigger bodies, in $$ or tagged $tag$ dollar quotes.
+	//    Only the tag that opened a body closes it, dollar quotes with other
+	//    tags nested in it, e.g. `EXECUTE $q$ ... $q$`, are part of the body.
+	// 7. ';', '--' and '//' in quoted strings and identifiers aren't special
+	// 8. terminators, comments, quotes and dollar quotes are those of the
+	//    dialect, the notes above are about DialectPostgres
+	// 9. backslashes escape the next character in E'...' strings
+	// 10. input ending in a quote, body or c-style comment fails with
+	//    ErrUnterminated
+	d := p.dialect()
+	// terminator ends statements, DELIMITER commands change it
+	terminator := []byte(d.Terminator)
 	var err error = nil
-	// buf is the bytes read from input reader
-	buf := make([]byte, ParseBufSize)
+	// buf is the bytes read from input reader, preceded by the bytes carried
+	// over from the previous read. It's allocated once and reused by every read.
+	buf := make([]byte, ParseBufSize+1)
 	// true when we're ignoring input(during comments)
 	discard := false
 	// fnbody is true when a function body delimiters $$ are encountered
 	fnbody := false
+	// tag is the dollar quote, e.g. $$ or $body$, that opened the function body
+	var tag string
+	// tagStart is the index in accum of the '$' that may start a dollar quote,
+	// -1 when there's none. Tags can span reads, so they're matched in accum.
+	tagStart := -1
+	// lineStart is true while only whitespace has been read since the last
+	// line break
+	lineStart := true
+	// quote is the quote character of the string or identifier being read,
+	// zero outside of them
+	var quote byte
+	// escapes is true when backslashes escape the next character in the
+	// string being read, escapeNext when the previous character was one
+	escapes, escapeNext := false, false
+	// blockDepth is the nesting depth of the c-style comment being read,
+	// skipNext is true when the next character is the second of its marker
+	blockDepth := 0
+	skipNext := false
 	// accumulate statements intermediate buffer, this buffer will be incomplete
 	// until end-of-statement char ';'
 	accum := make([]byte, 0, 2048)
-	// tmp is a carry-over buffer used when doing look ahead,
-	// tmp is the characters in the buf that are insufficient to do a look ahead
+	// carried is the number of bytes at the start of buf carried over when doing
+	// look ahead, the characters that are insufficient to do a look ahead
 	// comparison but could be combined with characters further in the stream.
-	var tmp []byte
+	carried := 0
 	// counter is using during tracing to keep track of a total number of characters
 	counter := 0
+	// comment is the text of the comment being read, from its marker, while
+	// commenting is true
+	var comment []byte
+	commenting := false
+	// start is the offset in the input of the first character of the
+	// statement being read other than whitespace, -1 until there is one
+	start := -1
+	// deferNext is true when the next statement is flagged by a DeferDirective,
+	// deferred are the statements held back until the end of the input
+	deferNext := false
+	type offsetStmt struct {
+		stmt       []byte
+		start, end int
+	}
+	var deferred []offsetStmt
 	for err == nil {
-		n, err := reader.Read(buf)
-		trace("tmp(2): '%s', buf: %s, discard: %v\n", tmp, buf, discard)
-		// tmp is the carry-over buffer,
 		// if the previous loop iteration had two few characters to make comparisions,
-		// tmp will have the characters at the point the loop iteration was abandoned(
-		// break'd out of)
-		trace("prepending '%s' to buf: %s\n", tmp, buf)
-		buf = append(tmp, buf...)
-		trace("len(buf): %d, buf: %s\n", len(buf), buf)
-		// n needs to include the length of tmp since it was copied into n,
-		// but n originally only held the number of chars read from the
-		// reader.Read(buf) call.
-		n = n + len(tmp)
-		// erase tmp, we put tmp's contents in buf
-		tmp = tmp[:0]
+		// the characters at the point the loop iteration was abandoned(break'd out of)
+		// were moved to the start of buf, read after them.
+		n, err := reader.Read(buf[carried : carried+ParseBufSize])
+		trace("carried(2): %d, buf: %s, discard: %v\n", carried, buf[:carried+n], discard)
+		// n needs to include the carried bytes, but n originally only held the
+		// number of chars read from the reader.Read(buf) call.
+		n = n + carried
+		carried = 0
 
 		if n > 0 {
 			// buf needs capacity(it is initialized with capapcity and length the same)
@@ -69,97 +312,252 @@ func Parse(reader io.Reader, _ []byte, _ int, replacementStatement string, h Han
 			// that are now in buf also.
 			for i := range buf[:n] {
 				// 2 here is the number of look ahead characters that we use.
-				// This tmp buffer is used to copy over bytes from the current loop
-				// iteration if there are not enough characters to lookahead and find a match
-				if i+1 >= len(buf) {
-					tmp = make([]byte, n-i)
-					trace("copying '%s' to tmp %s, len(tmp): %d\n", buf[i:n],
-						tmp,
-						len(tmp))
-
-					copy(tmp, buf[i:n])
+				// The bytes from the current loop iteration are carried over to the next
+				// read if there are not enough characters to lookahead and find a match.
+				// Only the n bytes read are valid, anything after them in buf is left over
+				// from previous reads. Readers may return fewer bytes than requested, so
+				// this also happens in the middle of the input, e.g. between the two
+				// characters of a `$$` delimiter. At EOF there is nothing left to look ahead at.
+				if i+1 >= n && err != io.EOF {
+					// the bytes being carried over may overlap with their destination,
+					// which copy handles
+					carried = copy(buf, buf[i:n])
 					trace("carry bytes over i: %v, n: %v, len(buf): %v, "+
 						"%s\n", i, n,
 						len(buf),
-						string(tmp))
+						buf[:carried])
 					break
 				}
-				if !fnbody {
-					// when first two chars are comment indicators.
+				// next is the look ahead character, zero at the end of the input
+				var next byte
+				if i+1 < n {
+					next = buf[i+1]
+				}
+				if skipNext {
+					skipNext = false
+					continue
+				}
+				if escapeNext {
+					// the character escaped by a backslash, e.g. a quote
+					escapeNext = false
+					accum = append(accum, buf[i])
+					continue
+				}
+				if blockDepth > 0 {
 					switch {
-					// ignore all lines that start with --
-					case len(buf) > 1 && i+1 < len(buf) && buf[i] == '-' && buf[i+1] == '-':
-						trace("comment\n")
-						discard = true
-					// ignore any lines that start with // (this also covers ///)
-					case len(buf) > 1 && i+1 < len(buf) && buf[i] == '/' && buf[i+1] == '/':
+					case buf[i] == '*' && next == '/':
+						blockDepth--
+						skipNext = true
+						// the comment separates the tokens around it
+						if blockDepth == 0 && len(accum) > 0 && !isSpace(accum[len(accum)-1]) {
+							accum = append(accum, ' ')
+						}
+					case d.NestedBlockComments && buf[i] == '/' && next == '*':
+						blockDepth++
+						skipNext = true
+					case buf[i] == '\n':
+						lineStart = true
+					}
+					continue
+				}
+				if d.BlockComments && !discard && !fnbody && quote == 0 && buf[i] == '/' && next == '*' {
+					trace("block comment\n")
+					blockDepth, skipNext = 1, true
+					lineStart = false
+					continue
+				}
+				if !fnbody && quote == 0 {
+					// ignore the rest of lines from a comment marker, e.g. -- or //
+					// (this also covers ///)
+					for _, c := range d.Comments {
+						if buf[i] == c[0] && (len(c) == 1 || next == c[1]) {
+							trace("comment\n")
+							if !discard && p.DeferForeignKeys {
+								comment, commenting = comment[:0], true
+							}
+							discard = true
+						}
+					}
+					// ignore psql meta-commands, lines that start with \
+					if p.SkipPsqlMeta && lineStart && buf[i] == '\\' {
+						trace("psql meta-command\n")
 						discard = true
 					}
 				}
-				// output the content, for logging
-				if buf[i] == ' ' {
-					trace("%d.\n", counter+i)
-				} else if buf[i] == '\t' {
-					trace("%d\\t\n", counter+i)
-				} else {
-					trace("%d '%c'\n", counter+i, buf[i])
+				if buf[i] == '\n' {
+					lineStart = true
+				} else if !isSpace(buf[i]) {
+					lineStart = false
+				}
+				if commenting && buf[i] != '\n' {
+					comment = append(comment, buf[i])
 				}
-				switch ch := buf[i]; ch {
-				case '$':
-					// look around is there another $?
-					// is there also and ending marker like "$$ LANGUAGE plpgsql"
-					if len(buf) >= i+1 && buf[i+1] == '$' {
-						// set fnbody false to trigger the check for the next `;`
-						fnbody = !fnbody
+				// output the content, for logging. ParseTrace is checked before the
+				// trace calls in the loop since the arguments would otherwise be
+				// allocated for every character even when not tracing.
+				if ParseTrace {
+					if buf[i] == ' ' {
+						trace("%d.\n", counter+i)
+					} else if buf[i] == '\t' {
+						trace("%d\\t\n", counter+i)
+					} else {
+						trace("%d '%c'\n", counter+i, buf[i])
 					}
+				}
+				switch ch := buf[i]; {
+				case strings.IndexByte(d.Quotes, ch) >= 0:
 					if !discard {
+						// a doubled quote, the escaped form, closes and reopens the string
+						if !fnbody && quote == 0 {
+							// an escaped string reopened by a doubled quote escapes still
+							reopened := escapes && len(accum) > 0 && accum[len(accum)-1] == ch
+							escapes = d.EscapeStrings && ch == '\'' && (reopened || isEscapePrefix(accum))
+							quote = ch
+						} else if quote == ch {
+							quote = 0
+						}
+						if start < 0 {
+							start = counter + i
+						}
 						accum = append(accum, ch)
 					}
-				case ';':
-					trace("discard(1): %v, fnbody: %v, i: %v, len(buf): %v\n",
-						discard, fnbody,
-						i, len(buf))
-					if fnbody {
-						accum = append(accum, ch)
-						continue
+				case ch == '$' && d.DollarQuotes:
+					if !discard && quote == 0 {
+						if tagStart >= 0 && isTag(accum[tagStart+1:]) {
+							// a complete dollar quote, either opening the function body
+							// or closing it when it's the tag that opened it.
+							// set fnbody false to trigger the check for the next `;`
+							delim := string(accum[tagStart:]) + "$"
+							switch {
+							case !fnbody:
+								tag, fnbody = delim, true
+								tagStart = -1
+							case delim == tag:
+								tag, fnbody = "", false
+								tagStart = -1
+							default:
+								// another tag nested in the body, this '$' may start the closing one
+								tagStart = len(accum)
+							}
+						} else if fnbody || len(accum) == 0 || !isTagChar(accum[len(accum)-1]) {
+							// outside of a body '$' continues identifiers like foo$bar
+							tagStart = len(accum)
+						} else {
+							tagStart = -1
+						}
 					}
 					if !discard {
-						// include ';' in accum
-						accum = append(accum, ch)
-						stmt := make([]byte, len(accum))
-						copy(stmt, accum)
-						if replacementStatement != "" {
-							stmt = bytes.ReplaceAll(stmt, []byte("<SCHEMA_NAME>"),
-								[]byte(replacementStatement))
+						if start < 0 {
+							start = counter + i
 						}
-
-						// fully formed statement(stmt), exec the statement
-						trace("%s\n", string(stmt))
-						if err := h(stmt); err != nil {
-							return err
-						}
-						// reset accum, maintain allocated memory
-						accum = accum[:0]
+						accum = append(accum, ch)
 					}
-				case '\n':
+				case ch == '\n':
 					// at end of line, reset discard
 					discard = false
-					if fnbody {
+					if commenting {
+						commenting = false
+						if isDeferDirective(comment, d.Comments) {
+							trace("defer directive\n")
+							deferNext = true
+						}
+					}
+					if d.DelimiterCommand && !fnbody && quote == 0 {
+						if delim, ok := delimiterCommand(accum); ok {
+							trace("delimiter: %s\n", delim)
+							terminator = delim
+							accum = accum[:0]
+							start = -1
+							break
+						}
+					}
+					// keep line breaks that separate tokens, e.g. in "SELECT 1\nFROM foo"
+					if p.NormalizeWhitespace && !fnbody && quote == 0 {
+						accum = appendSpace(accum)
+					} else if fnbody || quote != 0 || (len(accum) > 0 && !isSpace(accum[len(accum)-1])) {
 						accum = append(accum, ch)
 					}
-					trace("discard(2): %v, fnbody: %v, i: %v, len(buf): %v\n",
-						discard, fnbody,
-						i, len(buf))
+					if ParseTrace {
+						trace("discard(2): %v, fnbody: %v, i: %v, len(buf): %v\n",
+							discard, fnbody,
+							i, len(buf))
+					}
 				default:
-					if !discard {
+					if discard {
+						break
+					}
+					if quote != 0 && escapes && ch == '\\' {
+						escapeNext = true
+					}
+					if start < 0 && !isSpace(ch) {
+						start = counter + i
+					}
+					if p.NormalizeWhitespace && !fnbody && quote == 0 && isSpace(ch) {
+						accum = appendSpace(accum)
+					} else {
 						accum = append(accum, ch)
 					}
+					if fnbody || quote != 0 || !bytes.HasSuffix(accum, terminator) {
+						break
+					}
+					if d.DelimiterCommand {
+						if _, ok := delimiterCommand(accum); ok {
+							// the command runs to the end of the line
+							break
+						}
+					}
+					if ParseTrace {
+						trace("discard(1): %v, fnbody: %v, i: %v, len(buf): %v\n",
+							discard, fnbody,
+							i, len(buf))
+					}
+					accum = accum[:len(accum)-len(terminator)]
+					if p.NormalizeWhitespace {
+						accum = bytes.TrimRight(accum, " ")
+					}
+					// include the terminator in accum, unless it's stripped
+					if !p.StripTerminator {
+						accum = append(accum, terminator...)
+					}
+					stmt := make([]byte, len(accum))
+					copy(stmt, accum)
+					if replacementStatement != "" {
+						stmt = bytes.ReplaceAll(stmt, []byte("<SCHEMA_NAME>"),
+							[]byte(replacementStatement))
+					}
+
+					// fully formed statement(stmt), exec the statement
+					if ParseTrace {
+						trace("%s\n", stmt)
+					}
+					if deferNext {
+						deferNext = false
+						if !addsForeignKey(stmt) {
+							return fmt.Errorf("%s directive on a statement not adding a foreign key: %s",
+								DeferDirective, bytes.TrimSpace(stmt))
+						}
+						deferred = append(deferred, offsetStmt{stmt: stmt, start: start, end: counter + i + 1})
+						accum = accum[:0]
+						tagStart = -1
+						start = -1
+						break
+					}
+					if err := h(stmt, start, counter+i+1); err != nil {
+						if errors.Is(err, ErrStopParsing) {
+							return nil
+						}
+						return err
+					}
+					// reset accum, maintain allocated memory
+					accum = accum[:0]
+					tagStart = -1
+					start = -1
 				}
 			}
-			trace("tmp(1): '%s'\n", tmp)
+			trace("carried(1): %d\n", carried)
 		}
 		// keep a counter of the characters we've seen, used for debugging/tracing output
-		counter = counter + n - len(tmp)
+		counter = counter + n - carried
 		if err == io.EOF {
 			break
 		}
@@ -167,9 +565,110 @@ func Parse(reader io.Reader, _ []byte, _ int, replacementStatement string, h Han
 			return err
 		}
 	}
+	switch {
+	case quote != 0:
+		return fmt.Errorf("%w: string quoted with %c", ErrUnterminated, quote)
+	case fnbody:
+		return fmt.Errorf("%w: body quoted with %s", ErrUnterminated, tag)
+	case blockDepth > 0:
+		return fmt.Errorf("%w: block comment", ErrUnterminated)
+	}
+	for _, d := range deferred {
+		if err := h(d.stmt, d.start, d.end); err != nil {
+			if errors.Is(err, ErrStopParsing) {
+				return nil
+			}
+			return err
+		}
+	}
 	return nil
 }
 
+// isDeferDirective reports whether comment, starting with one of the comment
+// markers, is a DeferDirective
+func isDeferDirective(comment []byte, markers []string) bool {
+	for _, marker := range markers {
+		if bytes.HasPrefix(comment, []byte(marker)) {
+			return string(bytes.TrimSpace(bytes.TrimLeft(comment, marker))) == DeferDirective
+		}
+	}
+	return false
+}
+
+// addsForeignKey reports whether stmt is an ALTER TABLE adding a foreign key
+// constraint
+func addsForeignKey(stmt []byte) bool {
+	words := strings.Fields(strings.ToUpper(string(stmt)))
+	if len(words) < 2 || words[0] != "ALTER" || words[1] != "TABLE" {
+		return false
+	}
+	add := false
+	for i, w := range words {
+		switch {
+		case w == "ADD":
+			add = true
+		case add && w == "FOREIGN" && i+1 < len(words) && strings.HasPrefix(words[i+1], "KEY"):
+			return true
+		}
+	}
+	return false
+}
+
+// delimiterPrefix starts the DELIMITER command
+var delimiterPrefix = []byte("DELIMITER")
+
+// delimiterCommand returns the terminator set by accum if it's a DELIMITER
+// command, e.g. `DELIMITER //`
+func delimiterCommand(accum []byte) ([]byte, bool) {
+	accum = bytes.TrimLeft(accum, " \t\r\n\f")
+	if len(accum) <= len(delimiterPrefix) || !bytes.EqualFold(accum[:len(delimiterPrefix)], delimiterPrefix) ||
+		!isSpace(accum[len(delimiterPrefix)]) {
+		return nil, false
+	}
+	delim := bytes.TrimSpace(accum[len(delimiterPrefix):])
+	if len(delim) == 0 {
+		return nil, false
+	}
+	return append([]byte(nil), delim...), true
+}
+
+// isEscapePrefix reports whether accum ends with the E prefix of an escape
+// string, e.g. E'it\'s'
+func isEscapePrefix(accum []byte) bool {
+	n := len(accum)
+	return n > 0 && (accum[n-1] == 'E' || accum[n-1] == 'e') && (n == 1 || !isTagChar(accum[n-2]))
+}
+
+// isTag reports whether b is the tag between the '$'s of a dollar quote, an
+// identifier that doesn't start with a digit or empty for $$
+func isTag(b []byte) bool {
+	for i, c := range b {
+		if !isTagChar(c) || (i == 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// isTagChar reports whether c can be part of a dollar quote tag
+func isTagChar(c byte) bool {
+	return c == '_' || c >= 0x80 || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// isSpace reports whether c is whitespace
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// appendSpace appends a space separating tokens to accum, unless it's empty
+// or already ends with one
+func appendSpace(accum []byte) []byte {
+	if len(accum) == 0 || accum[len(accum)-1] == ' ' {
+		return accum
+	}
+	return append(accum, ' ')
+}
+
 // trace output tracing when tracing enabled by the ParseTrace variable
 func trace(spec string, args ...interface{}) {
 	if !ParseTrace {
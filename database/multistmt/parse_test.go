@@ -1,8 +1,10 @@
 package multistmt_test
 
 import (
+	"io"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
 
@@ -11,9 +13,7 @@ import (
 
 const maxMigrationSize = 1024
 
-func TestParse(t *testing.T) {
-
-	plpgsqlBody := `CREATE OR REPLACE function fn1() returns TRIGGER as $$
+const plpgsqlBody = `CREATE OR REPLACE function fn1() returns TRIGGER as $$
 	-- this is a function body
 	DECLARE
 	BEGIN
@@ -24,6 +24,15 @@ func TestParse(t *testing.T) {
 	END;
 	$$ LANGUAGE plpgsql;`
 
+// plpgsqlNestedBody has a dollar quote with another tag nested in the body,
+// its `$$` and `;` don't end the function
+const plpgsqlNestedBody = `CREATE FUNCTION fn2() RETURNS void AS $fn$
+	BEGIN
+	EXECUTE $q$ SELECT '$$'; $q$;
+	END;
+	$fn$ LANGUAGE plpgsql;`
+
+func TestParse(t *testing.T) {
 	testCases := []struct {
 		name         string
 		multiStmt    string
@@ -53,11 +62,66 @@ func TestParse(t *testing.T) {
 			delimiter:   ";",
 			expected:    []string{"statement one;", " statement two;"},
 			expectedErr: nil},
+		{name: "multi line statement",
+			multiStmt:   "SELECT id\nFROM foo -- comment\nWHERE id = 1;\n",
+			delimiter:   ";",
+			expected:    []string{"SELECT id\nFROM foo WHERE id = 1;"},
+			expectedErr: nil},
+		{name: "delimiter and comment in quotes",
+			multiStmt:   "INSERT INTO \"a;b\" VALUES ('it''s; -- not a comment');\nSELECT 1;",
+			delimiter:   ";",
+			expected:    []string{"INSERT INTO \"a;b\" VALUES ('it''s; -- not a comment');", "SELECT 1;"},
+			expectedErr: nil},
 		{name: "multi line plpgsql body",
 			multiStmt:   plpgsqlBody,
 			delimiter:   "$$.*;",
 			expected:    []string{plpgsqlBody},
 			expectedErr: nil},
+		{name: "nested dollar quote in plpgsql body",
+			multiStmt:   plpgsqlNestedBody + "\nSELECT $1;",
+			delimiter:   ";",
+			expected:    []string{plpgsqlNestedBody, "SELECT $1;"},
+			expectedErr: nil},
+		{name: "delimiter and quote in block comment",
+			multiStmt:   "/* drop old; add new */\nCREATE TABLE x (id int);",
+			delimiter:   ";",
+			expected:    []string{"CREATE TABLE x (id int);"},
+			expectedErr: nil},
+		{name: "apostrophe in block comment",
+			multiStmt:   "/* don't touch */\nCREATE TABLE a (id int);\nCREATE TABLE b (id int);",
+			delimiter:   ";",
+			expected:    []string{"CREATE TABLE a (id int);", "CREATE TABLE b (id int);"},
+			expectedErr: nil},
+		{name: "nested block comments separate tokens",
+			multiStmt:   "SELECT/* outer /* inner; */ still; */1;",
+			delimiter:   ";",
+			expected:    []string{"SELECT 1;"},
+			expectedErr: nil},
+		{name: "escaped quote in escape string",
+			multiStmt:   "INSERT INTO t VALUES (E'it\\'s; ok', e'a''b\\'c;');\nSELECT 1;",
+			delimiter:   ";",
+			expected:    []string{"INSERT INTO t VALUES (E'it\\'s; ok', e'a''b\\'c;');", "SELECT 1;"},
+			expectedErr: nil},
+		{name: "backslash in standard string",
+			multiStmt:   "SELECT 'C:\\';\nSELECT 1;",
+			delimiter:   ";",
+			expected:    []string{"SELECT 'C:\\';", "SELECT 1;"},
+			expectedErr: nil},
+		{name: "unterminated quote",
+			multiStmt:   "SELECT 1;\nINSERT INTO t VALUES ('oops);\nSELECT 2;",
+			delimiter:   ";",
+			expected:    []string{"SELECT 1;"},
+			expectedErr: multistmt.ErrUnterminated},
+		{name: "unterminated dollar-quoted body",
+			multiStmt:   "CREATE FUNCTION f() RETURNS void AS $$ BEGIN; END;",
+			delimiter:   ";",
+			expected:    []string{},
+			expectedErr: multistmt.ErrUnterminated},
+		{name: "unterminated block comment",
+			multiStmt:   "SELECT 1;\n/* SELECT 2;",
+			delimiter:   ";",
+			expected:    []string{"SELECT 1;"},
+			expectedErr: multistmt.ErrUnterminated},
 		// this test case has the following characteristics:
 		// 1. there is a comment at the very last character/index of the read
 		//    buffer when the buffer size is 5
@@ -96,12 +160,255 @@ CREATE EXTENSION IF NOT EXISTS citext SCHEMA public;
 					stmts = append(stmts, string(b))
 					return nil
 				})
-			assert.Equal(t, tc.expectedErr, err)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+			} else {
+				assert.Nil(t, err)
+			}
 			assert.Equal(t, tc.expected, stmts)
 		})
 	}
 }
 
+func TestParseStripTerminator(t *testing.T) {
+	multiStmt := "CREATE TABLE a (id int);\nINSERT INTO a VALUES (';');\n" + plpgsqlBody
+	testCases := []struct {
+		name            string
+		stripTerminator bool
+		expected        []string
+	}{
+		{name: "with terminator",
+			expected: []string{"CREATE TABLE a (id int);", "INSERT INTO a VALUES (';');", plpgsqlBody}},
+		{name: "without terminator",
+			stripTerminator: true,
+			expected: []string{"CREATE TABLE a (id int)", "INSERT INTO a VALUES (';')",
+				strings.TrimSuffix(plpgsqlBody, ";")}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &multistmt.Parser{StripTerminator: tc.stripTerminator}
+			stmts := make([]string, 0, len(tc.expected))
+			err := p.Parse(strings.NewReader(multiStmt), []byte(";"),
+				maxMigrationSize, "", func(b []byte) error {
+					stmts = append(stmts, string(b))
+					return nil
+				})
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, stmts)
+		})
+	}
+}
+
+func TestParseNormalizeWhitespace(t *testing.T) {
+	multiStmt := "  CREATE TABLE a (\n\tid int,\r\n  name   text\n)  ;\n" +
+		"INSERT INTO a VALUES (1,\n  'two  spaces\n\tand a tab')   ;\n" +
+		"SELECT 1 -- trailing  comment\n  FROM a;\n" +
+		"CREATE FUNCTION f() RETURNS int AS $$\n  SELECT   1;\n$$   LANGUAGE sql;"
+	expected := []string{
+		"CREATE TABLE a ( id int, name text );",
+		"INSERT INTO a VALUES (1, 'two  spaces\n\tand a tab');",
+		"SELECT 1 FROM a;",
+		"CREATE FUNCTION f() RETURNS int AS $$\n  SELECT   1;\n$$ LANGUAGE sql;",
+	}
+
+	p := &multistmt.Parser{NormalizeWhitespace: true}
+	stmts := make([]string, 0, len(expected))
+	err := p.Parse(strings.NewReader(multiStmt), []byte(";"),
+		maxMigrationSize, "", func(b []byte) error {
+			stmts = append(stmts, string(b))
+			return nil
+		})
+	assert.Nil(t, err)
+	assert.Equal(t, expected, stmts)
+}
+
+func TestParseSkipPsqlMeta(t *testing.T) {
+	multiStmt := "\\timing on\n\\set ON_ERROR_STOP 1\nCREATE TABLE a (id int);\n" +
+		"  \\echo 'inserting;'\nINSERT INTO a VALUES (1), ('\n\\not a command');\n" +
+		"CREATE FUNCTION f() RETURNS text AS $$\n\\x\n$$ LANGUAGE sql;"
+	testCases := []struct {
+		name         string
+		skipPsqlMeta bool
+		expected     []string
+	}{
+		{name: "skipped",
+			skipPsqlMeta: true,
+			expected: []string{"CREATE TABLE a (id int);",
+				"  INSERT INTO a VALUES (1), ('\n\\not a command');",
+				"CREATE FUNCTION f() RETURNS text AS $$\n\\x\n$$ LANGUAGE sql;"}},
+		{name: "kept",
+			expected: []string{"\\timing on\n\\set ON_ERROR_STOP 1\nCREATE TABLE a (id int);",
+				"  \\echo 'inserting;'\nINSERT INTO a VALUES (1), ('\n\\not a command');",
+				"CREATE FUNCTION f() RETURNS text AS $$\n\\x\n$$ LANGUAGE sql;"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &multistmt.Parser{SkipPsqlMeta: tc.skipPsqlMeta}
+			stmts := make([]string, 0, len(tc.expected))
+			err := p.Parse(strings.NewReader(multiStmt), []byte(";"),
+				maxMigrationSize, "", func(b []byte) error {
+					stmts = append(stmts, string(b))
+					return nil
+				})
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, stmts)
+		})
+	}
+}
+
+func TestParseDeferForeignKeys(t *testing.T) {
+	multiStmt := "CREATE TABLE users (id int PRIMARY KEY);\n" +
+		"CREATE TABLE orders (id int, user_id int);\n" +
+		"-- migrate:defer\n" +
+		"ALTER TABLE orders ADD CONSTRAINT orders_user_fk FOREIGN KEY (user_id) REFERENCES users (id);\n" +
+		"ALTER TABLE orders ADD PRIMARY KEY (id);\n" +
+		"--migrate:defer\n" +
+		"ALTER TABLE orders\n  ADD FOREIGN KEY (id) REFERENCES orders (id);\n" +
+		"-- migrate:defer is only a directive on its own\n" +
+		"INSERT INTO users VALUES (1);"
+	testCases := []struct {
+		name             string
+		deferForeignKeys bool
+		expected         []string
+	}{
+		{name: "deferred",
+			deferForeignKeys: true,
+			expected: []string{"CREATE TABLE users (id int PRIMARY KEY);",
+				"CREATE TABLE orders (id int, user_id int);",
+				"ALTER TABLE orders ADD PRIMARY KEY (id);",
+				"INSERT INTO users VALUES (1);",
+				"ALTER TABLE orders ADD CONSTRAINT orders_user_fk FOREIGN KEY (user_id) REFERENCES users (id);",
+				"ALTER TABLE orders\n  ADD FOREIGN KEY (id) REFERENCES orders (id);"}},
+		{name: "in order",
+			expected: []string{"CREATE TABLE users (id int PRIMARY KEY);",
+				"CREATE TABLE orders (id int, user_id int);",
+				"ALTER TABLE orders ADD CONSTRAINT orders_user_fk FOREIGN KEY (user_id) REFERENCES users (id);",
+				"ALTER TABLE orders ADD PRIMARY KEY (id);",
+				"ALTER TABLE orders\n  ADD FOREIGN KEY (id) REFERENCES orders (id);",
+				"INSERT INTO users VALUES (1);"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &multistmt.Parser{DeferForeignKeys: tc.deferForeignKeys}
+			stmts := make([]string, 0, len(tc.expected))
+			err := p.Parse(strings.NewReader(multiStmt), []byte(";"),
+				maxMigrationSize, "", func(b []byte) error {
+					stmts = append(stmts, string(b))
+					return nil
+				})
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, stmts)
+		})
+	}
+
+	err := (&multistmt.Parser{DeferForeignKeys: true}).Parse(
+		strings.NewReader("-- migrate:defer\nCREATE INDEX ON orders (user_id);"), []byte(";"),
+		maxMigrationSize, "", func(b []byte) error { return nil })
+	assert.ErrorContains(t, err, "migrate:defer directive on a statement not adding a foreign key")
+}
+
+func TestParseWithOffsets(t *testing.T) {
+	multiStmt := "-- create the table\n\nCREATE TABLE foo (id int);\n\n\n" +
+		"// a comment; with a semicolon\n  INSERT INTO foo -- inline comment\nVALUES (1);" +
+		"   SELECT 'ü; -- not a comment';\n-- trailing comment"
+	type offsetStmt struct {
+		stmt       string
+		start, end int
+	}
+	expected := []offsetStmt{
+		{stmt: "CREATE TABLE foo (id int);", start: 21, end: 47},
+		{stmt: "  INSERT INTO foo VALUES (1);", start: 83, end: 128},
+		{stmt: "   SELECT 'ü; -- not a comment';", start: 131, end: 161},
+	}
+
+	for bufSize := 2; bufSize <= len(multiStmt)+1; bufSize++ {
+		parseBufSize := multistmt.ParseBufSize
+		multistmt.ParseBufSize = bufSize
+
+		var stmts []offsetStmt
+		err := multistmt.ParseWithOffsets(strings.NewReader(multiStmt), func(stmt []byte, start, end int) error {
+			stmts = append(stmts, offsetStmt{stmt: string(stmt), start: start, end: end})
+			return nil
+		})
+		multistmt.ParseBufSize = parseBufSize
+
+		assert.Nil(t, err, "buffer size %d", bufSize)
+		assert.Equal(t, expected, stmts, "buffer size %d", bufSize)
+	}
+	assert.Equal(t, "INSERT INTO foo -- inline comment\nVALUES (1);", multiStmt[83:128])
+	assert.Equal(t, "SELECT 'ü; -- not a comment';", multiStmt[131:161])
+}
+
+func TestParserConfig(t *testing.T) {
+	defer func(size int) { multistmt.ParseBufSize = size }(multistmt.ParseBufSize)
+	multistmt.ParseBufSize = 4096
+
+	c := (&multistmt.Parser{StripTerminator: true}).Config()
+	assert.Equal(t, multistmt.ParserConfig{
+		BufSize:         4096,
+		Dialect:         "postgres",
+		Terminator:      ";",
+		Comments:        []string{"--", "//"},
+		StripTerminator: true,
+	}, c)
+	assert.JSONEq(t, `{"buf_size": 4096, "dialect": "postgres", "terminator": ";", "comments": ["--", "//"],
+		"strip_terminator": true, "normalize_whitespace": false, "skip_psql_meta": false,
+		"defer_foreign_keys": false}`, c.String())
+}
+
+func TestParseDialect(t *testing.T) {
+	testCases := []struct {
+		name      string
+		dialect   multistmt.Dialect
+		multiStmt string
+		expected  []string
+	}{
+		{name: "postgres is the default",
+			multiStmt: "SELECT 1; -- comment; \n" + plpgsqlBody + " SELECT '#';",
+			expected:  []string{"SELECT 1;", " " + plpgsqlBody, " SELECT '#';"}},
+		{name: "postgres",
+			dialect:   multistmt.DialectPostgres,
+			multiStmt: "SELECT 1; // comment; \nSELECT \"a;b\"; # not a comment\n;",
+			expected:  []string{"SELECT 1;", ` SELECT "a;b";`, " # not a comment\n;"}},
+		{name: "mysql comments and quotes",
+			dialect:   multistmt.DialectMySQL,
+			multiStmt: "SELECT 1; # comment; \nSELECT `a;b`, 'c;d'; -- comment;\nSELECT '$$;' ;",
+			expected:  []string{"SELECT 1;", " SELECT `a;b`, 'c;d';", " SELECT '$$;' ;"}},
+		{name: "mysql without dollar quotes",
+			dialect:   multistmt.DialectMySQL,
+			multiStmt: "SELECT $$; SELECT 1;",
+			expected:  []string{"SELECT $$;", " SELECT 1;"}},
+		{name: "mysql delimiter command",
+			dialect: multistmt.DialectMySQL,
+			multiStmt: "DELIMITER //\nCREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END//\n" +
+				"delimiter ;\nSELECT 3;",
+			expected: []string{"CREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END//", "SELECT 3;"}},
+		{name: "custom dialect",
+			dialect:   multistmt.Dialect{Name: "custom", Terminator: "GO", Comments: []string{"%"}, Quotes: "'"},
+			multiStmt: "SELECT 1 GO % comment GO\nSELECT 'GO'GO",
+			expected:  []string{"SELECT 1 GO", " SELECT 'GO'GO"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stmts := []string{}
+			err := (&multistmt.Parser{Dialect: tc.dialect}).Parse(iotest.OneByteReader(strings.NewReader(tc.multiStmt)),
+				nil, maxMigrationSize, "", func(b []byte) error {
+					stmts = append(stmts, string(b))
+					return nil
+				})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, stmts)
+		})
+	}
+
+	c := (&multistmt.Parser{Dialect: multistmt.DialectMySQL}).Config()
+	assert.Equal(t, "mysql", c.Dialect)
+	assert.Equal(t, []string{"--", "#"}, c.Comments)
+}
+
 func TestParseDiscontinue(t *testing.T) {
 	multiStmt := "statement one; statement two"
 	delimiter := ";"
@@ -116,3 +423,88 @@ func TestParseDiscontinue(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, expected, stmts)
 }
+
+func TestParseStop(t *testing.T) {
+	multiStmt := "statement one; statement two; statement three;"
+	delimiter := ";"
+	expected := []string{"statement one;"}
+
+	stmts := make([]string, 0, len(expected))
+	err := multistmt.Parse(strings.NewReader(multiStmt), []byte(delimiter),
+		maxMigrationSize, "", func(b []byte) error {
+			stmts = append(stmts, string(b))
+			return multistmt.ErrStopParsing
+		})
+	assert.Nil(t, err)
+	assert.Equal(t, expected, stmts)
+}
+
+func TestParseDollarQuoteAcrossBufferBoundary(t *testing.T) {
+	readers := map[string]func(io.Reader) io.Reader{
+		"full reads":     func(r io.Reader) io.Reader { return r },
+		"one byte reads": iotest.OneByteReader,
+		"half reads":     iotest.HalfReader,
+	}
+	multiStmt := "SELECT 1;\n" + plpgsqlBody + "\nSELECT 2;\n" + plpgsqlNestedBody
+	expected := []string{"SELECT 1;", plpgsqlBody, "SELECT 2;", plpgsqlNestedBody}
+
+	// every buffer size splits the input at a different position, including
+	// right between the two characters of each `$$` delimiter and in tags
+	for bufSize := 2; bufSize <= len(multiStmt)+1; bufSize++ {
+		for name, reader := range readers {
+			parseBufSize := multistmt.ParseBufSize
+			multistmt.ParseBufSize = bufSize
+
+			stmts := make([]string, 0, len(expected))
+			err := multistmt.Parse(reader(strings.NewReader(multiStmt)), []byte(";"),
+				maxMigrationSize, "", func(b []byte) error {
+					stmts = append(stmts, string(b))
+					return nil
+				})
+			multistmt.ParseBufSize = parseBufSize
+
+			assert.Nil(t, err, "buffer size %d, %s", bufSize, name)
+			assert.Equal(t, expected, stmts, "buffer size %d, %s", bufSize, name)
+		}
+	}
+}
+
+func TestHashStatements(t *testing.T) {
+	hashes, err := multistmt.HashStatements(strings.NewReader("CREATE TABLE foo (id int);\n-- seed it\nINSERT INTO foo VALUES (1);"))
+	assert.Nil(t, err)
+	assert.Len(t, hashes, 2)
+
+	// formatting and comments don't change the digests, edits do
+	reformatted, err := multistmt.HashStatements(strings.NewReader("CREATE TABLE foo\n  (id int);\nINSERT INTO foo VALUES (1);\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, hashes, reformatted)
+	edited, err := multistmt.HashStatements(strings.NewReader("CREATE TABLE foo (id int);\nINSERT INTO foo VALUES (2);"))
+	assert.Nil(t, err)
+	assert.Equal(t, hashes[0], edited[0])
+	assert.NotEqual(t, hashes[1], edited[1])
+
+	// the last statement is hashed without its terminator too
+	unterminated, err := multistmt.HashStatements(strings.NewReader("CREATE TABLE foo (id int);\nINSERT INTO foo VALUES (1)"))
+	assert.Nil(t, err)
+	assert.Equal(t, hashes, unterminated)
+}
+
+func BenchmarkParse(b *testing.B) {
+	var sb strings.Builder
+	for sb.Len() < 4<<20 {
+		sb.WriteString("-- insert another row\nINSERT INTO foo (id, name) VALUES (1, 'bar');\n")
+		sb.WriteString(plpgsqlBody)
+		sb.WriteString("\n")
+	}
+	multiStmt := sb.String()
+
+	b.SetBytes(int64(len(multiStmt)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := multistmt.Parse(strings.NewReader(multiStmt), []byte(";"), maxMigrationSize, "",
+			func(b []byte) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
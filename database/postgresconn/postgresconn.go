@@ -4,26 +4,39 @@
 package postgresconn
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	nurl "net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/getoutreach/migrate/v4"
 
 	"go.uber.org/atomic"
 
+	"github.com/google/uuid"
 	"github.com/hashicorp/go-multierror"
 	"github.com/lib/pq"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 
 	"github.com/getoutreach/migrate/v4/database"
+	"github.com/getoutreach/migrate/v4/database/multistmt"
 )
 
 func init() {
@@ -35,13 +48,82 @@ func init() {
 var (
 	DefaultMigrationsTable       = "schema_migrations"
 	DefaultMultiStatementMaxSize = 10 * 1 << 20 // 10 MB
+	DefaultTableCreateRetries    = 3
 )
 
+// WaitForVersion backs off exponentially between these intervals
+var (
+	waitForVersionMinInterval = 50 * time.Millisecond
+	waitForVersionMaxInterval = 5 * time.Second
+)
+
+// migrations failing to acquire a lock are retried, with DDLLockRetries,
+// backing off exponentially between these intervals
+var (
+	ddlLockRetryMinInterval = 100 * time.Millisecond
+	ddlLockRetryMaxInterval = 5 * time.Second
+)
+
+// creating the migrations table is retried, with TableCreateRetries, backing
+// off exponentially between these intervals, jittered
+var (
+	tableCreateRetryMinInterval = 50 * time.Millisecond
+	tableCreateRetryMaxInterval = time.Second
+)
+
+// CancelLock polls at this interval for the session of Lock to wait for the
+// advisory lock
+var lockWaitPollInterval = 10 * time.Millisecond
+
+// ErrPartialRun is returned by Run when a migration fails, telling how far it
+// got. Err is the error the migration failed with, usually a database.Error.
+type ErrPartialRun struct {
+	// Executed is the number of statements of the migration executed
+	// successfully before it failed. With StatementBatchSize, the statements
+	// of the batch that failed aren't counted.
+	Executed int
+	// RolledBack is true if the statements executed are rolled back with the
+	// migration's transaction, false if they ran outside of a transaction
+	RolledBack bool
+	Err        error
+}
+
+// Error implements the error interface, it's the error the migration failed
+// with.
+func (e ErrPartialRun) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error the migration failed with
+func (e ErrPartialRun) Unwrap() error {
+	return e.Err
+}
+
 var (
 	ErrNilConfig      = fmt.Errorf("no config")
 	ErrNoDatabaseName = fmt.Errorf("no database name")
 	ErrNoSchema       = fmt.Errorf("no schema")
 	ErrDatabaseDirty  = fmt.Errorf("database is dirty")
+	ErrNoFailureTable = fmt.Errorf("no failure table configured")
+	// ErrDriverInUse is returned by the methods running statements, e.g.
+	// Run, Begin, SetVersion or Version, called while another call to one of
+	// them is in progress on the same driver, and by Begin while a
+	// transaction is, which would interleave their statements on its single
+	// connection.
+	ErrDriverInUse = fmt.Errorf("driver in use by another goroutine")
+	// ErrTxLeaked is returned by Close when a transaction begun with Begin
+	// was never committed or rolled back, Close rolled it back.
+	ErrTxLeaked = fmt.Errorf("transaction begun but never committed or rolled back")
+	// ErrVerificationFailed is returned by Run, wrapped, when a query of a
+	// `-- migrate:verify` directive of the migration returns rows or false.
+	ErrVerificationFailed = fmt.Errorf("verification failed")
+	// ErrLockNotOwned is returned by SetVersion, wrapped, when the session
+	// it runs on isn't the one that acquired the advisory lock with Lock, e.g.
+	// after the connection was swapped, so the lock no longer guards it.
+	ErrLockNotOwned = fmt.Errorf("advisory lock not held by the recording session")
+	// ErrNoLockWait is returned by CancelLock when no Lock call of the driver
+	// is waiting for the advisory lock.
+	ErrNoLockWait = fmt.Errorf("no Lock waiting for the advisory lock")
 )
 
 type Config struct {
@@ -53,19 +135,372 @@ type Config struct {
 	migrationsSchemaName  string
 	migrationsTableName   string
 	StatementTimeout      time.Duration
+	// ConnectHook are statements executed on the driver's connection once
+	// it's created, before anything else, e.g. `SET application_name = ...` or
+	// `SELECT set_config(...)`, so each connection migrations run on is
+	// initialized the same way. With WithTx they run in the caller's
+	// transaction.
+	ConnectHook []string
+	// AcquireTimeout, if set, is how long Open and WithDB wait for a
+	// connection of the pool, e.g. when it's exhausted, before failing
+	// instead of blocking.
+	AcquireTimeout        time.Duration
 	MultiStatementMaxSize int
+	// StatementBatchSize, if set along with MultiStatementEnabled, splits
+	// migrations into statements and sends them in batches of this many
+	// statements, instead of the whole migration at once. Migrations are then
+	// streamed, i.e. executed while they're read, unless DDLLockRetries,
+	// AnalyzeAfter, StatementHashes or DeferForeignKeys need the whole
+	// migration. It can't be combined with Idempotent, IgnoreSQLStates,
+	// RetryClassifier or Params, which execute statements one by one.
+	StatementBatchSize int
+	// FailureTable is the name of an optional table, in the migrations schema,
+	// that gets a row for every failed migration. The row is written after the
+	// migration's transaction is rolled back, so it persists. It also records
+	// the direction of the migration and how far it got, see RecoveryInfo.
+	FailureTable string
+	// ShouldApply, if set, is consulted before each migration runs with the
+	// version the migration migrates to and the connection the migration runs
+	// on, inside the migration's transaction, see
+	// database.ConditionalApplier. When it returns false the
+	// migration's body isn't executed, but its version is still recorded
+	// unless ForgetSkipped is set. conn is nil for drivers created with WithTx.
+	ShouldApply func(version uint, conn *sql.Conn) (bool, error)
+	// AnalyzeAfter runs ANALYZE on the tables modified by DML statements in a
+	// migration once the migration commits, so the planner doesn't use stale
+	// statistics after bulk data migrations until autovacuum catches up.
+	// ANALYZE failures are logged, the migration is committed already.
+	AnalyzeAfter bool
+	// StatementHashes records the digests of the statements each migration
+	// executed with its version, in the statement_hashes column of the
+	// migrations table, see multistmt.HashStatements, so VerifyStatements
+	// can detect statements edited after they were applied. Migrations
+	// aren't streamed with it.
+	StatementHashes bool
+	// ResumeTokens persists the resume token of each run of migrations, see
+	// migrate.Resume, in a table named after the migrations table with a
+	// _resume suffix. Without it the driver returns migrate.ErrNoResume.
+	ResumeTokens bool
+	// DeferConstraints defers constraint checks until each migration's
+	// transaction commits, e.g. for data migrations that temporarily violate
+	// foreign keys. It only affects constraints declared DEFERRABLE.
+	DeferConstraints bool
+	// DeferForeignKeys runs the statements adding foreign keys that are
+	// preceded by a `-- migrate:defer` comment line after all other
+	// statements of their migration, in the same transaction, e.g. to load
+	// tables before their constraints are added. Migrations without the
+	// directive run as written, errors in the others point at the statements
+	// as written.
+	DeferForeignKeys bool
+	// StrictTransactionless fails migrations mixing statements Postgres
+	// refuses to run in a transaction block, like CREATE INDEX CONCURRENTLY
+	// or VACUUM, with other statements. Without it such migrations are run
+	// outside of a transaction, statement by statement, so the statements
+	// besides them aren't atomic. Migrations consisting only of such
+	// statements are run outside of a transaction either way.
+	StrictTransactionless bool
+	// Component, if set, gives an independently versioned component its own
+	// migrations table, suffixed with the component e.g.
+	// schema_migrations_billing, and its own advisory lock, so several
+	// components can share a schema.
+	Component string
+	// MinServerVersion, if set, makes WithConn fail when the server's
+	// server_version_num is lower, e.g. 140000 requires Postgres 14.
+	MinServerVersion int
+	// RequireEncoding, if set, makes WithConn fail when the database's
+	// server_encoding is another one, e.g. UTF8 for migrations authored in
+	// UTF-8 that a LATIN1 database would silently corrupt. Case, dashes and
+	// underscores are ignored, so UTF-8 matches UTF8.
+	RequireEncoding string
+	// ForgetSkipped leaves the version of migrations skipped by ShouldApply
+	// unrecorded, so they're considered again by the next run.
+	ForgetSkipped bool
+	// SessionSettings are run time parameters set with SET LOCAL at the start
+	// of each migration's transaction, e.g. a larger maintenance_work_mem for
+	// index builds.
+	SessionSettings map[string]string
+	// BeforeEach and AfterEach are SQL run in each migration's transaction
+	// before and after the migration's body, e.g. to SET parameters or write
+	// audit rows. A hook failing fails the migration.
+	BeforeEach string
+	AfterEach  string
+	// AuditWriter, if set, gets every statement before it's executed,
+	// preceded by a comment with the version it migrates to and the time, e.g.
+	// to archive the SQL executed against production. Writers with a Flush
+	// method, like *bufio.Writer, are flushed before the statement executes.
+	AuditWriter io.Writer
+	// AuditCompress gzips what's written to AuditWriter on the fly. The
+	// stream is flushed after each statement, so what's written so far
+	// decompresses even if the run fails, and each run, from Lock to Unlock,
+	// ends a gzip member of it, which gzip readers read one after the other.
+	AuditCompress bool
+	// LockTimeout, if set, is the lock_timeout of each migration's transaction,
+	// so DDL on busy tables fails instead of queueing behind other queries.
+	LockTimeout time.Duration
+	// IsolationLevel is the isolation level of each migration's transaction,
+	// the server's default_transaction_isolation if it's sql.LevelDefault.
+	// A migration can override it with a leading comment line like
+	// `-- migrate:isolation-level serializable`. Transactions given to WithTx
+	// keep the level they were begun with.
+	IsolationLevel sql.IsolationLevel
+	// DDLLockRetries is the number of times a migration failing to acquire a
+	// lock (SQLSTATE 55P03), e.g. within LockTimeout, is retried, each time in
+	// a new transaction after backing off: Run returns a database.RetryError
+	// for migrate to run the migration again. Migrations running in a
+	// transaction given to WithTx or without Begin aren't retried.
+	DDLLockRetries int
+	// TableCreateRetries is the number of times creating the migrations table
+	// and its columns is retried when it deadlocks (SQLSTATE 40P01) or races
+	// another session creating them, e.g. many processes opening a new
+	// database at once, each time after a jittered backoff.
+	// DefaultTableCreateRetries if zero, negative values disable retries.
+	TableCreateRetries int
+	// VersionCacheTTL, if set, is how long Version reuses the version it read,
+	// e.g. when several components check the version at startup. Recording a
+	// version invalidates it.
+	VersionCacheTTL time.Duration
+	// TracerProvider, if set, traces migrations with a span for each run,
+	// from Lock to Unlock, each migration within it and each statement of a
+	// migration, or each batch of statements with StatementBatchSize.
+	TracerProvider trace.TracerProvider
+	// Idempotent runs each statement of a migration in a savepoint and skips
+	// the statements failing because the object they create already exists,
+	// e.g. created outside of migrations, so re-running migrations converges
+	// instead of failing. Other errors still fail the migration.
+	Idempotent bool
+	// IgnoreSQLStates are the SQLSTATEs of errors that don't fail migrations,
+	// e.g. 23505 (unique_violation) for best-effort seed data. Each statement
+	// of a migration runs in a savepoint then, a statement failing with one of
+	// them is rolled back to it, logged to Logger and skipped. Other errors
+	// still fail the migration.
+	IgnoreSQLStates []string
+	// RetryClassifier, if set, is consulted when a statement of a migration
+	// fails with the error, the statement and how many times it was retried
+	// already. Returning true executes the statement again after delay,
+	// false fails the migration. Each statement runs in a savepoint then,
+	// rolled back to before retrying. It generalizes DDLLockRetries, which
+	// retries whole migrations, to e.g. transient errors of a deployment.
+	RetryClassifier func(err error, stmt []byte, attempt int) (retry bool, delay time.Duration)
+	// Logger, if set, is told about the statements skipped by Idempotent and
+	// IgnoreSQLStates or retried by RetryClassifier and, once the driver is
+	// opened, the configuration statements are parsed with
+	Logger Logger
+	// Debug logs to Logger how the driver resolved where the migrations table
+	// is when it opens: the connection's search_path, the schema it resolves
+	// to and the schema qualified migrations table, e.g. to find out why the
+	// table ended up in another schema than expected.
+	Debug bool
+	// SkipLock makes Lock and Unlock skip the advisory lock, for servers that
+	// restrict advisory locks. Nothing prevents several processes from
+	// migrating the database concurrently then, runs need to be serialized
+	// otherwise, e.g. by the deployment.
+	SkipLock bool
+	// StampSchemaComment sets the comment of the migrations schema to the
+	// version recorded by each SetVersion, for tools showing schema comments.
+	// It's informational only, failing to set the comment is logged to Logger
+	// and doesn't fail SetVersion.
+	StampSchemaComment bool
+	// Params are bound to the `@name` placeholders of migrations, e.g. a
+	// cutoff timestamp for `UPDATE ... WHERE created_at < @cutoff` known at
+	// run time. Migrations are executed statement by statement then, the
+	// statements referencing params with the placeholders rewritten to
+	// positional parameters. Placeholders of names not in Params, as well as
+	// `@` in quoted strings, function bodies and comments, are left alone.
+	Params map[string]interface{}
+	// MigrationsTableDDL, if set, creates the migrations table when it
+	// doesn't exist instead of the driver's default definition, e.g. to meet
+	// standards on primary keys, column types or storage parameters. It's a
+	// statement with `<TABLE_NAME>` standing for the quoted, schema qualified
+	// table, e.g. `CREATE TABLE <TABLE_NAME> (id bigint GENERATED ALWAYS AS
+	// IDENTITY PRIMARY KEY, version bigint NOT NULL UNIQUE, ...)`. The table
+	// needs the columns in VersionTableColumns, the driver doesn't add columns
+	// or constraints to it.
+	MigrationsTableDDL string
+	// Actor is who runs the migrations, e.g. the identity of a CI job,
+	// recorded with each version in the applied_by column of the migrations
+	// table and returned by Actor. The connection's role is recorded when it's
+	// empty.
+	Actor string
+	// RunID identifies the runs of migrations, from Lock to Unlock, e.g. the
+	// id of a deployment, to correlate them across logs, traces and the
+	// migrations table, which records it with each version in the run_id
+	// column. Each run gets a random UUID when it's empty.
+	RunID string
+}
+
+// VersionTableColumns are the columns of the migrations table the driver
+// reads and writes, which a MigrationsTableDDL has to define. The id column
+// needs a default, e.g. an identity.
+var VersionTableColumns = []string{"id", "version", "dirty", "created_at", "updated_at", "info", "metadata", "applied_by", "run_id"}
+
+// Logger is the logger of the driver, e.g. a *log.Logger
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// alreadyExistsCodes are the SQLSTATEs of statements creating an object that
+// already exists, which Idempotent skips
+var alreadyExistsCodes = map[pq.ErrorCode]bool{
+	"42P06": true, // duplicate_schema
+	"42P07": true, // duplicate_table, also indexes, sequences and views
+	"42701": true, // duplicate_column
+	"42710": true, // duplicate_object, e.g. constraints, types and triggers
+	"42723": true, // duplicate_function
+}
+
+// tracerName is the name of the tracer spans are started with
+const tracerName = "github.com/getoutreach/migrate/v4/database/postgresconn"
+
+// settingName matches the names of run time parameters, optionally qualified
+// for custom settings like myapp.setting
+var settingName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// queryer runs statements, either *sql.Conn or *sql.Tx
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
 type Postgres struct {
-	// Locking and unlocking need to use the same connection
-	conn     *sql.Conn
+	// Locking and unlocking need to use the same connection, nil for drivers
+	// created with WithTx
+	conn *sql.Conn
+	// db runs all statements, it's conn or the caller's transaction
+	db queryer
+	// callerTx is the transaction given to WithTx, which migrations run in
+	// and which the caller commits or rolls back
+	callerTx *sql.Tx
 	isLocked atomic.Bool
-	// Open and WithConn need to guarantee that config is never nil
+	// lockPID is the backend process of the session holding the advisory
+	// lock, 0 if there's none or the lock is a transaction level one
+	lockPID int
+	// lockWaitPID is the backend process of the session waiting for the
+	// advisory lock in Lock, 0 if none is, see CancelLock
+	lockWaitPID atomic.Int64
+	// pool is the pool of Open and WithDB that conn was acquired from, which
+	// CancelLock cancels the wait for the lock with, nil for other drivers
+	pool *sql.DB
+	// inUse is held by the calls running statements, which mustn't be made
+	// concurrently, see use. inTx is held from Begin until Commit or Rollback,
+	// txHeld while it is.
+	inUse  sync.Mutex
+	inTx   sync.Mutex
+	txHeld atomic.Bool
+	// isRLocked is set while the shared lock taken by RLock is held
+	isRLocked atomic.Bool
+	// Open, WithConn and WithTx need to guarantee that config is never nil
 	config *Config
 	// tx transaction surrounding migration
 	tx *sql.Tx
 	// context used during migrations
 	ctx context.Context
+	// failure is recorded into the failure table once the migration's
+	// transaction is rolled back
+	failure *failure
+	// skip is set when ShouldApply declined the migration in progress
+	skip bool
+	// analyze are the tables to analyze once the migration in progress commits
+	analyze []string
+	// direction of the migration in progress, up or down, only tracked with a
+	// failure table
+	direction string
+	// failedStatement is the index of the statement the last Run failed at, -1
+	// if it's unknown
+	failedStatement int
+	// version the migration in progress migrates to
+	version int
+	// isolation is the isolation level of the migration's transaction
+	isolation sql.IsolationLevel
+	// lockRetries is the number of times in a row the migration was retried
+	// after failing to acquire a lock
+	lockRetries int
+	// stats of the migration in progress or, once Run returned, the last one
+	stats RunStats
+	// cachedVersion was read at cachedAt, reused within VersionCacheTTL
+	cachedVersion *database.Version
+	cachedAt      time.Time
+	// tracer starts spans, a no-op tracer unless Config.TracerProvider is set
+	tracer trace.Tracer
+	// runSpan and migrationSpan trace the run and the migration in progress,
+	// their contexts parent the spans started within them
+	runCtx, migrationCtx   context.Context
+	runSpan, migrationSpan trace.Span
+	// runID identifies the run in progress or, once it ended, the last one
+	runID string
+	// auditGzip compresses the audit of the run in progress with
+	// Config.AuditCompress, nil until its first statement
+	auditGzip *gzip.Writer
+	// metadata are the metadata headers of the migration in progress, recorded
+	// with its version once it's applied
+	metadata map[string]string
+	// statementHashes are the digests of the statements of the migration in
+	// progress with Config.StatementHashes, recorded with its version
+	statementHashes []string
+	// parser splits the migrations DeferForeignKeys reorders, configured
+	// once from Config
+	parser *multistmt.Parser
+	// deferredFrom is the migration in progress as written when
+	// DeferForeignKeys reordered its statements, deferredOrigins the offset
+	// in it of the statement at each offset of the reordered migration
+	deferredFrom    []byte
+	deferredOrigins map[int]int
+	// versionTableEnsured is set once the migrations table was created, and
+	// reset by DropMigrationsTable
+	versionTableEnsured bool
+	// versionUnique is set when the migrations table has a unique index on
+	// version that SetVersionStatement can upsert on
+	versionUnique bool
+}
+
+// componentName suffixes name with the component, if any, for tables and
+// other schema objects that each component needs its own of
+func (c *Config) componentName(name string) string {
+	if c.Component == "" {
+		return name
+	}
+	return name + "_" + c.Component
+}
+
+// failure is a failed migration attempt destined for the failure table
+type failure struct {
+	version   int
+	statement string
+	err       string
+	failedAt  time.Time
+	direction string
+	// statementIndex is the index of the failed statement, -1 if unknown
+	statementIndex int
+}
+
+// Recovery describes the most recent failed migration, to help resuming after
+// it, e.g. after a down migration failed midway.
+type Recovery struct {
+	// Version the failed migration migrated to
+	Version int
+	// Direction of the failed migration, up or down
+	Direction string
+	// LastStatement is the index of the last statement of the migration that
+	// executed successfully before the failure. It's -1 if the first statement
+	// failed or the failed statement couldn't be determined.
+	LastStatement int
+	// Err is the error the migration failed with
+	Err string
+	// FailedAt is when the migration failed
+	FailedAt time.Time
+}
+
+// RunStats describes the execution of a migration by Run.
+type RunStats struct {
+	// Statements is the number of statements executed
+	Statements int
+	// RowsAffected is the total of the rows affected by the statements, DDL
+	// affecting none. Postgres only reports the rows affected by the last of
+	// statements sent at once, use x-multi-statement with
+	// x-statement-batch-size=1 to count the rows of each statement.
+	RowsAffected int64
+	// Duration is how long Run took
+	Duration time.Duration
 }
 
 func WithConn(ctx context.Context, conn *sql.Conn, config *Config) (database.Driver, error) {
@@ -77,10 +512,124 @@ func WithConn(ctx context.Context, conn *sql.Conn, config *Config) (database.Dri
 		return nil, err
 	}
 
+	return newPostgres(ctx, &Postgres{
+		conn:   conn,
+		db:     conn,
+		config: config,
+	})
+}
+
+// WithDB returns a driver running migrations on a connection acquired from db,
+// waiting at most config.AcquireTimeout for one if it's set. Close returns the
+// connection to db.
+func WithDB(ctx context.Context, db *sql.DB, config *Config) (database.Driver, error) {
+	if config == nil {
+		return nil, ErrNilConfig
+	}
+	conn, err := acquireConn(ctx, db, config.AcquireTimeout)
+	if err != nil {
+		return nil, err
+	}
+	d, err := WithConn(ctx, conn, config)
+	if err != nil {
+		return nil, multierror.Append(err, conn.Close())
+	}
+	d.(*Postgres).pool = db
+	return d, nil
+}
+
+// acquireConn acquires a connection from db, failing after timeout if it's
+// set
+func acquireConn(ctx context.Context, db *sql.DB, timeout time.Duration) (*sql.Conn, error) {
+	if timeout <= 0 {
+		return db.Conn(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("could not acquire connection within %v: %w", timeout, err)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// WithTx returns a driver that runs migrations in tx, a transaction started
+// by the caller, e.g. to bootstrap test fixtures within a larger transaction.
+// The driver never commits or rolls back tx, the caller owns it and decides
+// whether the migrations persist. Without a session of its own, the driver's
+// advisory lock is a transaction level lock, Unlock doesn't release it and it's
+// held until tx ends.
+func WithTx(ctx context.Context, tx *sql.Tx, config *Config) (database.Driver, error) {
+	if config == nil {
+		return nil, ErrNilConfig
+	}
+
+	return newPostgres(ctx, &Postgres{
+		db:       tx,
+		callerTx: tx,
+		config:   config,
+	})
+}
+
+// newPostgres completes the configuration of px and ensures its version table
+// exists
+func newPostgres(ctx context.Context, px *Postgres) (*Postgres, error) {
+	config := px.config
+	px.tracer = noop.NewTracerProvider().Tracer(tracerName)
+	px.parser = &multistmt.Parser{DeferForeignKeys: config.DeferForeignKeys}
+	if config.TracerProvider != nil {
+		px.tracer = config.TracerProvider.Tracer(tracerName)
+	}
+	for name := range config.SessionSettings {
+		if !settingName.MatchString(name) {
+			return nil, fmt.Errorf("invalid session setting name %q", name)
+		}
+	}
+	if config.MigrationsTableDDL != "" && !strings.Contains(config.MigrationsTableDDL, "<TABLE_NAME>") {
+		return nil, fmt.Errorf("MigrationsTableDDL doesn't create <TABLE_NAME>")
+	}
+	if config.MultiStatementEnabled && config.StatementBatchSize > 0 && executesEach(config) {
+		return nil, fmt.Errorf("StatementBatchSize can't be combined with Idempotent, IgnoreSQLStates, " +
+			"RetryClassifier or Params, which execute statements one by one")
+	}
+	for i, stmt := range config.ConnectHook {
+		if strings.TrimSpace(stmt) == "" {
+			return nil, fmt.Errorf("ConnectHook statement %d is empty", i)
+		}
+	}
+	for _, stmt := range config.ConnectHook {
+		if _, err := px.db.ExecContext(ctx, stmt); err != nil {
+			return nil, &database.Error{OrigErr: err, Err: "connect hook failed", Query: []byte(stmt)}
+		}
+	}
+	if config.MinServerVersion != 0 {
+		version, err := serverVersion(ctx, px.db)
+		if err != nil {
+			return nil, err
+		}
+		if version < config.MinServerVersion {
+			return nil, fmt.Errorf("server version %d is older than the minimum %d",
+				version, config.MinServerVersion)
+		}
+	}
+	if config.RequireEncoding != "" {
+		query := `SHOW server_encoding`
+		var encoding string
+		if err := px.db.QueryRowContext(ctx, query).Scan(&encoding); err != nil {
+			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		if normalizeEncoding(encoding) != normalizeEncoding(config.RequireEncoding) {
+			return nil, fmt.Errorf("server encoding %s isn't the required %s", encoding, config.RequireEncoding)
+		}
+	}
+
 	if config.DatabaseName == "" {
 		query := `SELECT CURRENT_DATABASE()`
 		var databaseName string
-		if err := conn.QueryRowContext(ctx, query).Scan(&databaseName); err != nil {
+		if err := px.db.QueryRowContext(ctx, query).Scan(&databaseName); err != nil {
 			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
 		}
 
@@ -93,7 +642,7 @@ func WithConn(ctx context.Context, conn *sql.Conn, config *Config) (database.Dri
 	if config.SchemaName == "" {
 		query := `SELECT CURRENT_SCHEMA()`
 		var schemaName string
-		if err := conn.QueryRowContext(ctx, query).Scan(&schemaName); err != nil {
+		if err := px.db.QueryRowContext(ctx, query).Scan(&schemaName); err != nil {
 			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
 		}
 
@@ -120,16 +669,23 @@ func WithConn(ctx context.Context, conn *sql.Conn, config *Config) (database.Dri
 			return nil, fmt.Errorf("\"%s\" MigrationsTable contains too many dot characters", config.MigrationsTable)
 		}
 	}
+	config.migrationsTableName = config.componentName(config.migrationsTableName)
 
-	px := &Postgres{
-		conn:   conn,
-		config: config,
+	if config.Debug {
+		query := `SELECT current_setting('search_path'), COALESCE(current_schema(), '')`
+		var searchPath, currentSchema string
+		if err := px.db.QueryRowContext(ctx, query).Scan(&searchPath, &currentSchema); err != nil {
+			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		px.logf("search_path %q, current schema %q, driver schema %q, migrations table %q.%q",
+			searchPath, currentSchema, config.SchemaName, config.migrationsSchemaName, config.migrationsTableName)
 	}
 
 	if err := px.ensureVersionTable(); err != nil {
 		return nil, errors.Wrap(err, "error ensuring version table")
 	}
 
+	px.logf("parser config: %v", px.parser.Config())
 	return px, nil
 }
 
@@ -146,90 +702,1531 @@ func (p *Postgres) Open(url string) (database.Driver, error) {
 		return nil, err
 	}
 
-	conn, err := db.Conn(context.Background())
-	if err != nil {
-		return nil, err
-	}
-
 	config := Config{
 		DatabaseName:          purl.Path,
 		MigrationsTable:       DefaultMigrationsTable,
 		MultiStatementMaxSize: DefaultMultiStatementMaxSize,
 	}
+	if s := purl.Query().Get("x-multi-statement"); s != "" {
+		config.MultiStatementEnabled, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-multi-statement: %w", err)
+		}
+	}
+	if s := purl.Query().Get("x-statement-batch-size"); s != "" {
+		config.StatementBatchSize, err = strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-statement-batch-size: %w", err)
+		}
+	}
+	config.Component = purl.Query().Get("x-component")
+	if s := purl.Query().Get("x-defer-constraints"); s != "" {
+		config.DeferConstraints, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-defer-constraints: %w", err)
+		}
+	}
+	if s := purl.Query().Get("x-defer-foreign-keys"); s != "" {
+		config.DeferForeignKeys, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-defer-foreign-keys: %w", err)
+		}
+	}
+	if s := purl.Query().Get("x-strict-transactionless"); s != "" {
+		config.StrictTransactionless, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-strict-transactionless: %w", err)
+		}
+	}
+	if s := purl.Query().Get("x-analyze-after"); s != "" {
+		config.AnalyzeAfter, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-analyze-after: %w", err)
+		}
+	}
+	if s := purl.Query().Get("x-statement-hashes"); s != "" {
+		config.StatementHashes, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-statement-hashes: %w", err)
+		}
+	}
+	if s := purl.Query().Get("x-resume-tokens"); s != "" {
+		config.ResumeTokens, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-resume-tokens: %w", err)
+		}
+	}
+	if s := purl.Query().Get("x-idempotent"); s != "" {
+		config.Idempotent, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-idempotent: %w", err)
+		}
+	}
+	config.Actor = purl.Query().Get("x-actor")
+	config.RunID = purl.Query().Get("x-run-id")
+	if s := purl.Query().Get("x-ignore-sqlstates"); s != "" {
+		config.IgnoreSQLStates = strings.Split(s, ",")
+	}
+	if s := purl.Query().Get("x-skip-lock"); s != "" {
+		config.SkipLock, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-skip-lock: %w", err)
+		}
+	}
+	if s := purl.Query().Get("x-stamp-schema-comment"); s != "" {
+		config.StampSchemaComment, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-stamp-schema-comment: %w", err)
+		}
+	}
+	if s := purl.Query().Get("x-lock-timeout"); s != "" {
+		ms, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-lock-timeout: %w", err)
+		}
+		config.LockTimeout = time.Duration(ms) * time.Millisecond
+	}
+	if s := purl.Query().Get("x-ddl-lock-retries"); s != "" {
+		config.DDLLockRetries, err = strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-ddl-lock-retries: %w", err)
+		}
+	}
+	if s := purl.Query().Get("x-debug"); s != "" {
+		config.Debug, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-debug: %w", err)
+		}
+	}
+	if s := purl.Query().Get("x-table-create-retries"); s != "" {
+		config.TableCreateRetries, err = strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-table-create-retries: %w", err)
+		}
+	}
+	if s := purl.Query().Get("x-version-cache-ttl"); s != "" {
+		ms, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-version-cache-ttl: %w", err)
+		}
+		config.VersionCacheTTL = time.Duration(ms) * time.Millisecond
+	}
+	if s := purl.Query().Get("x-isolation-level"); s != "" {
+		config.IsolationLevel, err = database.ParseIsolationLevel(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-isolation-level: %w", err)
+		}
+	}
+	if s := purl.Query().Get("x-min-server-version"); s != "" {
+		config.MinServerVersion, err = strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-min-server-version: %w", err)
+		}
+	}
+	config.RequireEncoding = purl.Query().Get("x-require-encoding")
+	if s := purl.Query().Get("x-acquire-timeout"); s != "" {
+		ms, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse option x-acquire-timeout: %w", err)
+		}
+		config.AcquireTimeout = time.Duration(ms) * time.Millisecond
+	}
+	conn, err := acquireConn(context.Background(), db, config.AcquireTimeout)
+	if err != nil {
+		return nil, err
+	}
 	px, err := WithConn(context.Background(), conn, &config)
 	if err != nil {
 		return nil, err
 	}
+	px.(*Postgres).pool = db
 	return px, nil
 }
 
-func (p *Postgres) Close() error {
-	err := p.conn.Close()
+// CreateDatabaseAndMigrate creates the database name on the server of
+// databaseURL, e.g. a uniquely named database for an isolated test run, and
+// applies the migrations at sourceURL to it. It returns the migrate instance
+// connected to the new database, configured by the x- options of databaseURL,
+// which the caller closes before dropping the database with DropDatabase. If
+// migrating fails, the database is left in place for inspection.
+func CreateDatabaseAndMigrate(databaseURL, name, sourceURL string) (*migrate.Migrate, error) {
+	purl, err := nurl.Parse(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	// CREATE DATABASE can't run in a transaction, it's executed on its own
+	if err := serverExec(purl, `CREATE DATABASE `+pq.QuoteIdentifier(name)); err != nil {
+		return nil, err
+	}
+
+	target := *purl
+	target.Path = "/" + name
+	m, err := migrate.New(sourceURL, target.String())
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		if srcErr, dbErr := m.Close(); srcErr != nil || dbErr != nil {
+			err = multierror.Append(err, srcErr, dbErr)
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+// DropDatabase drops the database name, e.g. created by
+// CreateDatabaseAndMigrate, on the server of databaseURL, which needs to be
+// the URL of another database. Connections to the database need to be closed
+// first. It's not an error if the database doesn't exist.
+func DropDatabase(databaseURL, name string) error {
+	purl, err := nurl.Parse(databaseURL)
+	if err != nil {
+		return err
+	}
+	return serverExec(purl, `DROP DATABASE IF EXISTS `+pq.QuoteIdentifier(name))
+}
+
+// serverExec executes stmt on a connection of its own to purl, outside of a
+// transaction
+func serverExec(purl *nurl.URL, stmt string) (err error) {
+	db, err := sql.Open("postgres", migrate.FilterCustomQuery(purl).String())
 	if err != nil {
-		return fmt.Errorf("conn: %w", err)
+		return err
+	}
+	defer func() {
+		if errClose := db.Close(); errClose != nil {
+			err = multierror.Append(err, errClose)
+		}
+	}()
+	if _, err := db.ExecContext(context.Background(), stmt); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(stmt)}
 	}
 	return nil
 }
 
+// ServerVersion returns the server's version as a number, e.g. 130004 for
+// 13.4, see server_version_num.
+func (p *Postgres) ServerVersion() (int, error) {
+	return serverVersion(p.context(), p.db)
+}
+
+func serverVersion(ctx context.Context, conn queryer) (int, error) {
+	query := `SELECT current_setting('server_version_num')::int`
+	var version int
+	if err := conn.QueryRowContext(ctx, query).Scan(&version); err != nil {
+		return 0, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return version, nil
+}
+
+// normalizeEncoding returns the name of an encoding in upper case without
+// dashes and underscores, e.g. UTF8 for utf-8
+func normalizeEncoding(name string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", "_", "").Replace(strings.TrimSpace(name)))
+}
+
+// Close closes the driver's connection. A transaction begun with Begin and
+// never committed or rolled back, which would hold its locks and the
+// connection, is rolled back first and reported to Logger, Close returns
+// ErrTxLeaked then.
+func (p *Postgres) Close() error {
+	if p.callerTx != nil {
+		// the caller owns the transaction and its connection
+		return nil
+	}
+	var err error
+	if p.tx != nil {
+		err = ErrTxLeaked
+		p.logf("transaction of version %d still open on close, rolling it back", p.version)
+		if errRollback := p.tx.Rollback(); errRollback != nil {
+			err = multierror.Append(err, errRollback)
+		}
+		p.tx = nil
+		p.endMigrationSpan(ErrTxLeaked)
+	}
+	p.endTx()
+	if errAudit := p.closeAudit(); errAudit != nil {
+		err = multierror.Append(err, errAudit)
+	}
+	if errClose := p.conn.Close(); errClose != nil {
+		errClose = fmt.Errorf("conn: %w", errClose)
+		if err == nil {
+			return errClose
+		}
+		return multierror.Append(err, errClose)
+	}
+	return err
+}
+
 // Lock https://www.postgresql.org/docs/9.6/static/explicit-locking.html#ADVISORY-LOCKS
 func (p *Postgres) Lock() error {
+	if err := p.use(); err != nil {
+		return err
+	}
+	defer p.done()
+	if err := p.lock(); err != nil {
+		return err
+	}
+	p.runID = p.newRunID()
+	p.runCtx, p.runSpan = p.tracer.Start(context.Background(), "migrate.run",
+		trace.WithAttributes(attribute.String("migrate.run_id", p.runID)))
+	return nil
+}
+
+// RunID returns the id of the run in progress, from Lock to Unlock, or of the
+// last one, empty before the first run
+func (p *Postgres) RunID() string {
+	return p.runID
+}
+
+// newRunID returns the id of a new run, the configured RunID or a random UUID
+func (p *Postgres) newRunID() string {
+	if p.config.RunID != "" {
+		return p.config.RunID
+	}
+	return uuid.NewString()
+}
+
+// logf logs to the Logger, if any, prefixed with the id of the run
+func (p *Postgres) logf(format string, v ...interface{}) {
+	if p.config.Logger == nil {
+		return
+	}
+	if p.runID != "" {
+		format = "run " + p.runID + ": " + format
+	}
+	p.config.Logger.Printf(format, v...)
+}
+
+// lock acquires the advisory lock without tracing a run
+func (p *Postgres) lock() error {
 	return database.CasRestoreOnErr(&p.isLocked, false, true, database.ErrLocked, func() error {
-		aid, err := database.GenerateAdvisoryLockId(p.config.DatabaseName, p.config.migrationsSchemaName, p.config.migrationsTableName)
+		// a version cached before the lock may have been changed by the
+		// session that held it
+		p.cachedVersion = nil
+		if p.config.SkipLock {
+			return nil
+		}
+		aid, err := p.advisoryLockID()
+		if err != nil {
+			return err
+		}
+
+		if p.callerTx != nil {
+			query := `SELECT pg_advisory_xact_lock($1)`
+			if _, err := p.db.ExecContext(context.Background(), query, aid); err != nil {
+				return &database.Error{OrigErr: err, Err: "try lock failed", Query: []byte(query)}
+			}
+			return nil
+		}
+
+		// the session's backend is recorded before waiting, so CancelLock
+		// can cancel the wait
+		pid, err := p.backendPID()
 		if err != nil {
 			return err
 		}
+		p.lockWaitPID.Store(int64(pid))
+		defer p.lockWaitPID.Store(0)
 
 		// This will wait indefinitely until the lock can be acquired.
 		query := `SELECT pg_advisory_lock($1)`
-		if _, err := p.conn.ExecContext(context.Background(), query, aid); err != nil {
+		if _, err := p.db.ExecContext(context.Background(), query, aid); err != nil {
 			return &database.Error{OrigErr: err, Err: "try lock failed", Query: []byte(query)}
 		}
-
+		p.lockPID = pid
 		return nil
 	})
 }
 
-func (p *Postgres) Unlock() error {
-	return database.CasRestoreOnErr(&p.isLocked, true, false, database.ErrNotLocked, func() error {
-		aid, err := database.GenerateAdvisoryLockId(p.config.DatabaseName, p.config.migrationsSchemaName, p.config.migrationsTableName)
-		if err != nil {
-			return err
-		}
+// backendPID returns the id of the backend process of the driver's session
+func (p *Postgres) backendPID() (int, error) {
+	query := `SELECT pg_backend_pid()`
+	var pid int
+	if err := p.db.QueryRowContext(context.Background(), query).Scan(&pid); err != nil {
+		return 0, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return pid, nil
+}
 
-		query := `SELECT pg_advisory_unlock($1)`
-		if _, err := p.conn.ExecContext(context.Background(), query, aid); err != nil {
+// CancelLock cancels the Lock call waiting for the advisory lock, e.g. from an
+// operator tool breaking a migration stuck behind another session during an
+// incident, with pg_cancel_backend on the backend of the waiting session. The
+// Lock call then fails. Lock records its backend before sending the query
+// taking the lock, so CancelLock waits for the backend to wait for the lock
+// before canceling it. It returns ErrNoLockWait if no Lock call is waiting,
+// or once Lock acquires the lock. It needs a driver created with Open or
+// WithDB, whose pool it runs on, as the driver's own connection is busy
+// waiting.
+func (p *Postgres) CancelLock() error {
+	pid := p.lockWaitPID.Load()
+	if pid == 0 {
+		return ErrNoLockWait
+	}
+	if p.pool == nil {
+		return fmt.Errorf("unable to cancel the wait of backend %d for the lock without the pool of Open or WithDB", pid)
+	}
+	for {
+		query := `SELECT EXISTS (SELECT 1 FROM pg_stat_activity WHERE pid = $1 AND wait_event_type = 'Lock')`
+		var waiting bool
+		if err := p.pool.QueryRowContext(context.Background(), query, pid).Scan(&waiting); err != nil {
 			return &database.Error{OrigErr: err, Query: []byte(query)}
 		}
-		return nil
-	})
+		if waiting {
+			break
+		}
+		time.Sleep(lockWaitPollInterval)
+		if p.lockWaitPID.Load() != pid {
+			return ErrNoLockWait
+		}
+	}
+	query := `SELECT pg_cancel_backend($1)`
+	var canceled bool
+	if err := p.pool.QueryRowContext(context.Background(), query, pid).Scan(&canceled); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	if !canceled {
+		return fmt.Errorf("unable to cancel the wait of backend %d for the lock", pid)
+	}
+	p.logf("canceled the wait of backend %d for the lock", pid)
+	return nil
 }
 
-func (p *Postgres) Run(migration io.Reader) error {
-	buf, err := io.ReadAll(migration)
+// checkLockOwner returns ErrLockNotOwned if the advisory lock taken by Lock was
+// acquired by another session than the one the driver runs statements on
+func (p *Postgres) checkLockOwner() error {
+	if !p.isLocked.Load() || p.lockPID == 0 {
+		return nil
+	}
+	pid, err := p.backendPID()
 	if err != nil {
-		return errors.Wrap(err, "error reading migration")
+		return err
 	}
-
-	ctx := p.context()
-	if p.config.StatementTimeout != 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(p.ctx, p.config.StatementTimeout)
-		defer cancel()
+	if pid != p.lockPID {
+		return fmt.Errorf("%w: the lock was acquired by backend %d, versions are recorded by backend %d",
+			ErrLockNotOwned, p.lockPID, pid)
 	}
+	return nil
+}
 
-	if p.config.SchemaName != "" {
-		buf = bytes.ReplaceAll(buf, []byte("<SCHEMA_NAME>"),
-			[]byte(p.config.SchemaName))
-	}
+// RLock acquires the advisory lock guarding the migrations table in shared
+// mode, e.g. to check the version without racing a migration. Any number of
+// sessions can hold the shared lock at once, but not while another session
+// holds the exclusive lock taken by Lock, which in turn waits for all shared
+// locks to be released. It waits until the lock can be acquired.
+func (p *Postgres) RLock() error {
+	return database.CasRestoreOnErr(&p.isRLocked, false, true, database.ErrLocked, func() error {
+		if p.config.SkipLock {
+			return nil
+		}
+		aid, err := p.advisoryLockID()
+		if err != nil {
+			return err
+		}
+
+		query := `SELECT pg_advisory_lock_shared($1)`
+		if p.callerTx != nil {
+			query = `SELECT pg_advisory_xact_lock_shared($1)`
+		}
+		if _, err := p.db.ExecContext(context.Background(), query, aid); err != nil {
+			return &database.Error{OrigErr: err, Err: "try shared lock failed", Query: []byte(query)}
+		}
+		return nil
+	})
+}
+
+// RUnlock releases the shared lock acquired by RLock.
+func (p *Postgres) RUnlock() error {
+	return database.CasRestoreOnErr(&p.isRLocked, true, false, database.ErrNotLocked, func() error {
+		if p.config.SkipLock || p.callerTx != nil {
+			// transaction level locks are released when the transaction ends
+			return nil
+		}
+		aid, err := p.advisoryLockID()
+		if err != nil {
+			return err
+		}
+
+		query := `SELECT pg_advisory_unlock_shared($1)`
+		if _, err := p.db.ExecContext(context.Background(), query, aid); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		return nil
+	})
+}
+
+// advisoryLockID returns the id of the advisory lock guarding the migrations
+// table, components get their own lock
+func (p *Postgres) advisoryLockID() (string, error) {
+	names := []string{p.config.migrationsSchemaName, p.config.migrationsTableName}
+	if p.config.Component != "" {
+		names = append(names, p.config.Component)
+	}
+	return database.GenerateAdvisoryLockId(p.config.DatabaseName, names...)
+}
+
+func (p *Postgres) Unlock() error {
+	if err := p.use(); err != nil {
+		return err
+	}
+	defer p.done()
+	if err := p.unlock(); err != nil {
+		return err
+	}
+	if p.runSpan != nil {
+		p.runSpan.End()
+		p.runCtx, p.runSpan = nil, nil
+	}
+	return p.closeAudit()
+}
+
+// unlock releases the advisory lock without tracing a run
+func (p *Postgres) unlock() error {
+	return database.CasRestoreOnErr(&p.isLocked, true, false, database.ErrNotLocked, func() error {
+		if p.config.SkipLock {
+			return nil
+		}
+		aid, err := p.advisoryLockID()
+		if err != nil {
+			return err
+		}
+
+		if p.callerTx != nil {
+			// transaction level locks are released when the transaction ends
+			return nil
+		}
+
+		query := `SELECT pg_advisory_unlock($1)`
+		if _, err := p.db.ExecContext(context.Background(), query, aid); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		p.lockPID = 0
+		return nil
+	})
+}
+
+func (p *Postgres) Run(migration io.Reader) error {
+	if err := p.use(); err != nil {
+		return err
+	}
+	defer p.done()
+	return p.run(migration)
+}
+
+// run executes migration, the calls of Run and RunContext
+func (p *Postgres) run(migration io.Reader) error {
+	p.stats = RunStats{}
+	defer func(start time.Time) { p.stats.Duration = time.Since(start) }(time.Now())
+
+	// the leading comments are read ahead, the rest of the migration is
+	// only read into memory if it isn't streamed
+	r := bufio.NewReaderSize(migration, migrationHeadSize)
+	head, err := r.Peek(migrationHeadSize)
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "error reading migration")
+	}
+	p.metadata = database.ParseMetadata(head)
+
+	ctx := p.context()
+	if p.config.StatementTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(p.ctx, p.config.StatementTimeout)
+		defer cancel()
+	}
+
+	directives, _ := database.ParseDirectives(head)
+	verifications := verifyDirectives(directives)
+	_, noLock := database.LookupDirective(directives, migrate.NoLockDirective)
+
+	if p.streams() && !noLock {
+		if err := p.runStreamed(ctx, r); err != nil {
+			return p.partialRunError(err)
+		}
+		return p.verify(ctx, verifications)
+	}
+
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "error reading migration")
+	}
+	orig := buf
+
+	// the statements are hashed as written in the source, so that
+	// VerifyStatements can compare them with it
+	if p.config.StatementHashes {
+		if p.statementHashes, err = multistmt.HashStatements(bytes.NewReader(buf)); err != nil {
+			return errors.Wrap(err, "error hashing statements")
+		}
+	}
+
+	if p.config.SchemaName != "" {
+		buf = bytes.ReplaceAll(buf, []byte("<SCHEMA_NAME>"),
+			[]byte(p.config.SchemaName))
+	}
+
+	if stmt, err := transactionControl(buf); err != nil {
+		return err
+	} else if stmt != nil {
+		return errTransactionControl(stmt)
+	}
+
+	if p.config.DeferForeignKeys {
+		written := buf
+		if buf, p.deferredOrigins, err = deferForeignKeys(p.parser, buf); err != nil {
+			return err
+		}
+		if p.deferredOrigins != nil {
+			p.deferredFrom = written
+			defer func() { p.deferredFrom, p.deferredOrigins = nil, nil }()
+		}
+	}
+
+	stmt, mixed, err := transactionlessStatement(buf)
+	if err != nil {
+		return err
+	}
+	if stmt != nil {
+		if err := p.runTransactionless(ctx, buf, stmt, mixed); err != nil {
+			return err
+		}
+	} else if noLock && p.callerTx == nil {
+		// migrations releasing the lock, e.g. to build indexes
+		// concurrently, don't hold their transaction's locks either
+		p.logf("running version %d outside of a transaction, it has the %s directive", p.version, migrate.NoLockDirective)
+		if err := p.runOutsideTx(ctx, buf); err != nil {
+			return err
+		}
+	} else if err := p.runRetrying(ctx, buf, orig); err != nil {
+		return err
+	}
+
+	if p.config.AnalyzeAfter {
+		if err := p.collectAnalyzeTables(buf); err != nil {
+			return err
+		}
+	}
+	if err := p.verify(ctx, verifications); err != nil {
+		return err
+	}
+
+	// exec was successful, commit here, then nothing to rollback
+	return nil
+}
+
+// runRetrying executes the migration. When it fails to acquire a lock in the
+// driver's own transaction it returns a database.RetryError, up to
+// DDLLockRetries times in a row, with orig, the migration as it was read, so
+// that it's run again in a new transaction.
+func (p *Postgres) runRetrying(ctx context.Context, migration, orig []byte) error {
+	err := p.runMigration(ctx, migration)
+	if err == nil {
+		p.lockRetries = 0
+		return nil
+	}
+	if p.tx == nil || p.callerTx != nil || p.lockRetries >= p.config.DDLLockRetries || !isLockNotAvailable(err) {
+		p.lockRetries = 0
+		return p.partialRunError(err)
+	}
+
+	interval := ddlLockRetryMinInterval
+	for i := 0; i < p.lockRetries && interval < ddlLockRetryMaxInterval; i++ {
+		interval *= 2
+	}
+	if interval > ddlLockRetryMaxInterval {
+		interval = ddlLockRetryMaxInterval
+	}
+	p.lockRetries++
+	return &database.RetryError{Err: p.partialRunError(err), After: interval, Migration: orig}
+}
+
+// verifyDirective is the directive of a query verifying a migration
+const verifyDirective = "migrate:verify"
+
+// verifyDirectives returns the queries of directives like
+// `-- migrate:verify SELECT 1 FROM users WHERE email IS NULL`
+func verifyDirectives(directives []database.Directive) []string {
+	var queries []string
+	for _, d := range directives {
+		if d.Name == verifyDirective && d.Arg != "" {
+			queries = append(queries, d.Arg)
+		}
+	}
+	return queries
+}
+
+// verify runs the queries verifying the migration that ran, in its
+// transaction so a failure rolls it back with its version. A query passes if
+// it returns no rows or a single true value.
+func (p *Postgres) verify(ctx context.Context, queries []string) error {
+	for _, query := range queries {
+		ok, err := p.verifyQuery(ctx, query)
+		if err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		if !ok {
+			return fmt.Errorf("%w: %s of version %d", ErrVerificationFailed, query, p.version)
+		}
+	}
+	return nil
+}
+
+// verifyQuery runs query and reports whether it returned no rows or a single
+// true value
+func (p *Postgres) verifyQuery(ctx context.Context, query string) (ok bool, err error) {
+	rows, err := p.db.QueryContext(ctx, query)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if errClose := rows.Close(); errClose != nil {
+			err = multierror.Append(err, errClose)
+		}
+	}()
+	if !rows.Next() {
+		return true, rows.Err()
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return false, err
+	}
+	if len(columns) != 1 {
+		return false, nil
+	}
+	var value interface{}
+	if err := rows.Scan(&value); err != nil {
+		return false, err
+	}
+	if b, isBool := value.(bool); !isBool || !b || rows.Next() {
+		return false, rows.Err()
+	}
+	return true, rows.Err()
+}
+
+// transactionControlCommands are the commands beginning, committing or
+// rolling back a transaction
+var transactionControlCommands = map[string]bool{
+	"BEGIN":    true,
+	"START":    true,
+	"COMMIT":   true,
+	"END":      true,
+	"ROLLBACK": true,
+	"ABORT":    true,
+}
+
+// transactionControl returns the first statement of migration that begins,
+// commits or rolls back a transaction, nil if there's none. Rolling back to a
+// savepoint and the BEGIN ATOMIC ... END bodies of SQL functions are allowed.
+func transactionControl(migration []byte) ([]byte, error) {
+	var found []byte
+	var scanner txControlScanner
+	// the parser only emits terminated statements, terminate the last one in
+	// case the migration doesn't
+	migration = append(migration[:len(migration):len(migration)], "\n;"...)
+	err := multistmt.Parse(bytes.NewReader(migration), nil, 0, "", func(stmt []byte) error {
+		if !scanner.scan(stmt) {
+			return nil
+		}
+		found = bytes.TrimSpace(stmt)
+		return multistmt.ErrStopParsing
+	})
+	return found, err
+}
+
+// txControlScanner finds the statements of a migration beginning, committing
+// or rolling back a transaction, given the statements one after the other
+type txControlScanner struct {
+	// inAtomic is true within the BEGIN ATOMIC ... END body of a function
+	inAtomic bool
+}
+
+// scan reports whether stmt, following the statements scanned before, begins,
+// commits or rolls back a transaction
+func (s *txControlScanner) scan(stmt []byte) bool {
+	words := multistmt.StatementKeywords(stmt, 2)
+	if s.inAtomic {
+		// the body's statements are split at their ';', END closes it
+		s.inAtomic = len(words) == 0 || words[0] != "END"
+		return false
+	}
+	if beginAtomic.Match(stmt) {
+		s.inAtomic = true
+		return false
+	}
+	return len(words) > 0 && transactionControlCommands[words[0]] &&
+		!(words[0] == "ROLLBACK" && len(words) > 1 && words[1] == "TO")
+}
+
+// errTransactionControl is the error of a migration controlling the
+// transaction with stmt
+func errTransactionControl(stmt []byte) error {
+	return database.Error{
+		Err: "migration must not begin, commit or roll back transactions, each migration already" +
+			" runs in one: remove its BEGIN, COMMIT and ROLLBACK statements",
+		Query: stmt,
+	}
+}
+
+// beginAtomic matches the start of a SQL-standard function body
+var beginAtomic = regexp.MustCompile(`(?i)\bBEGIN\s+ATOMIC\b`)
+
+// transactionlessStatement returns the first statement of migration Postgres
+// refuses to run in a transaction block, nil if there's none, and whether
+// migration has other statements besides the ones like it
+func transactionlessStatement(migration []byte) (found []byte, mixed bool, err error) {
+	// the parser only emits terminated statements, terminate the last one in
+	// case the migration doesn't
+	migration = append(migration[:len(migration):len(migration)], "\n;"...)
+	others := false
+	err = multistmt.Parse(bytes.NewReader(migration), nil, 0, "", func(stmt []byte) error {
+		if len(multistmt.StatementKeywords(stmt, 1)) == 0 {
+			return nil
+		}
+		if !isTransactionless(stmt) {
+			others = true
+		} else if found == nil {
+			found = bytes.TrimSpace(stmt)
+		}
+		return nil
+	})
+	return found, found != nil && others, err
+}
+
+// concurrently and addValue match the clauses making REINDEX and ALTER TYPE
+// statements unable to run in a transaction block
+var (
+	concurrently = regexp.MustCompile(`(?i)\bCONCURRENTLY\b`)
+	addValue     = regexp.MustCompile(`(?i)\bADD\s+VALUE\b`)
+)
+
+// isTransactionless reports whether Postgres refuses to run stmt in a
+// transaction block, e.g. CREATE INDEX CONCURRENTLY, VACUUM or CREATE DATABASE.
+// ALTER TYPE ... ADD VALUE is included, the value it adds can't be used in
+// the transaction adding it.
+func isTransactionless(stmt []byte) bool {
+	words := multistmt.StatementKeywords(stmt, 4)
+	if len(words) == 0 {
+		return false
+	}
+	switch words[0] {
+	case "VACUUM":
+		return true
+	case "REINDEX":
+		return concurrently.Match(stmt) ||
+			len(words) > 1 && (words[1] == "DATABASE" || words[1] == "SYSTEM")
+	case "CREATE", "DROP":
+		if len(words) < 2 {
+			return false
+		}
+		switch words[1] {
+		case "DATABASE", "TABLESPACE":
+			return true
+		case "INDEX":
+			return len(words) > 2 && words[2] == "CONCURRENTLY"
+		case "UNIQUE":
+			return len(words) > 3 && words[2] == "INDEX" && words[3] == "CONCURRENTLY"
+		}
+	case "ALTER":
+		return len(words) > 1 && (words[1] == "SYSTEM" || words[1] == "TYPE" && addValue.Match(stmt))
+	}
+	return false
+}
+
+// errTransactionless is the error of a migration mixing stmt, which can't run
+// in a transaction, with other statements while StrictTransactionless is set
+func errTransactionless(stmt []byte) error {
+	return database.Error{
+		Err: "migration mixes a statement that can't run in a transaction with other statements:" +
+			" move it to a migration of its own",
+		Query: stmt,
+	}
+}
+
+// runTransactionless executes migration, which has statements like stmt that
+// can't run in a transaction, outside of one, see runOutsideTx
+func (p *Postgres) runTransactionless(ctx context.Context, migration, stmt []byte, mixed bool) error {
+	if mixed && p.config.StrictTransactionless {
+		return errTransactionless(stmt)
+	}
+	if p.callerTx != nil {
+		return database.Error{Err: "migration can't run in the caller's transaction", Query: stmt}
+	}
+	p.logf("running version %d outside of a transaction, this statement can't run in one: %s", p.version, stmt)
+	return p.runOutsideTx(ctx, migration)
+}
+
+// runOutsideTx executes migration outside of a transaction, statement by
+// statement, as statements like CREATE INDEX CONCURRENTLY can't be sent with
+// others, which run in an implicit transaction then. The migration's transaction is committed first with the dirty
+// version recorded in it, so a migration failing halfway stays dirty, and a
+// new one is begun afterwards to record the version in.
+func (p *Postgres) runOutsideTx(ctx context.Context, migration []byte) error {
+	inTx := p.tx != nil
+	if inTx {
+		if err := p.tx.Commit(); err != nil {
+			return err
+		}
+		p.tx = nil
+		p.endMigrationSpan(nil)
+	}
+	err := p.runHooked(ctx, func() error {
+		return p.runEach(ctx, migration)
+	})
+	if err != nil {
+		err = p.partialRunError(err)
+	}
+	if inTx {
+		// begin resets the context RunContext set
+		runCtx := p.ctx
+		if errBegin := p.begin(p.isolation); errBegin != nil {
+			if err != nil {
+				return multierror.Append(err, errBegin)
+			}
+			return errBegin
+		}
+		p.ctx = runCtx
+	}
+	return err
+}
+
+// partialRunError returns the error of the migration that failed with err,
+// telling how far it got
+func (p *Postgres) partialRunError(err error) error {
+	return ErrPartialRun{
+		Executed:   p.stats.Statements,
+		RolledBack: p.tx != nil || p.callerTx != nil,
+		Err:        err,
+	}
+}
+
+// RunContext runs migration like Run, cancelling its statements once ctx is
+// done, implementing database.ContextRunner.
+func (p *Postgres) RunContext(ctx context.Context, migration io.Reader) error {
+	if err := p.use(); err != nil {
+		return err
+	}
+	defer p.done()
+	prev := p.ctx
+	p.ctx = ctx
+	defer func() { p.ctx = prev }()
+	return p.run(migration)
+}
+
+// RunForSchema runs migration in its own transaction, like a migration
+// without a version, with the search_path of the driver's connection set to
+// schema, e.g. to apply a migration to the schema of every tenant without
+// opening a driver for each of them. For the run, the schema's lock is held
+// and the migrations and failure tables, as well as `<SCHEMA_NAME>`, resolve
+// to schema, unless MigrationsTable names another schema. The search_path is
+// reset afterwards. The driver mustn't be locked or in a migration already.
+func (p *Postgres) RunForSchema(ctx context.Context, schema string, migration io.Reader) (err error) {
+	if p.callerTx != nil {
+		return fmt.Errorf("unable to set the search_path of the caller's transaction")
+	}
+	if p.tx != nil {
+		return fmt.Errorf("transaction already started")
+	}
+
+	var searchPath string
+	query := `SHOW search_path`
+	if err := p.conn.QueryRowContext(ctx, query).Scan(&searchPath); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	query = `SELECT set_config('search_path', $1, false)`
+	if _, err := p.conn.ExecContext(ctx, query, pq.QuoteIdentifier(schema)); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	defer func() {
+		// reset even if ctx is done
+		if _, errReset := p.conn.ExecContext(context.Background(), query, searchPath); errReset != nil {
+			errReset = &database.Error{OrigErr: errReset, Query: []byte(query)}
+			if err == nil {
+				err = errReset
+			} else {
+				err = multierror.Append(err, errReset)
+			}
+		}
+	}()
+
+	config, versionTableEnsured := p.config, p.versionTableEnsured
+	schemaConfig := *config
+	schemaConfig.SchemaName = schema
+	if config.migrationsSchemaName == config.SchemaName {
+		schemaConfig.migrationsSchemaName = schema
+	}
+	p.config, p.versionTableEnsured, p.cachedVersion = &schemaConfig, false, nil
+	defer func() {
+		p.config, p.versionTableEnsured, p.cachedVersion = config, versionTableEnsured, nil
+	}()
+
+	if err := p.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if errUnlock := p.unlock(); errUnlock != nil {
+			if err == nil {
+				err = errUnlock
+			} else {
+				err = multierror.Append(err, errUnlock)
+			}
+		}
+	}()
+	if err := p.ensureVersionTable(); err != nil {
+		return err
+	}
+
+	if err := p.Begin(); err != nil {
+		return err
+	}
+	if err := p.RunContext(ctx, migration); err != nil {
+		if errRollback := p.Rollback(); errRollback != nil {
+			return multierror.Append(err, errRollback)
+		}
+		return err
+	}
+	return p.Commit()
+}
+
+// runMigration executes the migration with its hooks, in a single round trip
+// unless the driver's options act on each statement
+func (p *Postgres) runMigration(ctx context.Context, migration []byte) error {
+	return p.runHooked(ctx, func() error {
+		switch {
+		// newPostgres rejects batches with the options executing statements
+		// one by one
+		case p.config.MultiStatementEnabled && p.config.StatementBatchSize > 0:
+			return p.runBatches(ctx, bytes.NewReader(migration), nil)
+		case p.splitsStatements():
+			return p.runEach(ctx, migration)
+		default:
+			return p.execAt(ctx, migration, migration, 0, 0, countStatements(migration))
+		}
+	})
+}
+
+// splitsStatements reports whether migrations are executed statement by
+// statement, for the options acting on each of them or telling which one
+// failed, and to point errors at the statements DeferForeignKeys reordered
+// as written
+func (p *Postgres) splitsStatements() bool {
+	c := p.config
+	return executesEach(c) || c.FailureTable != "" || c.StatementHashes || p.deferredOrigins != nil
+}
+
+// executesEach reports whether config has options that need the statements
+// of migrations executed one by one, which can't be sent in batches
+func executesEach(config *Config) bool {
+	return config.Idempotent || len(config.IgnoreSQLStates) > 0 || config.RetryClassifier != nil || len(config.Params) > 0
+}
 
-	if _, err := p.conn.ExecContext(ctx, string(buf)); err != nil {
+// runEach executes the statements of migration one by one, so that the
+// statement failing is known, binding the Params they reference. Errors point
+// at their position in migration. With Idempotent, IgnoreSQLStates or
+// RetryClassifier each statement runs in a savepoint, skipping the ones
+// creating objects that already exist, with Idempotent, and the ones failing
+// with IgnoreSQLStates, and retrying the ones RetryClassifier says to. It fails
+// without executing the statements after the ones the parser couldn't split,
+// rather than recording a migration that didn't run.
+func (p *Postgres) runEach(ctx context.Context, migration []byte) error {
+	c := p.config
+	// savepoints only exist in transactions, outside of them a failed
+	// statement doesn't abort the ones after it anyway
+	savepoints := (p.tx != nil || p.callerTx != nil) &&
+		(c.Idempotent || len(c.IgnoreSQLStates) > 0 || c.RetryClassifier != nil)
+	index := 0
+	// the parser only emits terminated statements, terminate the last one in
+	// case the migration doesn't
+	terminated := append(migration[:len(migration):len(migration)], "\n;"...)
+	// parsed is the offset the statements were split up to
+	parsed := 0
+	err := multistmt.ParseWithOffsets(bytes.NewReader(terminated), func(stmt []byte, start, end int) error {
+		if end > parsed {
+			parsed = end
+		}
+		if string(bytes.TrimSpace(stmt)) == ";" {
+			return nil
+		}
+		defer func() { index++ }()
+		stmt = terminated[start:end]
+		if savepoints {
+			if err := p.savepoint(ctx, "SAVEPOINT", "migrate_statement"); err != nil {
+				return err
+			}
+		}
+		// errors point at the statement as written
+		written, at := p.writtenAt(migration, stmt, start)
+		for attempt := 0; ; attempt++ {
+			err := p.execStatement(ctx, written, stmt, at, index)
+			if err == nil {
+				break
+			}
+			if reason, skip := p.skippable(err); skip {
+				p.failedStatement = -1
+				p.logf("skipped statement %d of version %d, %s: %v", index, p.version, reason, err)
+				if savepoints {
+					return p.savepoint(ctx, "ROLLBACK TO SAVEPOINT", "migrate_statement")
+				}
+				return nil
+			}
+			if c.RetryClassifier == nil {
+				return err
+			}
+			retry, delay := c.RetryClassifier(err, stmt, attempt)
+			if !retry {
+				return err
+			}
+			p.failedStatement = -1
+			p.logf("retrying statement %d of version %d in %v: %v", index, p.version, delay, err)
+			if savepoints {
+				if err := p.savepoint(ctx, "ROLLBACK TO SAVEPOINT", "migrate_statement"); err != nil {
+					return err
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(delay):
+			}
+		}
+		if savepoints {
+			return p.savepoint(ctx, "RELEASE SAVEPOINT", "migrate_statement")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if parsed < len(terminated) {
+		return fmt.Errorf("unable to split version %d into statements after byte %d of %d",
+			p.version, parsed, len(migration))
+	}
+	return nil
+}
+
+// execStatement executes stmt, the statement at index starting at offset in
+// migration, binding the Params it references
+func (p *Postgres) execStatement(ctx context.Context, migration, stmt []byte, offset, index int) error {
+	if query, args := bindParams(stmt, p.config.Params); len(args) > 0 {
+		// the positions of errors are those of the rewritten statement
+		return p.exec(ctx, query, index, 1, args...)
+	}
+	return p.execAt(ctx, migration, stmt, offset, index, 1)
+}
+
+// runHooked executes run between the hooks of each migration
+func (p *Postgres) runHooked(ctx context.Context, run func() error) error {
+	p.failedStatement = -1
+	if err := p.hook(ctx, "before each", p.config.BeforeEach); err != nil {
+		return err
+	}
+	if err := run(); err != nil {
+		return err
+	}
+	return p.hook(ctx, "after each", p.config.AfterEach)
+}
+
+// migrationHeadSize is how much of the start of a migration is read ahead
+// for its metadata and directives
+const migrationHeadSize = 64 * 1024
+
+// streams reports whether migrations are executed while they're read instead
+// of being read into memory first. Executing them in batches of statements
+// allows it, unless an option needs the whole migration, e.g. to run it again
+// or to analyze it after it ran.
+func (p *Postgres) streams() bool {
+	c := p.config
+	return c.MultiStatementEnabled && c.StatementBatchSize > 0 && !c.DeferForeignKeys && c.DDLLockRetries == 0 &&
+		!c.AnalyzeAfter && !c.StatementHashes
+}
+
+// runStreamed executes the migration with its hooks in batches of statements
+// as they're read, checking each statement for transaction control
+func (p *Postgres) runStreamed(ctx context.Context, migration io.Reader) error {
+	var scanner txControlScanner
+	return p.runHooked(ctx, func() error {
+		return p.runBatches(ctx, migration, func(stmt []byte) ([]byte, error) {
+			if p.config.SchemaName != "" {
+				stmt = bytes.ReplaceAll(stmt, []byte("<SCHEMA_NAME>"), []byte(p.config.SchemaName))
+			}
+			if scanner.scan(stmt) {
+				return nil, errTransactionControl(bytes.TrimSpace(stmt))
+			}
+			return stmt, nil
+		})
+	})
+}
+
+// spanContext returns the context of the innermost span in progress
+func (p *Postgres) spanContext() context.Context {
+	switch {
+	case p.migrationCtx != nil:
+		return p.migrationCtx
+	case p.runCtx != nil:
+		return p.runCtx
+	}
+	return context.Background()
+}
+
+// endMigrationSpan ends the span of the migration in progress, if any
+func (p *Postgres) endMigrationSpan(err error) {
+	if p.migrationSpan != nil {
+		endSpan(p.migrationSpan, err)
+		p.migrationCtx, p.migrationSpan = nil, nil
+	}
+}
+
+// endSpan ends span, recording err if it failed
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// isLockNotAvailable reports whether err is Postgres failing to acquire a lock
+func isLockNotAvailable(err error) bool {
+	return errorCode(err) == "55P03"
+}
+
+// isAlreadyExists reports whether err is Postgres failing to create an object
+// because it already exists
+func isAlreadyExists(err error) bool {
+	return alreadyExistsCodes[errorCode(err)]
+}
+
+// errorCode returns the SQLSTATE of err, empty if it's not a Postgres error
+func errorCode(err error) pq.ErrorCode {
+	if dbErr, ok := err.(database.Error); ok {
+		err = dbErr.OrigErr
+	}
+	if pgErr, ok := err.(*pq.Error); ok {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// audit writes query to the AuditWriter, if any, before it's executed
+func (p *Postgres) audit(query []byte) error {
+	if p.config.AuditWriter == nil {
+		return nil
+	}
+	var w io.Writer = p.config.AuditWriter
+	if p.config.AuditCompress {
+		if p.auditGzip == nil {
+			p.auditGzip = gzip.NewWriter(p.config.AuditWriter)
+		}
+		w = p.auditGzip
+	}
+	if _, err := fmt.Fprintf(w, "-- version %d at %s\n", p.version, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return errors.Wrap(err, "error writing audit")
+	}
+	if len(query) > 0 && query[len(query)-1] != '\n' {
+		query = append(query[:len(query):len(query)], '\n')
+	}
+	if _, err := w.Write(query); err != nil {
+		return errors.Wrap(err, "error writing audit")
+	}
+	if p.auditGzip != nil {
+		// a sync flush, the stream stays open for the next statement
+		if err := p.auditGzip.Flush(); err != nil {
+			return errors.Wrap(err, "error flushing audit")
+		}
+	}
+	return p.flushAudit()
+}
+
+// flushAudit flushes the AuditWriter if it has a Flush method
+func (p *Postgres) flushAudit() error {
+	if f, ok := p.config.AuditWriter.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return errors.Wrap(err, "error flushing audit")
+		}
+	}
+	return nil
+}
+
+// closeAudit ends the gzip member of the run's audit with AuditCompress,
+// whether the run succeeded or not
+func (p *Postgres) closeAudit() error {
+	if p.auditGzip == nil {
+		return nil
+	}
+	err := p.auditGzip.Close()
+	p.auditGzip = nil
+	if err != nil {
+		return errors.Wrap(err, "error closing audit")
+	}
+	return p.flushAudit()
+}
+
+// hook runs the SQL of the hook name, if any
+func (p *Postgres) hook(ctx context.Context, name string, query string) error {
+	if query == "" {
+		return nil
+	}
+	if err := p.audit([]byte(query)); err != nil {
+		return err
+	}
+	if _, err := p.db.ExecContext(ctx, query); err != nil {
+		return database.Error{OrigErr: err, Err: name + " hook failed", Query: []byte(query)}
+	}
+	return nil
+}
+
+// runBatches splits migration into statements and executes them in batches of
+// StatementBatchSize statements as they're read. Each statement is passed
+// through check first, if it's not nil.
+func (p *Postgres) runBatches(ctx context.Context, migration io.Reader,
+	check func(stmt []byte) ([]byte, error)) error {
+	var batch [][]byte
+	first := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := p.exec(ctx, bytes.Join(batch, []byte("\n")), first, len(batch)); err != nil {
+			return err
+		}
+		first += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	// the parser only emits terminated statements, terminate the last one in
+	// case the migration doesn't
+	migration = io.MultiReader(migration, strings.NewReader("\n;"))
+	if err := multistmt.Parse(migration, nil, 0, "", func(stmt []byte) error {
+		if string(bytes.TrimSpace(stmt)) == ";" {
+			return nil
+		}
+		if check != nil {
+			var err error
+			if stmt, err = check(stmt); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, stmt)
+		if len(batch) < p.config.StatementBatchSize {
+			return nil
+		}
+		return flush()
+	}); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// bindParams rewrites the `@name` placeholders of the params in stmt to
+// positional parameters and returns the rewritten statement with the values
+// to bind. A statement that references no params is returned as is. `@` in
+// quoted strings, function bodies, line comments and nested block comments
+// isn't a placeholder.
+func bindParams(stmt []byte, params map[string]interface{}) ([]byte, []interface{}) {
+	var (
+		out       []byte
+		args      []interface{}
+		positions map[string]int
+		copied    int
+	)
+	for i := 0; i < len(stmt); i++ {
+		switch c := stmt[i]; {
+		case c == '\'' || c == '"':
+			if end := bytes.IndexByte(stmt[i+1:], c); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(stmt)
+			}
+		case c == '-' && i+1 < len(stmt) && stmt[i+1] == '-':
+			if end := bytes.IndexByte(stmt[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(stmt)
+			}
+		case c == '/' && i+1 < len(stmt) && stmt[i+1] == '*':
+			// skip to the end of the comment, block comments nest
+			for depth := 0; i+1 < len(stmt); i++ {
+				if stmt[i] == '/' && stmt[i+1] == '*' {
+					depth++
+					i++
+				} else if stmt[i] == '*' && stmt[i+1] == '/' {
+					depth--
+					i++
+					if depth == 0 {
+						break
+					}
+				}
+			}
+		case c == '$' && (i == 0 || !isIdentChar(stmt[i-1])):
+			end := i + 1
+			for end < len(stmt) && isIdentChar(stmt[end]) {
+				end++
+			}
+			if end < len(stmt) && stmt[end] == '$' && (end == i+1 || stmt[i+1] < '0' || stmt[i+1] > '9') {
+				tag := stmt[i : end+1]
+				if closing := bytes.Index(stmt[end+1:], tag); closing >= 0 {
+					i = end + closing + len(tag)
+				} else {
+					i = len(stmt)
+				}
+			}
+		case c == '@':
+			end := i + 1
+			for end < len(stmt) && isIdentChar(stmt[end]) {
+				end++
+			}
+			name := string(stmt[i+1 : end])
+			value, ok := params[name]
+			if name == "" || (name[0] >= '0' && name[0] <= '9') || !ok {
+				continue
+			}
+			if positions == nil {
+				positions = map[string]int{}
+			}
+			position, ok := positions[name]
+			if !ok {
+				args = append(args, value)
+				position = len(args)
+				positions[name] = position
+			}
+			out = append(out, stmt[copied:i]...)
+			out = append(out, '$')
+			out = strconv.AppendInt(out, int64(position), 10)
+			copied = end
+			i = end - 1
+		}
+	}
+	if len(args) == 0 {
+		return stmt, nil
+	}
+	return append(out, stmt[copied:]...), args
+}
+
+// isIdentChar reports whether c can be part of an unquoted identifier
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= 0x80 || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// deferForeignKeys moves the statements of migration adding foreign keys that
+// are flagged with a multistmt.DeferDirective to its end, split by parser. A migration without
+// the directive is returned as is, with nil origins. Otherwise origins maps
+// the offset of each statement in the reordered migration to its offset in
+// migration, to point errors at the statements as written.
+func deferForeignKeys(parser *multistmt.Parser, migration []byte) (reordered []byte, origins map[int]int, err error) {
+	type span struct{ start, end int }
+	var spans []span
+	deferred := false
+	// the parser only emits terminated statements, terminate the last one in
+	// case the migration doesn't
+	terminated := append(migration[:len(migration):len(migration)], "\n;"...)
+	if err := parser.ParseWithOffsets(bytes.NewReader(terminated), func(stmt []byte, start, end int) error {
+		if string(bytes.TrimSpace(stmt)) == ";" {
+			return nil
+		}
+		// the deferred statements come after the ones following them
+		if len(spans) > 0 && start < spans[len(spans)-1].start {
+			deferred = true
+		}
+		spans = append(spans, span{start, end})
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	if !deferred {
+		return migration, nil, nil
+	}
+	origins = make(map[int]int, len(spans))
+	for i, s := range spans {
+		if i > 0 {
+			reordered = append(reordered, '\n')
+		}
+		origins[len(reordered)] = s.start
+		reordered = append(reordered, terminated[s.start:s.end]...)
+	}
+	return reordered, origins, nil
+}
+
+// writtenAt returns the migration as written and the offset in it of stmt, at
+// offset in migration, which DeferForeignKeys may have reordered
+func (p *Postgres) writtenAt(migration, stmt []byte, offset int) ([]byte, int) {
+	origin, ok := p.deferredOrigins[offset]
+	if !ok || origin+len(stmt) > len(p.deferredFrom) || !bytes.Equal(p.deferredFrom[origin:origin+len(stmt)], stmt) {
+		return migration, offset
+	}
+	return p.deferredFrom, origin
+}
+
+// skippable returns why the statement failing with err is skipped, ok is false
+// if it fails the migration
+func (p *Postgres) skippable(err error) (reason string, ok bool) {
+	code := errorCode(err)
+	if code == "" {
+		return "", false
+	}
+	if p.config.Idempotent && isAlreadyExists(err) {
+		return "the object already exists", true
+	}
+	for _, state := range p.config.IgnoreSQLStates {
+		if strings.TrimSpace(state) == string(code) {
+			return fmt.Sprintf("SQLSTATE %s is ignored", code), true
+		}
+	}
+	return "", false
+}
+
+// savepoint executes the savepoint command, e.g. SAVEPOINT, on the savepoint
+// name
+func (p *Postgres) savepoint(ctx context.Context, command, name string) error {
+	query := command + " " + name
+	if _, err := p.db.ExecContext(ctx, query); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
+// exec executes query, the statements of a migration starting with the
+// statement at index firstStatement, binding args to its parameters.
+// statements is the number of statements in query.
+func (p *Postgres) exec(ctx context.Context, query []byte, firstStatement, statements int,
+	args ...interface{}) error {
+	return p.execAt(ctx, query, query, 0, firstStatement, statements, args...)
+}
+
+// execAt executes query, found at byte offset of migration, like exec. Errors
+// point at their position in migration.
+func (p *Postgres) execAt(ctx context.Context, migration, query []byte, offset, firstStatement, statements int,
+	args ...interface{}) error {
+	if err := p.audit(query); err != nil {
+		return err
+	}
+	_, span := p.tracer.Start(p.spanContext(), "migrate.statement",
+		trace.WithAttributes(attribute.Int("migrate.statement_index", firstStatement)))
+	result, err := p.db.ExecContext(ctx, string(query), args...)
+	if err == nil {
+		p.stats.Statements += statements
+		if rows, err := result.RowsAffected(); err == nil {
+			p.stats.RowsAffected += rows
+			span.SetAttributes(attribute.Int64("db.rows_affected", rows))
+		}
+	}
+	endSpan(span, err)
+	if err != nil {
+		// the statement failing is only known from the error's position
+		// when several are executed at once
+		p.failedStatement = firstStatement
+		if statements > 1 {
+			p.failedStatement = -1
+		}
 		if pgErr, ok := err.(*pq.Error); ok {
 			var line uint
 			var col uint
 			var lineColOK bool
 			if pgErr.Position != "" {
 				if pos, err := strconv.ParseUint(pgErr.Position, 10, 64); err == nil {
-					line, col, lineColOK = computeLineFromPos(string(buf), int(pos))
+					if statements > 1 {
+						p.failedStatement = firstStatement + statementIndexAt(query, int(pos))
+					}
+					pos += uint64(utf8.RuneCount(migration[:offset]))
+					line, col, lineColOK = computeLineFromPos(string(migration), int(pos))
 				}
 			}
 			message := fmt.Sprintf("migration failed: %s", pgErr.Message)
@@ -239,16 +2236,73 @@ func (p *Postgres) Run(migration io.Reader) error {
 			if pgErr.Detail != "" {
 				message = fmt.Sprintf("%s, %s", message, pgErr.Detail)
 			}
-			return database.Error{OrigErr: err, Err: message, Query: buf, Line: line}
+			return database.Error{OrigErr: err, Err: message, Query: migration, Line: line}
 		}
 
-		return database.Error{OrigErr: err, Err: "migration failed", Query: buf}
+		return database.Error{OrigErr: err, Err: "migration failed", Query: migration}
 	}
 
-	// exec was successful, commit here, then nothing to rollback
 	return nil
 }
 
+// collectAnalyzeTables adds the tables modified by DML statements in migration
+// to the tables analyzed once the migration commits
+func (p *Postgres) collectAnalyzeTables(migration []byte) error {
+	return multistmt.Parse(bytes.NewReader(migration), nil, 0, "", func(stmt []byte) error {
+		if multistmt.ClassifyStatement(stmt) != multistmt.StatementDML {
+			return nil
+		}
+		table := multistmt.StatementTable(stmt)
+		if table == "" {
+			return nil
+		}
+		for _, t := range p.analyze {
+			if t == table {
+				return nil
+			}
+		}
+		p.analyze = append(p.analyze, table)
+		return nil
+	})
+}
+
+// statementIndexAt returns the index of the statement in migration containing
+// pos, a 1-based character position like the ones in postgres errors
+func statementIndexAt(migration []byte, pos int) int {
+	runes := []rune(string(migration))
+	if pos < 1 || pos > len(runes) {
+		return -1
+	}
+	// the statements ending before pos
+	index := 0
+	prefix := []byte(string(runes[:pos-1]))
+	// pos may be in a quoted string the prefix doesn't close
+	if err := multistmt.Parse(bytes.NewReader(prefix), nil, 0, "", func([]byte) error {
+		index++
+		return nil
+	}); err != nil && !errors.Is(err, multistmt.ErrUnterminated) {
+		return -1
+	}
+	return index
+}
+
+// countStatements returns the number of statements in query
+func countStatements(query []byte) int {
+	count := 0
+	// the parser only emits terminated statements, terminate the last one in
+	// case the query doesn't
+	query = append(query[:len(query):len(query)], "\n;"...)
+	if err := multistmt.Parse(bytes.NewReader(query), nil, 0, "", func(stmt []byte) error {
+		if string(bytes.TrimSpace(stmt)) != ";" {
+			count++
+		}
+		return nil
+	}); err != nil {
+		return 0
+	}
+	return count
+}
+
 func computeLineFromPos(s string, pos int) (line uint, col uint, ok bool) {
 	// replace crlf with lf
 	s = strings.Replace(s, "\r\n", "\n", -1)
@@ -285,15 +2339,80 @@ func runesLastIndex(input []rune, target rune) int {
 }
 
 func (p *Postgres) SetVersion(version int, dirty bool) error {
+	if err := p.use(); err != nil {
+		return err
+	}
+	defer p.done()
 	// This function used to use its own transaction for writing
 	// dirty to the schema_version. But since we moved to externally
 	// managed transaction, we want the version to rollback when the
 	// migration fails. At some point it probably makes sense to remove
 	// dirty flag.
 
+	// the version is committed with the migration, make sure the lock still
+	// guards the session recording it
+	if err := p.checkLockOwner(); err != nil {
+		return err
+	}
+
+	p.cachedVersion = nil
+	if dirty {
+		p.version = version
+	}
+	// the migration in progress ran, record its metadata with its version
+	var metadata interface{}
+	if !dirty && p.metadata != nil {
+		b, err := json.Marshal(p.metadata)
+		if err != nil {
+			return errors.Wrap(err, "error encoding metadata")
+		}
+		metadata = string(b)
+	}
+	p.metadata = nil
+	var statementHashes interface{}
+	if !dirty && p.statementHashes != nil {
+		b, err := json.Marshal(p.statementHashes)
+		if err != nil {
+			return errors.Wrap(err, "error encoding statement hashes")
+		}
+		statementHashes = string(b)
+	}
+	p.statementHashes = nil
+	// the connection's role stands in for an unset Actor
+	var actor interface{}
+	if p.config.Actor != "" {
+		actor = p.config.Actor
+	}
+	if p.runID == "" {
+		// SetVersion called without Lock, e.g. by a caller driving migrations
+		p.runID = p.newRunID()
+	}
+	if p.skip && p.config.ForgetSkipped {
+		return nil
+	}
+	if !p.versionTableEnsured {
+		if err := p.ensureVersionTable(); err != nil {
+			return err
+		}
+	}
+	if dirty && (p.config.FailureTable != "" || p.config.TracerProvider != nil) {
+		current, err := p.currentVersion()
+		if err != nil {
+			return err
+		}
+		p.direction = "up"
+		if version < current.Version {
+			p.direction = "down"
+		}
+	}
+	if dirty && p.migrationSpan != nil {
+		p.migrationSpan.SetAttributes(attribute.Int("migrate.version", version),
+			attribute.String("migrate.direction", p.direction))
+	}
+
 	// check for in progress version, if it exists use the in-progress
 	// version to record the dirty, info etc. values.
-	row := p.conn.QueryRowContext(p.context(),
+	row := p.db.QueryRowContext(p.context(),
 		fmt.Sprintf(
 			`SELECT id FROM %q.%q WHERE version = $1 ORDER BY created_at DESC limit 1`,
 			p.config.migrationsSchemaName, p.config.migrationsTableName), version)
@@ -304,27 +2423,150 @@ func (p *Postgres) SetVersion(version int, dirty bool) error {
 			// empty schema version for failed down migration on the first migration
 			// See: https://github.com/getoutreach/migrate/issues/330
 			stmt := fmt.Sprintf(`INSERT INTO %q.%q`+
-				` (version, dirty, created_at) VALUES ($1, $2, now())`,
+				` (version, dirty, created_at, metadata, applied_by, run_id)`+
+				` VALUES ($1, $2, now(), $3, COALESCE($4::text, current_user::text), $5) RETURNING id`,
 				p.config.migrationsSchemaName, p.config.migrationsTableName)
-			if _, err := p.conn.ExecContext(p.context(), stmt, version, dirty); err != nil {
+			if err := p.db.QueryRowContext(p.context(), stmt, version, dirty, metadata, actor, p.runID).Scan(&id); err != nil {
 				return &database.Error{OrigErr: err, Query: []byte(stmt)}
 			}
 		}
 	} else {
 		stmt := fmt.Sprintf(
-			`UPDATE %q.%q SET dirty = $1, updated_at = now() WHERE id = $2`,
+			`UPDATE %q.%q SET dirty = $1, updated_at = now(), metadata = COALESCE($3::jsonb, metadata),`+
+				` applied_by = COALESCE($4::text, current_user::text), run_id = $5 WHERE id = $2`,
 			p.config.migrationsSchemaName,
 			p.config.migrationsTableName)
-		if _, err := p.conn.ExecContext(p.context(), stmt, dirty, id); err != nil {
+		if _, err := p.db.ExecContext(p.context(), stmt, dirty, id, metadata, actor, p.runID); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(stmt)}
+		}
+	}
+	if statementHashes != nil && id != 0 {
+		// only the row of this run, the earlier rows of version keep theirs
+		stmt := fmt.Sprintf(`UPDATE %q.%q SET statement_hashes = $1 WHERE id = $2`,
+			p.config.migrationsSchemaName, p.config.migrationsTableName)
+		if _, err := p.db.ExecContext(p.context(), stmt, statementHashes, id); err != nil {
 			return &database.Error{OrigErr: err, Query: []byte(stmt)}
 		}
 	}
+	if p.config.StampSchemaComment {
+		p.stampSchemaComment(version, dirty)
+	}
 
 	return nil
 }
 
-// Version get version from schema version table
-func (p *Postgres) Version() (*database.Version, error) {
+// stampSchemaComment sets the comment of the migrations schema to version.
+// Failures are only logged, in a transaction the comment is set in a
+// savepoint so that a failure doesn't abort the transaction.
+func (p *Postgres) stampSchemaComment(version int, dirty bool) {
+	ctx := p.context()
+	comment := fmt.Sprintf("migrate version %d", version)
+	if dirty {
+		comment += " (dirty)"
+	}
+	inTx := p.tx != nil || p.callerTx != nil
+	err := func() error {
+		if inTx {
+			if err := p.savepoint(ctx, "SAVEPOINT", "migrate_schema_comment"); err != nil {
+				return err
+			}
+		}
+		stmt := fmt.Sprintf(`COMMENT ON SCHEMA %q IS %s`, p.config.migrationsSchemaName, pq.QuoteLiteral(comment))
+		if _, err := p.db.ExecContext(ctx, stmt); err != nil {
+			err = &database.Error{OrigErr: err, Query: []byte(stmt)}
+			if inTx {
+				if errRollback := p.savepoint(ctx, "ROLLBACK TO SAVEPOINT", "migrate_schema_comment"); errRollback != nil {
+					return multierror.Append(err, errRollback)
+				}
+			}
+			return err
+		}
+		if inTx {
+			return p.savepoint(ctx, "RELEASE SAVEPOINT", "migrate_schema_comment")
+		}
+		return nil
+	}()
+	if err != nil {
+		p.logf("unable to set the comment of schema %s to version %d: %v",
+			p.config.migrationsSchemaName, version, err)
+	}
+}
+
+// SetVersionStatement returns a statement that records version like
+// SetVersion does, used to bundle migrations into a standalone script. It
+// upserts on version when the migrations table has a unique index on it and
+// deletes the rows of version before inserting otherwise, e.g. for a
+// MigrationsTableDDL without one.
+func (p *Postgres) SetVersionStatement(version int, dirty bool) string {
+	actor := "current_user"
+	if p.config.Actor != "" {
+		actor = pq.QuoteLiteral(p.config.Actor)
+	}
+	runID := "NULL"
+	if p.runID != "" {
+		runID = pq.QuoteLiteral(p.runID)
+	}
+	insert := fmt.Sprintf(`INSERT INTO %q.%q (version, dirty, created_at, applied_by, run_id) VALUES (%d, %v, now(), %s, %s)`,
+		p.config.migrationsSchemaName, p.config.migrationsTableName, version, dirty, actor, runID)
+	if !p.versionUnique {
+		return fmt.Sprintf(`DELETE FROM %q.%q WHERE version = %d; %s;`,
+			p.config.migrationsSchemaName, p.config.migrationsTableName, version, insert)
+	}
+	return insert + ` ON CONFLICT (version) DO UPDATE SET dirty = EXCLUDED.dirty, updated_at = now(),` +
+		` applied_by = EXCLUDED.applied_by, run_id = EXCLUDED.run_id;`
+}
+
+// Version get version from schema version table
+func (p *Postgres) Version() (*database.Version, error) {
+	if err := p.use(); err != nil {
+		return nil, err
+	}
+	defer p.done()
+	return p.currentVersion()
+}
+
+// ShouldApply implements database.ConditionalApplier with
+// Config.ShouldApply, applying every migration if it isn't set
+func (p *Postgres) ShouldApply(version int) (bool, error) {
+	if err := p.use(); err != nil {
+		return false, err
+	}
+	defer p.done()
+	p.skip = false
+	if p.config.ShouldApply == nil || p.tx == nil || version < 0 {
+		return true, nil
+	}
+	apply, err := p.config.ShouldApply(uint(version), p.conn)
+	if err != nil {
+		return false, err
+	}
+	p.skip = !apply
+	return apply, nil
+}
+
+// currentVersion returns the version Version returns, from the cache if it's
+// fresh
+func (p *Postgres) currentVersion() (*database.Version, error) {
+	if ttl := p.config.VersionCacheTTL; ttl > 0 && p.cachedVersion != nil && time.Since(p.cachedAt) < ttl {
+		v := *p.cachedVersion
+		return &v, nil
+	}
+	v, err := p.readVersion()
+	if err == nil && p.config.VersionCacheTTL > 0 {
+		cached := *v
+		p.cachedVersion, p.cachedAt = &cached, time.Now()
+	}
+	return v, err
+}
+
+// readVersion reads the latest version from the migrations table
+func (p *Postgres) readVersion() (*database.Version, error) {
+	if !p.versionTableEnsured {
+		if err := p.ensureVersionTable(); err != nil {
+			return nil, err
+		}
+	}
+
 	stmt := fmt.Sprintf(`SELECT version, dirty, info, current_schema() FROM %q.%q`+
 		` ORDER BY created_at desc nulls last LIMIT 1`,
 		p.config.migrationsSchemaName, p.config.migrationsTableName)
@@ -336,7 +2578,7 @@ func (p *Postgres) Version() (*database.Version, error) {
 		infoStr       sql.NullString
 		currentSchema string
 	)
-	err := p.conn.QueryRowContext(p.context(), stmt).Scan(&version, &dirty,
+	err := p.db.QueryRowContext(p.context(), stmt).Scan(&version, &dirty,
 		&infoStr, &currentSchema)
 	if infoStr.Valid {
 		info = infoStr.String
@@ -374,10 +2616,252 @@ func (p *Postgres) Version() (*database.Version, error) {
 	}
 }
 
+// AppliedVersions returns the clean versions recorded in the migrations table
+// in ascending order, implementing database.History.
+func (p *Postgres) AppliedVersions() (versions []uint, err error) {
+	stmt := fmt.Sprintf(`SELECT version FROM %q.%q WHERE NOT dirty AND version >= 0 ORDER BY version`,
+		p.config.migrationsSchemaName, p.config.migrationsTableName)
+	rows, err := p.db.QueryContext(p.context(), stmt)
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(stmt)}
+	}
+	defer func() {
+		if errClose := rows.Close(); errClose != nil {
+			err = multierror.Append(err, errClose)
+		}
+	}()
+
+	for rows.Next() {
+		var version uint
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(stmt)}
+	}
+	return versions, nil
+}
+
+// Metadata returns the metadata headers of the migration that applied version,
+// nil if it had none, implementing database.MetadataHistory.
+func (p *Postgres) Metadata(version uint) (map[string]string, error) {
+	var b []byte
+	if err := p.historyColumn(version, "metadata", &b); err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, nil
+	}
+	var metadata map[string]string
+	if err := json.Unmarshal(b, &metadata); err != nil {
+		return nil, errors.Wrap(err, "error decoding metadata")
+	}
+	return metadata, nil
+}
+
+// Actor returns who applied version, the Actor configured when it was applied
+// or the connection's role if there was none, implementing
+// database.ActorHistory. It's empty for versions applied before the driver
+// recorded it.
+func (p *Postgres) Actor(version uint) (string, error) {
+	var actor sql.NullString
+	if err := p.historyColumn(version, "applied_by", &actor); err != nil {
+		return "", err
+	}
+	return actor.String, nil
+}
+
+// StatementHashes returns the digests of the statements of the migration that
+// applied version, recorded with Config.StatementHashes, nil if they weren't,
+// implementing database.StatementHistory.
+func (p *Postgres) StatementHashes(version uint) ([]string, error) {
+	var b []byte
+	if err := p.historyColumn(version, "statement_hashes", &b); err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, nil
+	}
+	var hashes []string
+	if err := json.Unmarshal(b, &hashes); err != nil {
+		return nil, errors.Wrap(err, "error decoding statement hashes")
+	}
+	return hashes, nil
+}
+
+// historyColumn scans column of the latest row that applied version into dest,
+// the row of its last run if version was applied more than once
+func (p *Postgres) historyColumn(version uint, column string, dest interface{}) error {
+	stmt := fmt.Sprintf(`SELECT %q FROM %q.%q WHERE version = $1 AND NOT dirty ORDER BY created_at DESC LIMIT 1`,
+		column, p.config.migrationsSchemaName, p.config.migrationsTableName)
+	if err := p.db.QueryRowContext(p.context(), stmt, version).Scan(dest); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("version %d isn't applied: %w", version, err)
+		}
+		return &database.Error{OrigErr: err, Query: []byte(stmt)}
+	}
+	return nil
+}
+
+// resumeTableName is the name of the table the resume token is recorded in,
+// next to the migrations table
+func (p *Postgres) resumeTableName() string {
+	return p.config.migrationsTableName + "_resume"
+}
+
+// SetResumeToken records token in the resume table next to the migrations
+// table, in the migration's transaction if there's one. A nil token clears
+// it. It implements database.ResumeTokenStore, returning migrate.ErrNoResume
+// unless Config.ResumeTokens is set.
+func (p *Postgres) SetResumeToken(token []byte) error {
+	if !p.config.ResumeTokens {
+		return migrate.ErrNoResume
+	}
+	if err := p.use(); err != nil {
+		return err
+	}
+	defer p.done()
+	if !p.versionTableEnsured {
+		if err := p.ensureVersionTable(); err != nil {
+			return err
+		}
+	}
+	table := fmt.Sprintf("%q.%q", p.config.migrationsSchemaName, p.resumeTableName())
+	stmt := `DELETE FROM ` + table
+	if _, err := p.db.ExecContext(p.context(), stmt); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(stmt)}
+	}
+	if token == nil {
+		return nil
+	}
+	stmt = `INSERT INTO ` + table + ` (token) VALUES ($1)`
+	if _, err := p.db.ExecContext(p.context(), stmt, string(token)); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(stmt)}
+	}
+	return nil
+}
+
+// ResumeToken returns the token recorded by SetResumeToken, nil if there's
+// none. It implements database.ResumeTokenStore, returning
+// migrate.ErrNoResume unless Config.ResumeTokens is set.
+func (p *Postgres) ResumeToken() ([]byte, error) {
+	if !p.config.ResumeTokens {
+		return nil, migrate.ErrNoResume
+	}
+	if !p.versionTableEnsured {
+		if err := p.ensureVersionTable(); err != nil {
+			return nil, err
+		}
+	}
+	table := fmt.Sprintf("%q.%q", p.config.migrationsSchemaName, p.resumeTableName())
+	query := `SELECT token FROM ` + table
+	var token []byte
+	if err := p.db.QueryRowContext(p.context(), query).Scan(&token); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return token, nil
+}
+
+// Catalog describes the tables, columns, indexes, sequences, views, types and
+// functions in the current schema, leaving out the migrations and failure
+// tables with their indexes and sequences. It implements database.Cataloger.
+func (p *Postgres) Catalog() (objects []string, err error) {
+	bookkeeping := []string{
+		fmt.Sprintf("%q.%q", p.config.migrationsSchemaName, p.config.migrationsTableName),
+		fmt.Sprintf("%q.%q", p.config.migrationsSchemaName, p.resumeTableName()),
+	}
+	if p.config.FailureTable != "" {
+		bookkeeping = append(bookkeeping, fmt.Sprintf("%q.%q", p.config.migrationsSchemaName, p.config.FailureTable))
+	}
+	query := `WITH excluded AS (
+		SELECT to_regclass(name) AS oid FROM unnest($1::text[]) AS name
+	), bookkeeping AS (
+		SELECT oid FROM excluded WHERE oid IS NOT NULL
+		UNION SELECT indexrelid FROM pg_index WHERE indrelid IN (SELECT oid FROM excluded)
+		UNION SELECT objid FROM pg_depend WHERE classid = 'pg_class'::regclass
+			AND refobjid IN (SELECT oid FROM excluded)
+	)
+	SELECT object FROM (
+		SELECT CASE c.relkind WHEN 'r' THEN 'table' WHEN 'p' THEN 'table' WHEN 'i' THEN 'index'
+			WHEN 'I' THEN 'index' WHEN 'S' THEN 'sequence' WHEN 'v' THEN 'view'
+			WHEN 'm' THEN 'materialized view' WHEN 'c' THEN 'type' ELSE 'relation' END
+			|| ' ' || c.relname AS object
+		FROM pg_class c
+		WHERE c.relnamespace = current_schema()::regnamespace AND c.oid NOT IN (SELECT oid FROM bookkeeping)
+		UNION ALL
+		SELECT 'column ' || c.relname || '.' || a.attname || ' ' || format_type(a.atttypid, a.atttypmod)
+			|| CASE WHEN a.attnotnull THEN ' not null' ELSE '' END
+		FROM pg_attribute a JOIN pg_class c ON c.oid = a.attrelid
+		WHERE c.relnamespace = current_schema()::regnamespace AND c.relkind IN ('r', 'p', 'v', 'm')
+			AND c.oid NOT IN (SELECT oid FROM bookkeeping) AND a.attnum > 0 AND NOT a.attisdropped
+		UNION ALL
+		SELECT 'type ' || t.typname FROM pg_type t
+		WHERE t.typnamespace = current_schema()::regnamespace AND t.typtype IN ('d', 'e', 'r', 'm')
+		UNION ALL
+		SELECT 'function ' || f.proname || '(' || pg_get_function_identity_arguments(f.oid) || ')'
+		FROM pg_proc f WHERE f.pronamespace = current_schema()::regnamespace
+	) objects ORDER BY object`
+	rows, err := p.db.QueryContext(p.context(), query, pq.Array(bookkeeping))
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	defer func() {
+		if errClose := rows.Close(); errClose != nil {
+			err = multierror.Append(err, errClose)
+		}
+	}()
+
+	for rows.Next() {
+		var object string
+		if err := rows.Scan(&object); err != nil {
+			return nil, err
+		}
+		objects = append(objects, object)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return objects, nil
+}
+
+// WaitForVersion polls Version, backing off between attempts, until the
+// recorded version is at least version and clean, or ctx is done. It doesn't
+// lock or modify anything and is meant to coordinate services that depend on
+// migrations applied by someone else.
+func (p *Postgres) WaitForVersion(ctx context.Context, version uint) error {
+	interval := waitForVersionMinInterval
+	for {
+		v, err := p.Version()
+		if err != nil {
+			return err
+		}
+		if v.Version >= int(version) && !v.Dirty {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "waiting for version %d, current version %d (dirty: %v)",
+				version, v.Version, v.Dirty)
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > waitForVersionMaxInterval {
+			interval = waitForVersionMaxInterval
+		}
+	}
+}
+
 func (p *Postgres) Drop() (err error) {
+	p.cachedVersion = nil
+
 	// select all tables in current schema
 	stmt := `SELECT table_name FROM information_schema.tables WHERE table_schema=(SELECT current_schema()) AND table_type='BASE TABLE'`
-	tables, err := p.conn.QueryContext(p.context(), stmt)
+	tables, err := p.db.QueryContext(p.context(), stmt)
 	if err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(stmt)}
 	}
@@ -406,7 +2890,7 @@ func (p *Postgres) Drop() (err error) {
 		// delete one by one ...
 		for _, t := range tableNames {
 			stmt = `DROP TABLE IF EXISTS ` + pq.QuoteIdentifier(t) + ` CASCADE`
-			if _, err := p.conn.ExecContext(p.context(), stmt); err != nil {
+			if _, err := p.db.ExecContext(p.context(), stmt); err != nil {
 				return &database.Error{OrigErr: err, Query: []byte(stmt)}
 			}
 		}
@@ -415,45 +2899,117 @@ func (p *Postgres) Drop() (err error) {
 	return nil
 }
 
+// DropMigrationsTable drops the migrations table and its resume table,
+// leaving everything else in place, e.g. to reset version tracking in test
+// teardown. The tables are created again the next time a version is read or
+// recorded.
+func (p *Postgres) DropMigrationsTable() error {
+	stmt := fmt.Sprintf(`DROP TABLE IF EXISTS %q.%q, %q.%q`,
+		p.config.migrationsSchemaName, p.config.migrationsTableName,
+		p.config.migrationsSchemaName, p.resumeTableName())
+	if _, err := p.db.ExecContext(p.context(), stmt); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(stmt)}
+	}
+	p.versionTableEnsured = false
+	p.cachedVersion = nil
+	return nil
+}
+
 // ensureVersionTable checks if versions table exists and, if not, creates it.
-// Note that this function locks the database, which deviates from the usual
-// convention of "caller locks" in the Postgres type.
+// Note that this function locks the database, unless the driver holds the
+// lock already, which deviates from the usual convention of "caller locks" in
+// the Postgres type.
 func (p *Postgres) ensureVersionTable() (err error) {
-	if err = p.Lock(); err != nil {
+	if !p.isLocked.Load() {
+		if err = p.lock(); err != nil {
+			return err
+		}
+
+		defer func() {
+			if e := p.unlock(); e != nil {
+				if err == nil {
+					err = e
+				} else {
+					err = multierror.Append(err, e)
+				}
+			}
+		}()
+	}
+
+	err = p.retryTableCreation(func() error {
+		if p.config.MigrationsTableDDL != "" {
+			return p.ensureCustomVersionTable()
+		}
+		return p.ensureDefaultVersionTable()
+	})
+	if err != nil {
 		return err
 	}
 
-	defer func() {
-		if e := p.Unlock(); e != nil {
-			if err == nil {
-				err = e
-			} else {
-				err = multierror.Append(err, e)
-			}
+	if p.config.FailureTable != "" {
+		stmt := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %q.%q`+
+			` (id bigserial primary key, version bigint not null, statement text null,`+
+			` error text not null, created_at timestamp with time zone not null)`,
+			p.config.migrationsSchemaName, p.config.FailureTable)
+		if _, err = p.db.ExecContext(p.context(), stmt); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(stmt)}
 		}
-	}()
 
+		// add the direction and statement_index columns to track how far failed
+		// migrations got
+		stmt = fmt.Sprintf(`ALTER TABLE %q.%q `+
+			`ADD COLUMN IF NOT EXISTS direction text NULL, `+
+			`ADD COLUMN IF NOT EXISTS statement_index integer NULL`,
+			p.config.migrationsSchemaName, p.config.FailureTable)
+		if _, err = p.db.ExecContext(p.context(), stmt); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(stmt)}
+		}
+	}
+
+	if p.config.ResumeTokens {
+		stmt := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %q.%q (token jsonb NOT NULL)`,
+			p.config.migrationsSchemaName, p.resumeTableName())
+		if _, err = p.db.ExecContext(p.context(), stmt); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(stmt)}
+		}
+	}
+
+	p.versionTableEnsured = true
+	return nil
+}
+
+// ensureDefaultVersionTable creates the migrations table with the driver's
+// definition and migrates tables created by earlier versions of the driver
+func (p *Postgres) ensureDefaultVersionTable() error {
 	stmt := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %q.%q`+
 		` (version bigint not null, dirty boolean not null)`,
 		p.config.migrationsSchemaName, p.config.migrationsTableName)
-	if _, err = p.conn.ExecContext(p.context(), stmt); err != nil {
+	if _, err := p.db.ExecContext(p.context(), stmt); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(stmt)}
 	}
 
-	// add the created_at and info columns to track history and failures of migrations
+	// add the created_at and info columns to track history and failures of
+	// migrations, metadata for the metadata headers of migrations,
+	// applied_by for who ran them, run_id for the run they were applied in and
+	// statement_hashes for the digests of their statements
 	stmt = fmt.Sprintf(`ALTER TABLE %q.%q `+
 		`ADD COLUMN IF NOT EXISTS created_at timestamp with time zone NULL, `+
 		`ADD COLUMN IF NOT EXISTS updated_at timestamp with time zone NULL, `+
-		`ADD COLUMN IF NOT EXISTS info text NULL`,
+		`ADD COLUMN IF NOT EXISTS info text NULL, `+
+		`ADD COLUMN IF NOT EXISTS metadata jsonb NULL, `+
+		`ADD COLUMN IF NOT EXISTS applied_by text NULL, `+
+		`ADD COLUMN IF NOT EXISTS run_id text NULL, `+
+		`ADD COLUMN IF NOT EXISTS statement_hashes jsonb NULL`,
 		p.config.migrationsSchemaName, p.config.migrationsTableName)
-	if _, err = p.conn.ExecContext(p.context(), stmt); err != nil {
+	if _, err := p.db.ExecContext(p.context(), stmt); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(stmt)}
 	}
 
 	// adds index to the created_at to ensure queries ordering by created_at are snappy
-	stmt = fmt.Sprintf(`CREATE INDEX IF NOT EXISTS idx_on_created_at on %q.%q (created_at)`,
+	stmt = fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %q on %q.%q (created_at)`,
+		p.config.componentName("idx_on_created_at"),
 		p.config.migrationsSchemaName, p.config.migrationsTableName)
-	if _, err = p.conn.ExecContext(p.context(), stmt); err != nil {
+	if _, err := p.db.ExecContext(p.context(), stmt); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(stmt)}
 	}
 
@@ -470,7 +3026,111 @@ func (p *Postgres) ensureVersionTable() (err error) {
 	if err := p.ensureUniqueConstraintExists(); err != nil {
 		return &database.Error{OrigErr: err}
 	}
+	p.versionUnique = true
+
+	return nil
+}
+
+// retryTableCreation calls ensure, retrying it after a jittered backoff when
+// it deadlocks or races another session creating the same objects, up to
+// TableCreateRetries times. It isn't retried in a transaction, which the
+// failure aborted.
+func (p *Postgres) retryTableCreation(ensure func() error) error {
+	retries := p.config.TableCreateRetries
+	if retries == 0 {
+		retries = DefaultTableCreateRetries
+	}
+	interval := tableCreateRetryMinInterval
+	for attempt := 0; ; attempt++ {
+		err := ensure()
+		if err == nil || attempt >= retries || p.tx != nil || p.callerTx != nil || !isTableCreationConflict(err) {
+			return err
+		}
+		delay := interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+		p.logf("retrying creating the migrations table in %v: %v", delay, err)
+		select {
+		case <-p.context().Done():
+			return err
+		case <-time.After(delay):
+		}
+		if interval *= 2; interval > tableCreateRetryMaxInterval {
+			interval = tableCreateRetryMaxInterval
+		}
+	}
+}
+
+// isTableCreationConflict reports whether err is Postgres failing to create
+// an object because of a concurrent session, deadlocking with it or creating
+// the object first, which can fail with a unique violation on the catalog
+func isTableCreationConflict(err error) bool {
+	// the ensure functions wrap the Postgres error, sometimes twice
+	for dbErr, ok := err.(*database.Error); ok; dbErr, ok = err.(*database.Error) {
+		err = dbErr.OrigErr
+	}
+	code := errorCode(err)
+	return code == "40P01" || code == "23505" || isAlreadyExists(err)
+}
+
+// ensureCustomVersionTable creates the migrations table with the
+// MigrationsTableDDL if it doesn't exist and checks it has the
+// VersionTableColumns
+func (p *Postgres) ensureCustomVersionTable() error {
+	table := fmt.Sprintf("%q.%q", p.config.migrationsSchemaName, p.config.migrationsTableName)
+	query := `SELECT to_regclass($1) IS NOT NULL`
+	var exists bool
+	if err := p.db.QueryRowContext(p.context(), query, table).Scan(&exists); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	if !exists {
+		stmt := strings.ReplaceAll(p.config.MigrationsTableDDL, "<TABLE_NAME>", table)
+		if _, err := p.db.ExecContext(p.context(), stmt); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(stmt)}
+		}
+	}
+
+	query = `SELECT column_name FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2`
+	rows, err := p.db.QueryContext(p.context(), query, p.config.migrationsSchemaName, p.config.migrationsTableName)
+	if err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return err
+		}
+		columns[column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	if err := missingColumns(table, columns); err != nil {
+		return err
+	}
+
+	// the DDL may not make version unique, SetVersionStatement can't upsert
+	// on it then
+	unique, err := p.uniqueConstraintExists("version")
+	if err != nil {
+		return err
+	}
+	p.versionUnique = unique
+	return nil
+}
 
+// missingColumns returns an error naming the VersionTableColumns that aren't
+// in columns, nil if there are none
+func missingColumns(table string, columns map[string]bool) error {
+	var missing []string
+	for _, column := range VersionTableColumns {
+		if !columns[column] {
+			missing = append(missing, column)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("migrations table %s lacks the columns %s", table, strings.Join(missing, ", "))
+	}
 	return nil
 }
 
@@ -480,30 +3140,30 @@ func (p *Postgres) ensurePrimaryKeyExists() error {
 	// alter table schema_version add column id bigserial primary key
 	oldPrimaryKeyName := "schema_version_pkey"
 	// Remove the old (column name: version) primary key if it exists
-	exists, err := p.primaryKeyExists(p.config.MigrationsTable, "version")
+	exists, err := p.primaryKeyExists("version")
 	if err != nil {
 		return err
 	}
 	if exists {
 		// drop the constraint but not the column, keep the version column
-		_, err = p.conn.ExecContext(p.context(),
-			fmt.Sprintf(`ALTER TABLE %q DROP CONSTRAINT %s`,
-				p.config.MigrationsTable, oldPrimaryKeyName))
+		_, err = p.db.ExecContext(p.context(),
+			fmt.Sprintf(`ALTER TABLE %q.%q DROP CONSTRAINT %s`,
+				p.config.migrationsSchemaName, p.config.migrationsTableName, oldPrimaryKeyName))
 		if err != nil {
 			return errors.Wrapf(err, "error dropping %s", oldPrimaryKeyName)
 		}
 	}
 
 	// Add the new primary key if it does not exist
-	exists, err = p.primaryKeyExists(p.config.MigrationsTable, "id")
+	exists, err = p.primaryKeyExists("id")
 	if err != nil {
 		return err
 	}
 	if !exists {
 		// generated column will be schema_version_pkey
-		_, err = p.conn.ExecContext(p.context(),
-			fmt.Sprintf(`ALTER TABLE %q ADD COLUMN id BIGSERIAL PRIMARY KEY`,
-				p.config.MigrationsTable))
+		_, err = p.db.ExecContext(p.context(),
+			fmt.Sprintf(`ALTER TABLE %q.%q ADD COLUMN id BIGSERIAL PRIMARY KEY`,
+				p.config.migrationsSchemaName, p.config.migrationsTableName))
 		if err != nil {
 			return err
 		}
@@ -511,20 +3171,22 @@ func (p *Postgres) ensurePrimaryKeyExists() error {
 	return nil
 }
 
-// primaryKeyExists query for named table constraint
-func (p *Postgres) primaryKeyExists(tableName, primaryKeyName string) (bool, error) {
-	stmt := fmt.Sprintf(`SELECT 1
+// primaryKeyExists query for the primary key of the migrations table on the
+// named column, in the schema the table is configured in
+func (p *Postgres) primaryKeyExists(columnName string) (bool, error) {
+	stmt := `SELECT 1
 FROM pg_index
   JOIN pg_attribute a ON a.attrelid = pg_index.indrelid AND a.attnum = ANY(pg_index.indkey)
   JOIN pg_class ON pg_index.indrelid = pg_class.oid
   JOIN pg_namespace on pg_namespace.oid = pg_class.relnamespace
-WHERE pg_index.indrelid = '%s'::regclass
+WHERE pg_namespace.nspname = $1
+  AND pg_class.relname = $2
   AND  pg_index.indisprimary
-  AND pg_namespace.nspname = current_schema()
-  and a.attname = '%s'
-AND format_type(a.atttypid, a.atttypmod) = 'bigint'`, tableName, primaryKeyName)
+  and a.attname = $3
+AND format_type(a.atttypid, a.atttypmod) = 'bigint'`
 	// We expect one row to come back, for the id bigserial(bigint) column
-	rows := p.conn.QueryRowContext(p.context(), stmt)
+	rows := p.db.QueryRowContext(p.context(), stmt,
+		p.config.migrationsSchemaName, p.config.migrationsTableName, columnName)
 	var exists int
 	err := rows.Scan(&exists)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -542,7 +3204,7 @@ AND format_type(a.atttypid, a.atttypmod) = 'bigint'`, tableName, primaryKeyName)
 
 // ensureUniqueConstraintExists will add new unique constraint to the schema version table
 func (p *Postgres) ensureUniqueConstraintExists() error {
-	exists, err := p.uniqueConstraintExists(p.config.MigrationsTable, "version")
+	exists, err := p.uniqueConstraintExists("version")
 	if err != nil {
 		return err
 	}
@@ -550,30 +3212,35 @@ func (p *Postgres) ensureUniqueConstraintExists() error {
 		return nil
 	}
 
-	_, err = p.conn.ExecContext(p.context(),
-		fmt.Sprintf(`ALTER TABLE %q ADD CONSTRAINT unique_version UNIQUE (version)`,
-			p.config.MigrationsTable))
+	_, err = p.db.ExecContext(p.context(),
+		fmt.Sprintf(`ALTER TABLE %q.%q ADD CONSTRAINT %q UNIQUE (version)`,
+			p.config.migrationsSchemaName, p.config.migrationsTableName,
+			p.config.componentName("unique_version")))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// uniqueConstraintExists check existence of unique constraint
+// uniqueConstraintExists check existence of unique constraint on the
+// migrations table, in the schema the table is configured in
 // only supports single column unique check, could add array support for multiple columns
-func (p *Postgres) uniqueConstraintExists(tableName, columnName string) (bool, error) {
-	stmt := fmt.Sprintf(`SELECT 1
+func (p *Postgres) uniqueConstraintExists(columnName string) (bool, error) {
+	stmt := `SELECT 1
 FROM pg_index
   JOIN pg_attribute a ON a.attrelid = pg_index.indrelid AND a.attnum = ANY(pg_index.indkey)
   JOIN pg_class ON pg_index.indrelid = pg_class.oid
   JOIN pg_namespace on pg_namespace.oid = pg_class.relnamespace
-WHERE pg_index.indrelid = '%s'::regclass
+WHERE pg_namespace.nspname = $1
+  AND pg_class.relname = $2
   AND  pg_index.indisunique
-  AND pg_namespace.nspname = current_schema()
-  and a.attname = '%s'
-AND format_type(a.atttypid, a.atttypmod) = 'bigint'`, tableName, columnName)
+  AND pg_index.indnatts = 1
+  AND pg_index.indpred IS NULL
+  and a.attname = $3
+AND format_type(a.atttypid, a.atttypmod) = 'bigint'`
 	// We expect one row to come back, for the version column and
-	rows := p.conn.QueryRowContext(p.context(), stmt)
+	rows := p.db.QueryRowContext(p.context(), stmt,
+		p.config.migrationsSchemaName, p.config.migrationsTableName, columnName)
 	var exists int
 	err := rows.Scan(&exists)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -591,9 +3258,31 @@ AND format_type(a.atttypid, a.atttypmod) = 'bigint'`, tableName, columnName)
 
 // SetFailed set the current migration to failed and record the failure in the database
 func (p *Postgres) SetFailed(version int, err error) error {
+	if errUse := p.use(); errUse != nil {
+		return errUse
+	}
+	defer p.done()
+	if p.config.FailureTable != "" {
+		f := &failure{version: version, err: err.Error(), failedAt: time.Now(),
+			direction: p.direction, statementIndex: p.failedStatement}
+		var dbErr database.Error
+		if errors.As(err, &dbErr) {
+			f.statement = string(dbErr.Query)
+		}
+		if p.tx == nil {
+			if err := p.recordFailure(f); err != nil {
+				return err
+			}
+		} else {
+			// the failed statement aborted the transaction, record the failure
+			// once it's rolled back
+			p.failure = f
+		}
+	}
+
 	stmt := fmt.Sprintf(`UPDATE %q.%q SET info = $1 where version = $2`,
 		p.config.migrationsSchemaName, p.config.migrationsTableName)
-	if _, err := p.conn.ExecContext(p.context(), stmt, fmt.Sprintf("%+v", err), version); err != nil {
+	if _, err := p.db.ExecContext(p.context(), stmt, fmt.Sprintf("%+v", err), version); err != nil {
 		return err
 	}
 	return nil
@@ -601,22 +3290,124 @@ func (p *Postgres) SetFailed(version int, err error) error {
 
 // Begin begins transaction
 func (p *Postgres) Begin() error {
+	return p.BeginIsolation(p.config.IsolationLevel)
+}
+
+// BeginIsolation begins the transaction of a migration at level, e.g. the
+// one of its `-- migrate:isolation-level` directive, instead of
+// IsolationLevel. The caller's transaction given to WithTx can't change its
+// level.
+func (p *Postgres) BeginIsolation(level sql.IsolationLevel) error {
+	if err := p.use(); err != nil {
+		return err
+	}
+	defer p.done()
+	if p.callerTx != nil && level != p.config.IsolationLevel {
+		return fmt.Errorf("unable to set isolation level %s of a migration in the caller's transaction", level)
+	}
+	// the transaction holds inTx until it commits or rolls back
+	if !p.inTx.TryLock() {
+		return ErrDriverInUse
+	}
+	p.txHeld.Store(true)
+	if err := p.begin(level); err != nil {
+		p.endTx()
+		return err
+	}
+	return nil
+}
+
+// endTx releases inTx, if the transaction in progress holds it
+func (p *Postgres) endTx() {
+	if p.txHeld.Swap(false) {
+		p.inTx.Unlock()
+	}
+}
+
+// use marks the driver in use by a call running statements, until done. It
+// returns ErrDriverInUse while another call is in progress.
+func (p *Postgres) use() error {
+	if !p.inUse.TryLock() {
+		return ErrDriverInUse
+	}
+	return nil
+}
+
+// done ends the call marked by use
+func (p *Postgres) done() {
+	p.inUse.Unlock()
+}
+
+// begin begins the migration's transaction at the isolation level
+func (p *Postgres) begin(isolation sql.IsolationLevel) error {
 	if p.tx != nil {
 		return fmt.Errorf("transaction already started")
 	}
 
 	p.ctx = context.Background()
-	tx, err := p.conn.BeginTx(p.ctx, nil)
-	if err != nil {
-		return err
+	p.skip = false
+	p.analyze = nil
+	p.isolation = isolation
+	if p.callerTx != nil {
+		// migrations run in the caller's transaction
+		p.tx = p.callerTx
+	} else {
+		tx, err := p.conn.BeginTx(p.ctx, &sql.TxOptions{Isolation: isolation})
+		if err != nil {
+			return err
+		}
+		// capture tx so we know a transaction was started
+		p.tx = tx
 	}
-	// capture tx so we know a transaction was started
-	p.tx = tx
+
+	for _, query := range p.beginStatements() {
+		if _, err := p.db.ExecContext(p.ctx, query); err != nil {
+			if p.callerTx == nil {
+				if errRollback := p.tx.Rollback(); errRollback != nil {
+					err = multierror.Append(err, errRollback)
+				}
+			}
+			p.tx = nil
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+	}
+	p.migrationCtx, p.migrationSpan = p.tracer.Start(p.spanContext(), "migrate.migration")
 	return nil
 }
 
-// Commit commits in progress transaction
+// beginStatements returns the statements configuring each migration's
+// transaction when it begins
+func (p *Postgres) beginStatements() []string {
+	var stmts []string
+	if p.config.DeferConstraints {
+		stmts = append(stmts, `SET CONSTRAINTS ALL DEFERRED`)
+	}
+	if p.config.LockTimeout != 0 {
+		stmts = append(stmts, fmt.Sprintf(`SET LOCAL lock_timeout = %d`, p.config.LockTimeout.Milliseconds()))
+	}
+	names := make([]string, 0, len(p.config.SessionSettings))
+	for name := range p.config.SessionSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// names are validated by newPostgres, values are quoted
+		stmts = append(stmts, fmt.Sprintf(`SET LOCAL %s = %s`,
+			name, pq.QuoteLiteral(p.config.SessionSettings[name])))
+	}
+	return stmts
+}
+
+// Commit commits the transaction begun with Begin, persisting the migration
+// and the versions SetVersion recorded in it. It fails if no transaction is in
+// progress.
 func (p *Postgres) Commit() error {
+	if err := p.use(); err != nil {
+		return err
+	}
+	defer p.done()
+	// the transaction ends, successfully or not
+	defer p.endTx()
 	if p.tx == nil {
 		return fmt.Errorf("no transaction in progress")
 	}
@@ -624,16 +3415,69 @@ func (p *Postgres) Commit() error {
 	defer func() {
 		// reset p.tx so a new transaction can be started
 		p.tx = nil
+		p.skip = false
+		p.analyze = nil
 	}()
 
-	if err := p.tx.Commit(); err != nil {
-		return err
+	// the caller commits its own transaction
+	if p.callerTx == nil {
+		if err := p.tx.Commit(); err != nil {
+			p.endMigrationSpan(err)
+			return err
+		}
+	}
+	p.endMigrationSpan(nil)
+
+	// analyze outside of the migration's transaction, so the migration's
+	// locks aren't held any longer than needed. With WithTx that's up to the
+	// caller, so it's analyzed within the caller's transaction.
+	for _, table := range p.analyze {
+		p.analyzeTable(table)
 	}
 	return nil
 }
 
+// analyzeTable runs ANALYZE on table once the migration committed. Failures
+// are only logged, the migration is committed already and statistics catch
+// up with autovacuum. In the caller's transaction it's analyzed in a
+// savepoint so that a failure doesn't abort the transaction.
+func (p *Postgres) analyzeTable(table string) {
+	ctx := p.context()
+	inTx := p.callerTx != nil
+	err := func() error {
+		if inTx {
+			if err := p.savepoint(ctx, "SAVEPOINT", "migrate_analyze"); err != nil {
+				return err
+			}
+		}
+		stmt := fmt.Sprintf(`ANALYZE %s`, table)
+		if _, err := p.db.ExecContext(ctx, stmt); err != nil {
+			err = &database.Error{OrigErr: err, Query: []byte(stmt)}
+			if inTx {
+				if errRollback := p.savepoint(ctx, "ROLLBACK TO SAVEPOINT", "migrate_analyze"); errRollback != nil {
+					return multierror.Append(err, errRollback)
+				}
+			}
+			return err
+		}
+		if inTx {
+			return p.savepoint(ctx, "RELEASE SAVEPOINT", "migrate_analyze")
+		}
+		return nil
+	}()
+	if err != nil {
+		p.logf("unable to analyze table %s after the migration committed: %v", table, err)
+	}
+}
+
 // Rollback rolls back in progress transaction
 func (p *Postgres) Rollback() error {
+	if err := p.use(); err != nil {
+		return err
+	}
+	defer p.done()
+	// the transaction ends, successfully or not
+	defer p.endTx()
 	if p.tx == nil {
 		return fmt.Errorf("no transaction in progress")
 	}
@@ -641,12 +3485,104 @@ func (p *Postgres) Rollback() error {
 	defer func() {
 		// reset p.tx so a new transaction can be started
 		p.tx = nil
+		p.skip = false
+		p.analyze = nil
+		// the version may have been read within the transaction
+		p.cachedVersion = nil
+		p.endMigrationSpan(errors.New("rolled back"))
 	}()
 
+	if p.callerTx != nil {
+		// the caller rolls back its own transaction, a failure can't be
+		// recorded in it once the failed statement aborted it
+		p.failure = nil
+		return nil
+	}
+
 	if err := p.tx.Rollback(); err != nil {
 		return err
 	}
 
+	if p.failure != nil {
+		f := p.failure
+		p.failure = nil
+		if err := p.recordFailure(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LastRunStats returns the statistics of the last migration run by Run, e.g.
+// to log the rows a data migration updated.
+func (p *Postgres) LastRunStats() RunStats {
+	return p.stats
+}
+
+// RecoveryInfo returns how far the most recent failed migration got, read
+// from the failure table, or nil if no migration failed. The failed
+// migration's changes were rolled back, unless it ran statements that can't
+// be, and the statements after LastStatement are the ones left to resume it.
+func (p *Postgres) RecoveryInfo() (*Recovery, error) {
+	if p.config.FailureTable == "" {
+		return nil, ErrNoFailureTable
+	}
+
+	stmt := fmt.Sprintf(`SELECT version, direction, statement_index, error, created_at`+
+		` FROM %q.%q ORDER BY id DESC LIMIT 1`,
+		p.config.migrationsSchemaName, p.config.FailureTable)
+	var (
+		r              Recovery
+		direction      sql.NullString
+		statementIndex sql.NullInt64
+	)
+	err := p.db.QueryRowContext(p.context(), stmt).Scan(&r.Version, &direction,
+		&statementIndex, &r.Err, &r.FailedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(stmt)}
+	}
+	r.Direction = direction.String
+	r.LastStatement = -1
+	if statementIndex.Valid {
+		r.LastStatement = int(statementIndex.Int64) - 1
+	}
+	return &r, nil
+}
+
+// FailedDirection returns the direction of the last migration that failed
+// leaving the database dirty at version, read from the failure table,
+// implementing database.FailureHistory. It's empty without a FailureTable.
+func (p *Postgres) FailedDirection(version int) (string, error) {
+	if p.config.FailureTable == "" {
+		return "", nil
+	}
+	r, err := p.RecoveryInfo()
+	if err != nil || r == nil || r.Version != version {
+		return "", err
+	}
+	return r.Direction, nil
+}
+
+// recordFailure inserts f into the failure table outside of any migration
+// transaction. Errors are returned as is and never recorded themselves, so a
+// broken failure table can't cause a loop.
+func (p *Postgres) recordFailure(f *failure) error {
+	var statementIndex sql.NullInt64
+	if f.statementIndex >= 0 {
+		statementIndex = sql.NullInt64{Int64: int64(f.statementIndex), Valid: true}
+	}
+	stmt := fmt.Sprintf(`INSERT INTO %q.%q (version, statement, error, created_at, direction, statement_index)`+
+		` VALUES ($1, $2, $3, $4, $5, $6)`,
+		p.config.migrationsSchemaName, p.config.FailureTable)
+	if _, err := p.db.ExecContext(p.context(), stmt, f.version, f.statement,
+		f.err, f.failedAt, f.direction, statementIndex); err != nil {
+		return errors.Wrap(&database.Error{OrigErr: err, Query: []byte(stmt)},
+			"error recording migration failure")
+	}
 	return nil
 }
 
@@ -3,6 +3,8 @@ package postgresconn
 // error codes https://github.com/lib/pq/blob/master/error.go
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"database/sql"
 	sqldriver "database/sql/driver"
@@ -10,16 +12,26 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/getoutreach/migrate/v4"
 
 	"github.com/dhui/dktest"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 
 	"github.com/getoutreach/migrate/v4/database"
+	"github.com/getoutreach/migrate/v4/database/multistmt"
 	dt "github.com/getoutreach/migrate/v4/database/testing"
 	"github.com/getoutreach/migrate/v4/dktesting"
 	_ "github.com/getoutreach/migrate/v4/source/file"
@@ -128,6 +140,32 @@ func TestMigrate(t *testing.T) {
 	})
 }
 
+func TestReversibility(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := pgConnectionString(ip, port)
+		p := &Postgres{}
+		d, err := p.Open(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dt.TestReversibility(t, m)
+	})
+}
+
 func TestMultipleStatements(t *testing.T) {
 	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
 		ip, port, err := c.FirstPort()
@@ -230,6 +268,83 @@ func TestBeginAndRollback(t *testing.T) {
 	})
 }
 
+func TestBeginAndCommit(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := pgConnectionString(ip, port)
+		p := &Postgres{}
+		d, err := p.Open(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		if err := d.Commit(); err == nil {
+			t.Fatal("expected Commit without a transaction to fail")
+		}
+
+		if err := d.Begin(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.SetVersion(1, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(strings.NewReader("CREATE TABLE a (c1 text)")); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.SetVersion(1, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the table and the clean version persist, seen from another connection
+		db, err := sql.Open("postgres", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		var exists bool
+		if err := db.QueryRow("SELECT to_regclass('a') IS NOT NULL").Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Fatal("expected table a to exist after commit")
+		}
+		v, err := d.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 1 || v.Dirty {
+			t.Fatalf("expected clean version 1, got %d dirty %v", v.Version, v.Dirty)
+		}
+
+		// the transaction is done, a new one can begin
+		if err := d.Commit(); err == nil {
+			t.Fatal("expected a second Commit to fail")
+		}
+		if err := d.Begin(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
 func TestMultipleStatementsInMultiStatementMode(t *testing.T) {
 	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
 		ip, port, err := c.FirstPort()
@@ -319,6 +434,45 @@ func TestEmbeddedComment(t *testing.T) {
 	})
 }
 
+func TestBlockCommentStatements(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// executed at once and statement by statement
+		for i, option := range []string{"", "x-statement-hashes=true"} {
+			var options []string
+			if option != "" {
+				options = append(options, option)
+			}
+			p := &Postgres{}
+			d, err := p.Open(pgConnectionString(ip, port, options...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			migration := fmt.Sprintf("/* don't touch; */\nCREATE TABLE commented_a%d (id int);\n"+
+				"INSERT INTO commented_a%d VALUES (1) /* it's one */;\nCREATE TABLE commented_b%d (note text);\n"+
+				"INSERT INTO commented_b%d VALUES (E'it\\'s; ok')", i, i, i, i)
+			if err := d.Run(strings.NewReader(migration)); err != nil {
+				t.Fatal(err)
+			}
+			var note string
+			if err := d.(*Postgres).conn.QueryRowContext(context.Background(),
+				fmt.Sprintf("SELECT note FROM commented_b%d", i)).Scan(&note); err != nil {
+				t.Fatal(err)
+			}
+			if note != "it's; ok" {
+				t.Fatalf("expected the escaped string inserted, got %q", note)
+			}
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
 func TestFilterCustomQuery(t *testing.T) {
 	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
 		ip, port, err := c.FirstPort()
@@ -466,7 +620,8 @@ func TestFailToCreateTableWithoutPermissions(t *testing.T) {
 			t.Fatal("Unexpected error, want permission denied error. Got: ", err)
 		}
 
-		if !strings.Contains(e.OrigErr.Error(), "permission denied for schema barfoo") {
+		// insufficient_privilege
+		if e.Code() != "42501" {
 			t.Fatal(e)
 		}
 	})
@@ -630,82 +785,3805 @@ func TestWithInstance_Concurrent(t *testing.T) {
 		}
 	})
 }
-func Test_computeLineFromPos(t *testing.T) {
-	testcases := []struct {
-		pos      int
-		wantLine uint
-		wantCol  uint
-		input    string
-		wantOk   bool
-	}{
-		{
-			15, 2, 6, "SELECT *\nFROM foo", true, // foo table does not exists
-		},
-		{
-			16, 3, 6, "SELECT *\n\nFROM foo", true, // foo table does not exists, empty line
-		},
-		{
-			25, 3, 7, "SELECT *\nFROM foo\nWHERE x", true, // x column error
-		},
-		{
-			27, 5, 7, "SELECT *\n\nFROM foo\n\nWHERE x", true, // x column error, empty lines
-		},
-		{
-			10, 2, 1, "SELECT *\nFROMM foo", true, // FROMM typo
-		},
-		{
-			11, 3, 1, "SELECT *\n\nFROMM foo", true, // FROMM typo, empty line
-		},
-		{
-			17, 2, 8, "SELECT *\nFROM foo", true, // last character
-		},
-		{
-			18, 0, 0, "SELECT *\nFROM foo", false, // invalid position
-		},
-	}
-	for i, tc := range testcases {
-		t.Run("tc"+strconv.Itoa(i), func(t *testing.T) {
-			run := func(crlf bool, nonASCII bool) {
-				var name string
-				if crlf {
-					name = "crlf"
-				} else {
-					name = "lf"
+
+func TestTableCreateConcurrent(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// every opener is the first one to see the tables, which they all try
+		// to create at once
+		const concurrency = 50
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		db.SetMaxIdleConns(concurrency)
+		db.SetMaxOpenConns(concurrency)
+
+		ctx := context.Background()
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(concurrency)
+		for i := 0; i < concurrency; i++ {
+			go func(i int) {
+				defer wg.Done()
+				conn, err := db.Conn(ctx)
+				if err != nil {
+					t.Errorf("opener %d: %s", i, err)
+					return
 				}
-				if nonASCII {
-					name += "-nonascii"
-				} else {
-					name += "-ascii"
+				defer conn.Close()
+				<-start
+				if _, err := WithConn(ctx, conn, &Config{
+					MigrationsTable: "concurrent_migrations",
+					FailureTable:    "concurrent_failures",
+				}); err != nil {
+					t.Errorf("opener %d: %s", i, err)
 				}
-				t.Run(name, func(t *testing.T) {
-					input := tc.input
-					if crlf {
-						input = strings.Replace(input, "\n", "\r\n", -1)
-					}
-					if nonASCII {
-						input = strings.Replace(input, "FROM", "FRÖM", -1)
-					}
-					gotLine, gotCol, gotOK := computeLineFromPos(input, tc.pos)
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+	})
+}
 
-					if tc.wantOk {
-						t.Logf("pos %d, want %d:%d, %#v", tc.pos, tc.wantLine, tc.wantCol, input)
-					}
+func TestAcquireTimeout(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
 
-					if gotOK != tc.wantOk {
-						t.Fatalf("expected ok %v but got %v", tc.wantOk, gotOK)
-					}
-					if gotLine != tc.wantLine {
-						t.Fatalf("expected line %d but got %d", tc.wantLine, gotLine)
-					}
-					if gotCol != tc.wantCol {
-						t.Fatalf("expected col %d but got %d", tc.wantCol, gotCol)
-					}
-				})
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
 			}
-			run(false, false)
-			run(true, false)
-			run(false, true)
-			run(true, true)
-		})
+		}()
+		db.SetMaxOpenConns(1)
+
+		// saturate the pool
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &Config{AcquireTimeout: 100 * time.Millisecond}
+		_, err = WithDB(context.Background(), db, config)
+		if !errors.Is(err, context.DeadlineExceeded) ||
+			!strings.Contains(err.Error(), "could not acquire connection within 100ms") {
+			t.Fatalf("expected acquiring a connection to time out, got %v", err)
+		}
+
+		if err := conn.Close(); err != nil {
+			t.Fatal(err)
+		}
+		d, err := WithDB(context.Background(), db, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestFailureTable(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := WithConn(context.Background(), conn, &Config{FailureTable: "schema_migration_failures"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE foo (id int); SELECT * FROM missing_table;")), "failing", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runErr := m.Run(migr)
+		if runErr == nil {
+			t.Fatal("expected migration to fail")
+		}
+
+		// the migration rolled back, but the failure row persisted
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'foo')").Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Fatal("expected table foo to be rolled back")
+		}
+		var version int
+		var statement, errText string
+		if err := db.QueryRow("SELECT version, statement, error FROM schema_migration_failures").Scan(&version, &statement, &errText); err != nil {
+			t.Fatal(err)
+		}
+		if version != 1 {
+			t.Fatalf("expected failure for version 1, got %d", version)
+		}
+		if !strings.Contains(statement, "missing_table") {
+			t.Fatalf("expected failing statement to be recorded, got %q", statement)
+		}
+		if errText != runErr.Error() {
+			t.Fatalf("expected error %q, got %q", runErr.Error(), errText)
+		}
+	})
+}
+
+func TestShouldApply(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := WithConn(context.Background(), conn, &Config{
+			ShouldApply: func(version uint, conn *sql.Conn) (bool, error) {
+				return version%2 == 1, nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for version := uint(1); version <= 4; version++ {
+			migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+				fmt.Sprintf("CREATE TABLE t%d (id int);", version))), fmt.Sprintf("t%d", version), version, int(version))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Run(migr); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for version := 1; version <= 4; version++ {
+			var exists bool
+			if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = $1)",
+				fmt.Sprintf("t%d", version)).Scan(&exists); err != nil {
+				t.Fatal(err)
+			}
+			if want := version%2 == 1; exists != want {
+				t.Fatalf("expected table t%d to exist: %v, got %v", version, want, exists)
+			}
+		}
+
+		// skipped versions are still recorded
+		var recorded int
+		if err := db.QueryRow("SELECT count(*) FROM schema_migrations WHERE NOT dirty").Scan(&recorded); err != nil {
+			t.Fatal(err)
+		}
+		if recorded != 4 {
+			t.Fatalf("expected 4 recorded versions, got %d", recorded)
+		}
+	})
+}
+
+func TestServerVersion(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port, "x-min-server-version=130000"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		version, err := d.(*Postgres).ServerVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version < 130000 || version >= 140000 {
+			t.Fatalf("expected a postgres 13 server version, got %d", version)
+		}
+
+		if _, err := p.Open(pgConnectionString(ip, port, "x-min-server-version=140000")); err == nil {
+			t.Fatal("expected a server older than the minimum version to be rejected")
+		}
+	})
+}
+
+func TestRequireEncoding(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port, "x-require-encoding=UTF8"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Close(); err != nil {
+			t.Error(err)
+		}
+
+		_, err = p.Open(pgConnectionString(ip, port, "x-require-encoding=LATIN1"))
+		if err == nil || !strings.Contains(err.Error(), "server encoding UTF8 isn't the required LATIN1") {
+			t.Fatalf("expected the mismatched encoding to be rejected, got %v", err)
+		}
+	})
+}
+
+func TestComponent(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		components := map[string]uint{"billing": 2, "search": 1}
+		drivers := make(map[string]database.Driver, len(components))
+		for component, version := range components {
+			d, err := p.Open(pgConnectionString(ip, port, "x-component="+component))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := d.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+			drivers[component] = d
+
+			m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for v := uint(1); v <= version; v++ {
+				migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+					fmt.Sprintf("CREATE TABLE %s_%d (id int);", component, v))), component, v, int(v))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := m.Run(migr); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		// each component tracks its own version in its own table
+		for component, version := range components {
+			v, err := drivers[component].Version()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Version != int(version) || v.Dirty {
+				t.Fatalf("expected %s to be at clean version %d, got %+v", component, version, v)
+			}
+		}
+		var exists bool
+		if err := drivers["billing"].(*Postgres).conn.QueryRowContext(context.Background(), "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'schema_migrations_billing')").Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Fatal("expected table schema_migrations_billing to exist")
+		}
+	})
+}
+
+func TestAnalyzeAfter(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port, "x-analyze-after=true"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE foo (id int);\nINSERT INTO foo SELECT generate_series(1, 100000);")), "bulk", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatal(err)
+		}
+
+		// ANALYZE writes pg_statistic right away, unlike last_analyze in
+		// pg_stat_user_tables, which the statistics collector updates later
+		var analyzed bool
+		if err := d.(*Postgres).conn.QueryRowContext(context.Background(),
+			"SELECT EXISTS (SELECT 1 FROM pg_stats WHERE tablename = 'foo')").Scan(&analyzed); err != nil {
+			t.Fatal(err)
+		}
+		if !analyzed {
+			t.Fatal("expected foo to be analyzed")
+		}
+
+		// the migration dropped the table it modified, ANALYZE fails once it
+		// committed, which doesn't fail the migration
+		migr, err = migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE bar (id int);\nINSERT INTO bar VALUES (1);\nDROP TABLE bar;")), "dropped", 2, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatalf("expected the failed ANALYZE to be ignored, got %v", err)
+		}
+		v, err := m.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 2 || v.Dirty {
+			t.Fatalf("expected clean version 2, got %+v", v)
+		}
+	})
+}
+
+func TestWithTx(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := WithTx(context.Background(), tx, &Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE foo (id int);")), "foo", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatal(err)
+		}
+
+		// the migration is visible within the caller's transaction
+		v, err := d.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 1 {
+			t.Fatalf("expected version 1 within the transaction, got %v", v.Version)
+		}
+
+		if err := tx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// rolling back the caller's transaction discarded everything
+		for _, table := range []string{"foo", "schema_migrations"} {
+			var exists bool
+			if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = $1)", table).Scan(&exists); err != nil {
+				t.Fatal(err)
+			}
+			if exists {
+				t.Fatalf("expected table %s to be rolled back", table)
+			}
+		}
+	})
+}
+
+func TestWithTxSeesEarlierMigrations(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := tx.Rollback(); err != nil {
+				t.Error(err)
+			}
+		}()
+		d, err := WithTx(context.Background(), tx, &Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the second migration references the table the first one creates,
+		// both record the transaction they ran in
+		dir := t.TempDir()
+		for name, body := range map[string]string{
+			"1_parent.up.sql": "CREATE TABLE parent (id int PRIMARY KEY, txid bigint DEFAULT txid_current());" +
+				" INSERT INTO parent (id) VALUES (1);",
+			"2_child.up.sql": "CREATE TABLE child (parent_id int REFERENCES parent (id), txid bigint DEFAULT txid_current());" +
+				" INSERT INTO child (parent_id) VALUES (1);",
+		} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		m, err := migrate.NewWithDatabaseInstance("file://"+dir, "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Up(); err != nil {
+			t.Fatal(err)
+		}
+
+		var txids int
+		if err := tx.QueryRow("SELECT count(DISTINCT txid) FROM (SELECT txid FROM parent UNION ALL SELECT txid FROM child) t").
+			Scan(&txids); err != nil {
+			t.Fatal(err)
+		}
+		if txids != 1 {
+			t.Fatalf("expected both migrations to run in the caller's transaction, got %d transactions", txids)
+		}
+	})
+}
+
+func TestRecoveryInfo(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := WithConn(context.Background(), conn, &Config{FailureTable: "schema_migration_failures"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		recovery, err := d.(*Postgres).RecoveryInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recovery != nil {
+			t.Fatalf("expected no recovery info before any failure, got %+v", recovery)
+		}
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		up, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE a (id int); CREATE TABLE b (id int);")), "up", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(up); err != nil {
+			t.Fatal(err)
+		}
+		// the second statement of the down migration fails
+		down, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"DROP TABLE a;\nDROP TABLE missing;\nDROP TABLE b;")), "down", 1, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(down); err == nil {
+			t.Fatal("expected down migration to fail")
+		}
+
+		recovery, err = d.(*Postgres).RecoveryInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recovery == nil {
+			t.Fatal("expected recovery info after a failure")
+		}
+		if recovery.Direction != "down" {
+			t.Fatalf("expected direction down, got %q", recovery.Direction)
+		}
+		if recovery.LastStatement != 0 {
+			t.Fatalf("expected the first statement to be the last successful one, got %d", recovery.LastStatement)
+		}
+		if !strings.Contains(recovery.Err, "missing") {
+			t.Fatalf("expected the error to be recorded, got %q", recovery.Err)
+		}
+	})
+}
+
+func TestDeferConstraints(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port, "x-defer-constraints=true"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE parent (id int PRIMARY KEY);"+
+				"CREATE TABLE child (parent_id int REFERENCES parent (id) DEFERRABLE INITIALLY IMMEDIATE);")), "schema", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the child row references a parent that's only inserted afterwards,
+		// which fails unless the foreign key is checked at commit
+		data, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"INSERT INTO child VALUES (1); INSERT INTO parent VALUES (1);")), "data", 2, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(schema, data); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := d.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 2 || v.Dirty {
+			t.Fatalf("expected clean version 2, got %+v", v)
+		}
+	})
+}
+
+func TestStatementBatchSize(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port, "x-multi-statement=true", "x-statement-batch-size=7"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the last statement isn't terminated and doesn't fill a batch
+		var sql strings.Builder
+		sql.WriteString("CREATE TABLE batched (id int);\n")
+		for i := 0; i < 1000; i++ {
+			fmt.Fprintf(&sql, "INSERT INTO batched\nVALUES (%d);\n", i)
+		}
+		sql.WriteString("INSERT INTO batched VALUES (1000)")
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(sql.String())), "batched", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatal(err)
+		}
+
+		var count int
+		if err := d.(*Postgres).conn.QueryRowContext(context.Background(),
+			"SELECT count(*) FROM batched").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 1001 {
+			t.Fatalf("expected 1001 rows, got %d", count)
+		}
+	})
+}
+
+// statementReader lazily generates count INSERT statements, failing if more
+// than ahead statements are generated before the driver executes them
+type statementReader struct {
+	count, ahead, generated int
+	pending                 []byte
+	p                       *Postgres
+}
+
+func (r *statementReader) Read(b []byte) (int, error) {
+	if len(r.pending) == 0 {
+		if r.generated == r.count {
+			return 0, io.EOF
+		}
+		if executed := int(r.p.stats.Statements); r.generated-executed > r.ahead {
+			return 0, fmt.Errorf("%d statements generated but only %d executed, the migration is buffered",
+				r.generated, executed)
+		}
+		r.pending = []byte(fmt.Sprintf("INSERT INTO streamed VALUES (%d);\n", r.generated))
+		r.generated++
+	}
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func TestStreamedRun(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port, "x-multi-statement=true", "x-statement-batch-size=10"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		if err := d.Run(strings.NewReader("CREATE TABLE streamed (id int)")); err != nil {
+			t.Fatal(err)
+		}
+
+		// only the head of the migration is read ahead of the statements executed
+		r := &statementReader{count: 20000, ahead: 4000, p: d.(*Postgres)}
+		if err := d.Run(r); err != nil {
+			t.Fatal(err)
+		}
+		var count int
+		if err := d.(*Postgres).conn.QueryRowContext(context.Background(),
+			"SELECT count(*) FROM streamed").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != r.count {
+			t.Fatalf("expected %d rows, got %d", r.count, count)
+		}
+
+		// transaction control is still rejected, once it's read
+		err = d.Run(strings.NewReader("INSERT INTO streamed VALUES (1); COMMIT;"))
+		var dbErr database.Error
+		if !errors.As(err, &dbErr) || string(dbErr.Query) != "COMMIT;" {
+			t.Fatalf("expected the COMMIT to be rejected, got %v", err)
+		}
+	})
+}
+
+func TestSessionSettings(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		// WithConn doesn't close the connection it rejects
+		rejected, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := rejected.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		if _, err := WithConn(context.Background(), rejected, &Config{
+			SessionSettings: map[string]string{"work_mem = '1GB'; DROP TABLE users; --": "1"},
+		}); err == nil {
+			t.Fatal("expected an invalid setting name to be rejected")
+		}
+
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := WithConn(context.Background(), conn, &Config{
+			SessionSettings: map[string]string{"work_mem": "12MB"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE settings AS SELECT current_setting('work_mem') AS work_mem;")), "settings", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatal(err)
+		}
+
+		var workMem string
+		if err := conn.QueryRowContext(context.Background(),
+			"SELECT work_mem FROM settings").Scan(&workMem); err != nil {
+			t.Fatal(err)
+		}
+		if workMem != "12MB" {
+			t.Fatalf("expected work_mem 12MB during the migration, got %s", workMem)
+		}
+		// SET LOCAL only lasts for the migration's transaction
+		if err := conn.QueryRowContext(context.Background(),
+			"SELECT current_setting('work_mem')").Scan(&workMem); err != nil {
+			t.Fatal(err)
+		}
+		if workMem == "12MB" {
+			t.Fatal("expected work_mem to be reset after the migration")
+		}
+	})
+}
+
+func TestEachHooks(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		if _, err := db.Exec("CREATE TABLE hook_log (setting text)"); err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := WithConn(context.Background(), conn, &Config{
+			BeforeEach: "SELECT set_config('migrate.hook', 'before', true)",
+			AfterEach:  "INSERT INTO hook_log VALUES (current_setting('migrate.hook'))",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for version := uint(1); version <= 2; version++ {
+			migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+				fmt.Sprintf("CREATE TABLE t%d (id int);", version))), fmt.Sprintf("t%d", version), version, int(version))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Run(migr); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var settings []string
+		rows, err := db.Query("SELECT setting FROM hook_log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var setting string
+			if err := rows.Scan(&setting); err != nil {
+				t.Fatal(err)
+			}
+			settings = append(settings, setting)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(settings, ",") != "before,before" {
+			t.Fatalf("expected both hooks to run for each migration, got %v", settings)
+		}
+	})
+}
+
+func TestDropMigrationsTable(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE kept (id int);")), "kept", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := d.(*Postgres).DropMigrationsTable(); err != nil {
+			t.Fatal(err)
+		}
+		v, err := d.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != database.NilVersion {
+			t.Fatalf("expected no version after dropping the migrations table, got %d", v.Version)
+		}
+		if _, err := d.(*Postgres).conn.ExecContext(context.Background(), "SELECT * FROM kept"); err != nil {
+			t.Fatalf("expected other tables to be left in place, got %v", err)
+		}
+
+		// versions are recorded again
+		migr, err = migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE again (id int);")), "again", 2, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatal(err)
+		}
+		if v, err = d.Version(); err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 2 {
+			t.Fatalf("expected version 2, got %d", v.Version)
+		}
+	})
+}
+
+func TestAuditWriter(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var audit bytes.Buffer
+		d, err := WithConn(context.Background(), conn, &Config{
+			MultiStatementEnabled: true,
+			StatementBatchSize:    1,
+			AuditWriter:           &audit,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE audited (id int);\nINSERT INTO audited VALUES (1);")), "audited", 3, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatal(err)
+		}
+
+		var statements []string
+		for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+			if strings.HasPrefix(line, "-- version 3 at ") {
+				continue
+			}
+			statements = append(statements, line)
+		}
+		if strings.Count(audit.String(), "-- version 3 at ") != 2 ||
+			strings.Join(statements, "\n") != "CREATE TABLE audited (id int);\nINSERT INTO audited VALUES (1);" {
+			t.Fatalf("expected both statements to be audited in order, got %q", audit.String())
+		}
+	})
+}
+
+func TestDDLLockRetries(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := pgConnectionString(ip, port, "x-lock-timeout=50", "x-ddl-lock-retries=5")
+		p := &Postgres{}
+		d, err := p.Open(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		if _, err := db.Exec("CREATE TABLE busy (id int)"); err != nil {
+			t.Fatal(err)
+		}
+		// hold a lock conflicting with the migration's DDL for a couple of its
+		// attempts, each waiting 50ms for the lock
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec("LOCK TABLE busy IN ACCESS EXCLUSIVE MODE"); err != nil {
+			t.Fatal(err)
+		}
+		released := make(chan error, 1)
+		go func() {
+			time.Sleep(300 * time.Millisecond)
+			released <- tx.Commit()
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"ALTER TABLE busy ADD COLUMN name text;")), "busy", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-released; err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.Exec("SELECT name FROM busy"); err != nil {
+			t.Fatalf("expected the column to be added once the lock was released, got %v", err)
+		}
+		v, err := d.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 1 || v.Dirty {
+			t.Fatalf("expected clean version 1, got %+v", v)
+		}
+	})
+}
+
+func TestIdempotent(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := pgConnectionString(ip, port, "x-idempotent=true")
+		p := &Postgres{}
+		d, err := p.Open(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		// created outside of migrations
+		if err := d.(*Postgres).Run(strings.NewReader(
+			"CREATE TABLE converge (id int); CREATE INDEX converge_id ON converge (id);")); err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE converge (id int);\n"+
+				"CREATE INDEX converge_id ON converge (id);\n"+
+				"INSERT INTO converge VALUES (1);")), "converge", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatal(err)
+		}
+
+		var count int
+		if err := d.(*Postgres).db.QueryRowContext(context.Background(),
+			"SELECT count(*) FROM converge").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Fatalf("expected the statements after the skipped ones to run, got %d rows", count)
+		}
+		v, err := d.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 1 || v.Dirty {
+			t.Fatalf("expected clean version 1, got %+v", v)
+		}
+
+		// other errors still fail the migration
+		migr, err = migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE converge (id int);\nINSERT INTO missing VALUES (1);")), "missing", 2, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err == nil {
+			t.Fatal("expected a missing table to fail the migration")
+		}
+	})
+}
+
+func TestIgnoreSQLStates(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := pgConnectionString(ip, port, "x-ignore-sqlstates=23505")
+		p := &Postgres{}
+		d, err := p.Open(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE seeds (id int PRIMARY KEY);\n"+
+				"INSERT INTO seeds VALUES (1);\n"+
+				"INSERT INTO seeds VALUES (1);\n"+
+				"INSERT INTO seeds VALUES (2);")), "seeds", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatal(err)
+		}
+
+		var count int
+		if err := d.(*Postgres).db.QueryRowContext(context.Background(),
+			"SELECT count(*) FROM seeds").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Fatalf("expected the statements around the unique violation to run, got %d rows", count)
+		}
+
+		// undefined_table isn't ignored
+		migr, err = migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"INSERT INTO seeds VALUES (3);\nINSERT INTO missing VALUES (1);")), "missing", 2, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var partial ErrPartialRun
+		if err := m.Run(migr); !errors.As(err, &partial) || errorCode(partial.Err) != "42P01" {
+			t.Fatalf("expected the missing table to fail the migration, got %v", err)
+		}
+		if err := d.(*Postgres).db.QueryRowContext(context.Background(),
+			"SELECT count(*) FROM seeds").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Fatalf("expected the failed migration to be rolled back, got %d rows", count)
+		}
+	})
+}
+
+func TestRetryClassifier(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var attempts []int
+		d, err := WithConn(context.Background(), conn, &Config{
+			RetryClassifier: func(err error, stmt []byte, attempt int) (bool, time.Duration) {
+				attempts = append(attempts, attempt)
+				// division_by_zero stands in for a transient error
+				return errorCode(err) == "22012" && attempt == 0, 10 * time.Millisecond
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		// sequences aren't rolled back with the savepoint, so the statement
+		// fails the first time only
+		if err := d.Run(strings.NewReader("CREATE SEQUENCE attempts;\n" +
+			"CREATE TABLE retried AS SELECT 1 / (nextval('attempts') - 1) AS n;")); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(attempts, []int{0}) {
+			t.Fatalf("expected the statement to be retried once, got attempts %v", attempts)
+		}
+		var n int
+		if err := db.QueryRow("SELECT n FROM retried").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+
+		// the classifier gives up on the second failure
+		attempts = nil
+		var partial ErrPartialRun
+		if err := d.Run(strings.NewReader("SELECT 1 / 0;")); !errors.As(err, &partial) || errorCode(partial.Err) != "22012" {
+			t.Fatalf("expected the migration to fail with division_by_zero, got %v", err)
+		}
+		if !reflect.DeepEqual(attempts, []int{0, 1}) {
+			t.Fatalf("expected attempts [0 1], got %v", attempts)
+		}
+	})
+}
+
+func TestDeferForeignKeys(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := pgConnectionString(ip, port, "x-defer-foreign-keys=true")
+		p := &Postgres{}
+		d, err := p.Open(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the orders are loaded before the users they reference, adding the
+		// foreign key where it's written would fail the inserts
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE users (id int PRIMARY KEY);\n"+
+				"CREATE TABLE orders (id int PRIMARY KEY, user_id int);\n"+
+				"-- migrate:defer\n"+
+				"ALTER TABLE orders ADD CONSTRAINT orders_user_fk FOREIGN KEY (user_id) REFERENCES users (id);\n"+
+				"INSERT INTO orders VALUES (1, 1), (2, 2);\n"+
+				"INSERT INTO users VALUES (1), (2);")), "load", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatal(err)
+		}
+
+		var constraint string
+		if err := d.(*Postgres).db.QueryRowContext(context.Background(),
+			"SELECT conname FROM pg_constraint WHERE conrelid = 'orders'::regclass AND contype = 'f'").Scan(&constraint); err != nil {
+			t.Fatal(err)
+		}
+		if constraint != "orders_user_fk" {
+			t.Fatalf("expected the foreign key orders_user_fk, got %s", constraint)
+		}
+		var count int
+		if err := d.(*Postgres).db.QueryRowContext(context.Background(),
+			"SELECT count(*) FROM orders JOIN users ON users.id = orders.user_id").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Fatalf("expected 2 orders loaded, got %d", count)
+		}
+	})
+}
+
+func TestVerify(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := pgConnectionString(ip, port)
+		p := &Postgres{}
+		d, err := p.Open(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"-- migrate:verify SELECT 1 FROM users WHERE email IS NULL\n"+
+				"-- migrate:verify SELECT count(*) = 2 FROM users\n"+
+				"CREATE TABLE users (id int, email text);\n"+
+				"INSERT INTO users VALUES (1, 'a@example.com'), (2, 'b@example.com');")), "users", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatal(err)
+		}
+
+		// the backfill misses a row, the invariant is violated
+		migr, err = migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"-- migrate:verify SELECT id FROM users WHERE email_lower IS NULL\n"+
+				"ALTER TABLE users ADD COLUMN email_lower text;\n"+
+				"UPDATE users SET email_lower = lower(email) WHERE id = 1;")), "backfill", 2, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); !errors.Is(err, ErrVerificationFailed) {
+			t.Fatalf("expected the verification to fail the migration, got %v", err)
+		}
+
+		var exists bool
+		if err := d.(*Postgres).db.QueryRowContext(context.Background(),
+			"SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE column_name = 'email_lower')").Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Fatal("expected the failed migration to be rolled back")
+		}
+		v, err := m.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 1 {
+			t.Fatalf("expected version 1 after the failed verification, got %d", v.Version)
+		}
+	})
+}
+
+func TestTransactionless(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		newMigrate := func(options ...string) (*migrate.Migrate, *Postgres) {
+			d, err := (&Postgres{}).Open(pgConnectionString(ip, port, options...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if err := d.Close(); err != nil {
+					t.Error(err)
+				}
+			})
+			m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return m, d.(*Postgres)
+		}
+		run := func(m *migrate.Migrate, version int, body string) error {
+			migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(body)), "transactionless", uint(version), version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return m.Run(migr)
+		}
+
+		// CREATE INDEX CONCURRENTLY fails in a transaction block, the
+		// migration is run outside of one instead
+		m, p := newMigrate()
+		if err := run(m, 1, "CREATE TABLE users (id int, email text);\n"+
+			"CREATE INDEX CONCURRENTLY users_id ON users (id);"); err != nil {
+			t.Fatal(err)
+		}
+		var exists bool
+		if err := p.db.QueryRowContext(context.Background(),
+			"SELECT to_regclass('users_id') IS NOT NULL").Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Fatal("expected the index users_id to be created")
+		}
+		v, err := m.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 1 || v.Dirty {
+			t.Fatalf("expected clean version 1, got %d dirty %v", v.Version, v.Dirty)
+		}
+
+		strict, _ := newMigrate("x-strict-transactionless=true")
+		if err := run(strict, 2, "ALTER TABLE users ADD COLUMN name text;\n"+
+			"CREATE INDEX CONCURRENTLY users_name ON users (name);"); err == nil {
+			t.Fatal("expected a migration mixing CREATE INDEX CONCURRENTLY with other statements to fail")
+		}
+		if err := run(strict, 2, "CREATE INDEX CONCURRENTLY users_email ON users (email);\n"+
+			"VACUUM ANALYZE users;"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestNoLockOutsideTx(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := (&Postgres{}).Open(pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the statements of a migration releasing the lock run outside of a
+		// transaction, so the ones before a failure stay and the version
+		// stays dirty
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader("-- migrate:no-lock\n"+
+			"CREATE TABLE users (id int);\n"+
+			"SELECT 1/0;")), "no-lock", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pqErr *pq.Error
+		if err := m.Run(migr); !errors.As(err, &pqErr) || pqErr.Code != "22012" {
+			t.Fatalf("expected the migration to fail dividing by zero, got %v", err)
+		}
+		var exists bool
+		if err := d.(*Postgres).db.QueryRowContext(context.Background(),
+			"SELECT to_regclass('users') IS NOT NULL").Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Fatal("expected the table created before the failure to stay")
+		}
+		v, err := d.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 1 || !v.Dirty {
+			t.Fatalf("expected dirty version 1, got %d dirty %v", v.Version, v.Dirty)
+		}
+	})
+}
+
+func TestNoLockUp(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dir := t.TempDir()
+		migrations := map[string]string{
+			"1_users.up.sql":      "CREATE TABLE users (id int);",
+			"2_users_id.up.sql":   "-- migrate:no-lock\nCREATE INDEX CONCURRENTLY users_id ON users (id);",
+			"3_users_name.up.sql": "ALTER TABLE users ADD COLUMN name text;",
+		}
+		for name, body := range migrations {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		d, err := (&Postgres{}).Open(pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		m, err := migrate.NewWithDatabaseInstance("file://"+dir, "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the lock is released for the migration and taken again to record
+		// its version and apply the ones after it
+		if err := m.Up(); err != nil {
+			t.Fatal(err)
+		}
+		v, err := d.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 3 || v.Dirty {
+			t.Fatalf("expected clean version 3, got %d dirty %v", v.Version, v.Dirty)
+		}
+
+		// the lock is released once Up returns
+		other, err := (&Postgres{}).Open(pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := other.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		if err := other.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		if err := other.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestStatementHashes(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dir := t.TempDir()
+		file := filepath.Join(dir, "1_users.up.sql")
+		if err := os.WriteFile(file, []byte("CREATE TABLE users (id int);\nCREATE INDEX users_id ON users (id);\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := migrate.New("file://"+dir, pgConnectionString(ip, port, "x-statement-hashes=true"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if _, err := m.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		if err := m.Up(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.VerifyStatements(1); err != nil {
+			t.Fatalf("expected the applied statements to match, got %v", err)
+		}
+
+		// the index is edited after the migration was applied
+		if err := os.WriteFile(file, []byte("CREATE TABLE users (id int);\nCREATE UNIQUE INDEX users_id ON users (id);\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var drift migrate.ErrStatementDrift
+		if err := m.VerifyStatements(1); !errors.As(err, &drift) || drift.Index != 1 {
+			t.Fatalf("expected statement 1 to differ, got %v", err)
+		}
+	})
+}
+
+func TestRunInline(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		migrations := []migrate.InlineMigration{
+			{Version: 1, Up: "CREATE TABLE inline_users (id int);"},
+			{Version: 2, Up: "ALTER TABLE inline_users ADD COLUMN name text;"},
+			{Version: 3, Up: "INSERT INTO inline_users (id, name) VALUES (1, 'jane');"},
+		}
+		if err := migrate.RunInline(d, migrations); err != nil {
+			t.Fatal(err)
+		}
+		v, err := d.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 3 || v.Dirty {
+			t.Fatalf("expected clean version 3, got %+v", v)
+		}
+		var name string
+		if err := d.(*Postgres).db.QueryRowContext(context.Background(),
+			`SELECT name FROM inline_users WHERE id = 1`).Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		if name != "jane" {
+			t.Fatalf("expected the row inserted by migration 3, got %q", name)
+		}
+		if err := migrate.RunInline(d, migrations); !errors.Is(err, migrate.ErrNoChange) {
+			t.Fatalf("expected ErrNoChange, got %v", err)
+		}
+	})
+}
+
+func TestDebugSearchPath(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		admin, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := admin.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		if _, err := admin.Exec(`CREATE SCHEMA debug_schema AUTHORIZATION postgres`); err != nil {
+			t.Fatal(err)
+		}
+
+		// the first schema of the search_path that exists is the current one
+		db, err := sql.Open("postgres", pgConnectionString(ip, port, "search_path=missing_schema,debug_schema"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		var logs bytes.Buffer
+		d, err := WithDB(context.Background(), db, &Config{Debug: true, Logger: log.New(&logs, "", 0)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		for _, want := range []string{
+			`search_path "missing_schema,`,
+			`current schema "debug_schema", driver schema "debug_schema", ` +
+				`migrations table "debug_schema"."schema_migrations"`,
+		} {
+			if !strings.Contains(logs.String(), want) {
+				t.Fatalf("expected the logs to contain %q, got %q", want, logs.String())
+			}
+		}
+	})
+}
+
+func TestMetadata(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := pgConnectionString(ip, port)
+		p := &Postgres{}
+		d, err := p.Open(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"-- @author: jane\n-- @ticket: OPS-123\nCREATE TABLE audited (id int);")), "audited", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatal(err)
+		}
+		migr, err = migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE unaudited (id int);")), "unaudited", 2, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatal(err)
+		}
+
+		metadata, err := m.Metadata(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{"author": "jane", "ticket": "OPS-123"}
+		if !reflect.DeepEqual(metadata, expected) {
+			t.Fatalf("expected metadata %v, got %v", expected, metadata)
+		}
+		if metadata, err := m.Metadata(2); err != nil || metadata != nil {
+			t.Fatalf("expected no metadata, got %v, %v", metadata, err)
+		}
+		if _, err := m.Metadata(3); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected an unapplied version to fail, got %v", err)
+		}
+	})
+}
+
+func TestActor(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		run := func(addr string, version uint) *migrate.Migrate {
+			d, err := (&Postgres{}).Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if err := d.Close(); err != nil {
+					t.Error(err)
+				}
+			})
+			m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+				fmt.Sprintf("CREATE TABLE audited_%d (id int);", version))), "audited", version, int(version))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Run(migr); err != nil {
+				t.Fatal(err)
+			}
+			return m
+		}
+
+		m := run(pgConnectionString(ip, port, "x-actor=ci-deploy"), 1)
+		if actor, err := m.Actor(1); err != nil || actor != "ci-deploy" {
+			t.Fatalf("expected version 1 applied by ci-deploy, got %q, %v", actor, err)
+		}
+
+		// without an actor the connection's role is recorded
+		m = run(pgConnectionString(ip, port), 2)
+		if actor, err := m.Actor(2); err != nil || actor != "postgres" {
+			t.Fatalf("expected version 2 applied by postgres, got %q, %v", actor, err)
+		}
+		if _, err := m.Actor(3); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected an unapplied version to fail, got %v", err)
+		}
+	})
+}
+
+func TestRunID(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		var logs bytes.Buffer
+		d, err := WithDB(context.Background(), db, &Config{Logger: log.New(&logs, "", 0)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Up(); err != nil {
+			t.Fatal(err)
+		}
+
+		runID := d.(*Postgres).RunID()
+		if _, err := uuid.Parse(runID); err != nil {
+			t.Fatalf("expected a generated UUID, got %q: %v", runID, err)
+		}
+		var runIDs []string
+		rows, err := d.(*Postgres).db.QueryContext(context.Background(),
+			`SELECT DISTINCT COALESCE(run_id, '') FROM schema_migrations`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				t.Fatal(err)
+			}
+			runIDs = append(runIDs, id)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if len(runIDs) != 1 || runIDs[0] != runID {
+			t.Fatalf("expected every version applied by Up recorded with run %s, got %q", runID, runIDs)
+		}
+		if !strings.Contains(logs.String(), "run "+runID+": ") {
+			t.Fatalf("expected the logs to carry the run id, got %q", logs.String())
+		}
+
+		// a configured run id is used as is
+		d2, err := (&Postgres{}).Open(pgConnectionString(ip, port, "x-run-id=deploy-42"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d2.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		if err := d2.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		if got := d2.(*Postgres).RunID(); got != "deploy-42" {
+			t.Fatalf("expected run id deploy-42, got %q", got)
+		}
+		if err := d2.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestConnectHook(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		d, err := WithDB(context.Background(), db, &Config{ConnectHook: []string{
+			`SELECT set_config('migrate.environment', 'staging', false)`,
+			`SET application_name = 'migrate'`,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		var environment, application string
+		if err := d.(*Postgres).db.QueryRowContext(context.Background(),
+			`SELECT current_setting('migrate.environment'), current_setting('application_name')`).Scan(
+			&environment, &application); err != nil {
+			t.Fatal(err)
+		}
+		if environment != "staging" || application != "migrate" {
+			t.Fatalf("expected the connect hook to set staging and migrate, got %q and %q", environment, application)
+		}
+
+		if _, err := WithDB(context.Background(), db, &Config{ConnectHook: []string{`SET no_such_setting = 1`}}); err == nil {
+			t.Fatal("expected a failing connect hook to fail the driver")
+		}
+	})
+}
+
+func TestCancelLock(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		open := func() *Postgres {
+			d, err := WithDB(context.Background(), db, &Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if err := d.Close(); err != nil {
+					t.Error(err)
+				}
+			})
+			return d.(*Postgres)
+		}
+		holder, waiter := open(), open()
+		if err := waiter.CancelLock(); !errors.Is(err, ErrNoLockWait) {
+			t.Fatalf("expected ErrNoLockWait without a Lock waiting, got %v", err)
+		}
+
+		if err := holder.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := holder.Unlock(); err != nil {
+				t.Error(err)
+			}
+		}()
+		locked := make(chan error, 1)
+		go func() { locked <- waiter.Lock() }()
+
+		// wait for Lock to record its backend only, CancelLock waits for the
+		// backend to block on the advisory lock
+		deadline := time.Now().Add(10 * time.Second)
+		for waiter.lockWaitPID.Load() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("Lock isn't waiting for the advisory lock")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		if err := waiter.CancelLock(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-locked:
+			if err == nil {
+				t.Fatal("expected the canceled Lock to fail")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Lock didn't return once canceled")
+		}
+		if waiter.isLocked.Load() {
+			t.Fatal("expected the canceled Lock not to be recorded as locked")
+		}
+	})
+}
+
+func TestLockOwnership(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		d, err := WithDB(context.Background(), db, &Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		if err := d.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.SetVersion(1, false); err != nil {
+			t.Fatal(err)
+		}
+
+		// the pool hands out another connection, which doesn't hold the lock
+		pg := d.(*Postgres)
+		locked := pg.conn
+		other, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pg.conn, pg.db = other, other
+		if err := d.Begin(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.SetVersion(2, true); !errors.Is(err, ErrLockNotOwned) {
+			t.Fatalf("expected ErrLockNotOwned, got %v", err)
+		}
+		if err := d.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+		if err := other.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		pg.conn, pg.db = locked, locked
+		if err := d.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// countingQueryer counts the rows queried and records the statements executed
+// through it
+type countingQueryer struct {
+	queryer
+	rowQueries int
+	execs      []string
+}
+
+func (c *countingQueryer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	c.execs = append(c.execs, query)
+	return c.queryer.ExecContext(ctx, query, args...)
+}
+
+func (c *countingQueryer) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	c.rowQueries++
+	return c.queryer.QueryRowContext(ctx, query, args...)
+}
+
+func TestSkipLock(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port, "x-skip-lock=true"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		pg := d.(*Postgres)
+		counter := &countingQueryer{queryer: pg.db}
+		pg.db = counter
+
+		if err := d.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+		for _, query := range counter.execs {
+			if strings.Contains(query, "pg_advisory") {
+				t.Fatalf("expected no advisory lock queries, got %q", query)
+			}
+		}
+	})
+}
+
+func TestStampSchemaComment(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port, "x-stamp-schema-comment=true"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		pg := d.(*Postgres)
+
+		if err := d.SetVersion(3, false); err != nil {
+			t.Fatal(err)
+		}
+		var comment string
+		if err := pg.conn.QueryRowContext(context.Background(),
+			`SELECT obj_description(oid, 'pg_namespace') FROM pg_namespace WHERE nspname = $1`,
+			pg.config.migrationsSchemaName).Scan(&comment); err != nil {
+			t.Fatal(err)
+		}
+		if comment != "migrate version 3" {
+			t.Fatalf("expected the schema comment to be the version, got %q", comment)
+		}
+		if v, err := d.Version(); err != nil || v.Version != 3 || v.Dirty {
+			t.Fatalf("expected clean version 3, got %+v %v", v, err)
+		}
+	})
+}
+
+func TestParams(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cutoff := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		d, err := WithConn(context.Background(), conn, &Config{
+			Params: map[string]interface{}{"cutoff": cutoff},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE events (created_at timestamptz, archived bool NOT NULL DEFAULT false);\n"+
+				"INSERT INTO events (created_at) VALUES ('2019-06-01'), ('2021-06-01');\n"+
+				"UPDATE events SET archived = true WHERE created_at < @cutoff;")), "archive", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatal(err)
+		}
+
+		var archived int
+		if err := conn.QueryRowContext(context.Background(),
+			"SELECT count(*) FROM events WHERE archived").Scan(&archived); err != nil {
+			t.Fatal(err)
+		}
+		if archived != 1 {
+			t.Fatalf("expected the event before the cutoff to be archived, got %d", archived)
+		}
+	})
+}
+
+func TestIdempotentParams(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := WithConn(context.Background(), conn, &Config{
+			Idempotent: true,
+			Params:     map[string]interface{}{"name": "seeded"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		// the table existing already is skipped and the param is still bound
+		if _, err := conn.ExecContext(context.Background(), "CREATE TABLE users (name text)"); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(strings.NewReader(
+			"CREATE TABLE users (name text);\nINSERT INTO users (name) VALUES (@name);")); err != nil {
+			t.Fatal(err)
+		}
+		var name string
+		if err := conn.QueryRowContext(context.Background(), "SELECT name FROM users").Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		if name != "seeded" {
+			t.Fatalf("expected the bound name, got %q", name)
+		}
+	})
+}
+
+func TestRejectTransactionControl(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE early (id int);\nCOMMIT;\nCREATE TABLE late (id int);")), "commit", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m.Run(migr)
+		var dbErr database.Error
+		if !errors.As(err, &dbErr) || !strings.Contains(dbErr.Err, "remove its BEGIN, COMMIT and ROLLBACK") ||
+			string(dbErr.Query) != "COMMIT;" {
+			t.Fatalf("expected an error pointing at the COMMIT, got %v", err)
+		}
+
+		var exists bool
+		if err := d.(*Postgres).db.QueryRowContext(context.Background(),
+			"SELECT to_regclass('early') IS NOT NULL").Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Fatal("expected no statement of the migration to run")
+		}
+	})
+}
+
+func TestIsolationLevel(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port, "x-isolation-level=serializable"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE levels AS SELECT 1 AS version, current_setting('transaction_isolation') AS level;")),
+			"configured", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"-- migrate:isolation-level read committed\n"+
+				"INSERT INTO levels SELECT 2, current_setting('transaction_isolation');")),
+			"overridden", 2, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(first, second); err != nil {
+			t.Fatal(err)
+		}
+
+		levels := map[int]string{}
+		rows, err := d.(*Postgres).db.QueryContext(context.Background(), "SELECT version, level FROM levels")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var version int
+			var level string
+			if err := rows.Scan(&version, &level); err != nil {
+				t.Fatal(err)
+			}
+			levels[version] = level
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if want := map[int]string{1: "serializable", 2: "read committed"}; !reflect.DeepEqual(levels, want) {
+			t.Fatalf("expected isolation levels %v, got %v", want, levels)
+		}
+		if v, err := d.Version(); err != nil || v.Version != 2 || v.Dirty {
+			t.Fatalf("expected clean version 2, got %+v %v", v, err)
+		}
+	})
+}
+
+func TestPartialRun(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migr, err := migrate.NewMigration(io.NopCloser(strings.NewReader(
+			"CREATE TABLE partial (id int);\n"+
+				"INSERT INTO partial VALUES (1);\n"+
+				"INSERT INTO partial VALUES (2);\n"+
+				"INSERT INTO missing VALUES (3);\n"+
+				"INSERT INTO partial VALUES (4);")), "partial", 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m.Run(migr)
+		var partial ErrPartialRun
+		if !errors.As(err, &partial) {
+			t.Fatalf("expected ErrPartialRun, got %v", err)
+		}
+		if partial.Executed != 3 || !partial.RolledBack {
+			t.Fatalf("expected 3 statements executed and rolled back, got %+v", partial)
+		}
+
+		var exists bool
+		if err := d.(*Postgres).db.QueryRowContext(context.Background(),
+			"SELECT to_regclass('partial') IS NOT NULL").Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Fatal("expected the statements executed to be rolled back")
+		}
+	})
+}
+
+func TestCreateDatabaseAndMigrate(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := pgConnectionString(ip, port)
+		m, err := CreateDatabaseAndMigrate(addr, "throwaway", "file://./examples/migrations")
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := m.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 1885849751 || v.Dirty {
+			t.Fatalf("expected the throwaway database at the last version, got %+v", v)
+		}
+		if srcErr, dbErr := m.Close(); srcErr != nil || dbErr != nil {
+			t.Fatal(srcErr, dbErr)
+		}
+
+		if err := DropDatabase(addr, "throwaway"); err != nil {
+			t.Fatal(err)
+		}
+		db, err := sql.Open("postgres", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		var exists bool
+		if err := db.QueryRowContext(context.Background(),
+			"SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = 'throwaway')").Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Fatal("expected the throwaway database to be dropped")
+		}
+	})
+}
+
+func TestLastRunStats(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		pg := d.(*Postgres)
+
+		if err := d.Run(strings.NewReader(
+			"CREATE TABLE accounts (id int, active bool);\n" +
+				"INSERT INTO accounts SELECT i, false FROM generate_series(1, 5) i;")); err != nil {
+			t.Fatal(err)
+		}
+		if stats := pg.LastRunStats(); stats.Statements != 2 || stats.Duration <= 0 {
+			t.Fatalf("expected 2 statements, got %+v", stats)
+		}
+
+		if err := d.Run(strings.NewReader("UPDATE accounts SET active = true WHERE id > 1;")); err != nil {
+			t.Fatal(err)
+		}
+		if stats := pg.LastRunStats(); stats.Statements != 1 || stats.RowsAffected != 4 {
+			t.Fatalf("expected 1 statement updating 4 rows, got %+v", stats)
+		}
+	})
+}
+
+func TestMigrationsTableDDL(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		open := func(ddl string) (database.Driver, error) {
+			conn, err := db.Conn(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return WithConn(context.Background(), conn, &Config{MigrationsTable: "ledger", MigrationsTableDDL: ddl})
+		}
+
+		// a table without all the columns the driver needs is rejected
+		if _, err := open(`CREATE TABLE <TABLE_NAME> (version bigint PRIMARY KEY, dirty boolean NOT NULL)`); err == nil ||
+			!strings.Contains(err.Error(), "lacks the columns id, created_at, updated_at, info, metadata, applied_by, run_id") {
+			t.Fatalf("expected the missing columns to be reported, got %v", err)
+		}
+		if _, err := db.Exec(`DROP TABLE ledger`); err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := open(`CREATE TABLE <TABLE_NAME> (
+			id bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			version bigint NOT NULL UNIQUE,
+			dirty boolean NOT NULL,
+			created_at timestamp with time zone NOT NULL DEFAULT now(),
+			updated_at timestamp with time zone,
+			info text,
+			metadata jsonb,
+			applied_by text,
+			run_id text
+		) WITH (fillfactor = 90)`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		m, err := migrate.NewWithDatabaseInstance("file://./examples/migrations", "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Up(); err != nil {
+			t.Fatal(err)
+		}
+		v, err := m.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 1885849751 || v.Dirty {
+			t.Fatalf("expected clean version 1885849751, got %d dirty %v", v.Version, v.Dirty)
+		}
+
+		// the table keeps its definition, the driver didn't add its own key
+		var options []string
+		if err := db.QueryRow(`SELECT reloptions FROM pg_class WHERE relname = 'ledger'`).Scan(pq.Array(&options)); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(options, []string{"fillfactor=90"}) {
+			t.Fatalf("expected the storage parameters of the DDL, got %v", options)
+		}
+		var constraints int
+		if err := db.QueryRow(`SELECT count(*) FROM pg_constraint WHERE conrelid = 'ledger'::regclass`).Scan(&constraints); err != nil {
+			t.Fatal(err)
+		}
+		if constraints != 2 {
+			t.Fatalf("expected the primary key and unique constraint of the DDL only, got %d constraints", constraints)
+		}
+	})
+}
+
+func TestQuotedMigrationsTableConstraints(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		if _, err := db.Exec(`CREATE SCHEMA ledger`); err != nil {
+			t.Fatal(err)
+		}
+
+		// opening twice finds the constraints the first open added in the
+		// table's schema rather than the current one
+		for i := 0; i < 2; i++ {
+			conn, err := db.Conn(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := WithConn(context.Background(), conn,
+				&Config{MigrationsTable: `"ledger"."schema_migrations"`, MigrationsTableQuoted: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var primary, unique int
+		if err := db.QueryRow(`SELECT count(*) FILTER (WHERE contype = 'p'), count(*) FILTER (WHERE contype = 'u') `+
+			`FROM pg_constraint WHERE conrelid = 'ledger.schema_migrations'::regclass`).Scan(&primary, &unique); err != nil {
+			t.Fatal(err)
+		}
+		if primary != 1 || unique != 1 {
+			t.Fatalf("expected one primary key and one unique constraint, got %d and %d", primary, unique)
+		}
+	})
+}
+
+func TestSetVersionStatementWithoutUniqueVersion(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := WithConn(context.Background(), conn, &Config{MigrationsTable: "ledger", MigrationsTableDDL: `CREATE TABLE <TABLE_NAME> (
+			id bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			version bigint NOT NULL,
+			dirty boolean NOT NULL,
+			created_at timestamp with time zone NOT NULL DEFAULT now(),
+			updated_at timestamp with time zone,
+			info text,
+			metadata jsonb,
+			applied_by text,
+			run_id text
+		)`})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		// without a unique index on version the statement can't upsert, run
+		// twice it still leaves a single row
+		stmt := d.(*Postgres).SetVersionStatement(3, false)
+		for i := 0; i < 2; i++ {
+			if _, err := db.Exec(stmt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var rows int
+		if err := db.QueryRow(`SELECT count(*) FROM ledger WHERE version = 3 AND NOT dirty`).Scan(&rows); err != nil {
+			t.Fatal(err)
+		}
+		if rows != 1 {
+			t.Fatalf("expected one row for version 3, got %d", rows)
+		}
+	})
+}
+
+func TestRunForSchema(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		pg := d.(*Postgres)
+		if err := d.Run(strings.NewReader("CREATE SCHEMA foo; CREATE SCHEMA bar;")); err != nil {
+			t.Fatal(err)
+		}
+		var searchPath string
+		if err := pg.conn.QueryRowContext(context.Background(), "SHOW search_path").Scan(&searchPath); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, schema := range []string{"foo", "bar"} {
+			if err := pg.RunForSchema(context.Background(), schema,
+				strings.NewReader("CREATE TABLE tenants (id int); INSERT INTO <SCHEMA_NAME>.tenants VALUES (1);")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, table := range []string{"tenants", DefaultMigrationsTable} {
+			var schemas []string
+			if err := pg.conn.QueryRowContext(context.Background(),
+				"SELECT array_agg(table_schema::text ORDER BY table_schema) FROM information_schema.tables WHERE table_name = $1",
+				table).Scan(pq.Array(&schemas)); err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"bar", "foo"}
+			if table == DefaultMigrationsTable {
+				want = []string{"bar", "foo", "public"}
+			}
+			if !reflect.DeepEqual(schemas, want) {
+				t.Fatalf("expected %s in schemas %v, got %v", table, want, schemas)
+			}
+		}
+
+		var reset string
+		if err := pg.conn.QueryRowContext(context.Background(), "SHOW search_path").Scan(&reset); err != nil {
+			t.Fatal(err)
+		}
+		if reset != searchPath {
+			t.Fatalf("expected search_path to be reset to %q, got %q", searchPath, reset)
+		}
+
+		// a failing migration is rolled back and the search_path reset too
+		if err := pg.RunForSchema(context.Background(), "foo",
+			strings.NewReader("CREATE TABLE more (id int); SELECT * FROM missing;")); err == nil {
+			t.Fatal("expected the migration to fail")
+		}
+		var exists bool
+		if err := pg.conn.QueryRowContext(context.Background(),
+			"SELECT to_regclass('foo.more') IS NOT NULL").Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Fatal("expected the failed migration to be rolled back")
+		}
+		if err := pg.conn.QueryRowContext(context.Background(), "SHOW search_path").Scan(&reset); err != nil {
+			t.Fatal(err)
+		}
+		if reset != searchPath {
+			t.Fatalf("expected search_path to be reset to %q, got %q", searchPath, reset)
+		}
+	})
+}
+
+func TestConcurrentRun(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		// the second Run starts while the first one sleeps
+		started := make(chan struct{})
+		errs := make(chan error, 2)
+		go func() {
+			close(started)
+			errs <- d.Run(strings.NewReader("SELECT pg_sleep(1)"))
+		}()
+		<-started
+		time.Sleep(200 * time.Millisecond)
+		go func() {
+			errs <- d.Run(strings.NewReader("SELECT 1"))
+		}()
+
+		var inUse, succeeded int
+		for i := 0; i < 2; i++ {
+			switch err := <-errs; {
+			case err == nil:
+				succeeded++
+			case errors.Is(err, ErrDriverInUse):
+				inUse++
+			default:
+				t.Fatal(err)
+			}
+		}
+		if succeeded != 1 || inUse != 1 {
+			t.Fatalf("expected one Run to fail with ErrDriverInUse, got %d succeeded and %d in use", succeeded, inUse)
+		}
+
+		// the driver is usable again once the first Run returned
+		if err := d.Run(strings.NewReader("SELECT 1")); err != nil {
+			t.Fatal(err)
+		}
+
+		// no other transaction begins until the one in progress commits, the
+		// calls in it may come from any goroutine, like the core's Lock
+		if err := d.Begin(); err != nil {
+			t.Fatal(err)
+		}
+		other := func(call func() error) error {
+			errs := make(chan error, 1)
+			go func() { errs <- call() }()
+			return <-errs
+		}
+		if err := other(d.Begin); !errors.Is(err, ErrDriverInUse) {
+			t.Fatalf("expected Begin during a transaction to fail with ErrDriverInUse, got %v", err)
+		}
+		if err := other(func() error { return d.Run(strings.NewReader("SELECT 1")) }); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if err := other(d.Begin); err != nil {
+			t.Fatalf("expected Begin to succeed once committed, got %v", err)
+		}
+		if err := d.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestCloseLeakedTx(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var logs bytes.Buffer
+		d, err := WithConn(context.Background(), conn, &Config{Logger: log.New(&logs, "", 0)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// neither committed nor rolled back
+		if err := d.Begin(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.SetVersion(1, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(strings.NewReader("CREATE TABLE leaked (id int)")); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Close(); !errors.Is(err, ErrTxLeaked) {
+			t.Fatalf("expected ErrTxLeaked, got %v", err)
+		}
+		if !strings.Contains(logs.String(), "transaction of version 1 still open on close, rolling it back") {
+			t.Fatalf("expected the leaked transaction to be logged, got %q", logs.String())
+		}
+
+		var exists bool
+		if err := db.QueryRow("SELECT to_regclass('leaked') IS NOT NULL").Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Fatal("expected the leaked transaction to be rolled back")
+		}
+	})
+}
+
+func TestRLock(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := pgConnectionString(ip, port)
+		var readers []*Postgres
+		for i := 0; i < 2; i++ {
+			p := &Postgres{}
+			d, err := p.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := d.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+			readers = append(readers, d.(*Postgres))
+		}
+
+		// both readers hold the shared lock at once
+		for _, r := range readers {
+			if err := r.RLock(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := readers[0].RLock(); !errors.Is(err, database.ErrLocked) {
+			t.Fatalf("expected ErrLocked locking twice, got %v", err)
+		}
+
+		// while a writer can't take the exclusive lock
+		db, err := sql.Open("postgres", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		aid, err := readers[0].advisoryLockID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tryLock := func() bool {
+			var locked bool
+			if err := db.QueryRow("SELECT pg_try_advisory_xact_lock($1)", aid).Scan(&locked); err != nil {
+				t.Fatal(err)
+			}
+			return locked
+		}
+		if tryLock() {
+			t.Fatal("expected the exclusive lock to be unavailable while shared locks are held")
+		}
+
+		for _, r := range readers {
+			if err := r.RUnlock(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !tryLock() {
+			t.Fatal("expected the exclusive lock to be available once the shared locks are released")
+		}
+	})
+}
+
+func TestVersionCacheTTL(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Postgres{}
+		d, err := p.Open(pgConnectionString(ip, port, "x-version-cache-ttl=60000"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		pg := d.(*Postgres)
+		counter := &countingQueryer{queryer: pg.db}
+		pg.db = counter
+
+		for i := 0; i < 2; i++ {
+			v, err := d.Version()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Version != database.NilVersion {
+				t.Fatalf("expected NilVersion, got %v", v.Version)
+			}
+		}
+		if counter.rowQueries != 1 {
+			t.Fatalf("expected the version to be read once within the TTL, got %d reads", counter.rowQueries)
+		}
+
+		// locking invalidates the cached version, which another session may
+		// have changed before releasing the lock
+		if err := d.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		reads := counter.rowQueries
+		if _, err := d.Version(); err != nil {
+			t.Fatal(err)
+		}
+		if counter.rowQueries != reads+1 {
+			t.Fatalf("expected the version to be read again after Lock, got %d reads", counter.rowQueries-reads)
+		}
+		if err := d.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+
+		// recording a version invalidates the cached one
+		if err := d.SetVersion(3, false); err != nil {
+			t.Fatal(err)
+		}
+		v, err := d.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 3 {
+			t.Fatalf("expected version 3 after SetVersion, got %v", v.Version)
+		}
+	})
+}
+
+func TestTracerProvider(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("postgres", pgConnectionString(ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := tracetest.NewSpanRecorder()
+		d, err := WithConn(context.Background(), conn, &Config{
+			TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		dir := t.TempDir()
+		for name, body := range map[string]string{
+			"1_first.up.sql":  "CREATE TABLE first (id int);",
+			"2_second.up.sql": "CREATE TABLE second (id int); INSERT INTO second VALUES (1);",
+		} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		m, err := migrate.NewWithDatabaseInstance("file://"+dir, "postgres", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Up(); err != nil {
+			t.Fatal(err)
+		}
+
+		var run sdktrace.ReadOnlySpan
+		var migrations, statements []sdktrace.ReadOnlySpan
+		for _, span := range recorder.Ended() {
+			switch span.Name() {
+			case "migrate.run":
+				if run != nil {
+					t.Fatal("expected a single run span")
+				}
+				run = span
+			case "migrate.migration":
+				migrations = append(migrations, span)
+			case "migrate.statement":
+				statements = append(statements, span)
+			}
+		}
+		if run == nil || len(migrations) != 2 || len(statements) != 3 {
+			t.Fatalf("expected a run, 2 migrations and 3 statements, got %v, %d and %d",
+				run, len(migrations), len(statements))
+		}
+		for i, migration := range migrations {
+			if migration.Parent().SpanID() != run.SpanContext().SpanID() {
+				t.Errorf("expected migration %d to be a child of the run", i)
+			}
+			if v := spanAttribute(migration, "migrate.version"); v.AsInt64() != int64(i+1) {
+				t.Errorf("expected migration %d to migrate to version %d, got %v", i, i+1, v.AsInt64())
+			}
+			if v := spanAttribute(migration, "migrate.direction"); v.AsString() != "up" {
+				t.Errorf("expected migration %d to migrate up, got %v", i, v.AsString())
+			}
+		}
+		// a span for each statement, the second migration has two
+		for i, want := range []struct {
+			migration, index int
+		}{{0, 0}, {1, 0}, {1, 1}} {
+			if statements[i].Parent().SpanID() != migrations[want.migration].SpanContext().SpanID() {
+				t.Errorf("expected statement span %d to be a child of migration %d", i, want.migration)
+			}
+			if v := spanAttribute(statements[i], "migrate.statement_index"); v.AsInt64() != int64(want.index) {
+				t.Errorf("expected statement span %d to have index %d, got %v", i, want.index, v.AsInt64())
+			}
+		}
+		if v := spanAttribute(statements[2], "db.rows_affected"); v.AsInt64() != 1 {
+			t.Errorf("expected the INSERT to affect 1 row, got %v", v.AsInt64())
+		}
+	})
+}
+
+// spanAttribute returns the value of the attribute key of span
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestWaitForVersion(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		ip, port, err := c.FirstPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := pgConnectionString(ip, port)
+		p := &Postgres{}
+		writer, err := p.Open(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := writer.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+		waiter, err := p.Open(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := waiter.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		// nothing applies version 3, so waiting times out
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if err := waiter.(*Postgres).WaitForVersion(ctx, 3); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+
+		errs := make(chan error, 1)
+		go func() {
+			time.Sleep(300 * time.Millisecond)
+			errs <- writer.SetVersion(3, false)
+		}()
+
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := waiter.(*Postgres).WaitForVersion(ctx, 3); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func Test_use(t *testing.T) {
+	p := &Postgres{}
+	if err := p.use(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.use(); !errors.Is(err, ErrDriverInUse) {
+		t.Fatalf("expected a concurrent call to fail with ErrDriverInUse, got %v", err)
+	}
+	p.done()
+
+	// calls of other goroutines succeed once the call returned
+	errs := make(chan error, 1)
+	go func() {
+		err := p.use()
+		if err == nil {
+			p.done()
+		}
+		errs <- err
+	}()
+	if err := <-errs; err != nil {
+		t.Fatalf("expected another goroutine's call to succeed, got %v", err)
+	}
+
+	// ending a transaction that doesn't hold inTx leaves it alone
+	p.endTx()
+	if !p.inTx.TryLock() {
+		t.Fatal("expected inTx to be free")
+	}
+	p.txHeld.Store(true)
+	p.endTx()
+	if !p.inTx.TryLock() {
+		t.Fatal("expected endTx to release inTx")
+	}
+}
+
+func Test_statementBatchSizeConflicts(t *testing.T) {
+	configs := map[string]*Config{
+		"Idempotent":      {Idempotent: true},
+		"IgnoreSQLStates": {IgnoreSQLStates: []string{"23505"}},
+		"RetryClassifier": {RetryClassifier: func(error, []byte, int) (bool, time.Duration) { return false, 0 }},
+		"Params":          {Params: map[string]interface{}{"cutoff": 1}},
+	}
+	for name, config := range configs {
+		config.MultiStatementEnabled, config.StatementBatchSize = true, 2
+		// the configuration is rejected before the transaction is used
+		if _, err := WithTx(context.Background(), nil, config); err == nil ||
+			!strings.Contains(err.Error(), "StatementBatchSize") {
+			t.Fatalf("expected StatementBatchSize with %s to be rejected, got %v", name, err)
+		}
+	}
+}
+
+func Test_computeLineFromPos(t *testing.T) {
+	testcases := []struct {
+		pos      int
+		wantLine uint
+		wantCol  uint
+		input    string
+		wantOk   bool
+	}{
+		{
+			15, 2, 6, "SELECT *\nFROM foo", true, // foo table does not exists
+		},
+		{
+			16, 3, 6, "SELECT *\n\nFROM foo", true, // foo table does not exists, empty line
+		},
+		{
+			25, 3, 7, "SELECT *\nFROM foo\nWHERE x", true, // x column error
+		},
+		{
+			27, 5, 7, "SELECT *\n\nFROM foo\n\nWHERE x", true, // x column error, empty lines
+		},
+		{
+			10, 2, 1, "SELECT *\nFROMM foo", true, // FROMM typo
+		},
+		{
+			11, 3, 1, "SELECT *\n\nFROMM foo", true, // FROMM typo, empty line
+		},
+		{
+			17, 2, 8, "SELECT *\nFROM foo", true, // last character
+		},
+		{
+			18, 0, 0, "SELECT *\nFROM foo", false, // invalid position
+		},
+	}
+	for i, tc := range testcases {
+		t.Run("tc"+strconv.Itoa(i), func(t *testing.T) {
+			run := func(crlf bool, nonASCII bool) {
+				var name string
+				if crlf {
+					name = "crlf"
+				} else {
+					name = "lf"
+				}
+				if nonASCII {
+					name += "-nonascii"
+				} else {
+					name += "-ascii"
+				}
+				t.Run(name, func(t *testing.T) {
+					input := tc.input
+					if crlf {
+						input = strings.Replace(input, "\n", "\r\n", -1)
+					}
+					if nonASCII {
+						input = strings.Replace(input, "FROM", "FRÖM", -1)
+					}
+					gotLine, gotCol, gotOK := computeLineFromPos(input, tc.pos)
+
+					if tc.wantOk {
+						t.Logf("pos %d, want %d:%d, %#v", tc.pos, tc.wantLine, tc.wantCol, input)
+					}
+
+					if gotOK != tc.wantOk {
+						t.Fatalf("expected ok %v but got %v", tc.wantOk, gotOK)
+					}
+					if gotLine != tc.wantLine {
+						t.Fatalf("expected line %d but got %d", tc.wantLine, gotLine)
+					}
+					if gotCol != tc.wantCol {
+						t.Fatalf("expected col %d but got %d", tc.wantCol, gotCol)
+					}
+				})
+			}
+			run(false, false)
+			run(true, false)
+			run(false, true)
+			run(true, true)
+		})
+	}
+}
+
+func Test_statementIndexAt(t *testing.T) {
+	testcases := []struct {
+		pos       int
+		wantIndex int
+		input     string
+	}{
+		{1, 0, "DROP TABLE a;"},
+		{12, 0, "DROP TABLE a;\nDROP TABLE b;"},
+		{38, 1, "DROP TABLE ä;\n-- comment;\nDROP TABLE b; DROP TABLE c;"},
+		{26, 1, "DROP TABLE a;\nDROP TABLE b;"},
+		{45, 2, "DROP TABLE ä;\n-- comment;\nDROP TABLE b; DROP TABLE c;"},
+		{0, -1, "DROP TABLE a;"},
+		{14, -1, "DROP TABLE a;"},
+	}
+	for i, tc := range testcases {
+		t.Run("tc"+strconv.Itoa(i), func(t *testing.T) {
+			if got := statementIndexAt([]byte(tc.input), tc.pos); got != tc.wantIndex {
+				t.Fatalf("expected statement %d at %d, got %d", tc.wantIndex, tc.pos, got)
+			}
+		})
+	}
+}
+
+func Test_isLockNotAvailable(t *testing.T) {
+	lockErr := &pq.Error{Code: "55P03"}
+	testcases := []struct {
+		err  error
+		want bool
+	}{
+		{lockErr, true},
+		{database.Error{OrigErr: lockErr, Err: "migration failed"}, true},
+		{database.Error{OrigErr: &pq.Error{Code: "42P01"}}, false},
+		{errors.New("55P03"), false},
+	}
+	for _, tc := range testcases {
+		if got := isLockNotAvailable(tc.err); got != tc.want {
+			t.Errorf("isLockNotAvailable(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func Test_bindParams(t *testing.T) {
+	params := map[string]interface{}{"cutoff": "2020-01-01", "id": 1}
+	testcases := []struct {
+		input     string
+		wantQuery string
+		wantArgs  []interface{}
+	}{
+		{"UPDATE a SET b = 1 WHERE created_at < @cutoff;",
+			"UPDATE a SET b = 1 WHERE created_at < $1;", []interface{}{"2020-01-01"}},
+		{"SELECT @id, @cutoff, @id;", "SELECT $1, $2, $1;", []interface{}{1, "2020-01-01"}},
+		{"SELECT '@cutoff', \"@id\" -- @id\n;", "SELECT '@cutoff', \"@id\" -- @id\n;", nil},
+		{"CREATE FUNCTION f() AS $body$ SELECT @id $body$;", "CREATE FUNCTION f() AS $body$ SELECT @id $body$;", nil},
+		{"SELECT @unknown, @@ -1, a @> b;", "SELECT @unknown, @@ -1, a @> b;", nil},
+		{"SELECT /* @cutoff /* @id */ @cutoff */ @id, @cutoff;", "SELECT /* @cutoff /* @id */ @cutoff */ $1, $2;",
+			[]interface{}{1, "2020-01-01"}},
+		{"SELECT @id /* @cutoff", "SELECT $1 /* @cutoff", []interface{}{1}},
+	}
+	for i, tc := range testcases {
+		t.Run("tc"+strconv.Itoa(i), func(t *testing.T) {
+			query, args := bindParams([]byte(tc.input), params)
+			if string(query) != tc.wantQuery || !reflect.DeepEqual(args, tc.wantArgs) {
+				t.Fatalf("expected %q %v, got %q %v", tc.wantQuery, tc.wantArgs, query, args)
+			}
+		})
+	}
+}
+
+func Test_transactionControl(t *testing.T) {
+	testcases := []struct {
+		input string
+		want  string
+	}{
+		{"CREATE TABLE a (id int);\nCOMMIT;\nCREATE TABLE b (id int);", "COMMIT;"},
+		{"BEGIN;\nCREATE TABLE a (id int);", "BEGIN;"},
+		{"CREATE TABLE a (id int);\n-- done\nrollback", "rollback\n;"},
+		{"SAVEPOINT s;\nCREATE TABLE a (id int);\nROLLBACK TO SAVEPOINT s;", ""},
+		{"DO $$ BEGIN PERFORM 1; END $$;", ""},
+		{"CREATE FUNCTION f() RETURNS int LANGUAGE sql BEGIN ATOMIC\n  SELECT 1;\nEND;\nSELECT f();", ""},
+		{"INSERT INTO a VALUES ('COMMIT;');", ""},
+	}
+	for i, tc := range testcases {
+		t.Run("tc"+strconv.Itoa(i), func(t *testing.T) {
+			got, err := transactionControl([]byte(tc.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_countStatements(t *testing.T) {
+	testcases := []struct {
+		input string
+		want  int
+	}{
+		{"UPDATE a SET b = 1;", 1},
+		{"CREATE TABLE a (id int); INSERT INTO a VALUES (';')", 2},
+		{"-- nothing to do\n", 0},
+	}
+	for i, tc := range testcases {
+		t.Run("tc"+strconv.Itoa(i), func(t *testing.T) {
+			if got := countStatements([]byte(tc.input)); got != tc.want {
+				t.Fatalf("expected %d statements, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_missingColumns(t *testing.T) {
+	all := make(map[string]bool)
+	for _, column := range VersionTableColumns {
+		all[column] = true
+	}
+	if err := missingColumns(`"public"."ledger"`, all); err != nil {
+		t.Fatal(err)
+	}
+	err := missingColumns(`"public"."ledger"`, map[string]bool{"version": true, "dirty": true, "info": true, "extra": true})
+	want := `migrations table "public"."ledger" lacks the columns id, created_at, updated_at, metadata, applied_by, run_id`
+	if err == nil || err.Error() != want {
+		t.Fatalf("expected %q, got %v", want, err)
+	}
+}
+
+func Test_skippable(t *testing.T) {
+	uniqueViolation := database.Error{OrigErr: &pq.Error{Code: "23505"}}
+	alreadyExists := database.Error{OrigErr: &pq.Error{Code: "42P07"}}
+	undefinedTable := database.Error{OrigErr: &pq.Error{Code: "42P01"}}
+	testcases := []struct {
+		config Config
+		err    error
+		ok     bool
+	}{
+		{config: Config{IgnoreSQLStates: []string{"23505"}}, err: uniqueViolation, ok: true},
+		{config: Config{IgnoreSQLStates: []string{"23503", " 23505"}}, err: uniqueViolation, ok: true},
+		{config: Config{IgnoreSQLStates: []string{"23505"}}, err: undefinedTable},
+		{config: Config{IgnoreSQLStates: []string{"23505"}}, err: alreadyExists},
+		{config: Config{IgnoreSQLStates: []string{"23505"}}, err: errors.New("not a postgres error")},
+		{config: Config{Idempotent: true}, err: alreadyExists, ok: true},
+		{config: Config{Idempotent: true}, err: uniqueViolation},
+	}
+	for i, tc := range testcases {
+		t.Run("tc"+strconv.Itoa(i), func(t *testing.T) {
+			p := &Postgres{config: &tc.config}
+			if _, ok := p.skippable(tc.err); ok != tc.ok {
+				t.Fatalf("expected skippable %v for %v, got %v", tc.ok, tc.err, ok)
+			}
+		})
+	}
+}
+
+func Test_deferForeignKeys(t *testing.T) {
+	migration := "CREATE TABLE orders (id int, user_id int);\n" +
+		"-- migrate:defer\n" +
+		"ALTER TABLE orders ADD FOREIGN KEY (user_id) REFERENCES users (id);\n" +
+		"INSERT INTO orders VALUES (1, 1)"
+	parser := &multistmt.Parser{DeferForeignKeys: true}
+	got, origins, err := deferForeignKeys(parser, []byte(migration))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "CREATE TABLE orders (id int, user_id int);\n" +
+		"INSERT INTO orders VALUES (1, 1)\n;\n" +
+		"ALTER TABLE orders ADD FOREIGN KEY (user_id) REFERENCES users (id);"
+	if string(got) != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	// each statement maps back to where it's written
+	alter := strings.Index(want, "ALTER")
+	if origin := origins[alter]; origin != strings.Index(migration, "ALTER") {
+		t.Fatalf("expected the deferred statement at %d, got %d", strings.Index(migration, "ALTER"), origin)
+	}
+
+	// migrations without the directive are left alone, comments included
+	migration = "-- orders of users\nCREATE TABLE orders (id int, user_id int);\n" +
+		"ALTER TABLE orders ADD FOREIGN KEY (user_id) REFERENCES users (id);"
+	got, origins, err = deferForeignKeys(parser, []byte(migration))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != migration || origins != nil {
+		t.Fatalf("expected the migration as is, got %q with origins %v", got, origins)
+	}
+}
+
+func Test_normalizeEncoding(t *testing.T) {
+	for _, name := range []string{"UTF8", "utf8", "UTF-8", " utf_8 "} {
+		if got := normalizeEncoding(name); got != "UTF8" {
+			t.Errorf("expected %q to normalize to UTF8, got %q", name, got)
+		}
+	}
+	if normalizeEncoding("LATIN1") == normalizeEncoding("UTF8") {
+		t.Error("expected LATIN1 not to match UTF8")
+	}
+}
+
+func Test_verifyDirectives(t *testing.T) {
+	migration := "-- @author: jane\n" +
+		"-- migrate:verify SELECT 1 FROM users WHERE email IS NULL\n" +
+		"--migrate:verify   SELECT count(*) > 0 FROM users  \n" +
+		"-- migrate:verify\n" +
+		"CREATE TABLE users (id int);\n" +
+		"-- migrate:verify SELECT 1 FROM ignored\n"
+	want := []string{"SELECT 1 FROM users WHERE email IS NULL", "SELECT count(*) > 0 FROM users"}
+	directives, _ := database.ParseDirectives([]byte(migration))
+	if got := verifyDirectives(directives); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func Test_isTransactionless(t *testing.T) {
+	testCases := []struct {
+		stmt string
+		want bool
+	}{
+		{stmt: "CREATE INDEX CONCURRENTLY users_email ON users (email)", want: true},
+		{stmt: "create unique index concurrently users_email ON users (email)", want: true},
+		{stmt: "DROP INDEX CONCURRENTLY users_email", want: true},
+		{stmt: "REINDEX INDEX CONCURRENTLY users_email", want: true},
+		{stmt: "REINDEX (VERBOSE) TABLE CONCURRENTLY users", want: true},
+		{stmt: "REINDEX DATABASE app", want: true},
+		{stmt: "VACUUM", want: true},
+		{stmt: "-- reclaim space\nVACUUM (ANALYZE) users", want: true},
+		{stmt: "ALTER TYPE mood ADD VALUE 'happy'", want: true},
+		{stmt: "ALTER TYPE public.mood ADD VALUE IF NOT EXISTS 'sad' AFTER 'happy'", want: true},
+		{stmt: "CREATE DATABASE app", want: true},
+		{stmt: "DROP DATABASE app", want: true},
+		{stmt: "CREATE TABLESPACE fast LOCATION '/ssd'", want: true},
+		{stmt: "ALTER SYSTEM SET work_mem = '64MB'", want: true},
+		{stmt: "CREATE INDEX users_email ON users (email)", want: false},
+		{stmt: "CREATE INDEX concurrently_built ON users (email)", want: false},
+		{stmt: "REINDEX TABLE users", want: false},
+		{stmt: "ALTER TYPE mood RENAME VALUE 'sad' TO 'blue'", want: false},
+		{stmt: "ALTER TABLE users ADD COLUMN value text", want: false},
+		{stmt: "-- VACUUM\nANALYZE users", want: false},
+	}
+	for _, tc := range testCases {
+		if got := isTransactionless([]byte(tc.stmt)); got != tc.want {
+			t.Errorf("expected isTransactionless(%q) to be %v", tc.stmt, tc.want)
+		}
+	}
+}
+
+func Test_transactionlessStatement(t *testing.T) {
+	testCases := []struct {
+		name      string
+		migration string
+		wantStmt  string
+		wantMixed bool
+	}{
+		{name: "none", migration: "CREATE TABLE users (id int);\nCREATE INDEX users_id ON users (id);"},
+		{name: "dedicated", migration: "-- @author: jane\nCREATE INDEX CONCURRENTLY users_id ON users (id);\nVACUUM users",
+			wantStmt: "CREATE INDEX CONCURRENTLY users_id ON users (id);"},
+		{name: "mixed", migration: "CREATE TABLE users (id int);\nCREATE INDEX CONCURRENTLY users_id ON users (id);",
+			wantStmt: "CREATE INDEX CONCURRENTLY users_id ON users (id);", wantMixed: true},
+		{name: "quoted", migration: "INSERT INTO notes VALUES ('VACUUM;');"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stmt, mixed, err := transactionlessStatement([]byte(tc.migration))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(stmt) != tc.wantStmt || mixed != tc.wantMixed {
+				t.Fatalf("expected %q mixed %v, got %q mixed %v", tc.wantStmt, tc.wantMixed, stmt, mixed)
+			}
+		})
+	}
+}
+
+func Test_auditCompress(t *testing.T) {
+	var audit bytes.Buffer
+	p := &Postgres{config: &Config{AuditWriter: &audit, AuditCompress: true}, version: 3}
+	for _, stmt := range []string{"CREATE TABLE audited (id int);", "INSERT INTO audited VALUES (1);"} {
+		if err := p.audit([]byte(stmt)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readStatements := func(t *testing.T, compressed []byte) ([]string, error) {
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(zr)
+		var statements []string
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			if !strings.HasPrefix(line, "-- version 3 at ") {
+				statements = append(statements, line)
+			}
+		}
+		return statements, err
+	}
+	want := []string{"CREATE TABLE audited (id int);", "INSERT INTO audited VALUES (1);"}
+
+	// a run failing before it ends leaves a stream without its trailer, the
+	// statements flushed so far still decompress
+	statements, err := readStatements(t, audit.Bytes())
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected the unterminated stream to end unexpectedly, got %v", err)
+	}
+	if !reflect.DeepEqual(statements, want) {
+		t.Fatalf("expected %q, got %q", want, statements)
+	}
+
+	if err := p.closeAudit(); err != nil {
+		t.Fatal(err)
+	}
+	if statements, err = readStatements(t, audit.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(statements, want) {
+		t.Fatalf("expected %q, got %q", want, statements)
+	}
+}
+
+func Test_connectHookEmpty(t *testing.T) {
+	// the statements are validated before the connection is used
+	_, err := newPostgres(context.Background(), &Postgres{config: &Config{
+		ConnectHook: []string{"SET application_name = 'migrate'", " \n"},
+	}})
+	if err == nil || err.Error() != "ConnectHook statement 1 is empty" {
+		t.Fatalf("expected the empty statement to be rejected, got %v", err)
+	}
+}
+
+func Test_isTableCreationConflict(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "deadlock", err: &database.Error{OrigErr: &pq.Error{Code: "40P01"}}, want: true},
+		{name: "catalog unique violation", err: &database.Error{OrigErr: &pq.Error{Code: "23505"}}, want: true},
+		{name: "duplicate table", err: &database.Error{OrigErr: &pq.Error{Code: "42P07"}}, want: true},
+		{name: "wrapped twice", err: &database.Error{OrigErr: &database.Error{OrigErr: &pq.Error{Code: "40P01"}}}, want: true},
+		{name: "insufficient privilege", err: &database.Error{OrigErr: &pq.Error{Code: "42501"}}, want: false},
+		{name: "not a Postgres error", err: errors.New("connection refused"), want: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isTableCreationConflict(tc.err); got != tc.want {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_retryTableCreation(t *testing.T) {
+	deadlock := &database.Error{OrigErr: &pq.Error{Code: "40P01"}}
+	testCases := []struct {
+		name         string
+		retries      int
+		err          error
+		wantAttempts int
+	}{
+		{name: "default retries", retries: 0, err: deadlock, wantAttempts: DefaultTableCreateRetries + 1},
+		{name: "configured retries", retries: 1, err: deadlock, wantAttempts: 2},
+		{name: "disabled", retries: -1, err: deadlock, wantAttempts: 1},
+		{name: "other errors", retries: 5, err: &database.Error{OrigErr: &pq.Error{Code: "42501"}}, wantAttempts: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Postgres{config: &Config{TableCreateRetries: tc.retries}}
+			attempts := 0
+			err := p.retryTableCreation(func() error {
+				attempts++
+				return tc.err
+			})
+			if err != tc.err {
+				t.Fatalf("expected the last attempt's error, got %v", err)
+			}
+			if attempts != tc.wantAttempts {
+				t.Fatalf("expected %v attempts, got %v", tc.wantAttempts, attempts)
+			}
+		})
+	}
+
+	// a conflict resolved by a retry succeeds
+	p := &Postgres{config: &Config{}}
+	attempts := 0
+	if err := p.retryTableCreation(func() error {
+		if attempts++; attempts == 1 {
+			return deadlock
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
 }
@@ -1,9 +1,11 @@
 package stub
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"reflect"
+	"sort"
 
 	"go.uber.org/atomic"
 
@@ -21,6 +23,7 @@ type Stub struct {
 	MigrationSequence []string
 	LastRunMigration  []byte // todo: make []string
 	IsDirty           bool
+	Applied           []uint
 	isLocked          atomic.Bool
 
 	Config *Config
@@ -77,9 +80,26 @@ func (s *Stub) Run(migration io.Reader) error {
 func (s *Stub) SetVersion(version int, state bool) error {
 	s.CurrentVersion = version
 	s.IsDirty = state
+	if !state && version >= 0 {
+		for _, v := range s.Applied {
+			if v == uint(version) {
+				return nil
+			}
+		}
+		s.Applied = append(s.Applied, uint(version))
+		sort.Slice(s.Applied, func(i, j int) bool { return s.Applied[i] < s.Applied[j] })
+	}
 	return nil
 }
 
+func (s *Stub) AppliedVersions() ([]uint, error) {
+	return s.Applied, nil
+}
+
+func (s *Stub) SetVersionStatement(version int, dirty bool) string {
+	return fmt.Sprintf("SET VERSION %v DIRTY %v;", version, dirty)
+}
+
 func (s *Stub) Version() (*database.Version, error) {
 	return &database.Version{Version: s.CurrentVersion, Dirty: s.IsDirty, Info: "", Schema: ""}, nil
 }
@@ -89,6 +109,7 @@ const DROP = "DROP"
 func (s *Stub) Drop() error {
 	s.CurrentVersion = database.NilVersion
 	s.LastRunMigration = nil
+	s.Applied = nil
 	s.MigrationSequence = append(s.MigrationSequence, DROP)
 	return nil
 }
@@ -4,6 +4,7 @@
 package testing
 
 import (
+	"errors"
 	"testing"
 )
 
@@ -26,6 +27,46 @@ func TestMigrateDrop(t *testing.T, m *migrate.Migrate) {
 	}
 }
 
+// TestReversibility applies all up migrations, then all down migrations, and
+// fails if the schema objects differ from before, i.e. a down migration
+// doesn't reverse its up migration. The database must be at NilVersion and
+// its driver implement database.Cataloger, the test is skipped otherwise.
+func TestReversibility(t *testing.T, m *migrate.Migrate) {
+	before, err := m.Catalog()
+	if errors.Is(err, migrate.ErrNoCatalog) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		t.Fatal(err)
+	}
+	if err := m.Down(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		t.Fatal(err)
+	}
+
+	after, err := m.Catalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining := make(map[string]bool, len(before))
+	for _, object := range before {
+		remaining[object] = true
+	}
+	for _, object := range after {
+		if remaining[object] {
+			delete(remaining, object)
+			continue
+		}
+		t.Errorf("Reversibility: %s was left behind by the migrations", object)
+	}
+	for object := range remaining {
+		t.Errorf("Reversibility: %s was removed by the migrations", object)
+	}
+}
+
 func TestMigrateUp(t *testing.T, m *migrate.Migrate) {
 	t.Log("UP")
 	if err := m.Up(); err != nil {
@@ -0,0 +1,74 @@
+package migrate
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/getoutreach/migrate/v4/database"
+)
+
+// NoLockDirective in a leading comment of a migration, i.e.
+// `-- migrate:no-lock`, releases the database lock while the migration runs,
+// e.g. for long running index builds that shouldn't block other deploys. The
+// lock is acquired again before the migration's version is recorded clean.
+// Other migrate processes can acquire the lock meanwhile and see the version
+// before the migration or, with drivers running the migration outside of a
+// transaction, e.g. postgres for `CREATE INDEX CONCURRENTLY`, its dirty
+// version.
+const NoLockDirective = "migrate:no-lock"
+
+// IsolationLevelDirective in a leading comment of a migration, e.g.
+// `-- migrate:isolation-level serializable`, begins the migration's
+// transaction at that isolation level instead of the driver's default. The
+// driver must implement database.IsolationBeginner.
+const IsolationLevelDirective = "migrate:isolation-level"
+
+// NoopDirective as the only content of a migration, besides other comments,
+// i.e. `-- migrate:noop`, records the migration's version without running
+// anything, e.g. to reserve a version for a migration moved elsewhere. Without
+// it, migrations without statements fail with ErrEmptyMigration.
+const NoopDirective = "migrate:noop"
+
+// directivePeekSize is how much of the start of a migration is searched for
+// directives
+const directivePeekSize = 4096
+
+// peekDirectives returns the directives in the leading comment lines of r,
+// without consuming r, and a reader with all of r's contents. empty is true if
+// r has nothing but blank and comment lines.
+func peekDirectives(r io.Reader) (directives []database.Directive, empty bool, body io.Reader, err error) {
+	br := bufio.NewReaderSize(r, directivePeekSize)
+	head, err := br.Peek(directivePeekSize)
+	if err != nil && err != io.EOF {
+		return nil, false, nil, err
+	}
+
+	// a head filling the peek may be followed by statements
+	directives, commentsOnly := database.ParseDirectives(head)
+	return directives, err == io.EOF && commentsOnly, br, nil
+}
+
+// beginDirectives begins the transaction of a migration, at the isolation
+// level of its directives if they set one
+func (m *Migrate) beginDirectives(directives []database.Directive) error {
+	d, ok := database.LookupDirective(directives, IsolationLevelDirective)
+	if !ok {
+		return m.databaseDrv.Begin()
+	}
+	level, err := database.ParseIsolationLevel(d.Arg)
+	if err != nil {
+		return fmt.Errorf("invalid %s directive: %w", IsolationLevelDirective, err)
+	}
+	beginner, ok := m.databaseDrv.(database.IsolationBeginner)
+	if !ok {
+		return fmt.Errorf("the database driver doesn't support the %s directive", IsolationLevelDirective)
+	}
+	return beginner.BeginIsolation(level)
+}
+
+// hasDirective reports whether a directive named name is in directives
+func hasDirective(directives []database.Directive, name string) bool {
+	_, ok := database.LookupDirective(directives, name)
+	return ok
+}
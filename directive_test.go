@@ -0,0 +1,73 @@
+package migrate
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/getoutreach/migrate/v4/database/mock"
+	sStub "github.com/getoutreach/migrate/v4/source/stub"
+)
+
+func TestPeekDirectives(t *testing.T) {
+	directives, empty, body, err := peekDirectives(strings.NewReader("-- migrate:noop\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !empty || !hasDirective(directives, NoopDirective) {
+		t.Fatalf("expected an empty migration with the %s directive, got %v %v", NoopDirective, directives, empty)
+	}
+	if b, err := io.ReadAll(body); err != nil || string(b) != "-- migrate:noop\n" {
+		t.Fatalf("expected the whole migration to be read, got %q %v", b, err)
+	}
+
+	// only the end of the migration means it's empty, other errors are
+	// returned
+	failure := errors.New("connection reset")
+	r := io.MultiReader(strings.NewReader("-- migrate:noop\n"), iotest.ErrReader(failure))
+	if _, _, _, err := peekDirectives(r); !errors.Is(err, failure) {
+		t.Fatalf("expected the error reading the migration, got %v", err)
+	}
+}
+
+func TestIsolationLevelDirective(t *testing.T) {
+	db := mock.New()
+	srcDrv, _ := sStub.WithInstance(nil, &sStub.Config{})
+	m, err := NewWithInstance("stub", srcDrv, "mock", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newMigration := func(body string, version uint) *Migration {
+		migr, err := NewMigration(io.NopCloser(strings.NewReader(body)), body, version, int(version))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return migr
+	}
+
+	if err := m.Run(newMigration("CREATE 1", 1),
+		newMigration("-- migrate:isolation-level serializable\nUPDATE 2", 2)); err != nil {
+		t.Fatal(err)
+	}
+	var begins []string
+	for _, call := range db.Calls {
+		if strings.HasPrefix(call, "Begin") {
+			begins = append(begins, call)
+		}
+	}
+	if want := []string{"Begin", "BeginIsolation(Serializable)"}; !reflect.DeepEqual(begins, want) {
+		t.Fatalf("expected transactions begun with %v, got %v", want, begins)
+	}
+
+	// an unknown level fails the migration before its transaction begins
+	err = m.Run(newMigration("-- migrate:isolation-level snapshot\nUPDATE 3", 3))
+	if err == nil || !strings.Contains(err.Error(), IsolationLevelDirective) {
+		t.Fatalf("expected the invalid directive to be reported, got %v", err)
+	}
+	if db.CurrentVersion != 2 {
+		t.Fatalf("expected version 2 to stay current, got %v", db.CurrentVersion)
+	}
+}
@@ -0,0 +1,198 @@
+package migrate
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultEventBufferSize is the number of events the channel returned by
+// Events buffers with EventsDrop, unless EventBufferSize is set
+const DefaultEventBufferSize = 64
+
+// EventKind is the kind of an Event
+type EventKind string
+
+const (
+	// EventStart is sent when a migration starts
+	EventStart EventKind = "start"
+	// EventFinish is sent when a migration was applied
+	EventFinish EventKind = "finish"
+	// EventError is sent when the run fails, before the channel is closed
+	EventError EventKind = "error"
+)
+
+// Event reports the progress of a run of migrations, see Migrate.Events.
+type Event struct {
+	Kind EventKind
+	// Version, TargetVersion and Identifier are those of the migration, zero
+	// for errors that don't come from a migration
+	Version       uint
+	TargetVersion int
+	Identifier    string
+	// Duration is how long the migration took, for EventFinish
+	Duration time.Duration
+	// Err is the error the run failed with, for EventError
+	Err error
+	// Time is when the event happened
+	Time time.Time
+	// RunID identifies the run, empty unless the database driver identifies
+	// its runs, see database.RunIdentifier
+	RunID string
+}
+
+// EventPolicy is what a run does with the events the consumer of Events is
+// too slow to receive. Either way the run never waits for the consumer.
+type EventPolicy int
+
+const (
+	// EventsBuffer queues the events without bound until they're received
+	EventsBuffer EventPolicy = iota
+	// EventsDrop drops the events that don't fit in the channel's buffer of
+	// EventBufferSize events
+	EventsDrop
+)
+
+// Events returns a channel receiving the events of the next run applying
+// migrations, e.g. Up, Down or Steps, which is closed once the run returns,
+// e.g. to stream its progress to a UI. Runs failing before applying any
+// migration, e.g. on a dirty database, or with nothing to apply close it
+// without events. The run doesn't wait for the channel to be received from,
+// see EventPolicy. Calling Events again before the run starts closes the
+// channel returned before. Close drops the events not received yet.
+func (m *Migrate) Events() <-chan Event {
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+	m.events.close()
+	if m.eventsDone == nil {
+		m.eventsDone = make(chan struct{})
+	}
+	m.events = newEventStream(m.EventPolicy, m.EventBufferSize, m.eventsDone)
+	return m.events.out
+}
+
+// takeEvents returns the stream of the run starting, nil if there's none
+func (m *Migrate) takeEvents() *eventStream {
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+	events := m.events
+	m.events = nil
+	return events
+}
+
+// startEvents takes the stream of the run starting for runMigrations to send
+// the run's events to. The function returned closes it, to be deferred by the
+// methods running migrations so it's closed however early they return.
+func (m *Migrate) startEvents() func() {
+	events := m.takeEvents()
+	m.runEvents = events
+	return func() {
+		m.runEvents = nil
+		events.close()
+	}
+}
+
+// closeEvents closes the stream of the next run and drops the events of the
+// streams of past runs not received yet, see Close
+func (m *Migrate) closeEvents() {
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+	m.events.close()
+	m.events = nil
+	if m.eventsDone != nil {
+		close(m.eventsDone)
+		m.eventsDone = nil
+	}
+}
+
+// eventStream sends the events of a run to the channel returned by Events
+// without blocking the run. Its methods do nothing on a nil stream.
+type eventStream struct {
+	out    chan Event
+	policy EventPolicy
+	// done is closed when the queued events are dropped, e.g. because
+	// nothing will receive them
+	done <-chan struct{}
+
+	// queue holds the events of EventsBuffer not received yet
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []Event
+	closed bool
+}
+
+func newEventStream(policy EventPolicy, size int, done <-chan struct{}) *eventStream {
+	s := &eventStream{policy: policy, done: done}
+	if policy == EventsDrop {
+		if size <= 0 {
+			size = DefaultEventBufferSize
+		}
+		s.out = make(chan Event, size)
+		return s
+	}
+	s.out = make(chan Event)
+	s.cond = sync.NewCond(&s.mu)
+	go s.forward()
+	return s
+}
+
+// send sends e, queuing or dropping it if the consumer isn't ready for it
+func (s *eventStream) send(e Event) {
+	if s == nil {
+		return
+	}
+	e.Time = time.Now()
+	if s.policy == EventsDrop {
+		select {
+		case s.out <- e:
+		default:
+		}
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append(s.queue, e)
+	s.cond.Signal()
+}
+
+// close closes the channel once the events queued were received, it may be
+// called more than once
+func (s *eventStream) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.policy == EventsDrop {
+		close(s.out)
+		return
+	}
+	s.cond.Signal()
+}
+
+// forward sends the queued events to the channel, closing it once the stream
+// is closed and the queue is empty, or once done is closed
+func (s *eventStream) forward() {
+	defer close(s.out)
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		e := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+		select {
+		case s.out <- e:
+		case <-s.done:
+			return
+		}
+	}
+}
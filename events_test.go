@@ -0,0 +1,241 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getoutreach/migrate/v4/database/mock"
+	"github.com/getoutreach/migrate/v4/source"
+	sStub "github.com/getoutreach/migrate/v4/source/stub"
+)
+
+func newEventsMigrate(t *testing.T, db *mock.Mock) *Migrate {
+	migrations := source.NewMigrations()
+	for _, v := range []uint{1, 2, 3} {
+		migrations.Append(&source.Migration{Version: v, Direction: source.Up, Identifier: "CREATE"})
+	}
+	srcDrv, _ := sStub.WithInstance(nil, &sStub.Config{})
+	srcDrv.(*sStub.Stub).Migrations = migrations
+	m, err := NewWithInstance("stub", srcDrv, "mock", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// collect receives the events of ch until it's closed, in a goroutine
+func collect(ch <-chan Event) <-chan []Event {
+	done := make(chan []Event, 1)
+	go func() {
+		var events []Event
+		for e := range ch {
+			events = append(events, e)
+		}
+		done <- events
+	}()
+	return done
+}
+
+// kinds returns the kind and version of each event
+func kinds(events []Event) []string {
+	var got []string
+	for _, e := range events {
+		got = append(got, fmt.Sprintf("%s %d", e.Kind, e.Version))
+	}
+	return got
+}
+
+func TestEvents(t *testing.T) {
+	db := mock.New()
+	m := newEventsMigrate(t, db)
+
+	done := collect(m.Events())
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	events := <-done
+	want := []string{
+		"start 1", "finish 1",
+		"start 2", "finish 2",
+		"start 3", "finish 3",
+	}
+	if got := kinds(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected events %v, got %v", want, got)
+	}
+	for _, e := range events {
+		if e.Time.IsZero() {
+			t.Fatalf("expected the time of event %+v", e)
+		}
+	}
+
+	// Up closes the channel when there's nothing to apply
+	done = collect(m.Events())
+	if err := m.Up(); !errors.Is(err, ErrNoChange) {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+	if events := <-done; len(events) != 0 {
+		t.Fatalf("expected no events, got %v", kinds(events))
+	}
+}
+
+func TestEventsError(t *testing.T) {
+	db := mock.New()
+	failed := errors.New("failed")
+	runs := 0
+	db.RunErr = func(string) error {
+		if runs++; runs == 2 {
+			return failed
+		}
+		return nil
+	}
+	m := newEventsMigrate(t, db)
+
+	done := collect(m.Events())
+	if err := m.Up(); !errors.Is(err, failed) {
+		t.Fatalf("expected the migration's error, got %v", err)
+	}
+	events := <-done
+	want := []string{"start 1", "finish 1", "start 2", "error 2"}
+	if got := kinds(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected events %v, got %v", want, got)
+	}
+	if last := events[len(events)-1]; !errors.Is(last.Err, failed) {
+		t.Fatalf("expected the error event to carry the error, got %v", last.Err)
+	}
+}
+
+func TestEventsSlowConsumer(t *testing.T) {
+	testCases := []struct {
+		name       string
+		policy     EventPolicy
+		wantEvents int
+	}{
+		{name: "buffer", policy: EventsBuffer, wantEvents: 6},
+		{name: "drop", policy: EventsDrop, wantEvents: 2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newEventsMigrate(t, mock.New())
+			m.EventPolicy = tc.policy
+			m.EventBufferSize = 2
+
+			// nothing receives the events until the run completed
+			ch := m.Events()
+			if err := m.Up(); err != nil {
+				t.Fatal(err)
+			}
+			if events := <-collect(ch); len(events) != tc.wantEvents {
+				t.Fatalf("expected %v events, got %v", tc.wantEvents, kinds(events))
+			}
+		})
+	}
+}
+
+func TestEventsEarlyFailure(t *testing.T) {
+	db := mock.New()
+	m := newEventsMigrate(t, db)
+	db.CurrentVersion, db.Dirty = 1, true
+
+	// the runs failing before applying a migration close the channel too
+	runs := map[string]func() error{
+		"up":      m.Up,
+		"down":    m.Down,
+		"steps":   func() error { return m.Steps(0) },
+		"migrate": func() error { return m.Migrate(2) },
+	}
+	for name, run := range runs {
+		done := collect(m.Events())
+		if err := run(); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+		select {
+		case events := <-done:
+			if len(events) != 0 {
+				t.Fatalf("%s: expected no events, got %v", name, kinds(events))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: expected the channel to be closed", name)
+		}
+	}
+}
+
+func TestEventsClose(t *testing.T) {
+	m := newEventsMigrate(t, mock.New())
+
+	// nothing ever receives the events, Close stops forwarding them
+	ch := m.Events()
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-collect(ch):
+	case <-time.After(time.Second):
+		t.Fatal("expected the channel to be closed")
+	}
+}
+
+// identifiedMock is a database identifying its runs
+type identifiedMock struct {
+	*mock.Mock
+}
+
+func (identifiedMock) RunID() string {
+	return "run-1"
+}
+
+// recordingLogger records the lines logged
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Verbose() bool {
+	return false
+}
+
+func TestEventsRunID(t *testing.T) {
+	migrations := source.NewMigrations()
+	for _, v := range []uint{1, 2} {
+		migrations.Append(&source.Migration{Version: v, Direction: source.Up, Identifier: "CREATE"})
+	}
+	srcDrv, _ := sStub.WithInstance(nil, &sStub.Config{})
+	srcDrv.(*sStub.Stub).Migrations = migrations
+	m, err := NewWithInstance("stub", srcDrv, "mock", identifiedMock{mock.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := &recordingLogger{}
+	m.Log = logger
+
+	done := collect(m.Events())
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	events := <-done
+	if len(events) != 4 {
+		t.Fatalf("expected a start and finish event per migration, got %v", kinds(events))
+	}
+	for _, e := range events {
+		if e.RunID != "run-1" {
+			t.Fatalf("expected the run id on %s %d, got %q", e.Kind, e.Version, e.RunID)
+		}
+	}
+	if len(logger.lines) != 2 {
+		t.Fatalf("expected a line per migration, got %q", logger.lines)
+	}
+	for _, line := range logger.lines {
+		if !strings.Contains(line, "in run run-1") {
+			t.Fatalf("expected the run id in %q", line)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package migrate
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/getoutreach/migrate/v4/database"
+	"github.com/getoutreach/migrate/v4/source"
+)
+
+// InlineMigration is a migration given as SQL instead of being read from a
+// source, see RunInline.
+type InlineMigration struct {
+	// Version is the version the migration migrates to
+	Version uint
+	// Up are the statements of the migration
+	Up string
+}
+
+// RunInline applies migrations to the database of driver without a source,
+// e.g. for tiny tools embedding a handful of statements. Their versions must
+// ascend. It runs Up with them as the source: the migrations up to the
+// database's version, which must be nil or one of theirs, are skipped, the
+// others are run in order while the database is locked, each in a
+// transaction of its own with its version. It returns ErrNoChange if they
+// were all applied already and ErrDirty if the database is dirty. driver
+// isn't closed.
+func RunInline(driver database.Driver, migrations []InlineMigration) error {
+	src := &inlineSource{migrations: source.NewMigrations(), up: make(map[uint]string)}
+	for i, migr := range migrations {
+		if i > 0 && migr.Version <= migrations[i-1].Version {
+			return fmt.Errorf("inline migration versions must ascend, %v follows %v",
+				migr.Version, migrations[i-1].Version)
+		}
+		src.migrations.Append(&source.Migration{Version: migr.Version, Identifier: "inline", Direction: source.Up})
+		src.up[migr.Version] = migr.Up
+	}
+
+	m, err := NewWithInstance("inline", src, "", driver)
+	if err != nil {
+		return err
+	}
+	m.AllowEmptySource = true
+	return m.Up()
+}
+
+// inlineSource is the source.Driver serving the migrations of RunInline from
+// memory
+type inlineSource struct {
+	migrations *source.Migrations
+	up         map[uint]string
+}
+
+func (s *inlineSource) Open(url string) (source.Driver, error) {
+	return nil, fmt.Errorf("inline migrations can't be opened from %q", url)
+}
+
+func (s *inlineSource) Close() error {
+	return nil
+}
+
+func (s *inlineSource) First() (uint, error) {
+	v, ok := s.migrations.First()
+	if !ok {
+		return 0, source.ErrNoMigrations{Path: "inline"}
+	}
+	return v, nil
+}
+
+func (s *inlineSource) Prev(version uint) (uint, error) {
+	v, ok := s.migrations.Prev(version)
+	if !ok {
+		return 0, &os.PathError{Op: fmt.Sprintf("prev for version %v", version), Path: "inline", Err: os.ErrNotExist}
+	}
+	return v, nil
+}
+
+func (s *inlineSource) Next(version uint) (uint, error) {
+	v, ok := s.migrations.Next(version)
+	if !ok {
+		return 0, &os.PathError{Op: fmt.Sprintf("next for version %v", version), Path: "inline", Err: os.ErrNotExist}
+	}
+	return v, nil
+}
+
+func (s *inlineSource) ReadUp(version uint) (io.ReadCloser, string, error) {
+	if m, ok := s.migrations.Up(version); ok {
+		return ioutil.NopCloser(strings.NewReader(s.up[version])), m.Identifier, nil
+	}
+	return nil, "", &os.PathError{Op: fmt.Sprintf("read up version %v", version), Path: "inline", Err: os.ErrNotExist}
+}
+
+func (s *inlineSource) ReadDown(version uint) (io.ReadCloser, string, error) {
+	return nil, "", &os.PathError{Op: fmt.Sprintf("read down version %v", version), Path: "inline", Err: os.ErrNotExist}
+}
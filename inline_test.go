@@ -0,0 +1,50 @@
+package migrate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/getoutreach/migrate/v4/database/mock"
+)
+
+func TestRunInline(t *testing.T) {
+	db := mock.New()
+	migrations := []InlineMigration{
+		{Version: 1, Up: "CREATE 1"},
+		{Version: 2, Up: "CREATE 2"},
+	}
+	if err := RunInline(db, migrations); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Version", "Lock", "Version",
+		"Begin", "SetVersion(1, true)", "Run(CREATE 1)", "SetVersion(1, false)", "Commit",
+		"Begin", "SetVersion(2, true)", "Run(CREATE 2)", "SetVersion(2, false)", "Commit",
+		"Unlock",
+	}
+	if !reflect.DeepEqual(db.Calls, want) {
+		t.Fatalf("expected calls %v, got %v", want, db.Calls)
+	}
+	if err := RunInline(db, migrations); !errors.Is(err, ErrNoChange) {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+
+	// only the migration after the database's version runs, its failure
+	// rolls it back with its version
+	failed := errors.New("failed")
+	db.RunErr = func(string) error { return failed }
+	if err := RunInline(db, append(migrations, InlineMigration{Version: 3, Up: "CREATE 3"})); !errors.Is(err, failed) {
+		t.Fatalf("expected the migration's error, got %v", err)
+	}
+	if want := []string{"CREATE 1", "CREATE 2"}; !reflect.DeepEqual(db.Applied, want) || db.CurrentVersion != 2 {
+		t.Fatalf("expected %v applied up to version 2, got %v up to version %v", want, db.Applied, db.CurrentVersion)
+	}
+
+	if err := RunInline(db, nil); !errors.Is(err, ErrNoChange) {
+		t.Fatalf("expected ErrNoChange without migrations, got %v", err)
+	}
+	if err := RunInline(db, []InlineMigration{{Version: 2}, {Version: 1}}); err == nil {
+		t.Fatal("expected descending versions to fail")
+	}
+}
@@ -0,0 +1,141 @@
+package migrate
+
+import (
+	"bytes"
+
+	"github.com/getoutreach/migrate/v4/database/multistmt"
+	"github.com/getoutreach/migrate/v4/source"
+)
+
+// Rules of the findings Lint returns.
+const (
+	// LintCreateTable flags CREATE TABLE without IF NOT EXISTS
+	LintCreateTable = "create-table-if-not-exists"
+	// LintCreateIndex flags CREATE INDEX without IF NOT EXISTS
+	LintCreateIndex = "create-index-if-not-exists"
+	// LintDrop flags DROP without IF EXISTS
+	LintDrop = "drop-if-exists"
+)
+
+// LintFinding is a statement of a migration breaking a rule of Lint.
+type LintFinding struct {
+	Version   uint
+	Direction source.Direction
+	// Statement is the statement, without its terminating ';'
+	Statement string
+	// Rule is the id of the rule the statement breaks, e.g. LintDrop
+	Rule string
+}
+
+// Lint checks that the statements of the migrations in the source are
+// idempotent, i.e. that CREATE TABLE and CREATE INDEX use IF NOT EXISTS and
+// DROP uses IF EXISTS, and returns the statements that aren't. It only reads
+// the source, no database is needed.
+func Lint(sourceURL string) ([]LintFinding, error) {
+	r, err := NewSourceOnly(sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var findings []LintFinding
+	err = r.Each(func(version uint, up, down []byte) error {
+		for _, m := range []struct {
+			direction source.Direction
+			body      []byte
+		}{{source.Up, up}, {source.Down, down}} {
+			if m.body == nil {
+				continue
+			}
+			// the parser only emits terminated statements, terminate the last
+			// one in case the migration doesn't
+			body := append(m.body[:len(m.body):len(m.body)], "\n;"...)
+			if err := multistmt.Parse(bytes.NewReader(body), nil, 0, "", func(stmt []byte) error {
+				if rule := lintStatement(stmt); rule != "" {
+					findings = append(findings, LintFinding{
+						Version:   version,
+						Direction: m.direction,
+						Statement: string(bytes.TrimSpace(bytes.TrimSuffix(bytes.TrimSpace(stmt), []byte(";")))),
+						Rule:      rule,
+					})
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return findings, nil
+}
+
+// lintStatement returns the rule stmt breaks, empty if it breaks none
+func lintStatement(stmt []byte) string {
+	if multistmt.ClassifyStatement(stmt) != multistmt.StatementDDL {
+		return ""
+	}
+	// long enough for e.g. DROP TEXT SEARCH CONFIGURATION IF EXISTS
+	words := multistmt.StatementKeywords(stmt, 8)
+	if len(words) == 0 {
+		return ""
+	}
+	switch words[0] {
+	case "CREATE":
+		i := 1
+		for i < len(words) && createModifiers[words[i]] {
+			i++
+		}
+		if i >= len(words) {
+			return ""
+		}
+		var rule string
+		switch words[i] {
+		case "TABLE":
+			rule = LintCreateTable
+		case "INDEX":
+			rule = LintCreateIndex
+			if i+1 < len(words) && words[i+1] == "CONCURRENTLY" {
+				i++
+			}
+		default:
+			return ""
+		}
+		if !hasWords(words[i+1:], "IF", "NOT", "EXISTS") {
+			return rule
+		}
+	case "DROP":
+		for i := 1; i < len(words); i++ {
+			if hasWords(words[i:], "IF", "EXISTS") {
+				return ""
+			}
+		}
+		return LintDrop
+	}
+	return ""
+}
+
+// createModifiers are the words between CREATE and TABLE or INDEX
+var createModifiers = map[string]bool{
+	"GLOBAL":    true,
+	"LOCAL":     true,
+	"TEMP":      true,
+	"TEMPORARY": true,
+	"UNLOGGED":  true,
+	"UNIQUE":    true,
+}
+
+// hasWords reports whether words starts with prefix
+func hasWords(words []string, prefix ...string) bool {
+	if len(words) < len(prefix) {
+		return false
+	}
+	for i, w := range prefix {
+		if words[i] != w {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package migrate
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/getoutreach/migrate/v4/source"
+)
+
+func TestLint(t *testing.T) {
+	dir := t.TempDir()
+	for name, body := range map[string]string{
+		// compliant
+		"1_users.up.sql": "CREATE TABLE IF NOT EXISTS users (id int);\n" +
+			"CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS users_id ON users (id);\n" +
+			"INSERT INTO users VALUES (1);\n" +
+			"ALTER TABLE users DROP COLUMN IF EXISTS name",
+		"1_users.down.sql": "DROP INDEX CONCURRENTLY IF EXISTS users_id; DROP TABLE IF EXISTS users;",
+		// not compliant
+		"2_orders.up.sql": "create unlogged table orders (id int);\n" +
+			"CREATE INDEX orders_id ON orders (id);\n" +
+			"CREATE VIEW all_orders AS SELECT * FROM orders;",
+		"2_orders.down.sql": "DROP VIEW all_orders;\nDROP MATERIALIZED VIEW IF EXISTS totals;\nDROP TABLE orders",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	findings, err := Lint("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []LintFinding{
+		{Version: 2, Direction: source.Up, Statement: "create unlogged table orders (id int)", Rule: LintCreateTable},
+		{Version: 2, Direction: source.Up, Statement: "CREATE INDEX orders_id ON orders (id)", Rule: LintCreateIndex},
+		{Version: 2, Direction: source.Down, Statement: "DROP VIEW all_orders", Rule: LintDrop},
+		{Version: 2, Direction: source.Down, Statement: "DROP TABLE orders", Rule: LintDrop},
+	}
+	if !reflect.DeepEqual(findings, expected) {
+		t.Fatalf("expected findings\n%+v\ngot\n%+v", expected, findings)
+	}
+}
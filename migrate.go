@@ -5,15 +5,23 @@
 package migrate
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
 
 	"github.com/getoutreach/migrate/v4/database"
+	"github.com/getoutreach/migrate/v4/database/multistmt"
 	iurl "github.com/getoutreach/migrate/v4/internal/url"
 	"github.com/getoutreach/migrate/v4/source"
 )
@@ -25,6 +33,10 @@ import (
 // since each pre-read migration is buffered in memory. See DefaultBufferSize.
 var DefaultPrefetchMigrations = uint(10)
 
+// dirtyPollInterval is how often the version of a dirty database is read again
+// within DirtyWait
+var dirtyPollInterval = 100 * time.Millisecond
+
 // DefaultLockTimeout sets the max time a database driver has to acquire a lock.
 var DefaultLockTimeout = 15 * time.Second
 
@@ -34,6 +46,10 @@ var (
 	ErrInvalidVersion = errors.New("version must be >= -1")
 	ErrLocked         = errors.New("database locked")
 	ErrLockTimeout    = errors.New("timeout: can't acquire database lock")
+	ErrNoHistory      = errors.New("database driver doesn't record applied versions")
+	ErrNoCatalog      = errors.New("database driver doesn't describe schema objects")
+	ErrNotDirty       = errors.New("database is not dirty")
+	ErrNoResume       = errors.New("database driver doesn't persist resume tokens")
 )
 
 // ErrShortLimit is an error returned when not enough migrations
@@ -47,6 +63,43 @@ func (e ErrShortLimit) Error() string {
 	return fmt.Sprintf("limit %v short", e.Short)
 }
 
+// ErrEmptyMigration is returned when a migration file has no statements, e.g.
+// an accidentally empty file. Migrations meant to only record their version
+// hold a NoopDirective.
+type ErrEmptyMigration struct {
+	Version    uint
+	Identifier string
+}
+
+// Error implements the error interface.
+func (e ErrEmptyMigration) Error() string {
+	return fmt.Sprintf("migration %v %v is empty, add a `-- %s` line to only record its version",
+		e.Version, e.Identifier, NoopDirective)
+}
+
+// ErrTotalTimeout is returned when a run of migrations takes longer than the
+// timeout set with SetTotalTimeout.
+type ErrTotalTimeout struct {
+	// Version is the version the migration running or about to run when the
+	// timeout expired migrates to
+	Version int
+	// Err is the error the migration was aborted with, if any
+	Err error
+}
+
+// Error implements the error interface.
+func (e ErrTotalTimeout) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("total timeout expired migrating to version %v: %v", e.Version, e.Err)
+	}
+	return fmt.Sprintf("total timeout expired before migrating to version %v", e.Version)
+}
+
+// Unwrap returns context.DeadlineExceeded
+func (e ErrTotalTimeout) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
 type ErrDirty struct {
 	Version int
 	Info    string
@@ -58,6 +111,21 @@ func (e ErrDirty) Error() string {
 		e.Version, e.Schema)
 }
 
+// ErrBelowMinVersion is returned by RequireMinVersion when the database isn't
+// migrated to at least MinVersion. Version is database.NilVersion if no
+// migration has been applied.
+type ErrBelowMinVersion struct {
+	Version    int
+	MinVersion uint
+}
+
+func (e ErrBelowMinVersion) Error() string {
+	if e.Version == database.NilVersion {
+		return fmt.Sprintf("no migration applied, version %v or later is required", e.MinVersion)
+	}
+	return fmt.Sprintf("database version %v is below the required version %v", e.Version, e.MinVersion)
+}
+
 type ErrVersionNotFound struct {
 	Version uint
 	err     error
@@ -72,6 +140,34 @@ func (e ErrVersionNotFound) Is(target error) bool {
 	return target == os.ErrNotExist
 }
 
+// ErrStatementDrift is returned by VerifyStatements when a statement of the
+// migration in the source differs from the one executed when its version was
+// applied. Index is the position of the first statement that differs, or of
+// the first statement added or removed since.
+type ErrStatementDrift struct {
+	Version uint
+	Index   int
+}
+
+func (e ErrStatementDrift) Error() string {
+	return fmt.Sprintf("statement %v of migration %v differs from the one applied", e.Index, e.Version)
+}
+
+// ErrMissingDown is returned by Migrate, Steps, Up, UpSince and Resume when
+// RequireDown is set and pending migrations they would apply have no down
+// migration. Versions are those migrations, in ascending order.
+type ErrMissingDown struct {
+	Versions []uint
+}
+
+func (e ErrMissingDown) Error() string {
+	versions := make([]string, len(e.Versions))
+	for i, v := range e.Versions {
+		versions[i] = fmt.Sprint(v)
+	}
+	return fmt.Sprintf("pending migrations without a down migration: %s", strings.Join(versions, ", "))
+}
+
 type Migrate struct {
 	sourceName   string
 	sourceDrv    source.Driver
@@ -97,6 +193,61 @@ type Migrate struct {
 	// LockTimeout defaults to DefaultLockTimeout,
 	// but can be set per Migrate instance.
 	LockTimeout time.Duration
+
+	// DirtyWait, if set, is how long Migrate, Steps, Up, Down and Run wait for
+	// a dirty database to become clean before failing with ErrDirty, e.g. when
+	// processes starting together race another one that's mid-migration. The
+	// lock is released while waiting, so the other process can finish.
+	DirtyWait time.Duration
+
+	// Context, if set, cancels waiting between migrations, see
+	// SetInterMigrationDelay, and the migrations not applied yet, aborting the
+	// one in progress with drivers implementing database.ContextRunner.
+	Context context.Context
+
+	// AllowEmptySource makes Migrate, Steps, Up and Down return ErrNoChange,
+	// like for a database that's up to date, instead of the source's
+	// source.ErrNoMigrations if the source has no migrations at all, e.g. an
+	// empty directory.
+	AllowEmptySource bool
+
+	// OnNoop, if set, is called by Up when the database is already migrated
+	// to the source's last version, before Up returns ErrNoChange, e.g. to
+	// log fast startups.
+	OnNoop func()
+
+	// RequireDown makes Migrate, Steps, Up, UpSince and Resume check that
+	// every pending migration they would apply has a down migration before
+	// applying any of them, failing with ErrMissingDown otherwise, e.g. to
+	// enforce that all migrations are reversible.
+	RequireDown bool
+
+	// EventPolicy and EventBufferSize are what runs do with the events the
+	// consumer of Events is too slow to receive, see EventPolicy. The buffer
+	// defaults to DefaultEventBufferSize.
+	EventPolicy     EventPolicy
+	EventBufferSize int
+
+	// events is the stream of the next run, set by Events, eventsDone drops
+	// the events of past runs not received yet once closed
+	eventsMu   sync.Mutex
+	events     *eventStream
+	eventsDone chan struct{}
+	// runEvents is the stream of the run in progress
+	runEvents *eventStream
+
+	// interMigrationDelay is waited between applying migrations
+	interMigrationDelay time.Duration
+
+	// totalTimeout is how long each run of migrations may take
+	totalTimeout time.Duration
+
+	// runCtx is the context of the run of migrations in progress
+	runCtx context.Context
+
+	// resumeRun is the resume token of the run in progress, nil if it can't
+	// be resumed
+	resumeRun *ResumeToken
 }
 
 // New returns a new Migrate instance from a source URL and a database URL.
@@ -208,12 +359,30 @@ func newCommon() *Migrate {
 	}
 }
 
+// SetInterMigrationDelay makes Migrate wait d between applying migrations,
+// throttling the load of many heavy migrations run back to back. Zero, the
+// default, doesn't wait. Cancelling Context aborts the wait and the migrations
+// that weren't applied yet.
+func (m *Migrate) SetInterMigrationDelay(d time.Duration) {
+	m.interMigrationDelay = d
+}
+
+// SetTotalTimeout limits how long each run of migrations, e.g. Up or Migrate,
+// may take to d. Once it expires, the migration in progress is aborted with
+// drivers implementing database.ContextRunner, and otherwise once it returns,
+// and the run fails with ErrTotalTimeout. The migrations applied before stay
+// applied. Zero, the default, doesn't limit runs.
+func (m *Migrate) SetTotalTimeout(d time.Duration) {
+	m.totalTimeout = d
+}
+
 // Close closes the source and the database.
 func (m *Migrate) Close() (source error, database error) {
 	databaseSrvClose := make(chan error)
 	sourceSrvClose := make(chan error)
 
 	m.logVerbosePrintf("Closing source and database\n")
+	m.closeEvents()
 
 	go func() {
 		databaseSrvClose <- m.databaseDrv.Close()
@@ -229,43 +398,61 @@ func (m *Migrate) Close() (source error, database error) {
 // Migrate looks at the currently active migration version,
 // then migrates either up or down to the specified version.
 func (m *Migrate) Migrate(version uint) error {
+	defer m.startEvents()()
+
+	if err := m.checkSource(); err != nil {
+		return err
+	}
 	if err := m.lock(); err != nil {
 		return err
 	}
 
-	curVersion, err := m.databaseDrv.Version()
+	curVersion, err := m.cleanVersion()
 	if err != nil {
-		return m.unlockErr(err)
+		return err
 	}
 
-	if curVersion.Dirty {
-		return m.unlockErr(ErrDirty{curVersion.Version, curVersion.Info, curVersion.Schema})
+	if int(version) > curVersion.Version {
+		if err := m.checkDowns(curVersion.Version, int(version), -1); err != nil {
+			return m.unlockErr(err)
+		}
 	}
 
 	ret := make(chan interface{}, m.PrefetchMigrations)
+	m.resumeRun = &ResumeToken{Direction: "up", Target: int(version)}
+	if int(version) < curVersion.Version {
+		m.resumeRun.Direction = "down"
+	}
 	go m.read(curVersion.Version, int(version), ret)
 
-	return m.unlockErr(m.runMigrations(ret))
+	return m.unlockErr(m.endRun(m.runMigrations(ret)))
 }
 
 // Steps looks at the currently active migration version.
 // It will migrate up if n > 0, and down if n < 0.
 func (m *Migrate) Steps(n int) error {
+	defer m.startEvents()()
+
 	if n == 0 {
 		return ErrNoChange
 	}
+	if err := m.checkSource(); err != nil {
+		return err
+	}
 
 	if err := m.lock(); err != nil {
 		return err
 	}
 
-	curVersion, err := m.databaseDrv.Version()
+	curVersion, err := m.cleanVersion()
 	if err != nil {
-		return m.unlockErr(err)
+		return err
 	}
 
-	if curVersion.Dirty {
-		return m.unlockErr(ErrDirty{curVersion.Version, curVersion.Info, curVersion.Schema})
+	if n > 0 {
+		if err := m.checkDowns(curVersion.Version, -1, n); err != nil {
+			return m.unlockErr(err)
+		}
 	}
 
 	ret := make(chan interface{}, m.PrefetchMigrations)
@@ -282,44 +469,276 @@ func (m *Migrate) Steps(n int) error {
 // Up looks at the currently active migration version
 // and will migrate all the way up (applying all up migrations).
 func (m *Migrate) Up() error {
+	defer m.startEvents()()
+
+	if err := m.checkSource(); err != nil {
+		return err
+	}
+	if m.upToDate() {
+		m.logVerbosePrintf("No pending migrations\n")
+		if m.OnNoop != nil {
+			m.OnNoop()
+		}
+		return ErrNoChange
+	}
 	if err := m.lock(); err != nil {
 		return err
 	}
 
-	curVersion, err := m.databaseDrv.Version()
+	curVersion, err := m.cleanVersion()
 	if err != nil {
-		return m.unlockErr(err)
+		return err
 	}
 
-	if curVersion.Dirty {
-		return m.unlockErr(ErrDirty{curVersion.Version, curVersion.Info, curVersion.Schema})
+	if err := m.checkDowns(curVersion.Version, -1, -1); err != nil {
+		return m.unlockErr(err)
 	}
 
 	ret := make(chan interface{}, m.PrefetchMigrations)
 
+	m.resumeRun = &ResumeToken{Direction: "up", Target: database.NilVersion}
 	go m.readUp(curVersion.Version, -1, ret)
-	return m.unlockErr(m.runMigrations(ret))
+	return m.unlockErr(m.endRun(m.runMigrations(ret)))
+}
+
+// UpSince is Up applying only the migrations with versions greater than
+// bound, e.g. a timestamp when versions are timestamps, skipping pending
+// migrations at or below it, e.g. to skip a backlog when recovering. The
+// skipped migrations aren't recorded as applied.
+func (m *Migrate) UpSince(bound uint) error {
+	defer m.startEvents()()
+
+	if err := m.checkSource(); err != nil {
+		return err
+	}
+	if err := m.lock(); err != nil {
+		return err
+	}
+
+	curVersion, err := m.cleanVersion()
+	if err != nil {
+		return err
+	}
+
+	from := curVersion.Version
+	if from < int(bound) {
+		// the migrations start after the last one at or below bound
+		if from, err = m.lastVersionUpTo(bound); err != nil {
+			return m.unlockErr(err)
+		}
+	}
+
+	if err := m.checkDowns(from, -1, -1); err != nil {
+		return m.unlockErr(err)
+	}
+
+	ret := make(chan interface{}, m.PrefetchMigrations)
+
+	m.resumeRun = &ResumeToken{Direction: "up", Target: database.NilVersion}
+	go m.readUp(from, -1, ret)
+	return m.unlockErr(m.endRun(m.runMigrations(ret)))
+}
+
+// checkDowns returns ErrMissingDown with RequireDown if migrations of the
+// source after version from, up to version to and at most limit of them, have
+// no down migration. to and limit are -1 for no bound.
+func (m *Migrate) checkDowns(from, to, limit int) error {
+	if !m.RequireDown {
+		return nil
+	}
+	var (
+		v   uint
+		err error
+	)
+	if from == database.NilVersion {
+		v, err = m.sourceDrv.First()
+	} else {
+		v, err = m.sourceDrv.Next(uint(from))
+	}
+	var missing []uint
+	for n := 0; err == nil && (to < 0 || int(v) <= to) && (limit < 0 || n < limit); n++ {
+		r, _, errDown := m.sourceDrv.ReadDown(v)
+		switch {
+		case errDown == nil:
+			r.Close()
+		case errors.Is(errDown, os.ErrNotExist):
+			missing = append(missing, v)
+		default:
+			return errDown
+		}
+		v, err = m.sourceDrv.Next(v)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(missing) > 0 {
+		return ErrMissingDown{Versions: missing}
+	}
+	return nil
+}
+
+// lastVersionUpTo returns the greatest version of the source that's at most
+// bound, -1 if there is none
+func (m *Migrate) lastVersionUpTo(bound uint) (int, error) {
+	last := -1
+	v, err := m.sourceDrv.First()
+	for err == nil && v <= bound {
+		last = int(v)
+		v, err = m.sourceDrv.Next(v)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	return last, nil
 }
 
 // Down looks at the currently active migration version
 // and will migrate all the way down (applying all down migrations).
 func (m *Migrate) Down() error {
+	defer m.startEvents()()
+
+	if err := m.checkSource(); err != nil {
+		return err
+	}
 	if err := m.lock(); err != nil {
 		return err
 	}
 
-	curVersion, err := m.databaseDrv.Version()
+	curVersion, err := m.cleanVersion()
+	if err != nil {
+		return err
+	}
+
+	ret := make(chan interface{}, m.PrefetchMigrations)
+	m.resumeRun = &ResumeToken{Direction: "down", Target: database.NilVersion}
+	go m.readDown(curVersion.Version, -1, ret)
+	return m.unlockErr(m.endRun(m.runMigrations(ret)))
+}
+
+// ResumeToken records how far a run of migrations got, persisted by drivers
+// implementing database.ResumeTokenStore in the transaction of each migration
+// Up, UpSince, Down and Migrate apply, so Resume can continue it after an
+// interruption, e.g. a crash. It's cleared once the run completes.
+type ResumeToken struct {
+	// Version is the version the last migration completed migrated to
+	Version int `json:"version"`
+	// Direction of the run, up or down
+	Direction string `json:"direction"`
+	// Target is the version the run migrates to, database.NilVersion for
+	// runs migrating as far as the source goes, like Up and Down
+	Target int `json:"target"`
+	// RunID identifies the run with drivers implementing
+	// database.RunIdentifier
+	RunID string `json:"run_id,omitempty"`
+}
+
+// Resume continues the run of migrations interrupted after the migration its
+// resume token was recorded with, applying the migrations after the
+// database's version in the run's direction up to its target without redoing
+// completed ones. It returns ErrNoChange if no run was interrupted and
+// ErrNoResume if the driver doesn't implement database.ResumeTokenStore or
+// isn't configured to persist resume tokens.
+func (m *Migrate) Resume() error {
+	defer m.startEvents()()
+
+	store, ok := m.databaseDrv.(database.ResumeTokenStore)
+	if !ok {
+		return ErrNoResume
+	}
+	if err := m.checkSource(); err != nil {
+		return err
+	}
+	if err := m.lock(); err != nil {
+		return err
+	}
+
+	b, err := store.ResumeToken()
 	if err != nil {
 		return m.unlockErr(err)
 	}
+	if b == nil {
+		return m.unlockErr(ErrNoChange)
+	}
+	var token ResumeToken
+	if err := json.Unmarshal(b, &token); err != nil {
+		return m.unlockErr(fmt.Errorf("invalid resume token: %w", err))
+	}
 
-	if curVersion.Dirty {
-		return m.unlockErr(ErrDirty{curVersion.Version, curVersion.Info, curVersion.Schema})
+	curVersion, err := m.cleanVersion()
+	if err != nil {
+		return err
+	}
+	if curVersion.Version != token.Version {
+		return m.unlockErr(fmt.Errorf("database version %v isn't version %v the run to resume stopped at",
+			curVersion.Version, token.Version))
+	}
+
+	if token.Direction == "up" {
+		to := token.Target
+		if to == database.NilVersion {
+			to = -1
+		}
+		if err := m.checkDowns(curVersion.Version, to, -1); err != nil {
+			return m.unlockErr(err)
+		}
 	}
 
+	m.logVerbosePrintf("Resume run %v migrating %v from version %v\n", token.RunID, token.Direction, token.Version)
 	ret := make(chan interface{}, m.PrefetchMigrations)
-	go m.readDown(curVersion.Version, -1, ret)
-	return m.unlockErr(m.runMigrations(ret))
+	m.resumeRun = &ResumeToken{Direction: token.Direction, Target: token.Target}
+	switch {
+	case token.Target != database.NilVersion:
+		go m.read(curVersion.Version, token.Target, ret)
+	case token.Direction == "down":
+		go m.readDown(curVersion.Version, -1, ret)
+	default:
+		go m.readUp(curVersion.Version, -1, ret)
+	}
+	return m.unlockErr(m.endRun(m.runMigrations(ret)))
+}
+
+// saveResumeToken records the resume token of the run in progress, which
+// completed the migration to version, if the driver persists them
+func (m *Migrate) saveResumeToken(version int) error {
+	store, ok := m.databaseDrv.(database.ResumeTokenStore)
+	if !ok || m.resumeRun == nil {
+		return nil
+	}
+	m.resumeRun.Version = version
+	if runID := m.runID(); runID != "" {
+		m.resumeRun.RunID = runID
+	}
+	b, err := json.Marshal(m.resumeRun)
+	if err != nil {
+		return err
+	}
+	if err := store.SetResumeToken(b); !errors.Is(err, ErrNoResume) {
+		return err
+	}
+	return nil
+}
+
+// endRun ends the run of migrations that returned err, clearing the resume
+// token once the run completed, i.e. it reached its target and wasn't stopped
+// gracefully
+func (m *Migrate) endRun(err error) error {
+	resumable := m.resumeRun != nil
+	m.resumeRun = nil
+	store, ok := m.databaseDrv.(database.ResumeTokenStore)
+	if !ok || !resumable || (err != nil && err != ErrNoChange) || m.isGracefulStop {
+		return err
+	}
+	token, errToken := store.ResumeToken()
+	if errToken == nil && token != nil {
+		errToken = store.SetResumeToken(nil)
+	}
+	if errToken != nil && !errors.Is(errToken, ErrNoResume) {
+		if err != nil {
+			return multierror.Append(err, errToken)
+		}
+		return errToken
+	}
+	return err
 }
 
 // Drop deletes everything in the database.
@@ -338,6 +757,8 @@ func (m *Migrate) Drop() error {
 // Usually you don't need this function at all. Use Migrate,
 // Steps, Up or Down instead.
 func (m *Migrate) Run(migration ...*Migration) error {
+	defer m.startEvents()()
+
 	if len(migration) == 0 {
 		return ErrNoChange
 	}
@@ -346,13 +767,8 @@ func (m *Migrate) Run(migration ...*Migration) error {
 		return err
 	}
 
-	curVersion, err := m.databaseDrv.Version()
-	if err != nil {
-		return m.unlockErr(err)
-	}
-
-	if curVersion.Dirty {
-		return m.unlockErr(ErrDirty{curVersion.Version, curVersion.Info, curVersion.Schema})
+	if _, err := m.cleanVersion(); err != nil {
+		return err
 	}
 
 	ret := make(chan interface{}, m.PrefetchMigrations)
@@ -397,6 +813,66 @@ func (m *Migrate) Force(version int) error {
 	return m.unlock()
 }
 
+// RetryCurrent runs the migration that left the database dirty again, e.g.
+// after an operator fixed what made it fail, and clears the dirty flag in the
+// same transaction once it succeeds. A failed down migration, reported by
+// drivers implementing database.FailureHistory, is retried down, any other one
+// up. It returns ErrNotDirty if the database isn't dirty.
+func (m *Migrate) RetryCurrent() error {
+	defer m.startEvents()()
+
+	if err := m.lock(); err != nil {
+		return err
+	}
+
+	curVersion, err := m.databaseDrv.Version()
+	if err != nil {
+		return m.unlockErr(err)
+	}
+	if !curVersion.Dirty {
+		return m.unlockErr(ErrNotDirty)
+	}
+	var direction string
+	if failures, ok := m.databaseDrv.(database.FailureHistory); ok {
+		if direction, err = failures.FailedDirection(curVersion.Version); err != nil {
+			return m.unlockErr(err)
+		}
+	}
+
+	// the down migration that failed migrated to the dirty version from the
+	// version after it
+	version := curVersion.Version
+	if direction == "down" {
+		var next uint
+		if curVersion.Version == database.NilVersion {
+			next, err = m.sourceDrv.First()
+		} else {
+			next, err = m.sourceDrv.Next(uint(curVersion.Version))
+		}
+		if err != nil {
+			return m.unlockErr(err)
+		}
+		version = int(next)
+	} else if curVersion.Version < 0 {
+		return m.unlockErr(ErrInvalidVersion)
+	}
+
+	migr, err := m.newMigration(uint(version), curVersion.Version)
+	if err != nil {
+		return m.unlockErr(err)
+	}
+	go func() {
+		if err := migr.Buffer(); err != nil {
+			m.logErr(err)
+		}
+	}()
+
+	ret := make(chan interface{}, 1)
+	ret <- migr
+	close(ret)
+	return m.unlockErr(m.runMigrations(ret))
+}
+
 // Version returns the currently active migration version.
 // If no migration has been applied, yet, it will return ErrNilVersion.
 func (m *Migrate) Version() (version *database.Version, err error) {
@@ -412,6 +888,386 @@ func (m *Migrate) Version() (version *database.Version, err error) {
 	return v, nil
 }
 
+// RequireMinVersion returns ErrBelowMinVersion unless the database is migrated
+// to version n or later, e.g. for services that must not start before a
+// separate migration job migrated the database. It returns ErrDirty if the
+// database is dirty. It never applies migrations.
+func (m *Migrate) RequireMinVersion(n uint) error {
+	curVersion, err := m.databaseDrv.Version()
+	if err != nil {
+		return err
+	}
+	if curVersion.Dirty {
+		return ErrDirty{curVersion.Version, curVersion.Info, curVersion.Schema}
+	}
+	if curVersion.Version == database.NilVersion || uint(curVersion.Version) < n {
+		return ErrBelowMinVersion{Version: curVersion.Version, MinVersion: n}
+	}
+	return nil
+}
+
+// CurrentDownSQL returns the body of the down migration of the version the
+// database is at, i.e. what Steps(-1) would run, without running it. It
+// returns ErrNilVersion if no migration has been applied and ErrDirty if
+// the database is dirty.
+func (m *Migrate) CurrentDownSQL() (string, error) {
+	curVersion, err := m.databaseDrv.Version()
+	if err != nil {
+		return "", err
+	}
+	if curVersion.Version == database.NilVersion {
+		return "", ErrNilVersion
+	}
+	if curVersion.Dirty {
+		return "", ErrDirty{curVersion.Version, curVersion.Info, curVersion.Schema}
+	}
+
+	r, _, err := m.sourceDrv.ReadDown(uint(curVersion.Version))
+	if err != nil {
+		return "", err
+	}
+	body, err := io.ReadAll(r)
+	if errClose := r.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// RollbackSummary describes what Migrate would run to roll back to a version,
+// as returned by RollbackPlan. The statement counts are a best-effort static
+// analysis of the down migrations, e.g. statements in function bodies or
+// dynamic SQL aren't counted.
+type RollbackSummary struct {
+	// Versions are rolled back, in the order their down migrations run
+	Versions []uint
+	// DownMigrations is the number of versions with a down migration, the
+	// others are only unrecorded
+	DownMigrations int
+	// Statements is the number of statements of the down migrations
+	Statements int
+	// Drops and Alters are the number of DROP and ALTER statements among them
+	Drops  int
+	Alters int
+	// DropTables is the number of DROP TABLE statements among the Drops
+	DropTables int
+}
+
+// RollbackPlan returns what Migrate(to) would run to roll the database back
+// to the version to, without running anything, e.g. to confirm "7 down
+// migrations dropping 3 tables" before a rollback. It returns ErrNilVersion if
+// no migration has been applied, ErrDirty if the database is dirty and an
+// error if to is above the current version.
+func (m *Migrate) RollbackPlan(to uint) (RollbackSummary, error) {
+	var summary RollbackSummary
+	curVersion, err := m.databaseDrv.Version()
+	if err != nil {
+		return summary, err
+	}
+	if curVersion.Version == database.NilVersion {
+		return summary, ErrNilVersion
+	}
+	if curVersion.Dirty {
+		return summary, ErrDirty{curVersion.Version, curVersion.Info, curVersion.Schema}
+	}
+	if int(to) > curVersion.Version {
+		return summary, fmt.Errorf("version %v is above the current version %v, nothing to roll back", to, curVersion.Version)
+	}
+	if err := m.versionExists(to); err != nil {
+		return summary, err
+	}
+
+	for v := suint(curVersion.Version); v > to; {
+		summary.Versions = append(summary.Versions, v)
+		r, _, err := m.sourceDrv.ReadDown(v)
+		if err == nil {
+			summary.DownMigrations++
+			err = summary.count(r)
+			if errClose := r.Close(); err == nil {
+				err = errClose
+			}
+		} else if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		if err != nil {
+			return summary, err
+		}
+		if v, err = m.sourceDrv.Prev(v); err != nil {
+			return summary, err
+		}
+	}
+	return summary, nil
+}
+
+// count adds the statements of the down migration r to the summary
+func (s *RollbackSummary) count(r io.Reader) error {
+	// the parser only emits terminated statements, terminate the last one in
+	// case the migration doesn't
+	r = io.MultiReader(r, strings.NewReader("\n;"))
+	return multistmt.Parse(r, nil, 0, "", func(stmt []byte) error {
+		words := multistmt.StatementKeywords(stmt, 2)
+		if len(words) == 0 {
+			return nil
+		}
+		s.Statements++
+		switch multistmt.StatementCommand(stmt) {
+		case "DROP":
+			s.Drops++
+			if len(words) > 1 && words[0] == "DROP" && words[1] == "TABLE" {
+				s.DropTables++
+			}
+		case "ALTER":
+			s.Alters++
+		}
+		return nil
+	})
+}
+
+// Bundle renders the migrations for the versions from through to (inclusive)
+// as one annotated SQL script without touching the database. Up migrations
+// are bundled in ascending order if from <= to, down migrations in descending
+// order otherwise. Each migration is preceded by a `-- version N:` line and,
+// if the database driver implements database.Scripter, followed by the
+// statement recording the version it migrates to.
+func (m *Migrate) Bundle(from, to uint) (string, error) {
+	if err := m.versionExists(from); err != nil {
+		return "", err
+	}
+	if err := m.versionExists(to); err != nil {
+		return "", err
+	}
+
+	low, high := from, to
+	if low > high {
+		low, high = high, low
+	}
+
+	// collect every source version, down migrations need the previous one
+	var versions []uint
+	v, err := m.sourceDrv.First()
+	for err == nil && v <= high {
+		versions = append(versions, v)
+		v, err = m.sourceDrv.Next(v)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	scripter, _ := m.databaseDrv.(database.Scripter)
+	var script strings.Builder
+	bundle := func(version uint, targetVersion int) error {
+		migr, err := m.newMigration(version, targetVersion)
+		if err != nil {
+			return err
+		}
+
+		direction := "up"
+		if targetVersion < int(version) {
+			direction = "down"
+		}
+		fmt.Fprintf(&script, "-- version %v: %v (%v)\n", version, migr.Identifier, direction)
+		if migr.Body != nil {
+			body, err := io.ReadAll(migr.Body)
+			if errClose := migr.Body.Close(); err == nil {
+				err = errClose
+			}
+			if err != nil {
+				return err
+			}
+			script.Write(body)
+			if len(body) > 0 && body[len(body)-1] != '\n' {
+				script.WriteByte('\n')
+			}
+		}
+		if scripter != nil {
+			script.WriteString(scripter.SetVersionStatement(targetVersion, false))
+			script.WriteByte('\n')
+		}
+		script.WriteByte('\n')
+		return nil
+	}
+
+	if from <= to {
+		for _, v := range versions {
+			if v < low {
+				continue
+			}
+			if err := bundle(v, int(v)); err != nil {
+				return "", err
+			}
+		}
+	} else {
+		for i := len(versions) - 1; i >= 0; i-- {
+			if versions[i] < low {
+				break
+			}
+			prev := database.NilVersion
+			if i > 0 {
+				prev = int(versions[i-1])
+			}
+			if err := bundle(versions[i], prev); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return script.String(), nil
+}
+
+// SourceFingerprint returns a hex encoded SHA-256 digest of every migration in
+// the source, covering versions, identifiers, directions and contents. It only
+// changes when the migrations do, so callers can store it and skip migrating
+// when it matches. Migrations are hashed in version order, so the digest
+// doesn't depend on the order the source lists them in.
+func (m *Migrate) SourceFingerprint() (string, error) {
+	h := sha256.New()
+	fingerprint := func(version uint, direction source.Direction,
+		read func(uint) (io.ReadCloser, string, error)) error {
+		r, identifier, err := read(version)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		// lengths keep the boundaries between fields unambiguous
+		fmt.Fprintf(h, "%d %s %d:%s %d:", version, direction, len(identifier), identifier, len(body))
+		h.Write(body)
+		return nil
+	}
+
+	v, err := m.sourceDrv.First()
+	for err == nil {
+		if err := fingerprint(v, source.Up, m.sourceDrv.ReadUp); err != nil {
+			return "", err
+		}
+		if err := fingerprint(v, source.Down, m.sourceDrv.ReadDown); err != nil {
+			return "", err
+		}
+		v, err = m.sourceDrv.Next(v)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Metadata returns the metadata headers, like `-- @author: jane`, of the
+// migration that applied version, nil if it had none. It needs the database
+// driver to implement database.MetadataHistory and returns ErrNoHistory
+// otherwise.
+func (m *Migrate) Metadata(version uint) (map[string]string, error) {
+	history, ok := m.databaseDrv.(database.MetadataHistory)
+	if !ok {
+		return nil, ErrNoHistory
+	}
+	return history.Metadata(version)
+}
+
+// Actor returns who applied version, e.g. the CI identity the database driver
+// was configured with. It needs the database driver to implement
+// database.ActorHistory and returns ErrNoHistory otherwise.
+func (m *Migrate) Actor(version uint) (string, error) {
+	history, ok := m.databaseDrv.(database.ActorHistory)
+	if !ok {
+		return "", ErrNoHistory
+	}
+	return history.Actor(version)
+}
+
+// VerifyStatements compares the statements of the up migration of version in
+// the source with the digests of those executed when it was applied, see
+// multistmt.HashStatements, and returns an ErrStatementDrift reporting the
+// first one that diverged, nil if none did. It needs the database driver to
+// implement database.StatementHistory and returns ErrNoHistory otherwise.
+func (m *Migrate) VerifyStatements(version uint) error {
+	history, ok := m.databaseDrv.(database.StatementHistory)
+	if !ok {
+		return ErrNoHistory
+	}
+	applied, err := history.StatementHashes(version)
+	if err != nil {
+		return err
+	}
+	if applied == nil {
+		return fmt.Errorf("no statement hashes recorded for version %v", version)
+	}
+
+	r, _, err := m.sourceDrv.ReadUp(version)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	hashes, err := multistmt.HashStatements(r)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(hashes) || i < len(applied); i++ {
+		if i >= len(hashes) || i >= len(applied) || hashes[i] != applied[i] {
+			return ErrStatementDrift{Version: version, Index: i}
+		}
+	}
+	return nil
+}
+
+// CheckGaps returns the versions in the source below the highest applied
+// version that were never applied, e.g. a migration merged after later ones
+// already ran. It needs the database driver to implement database.History and
+// returns ErrNoHistory otherwise.
+func (m *Migrate) CheckGaps() ([]uint, error) {
+	history, ok := m.databaseDrv.(database.History)
+	if !ok {
+		return nil, ErrNoHistory
+	}
+	applied, err := history.AppliedVersions()
+	if err != nil {
+		return nil, err
+	}
+	if len(applied) == 0 {
+		return nil, nil
+	}
+
+	isApplied := make(map[uint]bool, len(applied))
+	for _, v := range applied {
+		isApplied[v] = true
+	}
+	highest := applied[len(applied)-1]
+
+	var gaps []uint
+	v, err := m.sourceDrv.First()
+	for err == nil && v < highest {
+		if !isApplied[v] {
+			gaps = append(gaps, v)
+		}
+		v, err = m.sourceDrv.Next(v)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return gaps, nil
+}
+
+// Catalog returns a sorted description of the objects in the database's
+// schema, leaving out the migrations table. It needs the database driver to
+// implement database.Cataloger and returns ErrNoCatalog otherwise.
+func (m *Migrate) Catalog() ([]string, error) {
+	cataloger, ok := m.databaseDrv.(database.Cataloger)
+	if !ok {
+		return nil, ErrNoCatalog
+	}
+	return cataloger.Catalog()
+}
+
 // read reads either up or down migrations from source `from` to `to`.
 // Each migration is then written to the ret channel.
 // If an error occurs during reading, that error is written to the ret channel, too.
@@ -739,8 +1595,37 @@ func (m *Migrate) readDown(from int, limit int, ret chan<- interface{}) {
 // Before running a newly received migration it will check if it's supposed
 // to stop execution because it might have received a stop signal on the
 // GracefulStop channel.
-func (m *Migrate) runMigrations(ret <-chan interface{}) error {
+func (m *Migrate) runMigrations(ret <-chan interface{}) (err error) {
+	// migr is the migration in progress, which errors are reported with
+	var migr *Migration
+	events := m.runEvents
+	// the run is identified once the database is locked
+	runID := m.runID()
+	defer func() {
+		if err != nil && err != ErrNoChange {
+			e := Event{Kind: EventError, Err: err, RunID: runID}
+			if migr != nil {
+				e.Version, e.TargetVersion, e.Identifier = migr.Version, migr.TargetVersion, migr.Identifier
+			}
+			events.send(e)
+		}
+	}()
+
+	ctx := m.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if m.totalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.totalTimeout)
+		defer cancel()
+	}
+	m.runCtx = ctx
+	defer func() { m.runCtx = nil }()
+
+	applied := false
 	for r := range ret {
+		migr = nil
 
 		if m.stop() {
 			return nil
@@ -751,12 +1636,58 @@ func (m *Migrate) runMigrations(ret <-chan interface{}) error {
 			return r
 
 		case *Migration:
-			migr := r
+			migr = r
+
+			if applied {
+				if err := m.waitBetweenMigrations(); err != nil {
+					return m.runCtxErr(migr, err)
+				}
+			}
+			if err := ctx.Err(); err != nil {
+				return m.runCtxErr(migr, err)
+			}
+
+			var (
+				directives []database.Directive
+				body       io.Reader
+				noop       bool
+			)
+			if migr.Body != nil {
+				var (
+					empty bool
+					err   error
+				)
+				directives, empty, body, err = peekDirectives(migr.BufferedBody)
+				if err != nil {
+					return fmt.Errorf("error reading migration %v: %w", migr.LogString(), err)
+				}
+				noop = hasDirective(directives, NoopDirective)
+				switch {
+				case empty && !noop:
+					return ErrEmptyMigration{Version: migr.Version, Identifier: migr.Identifier}
+				case !empty && noop:
+					return fmt.Errorf("migration %v has statements besides the %s directive", migr.LogString(), NoopDirective)
+				}
+			}
+
+			events.send(Event{Kind: EventStart, Version: migr.Version,
+				TargetVersion: migr.TargetVersion, Identifier: migr.Identifier, RunID: runID})
 
-			if err := m.databaseDrv.Begin(); err != nil {
+			if err := m.beginDirectives(directives); err != nil {
 				return err
 			}
 
+			declined := false
+			if migr.Body != nil && !noop {
+				var err error
+				if declined, err = m.declined(migr); err != nil {
+					if err := m.databaseDrv.Rollback(); err != nil {
+						m.logErr(err)
+					}
+					return err
+				}
+			}
+
 			// set version with dirty state
 			if err := m.databaseDrv.SetVersion(migr.TargetVersion, true); err != nil {
 				if err := m.databaseDrv.Rollback(); err != nil {
@@ -765,9 +1696,41 @@ func (m *Migrate) runMigrations(ret <-chan interface{}) error {
 				return err
 			}
 
-			if migr.Body != nil {
+			if noop {
+				m.logVerbosePrintf("Record %v without running it\n", migr.LogString())
+			} else if declined {
+				m.logVerbosePrintf("Skip %v declined by the database\n", migr.LogString())
+			} else if migr.Body != nil {
+				noLock := hasDirective(directives, NoLockDirective)
+				if noLock {
+					m.logVerbosePrintf("Release lock to execute %v\n", migr.LogString())
+					if err := m.unlock(); err != nil {
+						if err := m.databaseDrv.Rollback(); err != nil {
+							m.logErr(err)
+						}
+						return err
+					}
+				}
+
 				m.logVerbosePrintf("Read and execute %v\n", migr.LogString())
-				if err := m.databaseDrv.Run(migr.BufferedBody); err != nil {
+				err := m.runBody(body)
+				var retry *database.RetryError
+				for errors.As(err, &retry) {
+					err = m.retryMigration(migr, directives, retry)
+				}
+				if noLock {
+					// acquire the lock again before recording the version
+					if errLock := m.lock(); errLock != nil {
+						if err := m.databaseDrv.Rollback(); err != nil {
+							m.logErr(err)
+						}
+						if err != nil {
+							return multierror.Append(err, errLock)
+						}
+						return errLock
+					}
+				}
+				if err != nil {
 					if err := m.databaseDrv.SetFailed(migr.TargetVersion,
 						err); err != nil {
 						if err := m.databaseDrv.Rollback(); err != nil {
@@ -775,7 +1738,7 @@ func (m *Migrate) runMigrations(ret <-chan interface{}) error {
 						}
 						m.logErr(err)
 					}
-					return err
+					return m.runCtxErr(migr, err)
 				}
 			}
 
@@ -788,21 +1751,36 @@ func (m *Migrate) runMigrations(ret <-chan interface{}) error {
 				return err
 			}
 
+			if err := m.saveResumeToken(migr.TargetVersion); err != nil {
+				m.logErr(err)
+				if err := m.databaseDrv.Rollback(); err != nil {
+					m.logErr(err)
+				}
+				return err
+			}
+
 			if err := m.databaseDrv.Commit(); err != nil {
 				m.logErr(err)
 				return err
 			}
 
+			applied = true
 			endTime := time.Now()
 			readTime := migr.FinishedReading.Sub(migr.StartedBuffering)
 			runTime := endTime.Sub(migr.FinishedReading)
+			events.send(Event{Kind: EventFinish, Version: migr.Version, TargetVersion: migr.TargetVersion,
+				Identifier: migr.Identifier, Duration: readTime + runTime, RunID: runID})
 
 			// log either verbose or normal
 			if m.Log != nil {
+				logString := migr.LogString()
+				if runID != "" {
+					logString += " in run " + runID
+				}
 				if m.Log.Verbose() {
-					m.logPrintf("Finished %v (read %v, ran %v)\n", migr.LogString(), readTime, runTime)
+					m.logPrintf("Finished %v (read %v, ran %v)\n", logString, readTime, runTime)
 				} else {
-					m.logPrintf("%v (%v)\n", migr.LogString(), readTime+runTime)
+					m.logPrintf("%v (%v)\n", logString, readTime+runTime)
 				}
 			}
 
@@ -813,6 +1791,163 @@ func (m *Migrate) runMigrations(ret <-chan interface{}) error {
 	return nil
 }
 
+// cleanVersion reads the current version of the locked database, waiting up
+// to DirtyWait for it to become clean if it's dirty. On errors, including
+// ErrDirty, the lock is released.
+func (m *Migrate) cleanVersion() (*database.Version, error) {
+	deadline := time.Now().Add(m.DirtyWait)
+	for {
+		curVersion, err := m.databaseDrv.Version()
+		if err != nil {
+			return nil, m.unlockErr(err)
+		}
+		if !curVersion.Dirty {
+			return curVersion, nil
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, m.unlockErr(ErrDirty{curVersion.Version, curVersion.Info, curVersion.Schema})
+		}
+		if wait > dirtyPollInterval {
+			wait = dirtyPollInterval
+		}
+
+		m.logVerbosePrintf("Database is dirty at version %v, waiting for it to become clean\n", curVersion.Version)
+		if err := m.unlock(); err != nil {
+			return nil, err
+		}
+		time.Sleep(wait)
+		if err := m.lock(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// runBody runs the body of a migration, with the context of the run if the
+// driver supports it
+func (m *Migrate) runBody(body io.Reader) error {
+	if runner, ok := m.databaseDrv.(database.ContextRunner); ok && m.runCtx != nil {
+		return runner.RunContext(m.runCtx, body)
+	}
+	return m.databaseDrv.Run(body)
+}
+
+// retryMigration runs migr again in a new transaction, recording its version
+// dirty again, after the driver failed it with retry
+func (m *Migrate) retryMigration(migr *Migration, directives []database.Directive, retry *database.RetryError) error {
+	m.logVerbosePrintf("Retry %v in %v in a new transaction: %v\n", migr.LogString(), retry.After, retry.Err)
+	if err := m.databaseDrv.Rollback(); err != nil {
+		return multierror.Append(retry.Err, err)
+	}
+
+	ctx := m.runCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timer := time.NewTimer(retry.After)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return multierror.Append(retry.Err, ctx.Err())
+	case <-timer.C:
+	}
+
+	if err := m.beginDirectives(directives); err != nil {
+		return multierror.Append(retry.Err, err)
+	}
+	if err := m.databaseDrv.SetVersion(migr.TargetVersion, true); err != nil {
+		return err
+	}
+	return m.runBody(bytes.NewReader(retry.Migration))
+}
+
+// runCtxErr returns ErrTotalTimeout if the run timed out by the time migr
+// failed with err, err otherwise
+func (m *Migrate) runCtxErr(migr *Migration, err error) error {
+	if m.totalTimeout <= 0 || m.runCtx == nil || !errors.Is(m.runCtx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		// the run's own error adds nothing
+		err = nil
+	}
+	return ErrTotalTimeout{Version: migr.TargetVersion, Err: err}
+}
+
+// waitBetweenMigrations waits the inter migration delay, returning the
+// error of the run's context if it's cancelled meanwhile
+func (m *Migrate) waitBetweenMigrations() error {
+	if m.interMigrationDelay <= 0 {
+		return nil
+	}
+	ctx := m.runCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timer := time.NewTimer(m.interMigrationDelay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// upToDate reports whether the database is migrated to the source's last
+// version, so Up has nothing to do, without taking the lock. A clean version
+// with no migration after it in the source can't become pending by another
+// process migrating meanwhile. Anything else, e.g. a dirty version or one the
+// source doesn't have, is left to Up to handle under the lock.
+func (m *Migrate) upToDate() bool {
+	curVersion, err := m.databaseDrv.Version()
+	if err != nil || curVersion.Dirty || curVersion.Version == database.NilVersion {
+		return false
+	}
+	if err := m.versionExists(suint(curVersion.Version)); err != nil {
+		return false
+	}
+	_, err = m.sourceDrv.Next(suint(curVersion.Version))
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// runID returns the id the database driver identifies the run in progress
+// with, empty if it doesn't, see database.RunIdentifier
+func (m *Migrate) runID() string {
+	if runIdentifier, ok := m.databaseDrv.(database.RunIdentifier); ok {
+		return runIdentifier.RunID()
+	}
+	return ""
+}
+
+// declined reports whether the database declines to apply migr, see
+// database.ConditionalApplier
+func (m *Migrate) declined(migr *Migration) (bool, error) {
+	applier, ok := m.databaseDrv.(database.ConditionalApplier)
+	if !ok {
+		return false, nil
+	}
+	apply, err := applier.ShouldApply(migr.TargetVersion)
+	if err != nil {
+		return false, fmt.Errorf("error deciding whether to apply %v: %w", migr.LogString(), err)
+	}
+	return !apply, nil
+}
+
+// checkSource returns the source's source.ErrNoMigrations if it has no
+// migrations, or ErrNoChange if AllowEmptySource is set
+func (m *Migrate) checkSource() error {
+	_, err := m.sourceDrv.First()
+	if !errors.As(err, new(source.ErrNoMigrations)) {
+		return nil
+	}
+	if m.AllowEmptySource {
+		m.logVerbosePrintf("No migrations in the source\n")
+		return ErrNoChange
+	}
+	return err
+}
+
 // versionExists checks the source if either the up or down migration for
 // the specified migration version exists.
 func (m *Migrate) versionExists(version uint) (result error) {
@@ -2,18 +2,29 @@ package migrate
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 import (
+	"github.com/getoutreach/migrate/v4/database"
+	"github.com/getoutreach/migrate/v4/database/mock"
+	"github.com/getoutreach/migrate/v4/database/multistmt"
 	dStub "github.com/getoutreach/migrate/v4/database/stub"
 	"github.com/getoutreach/migrate/v4/source"
+	_ "github.com/getoutreach/migrate/v4/source/file"
 	sStub "github.com/getoutreach/migrate/v4/source/stub"
 )
 
@@ -879,6 +890,91 @@ func TestUpAndDown(t *testing.T) {
 	equalDbSeq(t, 1, expectedSequence, dbDrv)
 }
 
+func TestUpSince(t *testing.T) {
+	tt := []struct {
+		name             string
+		version          int
+		bound            uint
+		expectedSequence migrationSequence
+		expectedVersion  int
+		expectErr        error
+	}{
+		{name: "skips pending migrations at or below the bound", version: -1, bound: 3,
+			expectedSequence: migrationSequence{mr("CREATE 4"), mr("CREATE 7")}, expectedVersion: 7},
+		{name: "bound between versions", version: 1, bound: 2,
+			expectedSequence: migrationSequence{mr("CREATE 3"), mr("CREATE 4"), mr("CREATE 7")}, expectedVersion: 7},
+		{name: "bound below the current version", version: 4, bound: 1,
+			expectedSequence: migrationSequence{mr("CREATE 7")}, expectedVersion: 7},
+		{name: "bound below the first version", version: -1, bound: 0,
+			expectedSequence: migrationSequence{mr("CREATE 1"), mr("CREATE 3"), mr("CREATE 4"), mr("CREATE 7")},
+			expectedVersion:  7},
+		{name: "nothing after the bound", version: 1, bound: 7,
+			expectedVersion: 1, expectErr: ErrNoChange},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			m, _ := New("stub://", "stub://")
+			m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+			dbDrv := m.databaseDrv.(*dStub.Stub)
+			if tc.version != -1 {
+				if err := dbDrv.SetVersion(tc.version, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := m.UpSince(tc.bound); !errors.Is(err, tc.expectErr) {
+				t.Fatalf("expected %v, got %v", tc.expectErr, err)
+			}
+			equalDbSeq(t, 0, tc.expectedSequence, dbDrv)
+			if dbDrv.CurrentVersion != tc.expectedVersion {
+				t.Fatalf("expected version %d, got %d", tc.expectedVersion, dbDrv.CurrentVersion)
+			}
+		})
+	}
+}
+
+func TestUpNoop(t *testing.T) {
+	tt := []struct {
+		name       string
+		version    int
+		expectNoop bool
+	}{
+		{name: "last version", version: 7, expectNoop: true},
+		{name: "pending migrations", version: 4},
+		{name: "nil version", version: -1},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			m, _ := New("stub://", "stub://")
+			m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+			dbDrv := m.databaseDrv.(*dStub.Stub)
+			if tc.version != -1 {
+				if err := dbDrv.SetVersion(tc.version, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			noop := false
+			m.OnNoop = func() { noop = true }
+
+			// another process holds the lock, a no-op run doesn't wait for it
+			if err := dbDrv.Lock(); err != nil {
+				t.Fatal(err)
+			}
+			err := m.Up()
+			if tc.expectNoop && err != ErrNoChange {
+				t.Fatalf("expected ErrNoChange without acquiring the lock, got %v", err)
+			}
+			if !tc.expectNoop && (err == nil || err == ErrNoChange) {
+				t.Fatalf("expected acquiring the lock to fail, got %v", err)
+			}
+			if noop != tc.expectNoop {
+				t.Fatalf("expected OnNoop called %v, got %v", tc.expectNoop, noop)
+			}
+			equalDbSeq(t, 0, migrationSequence{}, dbDrv)
+		})
+	}
+}
+
 func TestUpDirty(t *testing.T) {
 	m, _ := New("stub://", "stub://")
 	dbDrv := m.databaseDrv.(*dStub.Stub)
@@ -1012,6 +1108,113 @@ func TestRunDirty(t *testing.T) {
 	}
 }
 
+// streamingMock is a database reading migrations in small chunks, counting
+// the bytes read
+type streamingMock struct {
+	*mock.Mock
+	read atomic.Int64
+}
+
+func (s *streamingMock) Run(migration io.Reader) error {
+	buf := make([]byte, 512)
+	for {
+		n, err := migration.Read(buf)
+		s.read.Add(int64(n))
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// generatedMigration lazily generates size bytes of statements, failing if
+// they're generated more than ahead bytes before the database reads them
+type generatedMigration struct {
+	size, ahead, generated int64
+	db                     *streamingMock
+}
+
+func (g *generatedMigration) Read(p []byte) (int, error) {
+	if g.generated >= g.size {
+		return 0, io.EOF
+	}
+	if g.generated-g.db.read.Load() > g.ahead {
+		return 0, fmt.Errorf("%v bytes generated but only %v read, the migration is buffered",
+			g.generated, g.db.read.Load())
+	}
+	n := len(p)
+	if remaining := g.size - g.generated; int64(n) > remaining {
+		n = int(remaining)
+	}
+	for i := 0; i < n; i++ {
+		p[i] = "SELECT 1;\n"[(g.generated+int64(i))%10]
+	}
+	g.generated += int64(n)
+	return n, nil
+}
+
+func (g *generatedMigration) Close() error {
+	return nil
+}
+
+func TestRunStreamsMigration(t *testing.T) {
+	db := &streamingMock{Mock: mock.New()}
+	srcDrv, _ := sStub.WithInstance(nil, &sStub.Config{})
+	m, err := NewWithInstance("stub", srcDrv, "mock", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the migration is only buffered up to its BufferSize and the directives
+	// peeked at, far less than the whole migration
+	body := &generatedMigration{size: 64 << 20, ahead: 1 << 20, db: db}
+	migr, err := NewMigration(body, "large", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(migr); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.read.Load(); got != body.size {
+		t.Fatalf("expected %v bytes read, got %v", body.size, got)
+	}
+}
+
+func TestEmptySource(t *testing.T) {
+	dir := t.TempDir()
+	testCases := []struct {
+		name       string
+		path       string
+		allowEmpty bool
+		wantErr    error
+	}{
+		{name: "empty directory", path: dir, wantErr: source.ErrNoMigrations{Path: dir}},
+		{name: "empty directory allowed", path: dir, allowEmpty: true, wantErr: ErrNoChange},
+		{name: "missing directory", path: dir + "/missing", wantErr: source.ErrNoMigrations{Path: dir + "/missing"}},
+		{name: "missing directory allowed", path: dir + "/missing", allowEmpty: true, wantErr: ErrNoChange},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := New("file://"+tc.path, "stub://")
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.AllowEmptySource = tc.allowEmpty
+			if err := m.Up(); err != tc.wantErr {
+				t.Fatalf("expected %v, got %v", tc.wantErr, err)
+			}
+			if err := m.Steps(1); err != tc.wantErr {
+				t.Fatalf("expected %v, got %v", tc.wantErr, err)
+			}
+			if _, err := m.Version(); err != ErrNilVersion {
+				t.Fatalf("expected no migration applied, got %v", err)
+			}
+		})
+	}
+}
+
 func TestForce(t *testing.T) {
 	m, _ := New("stub://", "stub://")
 	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
@@ -1344,6 +1547,469 @@ func TestLock(t *testing.T) {
 	}
 }
 
+func TestBundle(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+
+	tt := []struct {
+		from        uint
+		to          uint
+		expectErr   error
+		expectedSQL string
+	}{
+		{from: 1, to: 4, expectedSQL: "-- version 1: 1.up.stub (up)\nCREATE 1\nSET VERSION 1 DIRTY false;\n\n" +
+			"-- version 3: 3.up.stub (up)\nCREATE 3\nSET VERSION 3 DIRTY false;\n\n" +
+			"-- version 4: 4.up.stub (up)\nCREATE 4\nSET VERSION 4 DIRTY false;\n\n"},
+		{from: 5, to: 5, expectedSQL: "-- version 5: <empty> (up)\nSET VERSION 5 DIRTY false;\n\n"},
+		{from: 4, to: 1, expectedSQL: "-- version 4: 4.down.stub (down)\nDROP 4\nSET VERSION 3 DIRTY false;\n\n" +
+			"-- version 3: <empty> (down)\nSET VERSION 1 DIRTY false;\n\n" +
+			"-- version 1: 1.down.stub (down)\nDROP 1\nSET VERSION -1 DIRTY false;\n\n"},
+		{from: 1, to: 2, expectErr: os.ErrNotExist},
+	}
+
+	for i, v := range tt {
+		sql, err := m.Bundle(v.from, v.to)
+		if !errors.Is(err, v.expectErr) {
+			t.Fatalf("expected err %v, got %v, in %v", v.expectErr, err, i)
+		}
+		if sql != v.expectedSQL {
+			t.Errorf("expected bundle\n%v\ngot\n%v\nin %v", v.expectedSQL, sql, i)
+		}
+	}
+
+	// bundling never touches the database
+	if len(m.databaseDrv.(*dStub.Stub).MigrationSequence) != 0 {
+		t.Errorf("expected no migrations to run, got %v", m.databaseDrv.(*dStub.Stub).MigrationSequence)
+	}
+}
+
+func TestRequireMinVersion(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	var belowErr ErrBelowMinVersion
+	if err := m.RequireMinVersion(1); !errors.As(err, &belowErr) || belowErr.Version != -1 {
+		t.Fatalf("expected a fresh database to be below version 1, got %v", err)
+	}
+
+	if err := m.Migrate(3); err != nil {
+		t.Fatal(err)
+	}
+	tt := []struct {
+		minVersion uint
+		expectErr  bool
+	}{
+		{minVersion: 4, expectErr: true},
+		{minVersion: 3},
+		{minVersion: 1},
+	}
+	for _, v := range tt {
+		err := m.RequireMinVersion(v.minVersion)
+		if v.expectErr {
+			if !errors.As(err, &belowErr) || belowErr.Version != 3 || belowErr.MinVersion != v.minVersion {
+				t.Errorf("expected version 3 to be below %v, got %v", v.minVersion, err)
+			}
+		} else if err != nil {
+			t.Errorf("expected version 3 to satisfy %v, got %v", v.minVersion, err)
+		}
+	}
+	// checking never applies migrations
+	if len(dbDrv.MigrationSequence) != 2 {
+		t.Errorf("expected only migrations 1 and 3 to run, got %v", dbDrv.MigrationSequence)
+	}
+
+	if err := dbDrv.SetVersion(4, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RequireMinVersion(4); !errors.As(err, new(ErrDirty)) {
+		t.Fatalf("expected ErrDirty, got %v", err)
+	}
+}
+
+// finishingStub is a database another process finishes migrating to version 3
+// at its second lock
+type finishingStub struct {
+	*dStub.Stub
+	locks int
+}
+
+func (s *finishingStub) Lock() error {
+	if s.locks++; s.locks == 2 {
+		if err := s.Stub.SetVersion(3, false); err != nil {
+			return err
+		}
+	}
+	return s.Stub.Lock()
+}
+
+func TestDirtyWait(t *testing.T) {
+	tt := []struct {
+		dirtyWait time.Duration
+		expectErr bool
+	}{
+		{dirtyWait: 0, expectErr: true},
+		{dirtyWait: 5 * time.Second},
+	}
+	for _, v := range tt {
+		dbDrv, _ := dStub.WithInstance(nil, &dStub.Config{})
+		db := &finishingStub{Stub: dbDrv.(*dStub.Stub)}
+		srcDrv, _ := sStub.WithInstance(nil, &sStub.Config{})
+		srcDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+		m, err := NewWithInstance("stub", srcDrv, "stub", db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.DirtyWait = v.dirtyWait
+
+		// the other process is mid-migration
+		if err := db.SetVersion(3, true); err != nil {
+			t.Fatal(err)
+		}
+		err = m.Up()
+		if v.expectErr {
+			if !errors.As(err, new(ErrDirty)) {
+				t.Errorf("expected ErrDirty without waiting, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("expected the waiting process to proceed once the database is clean, got %v", err)
+		}
+		if db.CurrentVersion != 7 || db.IsDirty {
+			t.Errorf("expected clean version 7, got %v dirty %v", db.CurrentVersion, db.IsDirty)
+		}
+	}
+}
+
+func TestInterMigrationDelay(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	delay := 20 * time.Millisecond
+	m.SetInterMigrationDelay(delay)
+	start := time.Now()
+	// applies 1, 3 and 4, waiting twice
+	if err := m.Migrate(4); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*delay {
+		t.Errorf("expected migrating to take at least %v, took %v", 2*delay, elapsed)
+	}
+
+	// cancelling aborts the wait, the migrations applied before stay applied
+	ctx, cancel := context.WithCancel(context.Background())
+	m.Context = ctx
+	m.SetInterMigrationDelay(time.Hour)
+	time.AfterFunc(delay, cancel)
+	if err := m.Up(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if dbDrv.CurrentVersion != 5 || dbDrv.IsDirty {
+		t.Fatalf("expected clean version 5, got %v dirty %v", dbDrv.CurrentVersion, dbDrv.IsDirty)
+	}
+}
+
+// slowMock is a database taking delay to run each migration, aborting it
+// when the context is done
+type slowMock struct {
+	*mock.Mock
+	delay  time.Duration
+	ctxErr error
+}
+
+func newSlowMock(delay time.Duration) *slowMock {
+	s := &slowMock{Mock: mock.New(), delay: delay}
+	s.RunErr = func(string) error { return s.ctxErr }
+	return s
+}
+
+func (s *slowMock) RunContext(ctx context.Context, migration io.Reader) error {
+	select {
+	case <-ctx.Done():
+	case <-time.After(s.delay):
+	}
+	s.ctxErr = ctx.Err()
+	return s.Mock.Run(migration)
+}
+
+func TestTotalTimeout(t *testing.T) {
+	db := newSlowMock(50 * time.Millisecond)
+	srcDrv, _ := sStub.WithInstance(nil, &sStub.Config{})
+	srcDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	m, err := NewWithInstance("stub", srcDrv, "mock", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1 and 3 are applied in time, 4 is aborted
+	m.SetTotalTimeout(120 * time.Millisecond)
+	err = m.Up()
+	var timeoutErr ErrTotalTimeout
+	if !errors.As(err, &timeoutErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected ErrTotalTimeout, got %v", err)
+	}
+	if timeoutErr.Version != 4 {
+		t.Fatalf("expected the timeout to expire migrating to version 4, got %v", timeoutErr.Version)
+	}
+	if db.CurrentVersion != 3 || db.Dirty {
+		t.Fatalf("expected clean version 3, got %v dirty %v", db.CurrentVersion, db.Dirty)
+	}
+	if !reflect.DeepEqual(db.Applied, []string{"CREATE 1", "CREATE 3"}) {
+		t.Fatalf("expected the migrations before the timeout to stay applied, got %v", db.Applied)
+	}
+}
+
+func TestCurrentDownSQL(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	if _, err := m.CurrentDownSQL(); !errors.Is(err, ErrNilVersion) {
+		t.Fatalf("expected ErrNilVersion, got %v", err)
+	}
+
+	if err := m.Migrate(4); err != nil {
+		t.Fatal(err)
+	}
+	sql, err := m.CurrentDownSQL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sql != "DROP 4" {
+		t.Errorf("expected down migration DROP 4, got %q", sql)
+	}
+	// previewing never touches the database
+	if len(dbDrv.MigrationSequence) != 3 {
+		t.Errorf("expected only the up migrations to run, got %v", dbDrv.MigrationSequence)
+	}
+
+	// version 3 has no down migration
+	if err := m.Migrate(3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CurrentDownSQL(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+
+	if err := dbDrv.SetVersion(4, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CurrentDownSQL(); !errors.As(err, new(ErrDirty)) {
+		t.Fatalf("expected ErrDirty, got %v", err)
+	}
+}
+
+func TestRollbackPlan(t *testing.T) {
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE TABLE users (id int)"})
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "DROP TABLE users"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE TABLE orders (id int)"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Down,
+		Identifier: "DROP INDEX orders_id;\n-- DROP TABLE ignored;\nDROP TABLE orders;\nDROP TABLE IF EXISTS order_items"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "ALTER TABLE users ADD email text"})
+	migrations.Append(&source.Migration{Version: 4, Direction: source.Up, Identifier: "CREATE TYPE mood"})
+	migrations.Append(&source.Migration{Version: 4, Direction: source.Down,
+		Identifier: "ALTER TABLE users DROP COLUMN mood;\nUPDATE users SET email = 'x;y';\nDROP TYPE mood;"})
+
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	if _, err := m.RollbackPlan(1); !errors.Is(err, ErrNilVersion) {
+		t.Fatalf("expected ErrNilVersion, got %v", err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	applied := len(dbDrv.MigrationSequence)
+
+	summary, err := m.RollbackPlan(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// version 3 has no down migration, it's only unrecorded
+	expected := RollbackSummary{Versions: []uint{4, 3, 2}, DownMigrations: 2, Statements: 6,
+		Drops: 4, Alters: 1, DropTables: 2}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, summary)
+	}
+	// planning never touches the database
+	if len(dbDrv.MigrationSequence) != applied || dbDrv.CurrentVersion != 4 {
+		t.Fatalf("expected nothing to run, got %v at version %d", dbDrv.MigrationSequence, dbDrv.CurrentVersion)
+	}
+
+	if summary, err = m.RollbackPlan(4); err != nil || len(summary.Versions) != 0 {
+		t.Fatalf("expected an empty plan for the current version, got %+v, %v", summary, err)
+	}
+	if _, err := m.RollbackPlan(5); err == nil {
+		t.Fatal("expected a version above the current one to fail")
+	}
+}
+
+func TestSourceFingerprint(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+
+	fingerprint, err := m.SourceFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := m.SourceFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint != again {
+		t.Fatalf("expected stable fingerprint, got %v and %v", fingerprint, again)
+	}
+
+	// same migrations, with the contents of version 4 up changed
+	changed := source.NewMigrations()
+	changed.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	changed.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "DROP 1"})
+	changed.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "CREATE 3"})
+	changed.Append(&source.Migration{Version: 4, Direction: source.Up, Identifier: "CREATE 4 CHANGED"})
+	changed.Append(&source.Migration{Version: 4, Direction: source.Down, Identifier: "DROP 4"})
+	changed.Append(&source.Migration{Version: 5, Direction: source.Down, Identifier: "DROP 5"})
+	changed.Append(&source.Migration{Version: 7, Direction: source.Up, Identifier: "CREATE 7"})
+	changed.Append(&source.Migration{Version: 7, Direction: source.Down, Identifier: "DROP 7"})
+	m.sourceDrv.(*sStub.Stub).Migrations = changed
+
+	changedFingerprint, err := m.SourceFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changedFingerprint == fingerprint {
+		t.Fatalf("expected fingerprint to change with the contents, got %v", changedFingerprint)
+	}
+}
+
+func TestCheckGaps(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	for v := uint(1); v <= 5; v++ {
+		migrations.Append(&source.Migration{Version: v, Direction: source.Up, Identifier: fmt.Sprintf("CREATE %d", v)})
+	}
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+
+	// version 3 was merged after version 4 already ran
+	for _, v := range []uint{1, 2, 4} {
+		migr, err := m.newMigration(v, int(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(migr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gaps, err := m.CheckGaps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gaps, []uint{3}) {
+		t.Fatalf("expected gaps [3], got %v", gaps)
+	}
+}
+
+func TestCatalogUnsupported(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	if _, err := m.Catalog(); !errors.Is(err, ErrNoCatalog) {
+		t.Fatalf("expected ErrNoCatalog, got %v", err)
+	}
+}
+
+// lockProbe records whether the database lock was held while migrations ran
+// and when their clean version was recorded
+type lockProbe struct {
+	*dStub.Stub
+	lockedDuringRun []bool
+	lockedAfterRun  []bool
+}
+
+func (l *lockProbe) locked() bool {
+	if err := l.Stub.Lock(); err != nil {
+		return true
+	}
+	return l.Stub.Unlock() != nil
+}
+
+func (l *lockProbe) Run(migration io.Reader) error {
+	l.lockedDuringRun = append(l.lockedDuringRun, l.locked())
+	return l.Stub.Run(migration)
+}
+
+func (l *lockProbe) SetVersion(version int, dirty bool) error {
+	if !dirty {
+		l.lockedAfterRun = append(l.lockedAfterRun, l.locked())
+	}
+	return l.Stub.SetVersion(version, dirty)
+}
+
+func TestNoLockDirective(t *testing.T) {
+	d, _ := dStub.WithInstance(nil, &dStub.Config{})
+	probe := &lockProbe{Stub: d.(*dStub.Stub)}
+	m, err := NewWithDatabaseInstance("stub://", "stub", probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locked, err := NewMigration(ioutil.NopCloser(strings.NewReader("CREATE 1")), "locked", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlocked, err := NewMigration(ioutil.NopCloser(strings.NewReader(
+		"-- build the index without blocking deploys\n-- "+NoLockDirective+"\nCREATE INDEX CONCURRENTLY 2")), "unlocked", 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(locked, unlocked); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(probe.lockedDuringRun, []bool{true, false}) {
+		t.Fatalf("expected the lock to be released only while the no-lock migration ran, got %v", probe.lockedDuringRun)
+	}
+	if !reflect.DeepEqual(probe.lockedAfterRun, []bool{true, true}) {
+		t.Fatalf("expected the lock to be held when recording versions, got %v", probe.lockedAfterRun)
+	}
+	if !strings.HasSuffix(string(probe.LastRunMigration), "CREATE INDEX CONCURRENTLY 2") {
+		t.Fatalf("expected the whole migration to run, got %q", probe.LastRunMigration)
+	}
+}
+
+func TestNoopDirective(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	noop, err := NewMigration(ioutil.NopCloser(strings.NewReader(
+		"-- moved to the billing service\n-- "+NoopDirective+"\n")), "moved", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(noop); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.CurrentVersion != 1 || dbDrv.IsDirty {
+		t.Fatalf("expected clean version 1, got %v dirty %v", dbDrv.CurrentVersion, dbDrv.IsDirty)
+	}
+	if len(dbDrv.MigrationSequence) != 0 {
+		t.Fatalf("expected nothing to run, got %v", dbDrv.MigrationSequence)
+	}
+
+	empty, err := NewMigration(ioutil.NopCloser(strings.NewReader("\n-- TODO\n")), "empty", 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(empty); !errors.As(err, new(ErrEmptyMigration)) {
+		t.Fatalf("expected ErrEmptyMigration, got %v", err)
+	}
+	if dbDrv.CurrentVersion != 1 {
+		t.Fatalf("expected the version to stay 1, got %v", dbDrv.CurrentVersion)
+	}
+}
+
 func migrationsFromChannel(ret chan interface{}) ([]*Migration, error) {
 	slice := make([]*Migration, 0)
 	for r := range ret {
@@ -1439,3 +2105,423 @@ func equalDbSeq(t *testing.T, i int, expected migrationSequence, got *dStub.Stub
 		t.Fatalf("\nexpected sequence %v,\ngot               %v, in %v", bs, got.MigrationSequence, i)
 	}
 }
+
+// failingStub is a database that fails running migrations while fail is set
+type failingStub struct {
+	*dStub.Stub
+	fail bool
+}
+
+func (s *failingStub) Run(migration io.Reader) error {
+	if s.fail {
+		return errors.New("permission denied")
+	}
+	return s.Stub.Run(migration)
+}
+
+func TestRetryCurrent(t *testing.T) {
+	dbDrv, _ := dStub.WithInstance(nil, &dStub.Config{})
+	db := &failingStub{Stub: dbDrv.(*dStub.Stub)}
+	srcDrv, _ := sStub.WithInstance(nil, &sStub.Config{})
+	srcDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	m, err := NewWithInstance("stub", srcDrv, "stub", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RetryCurrent(); !errors.Is(err, ErrNotDirty) {
+		t.Fatalf("expected ErrNotDirty, got %v", err)
+	}
+	if err := m.Migrate(1); err != nil {
+		t.Fatal(err)
+	}
+	db.fail = true
+	if err := m.Steps(1); err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+	if db.CurrentVersion != 3 || !db.IsDirty {
+		t.Fatalf("expected dirty version 3, got %v dirty %v", db.CurrentVersion, db.IsDirty)
+	}
+
+	// the operator fixed what made the migration fail
+	db.fail = false
+	if err := m.RetryCurrent(); err != nil {
+		t.Fatal(err)
+	}
+	if db.CurrentVersion != 3 || db.IsDirty {
+		t.Fatalf("expected clean version 3, got %v dirty %v", db.CurrentVersion, db.IsDirty)
+	}
+	if !db.EqualSequence([]string{"CREATE 1", "CREATE 3"}) {
+		t.Fatalf("expected the migration of version 3 to run again, got %v", db.MigrationSequence)
+	}
+	if err := m.RetryCurrent(); !errors.Is(err, ErrNotDirty) {
+		t.Fatalf("expected ErrNotDirty once the database is clean, got %v", err)
+	}
+}
+
+// directedStub is a database reporting the direction of the migration that
+// failed
+type directedStub struct {
+	*failingStub
+	direction string
+}
+
+func (s *directedStub) FailedDirection(version int) (string, error) {
+	return s.direction, nil
+}
+
+func TestRetryCurrentDown(t *testing.T) {
+	dbDrv, _ := dStub.WithInstance(nil, &dStub.Config{})
+	db := &directedStub{failingStub: &failingStub{Stub: dbDrv.(*dStub.Stub)}}
+	srcDrv, _ := sStub.WithInstance(nil, &sStub.Config{})
+	srcDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	m, err := NewWithInstance("stub", srcDrv, "stub", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Migrate(4); err != nil {
+		t.Fatal(err)
+	}
+	db.fail = true
+	if err := m.Steps(-1); err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+	if db.CurrentVersion != 3 || !db.IsDirty {
+		t.Fatalf("expected dirty version 3, got %v dirty %v", db.CurrentVersion, db.IsDirty)
+	}
+
+	// the down migration of version 4 runs again, not the up one of version 3
+	db.fail = false
+	db.direction = "down"
+	if err := m.RetryCurrent(); err != nil {
+		t.Fatal(err)
+	}
+	if db.CurrentVersion != 3 || db.IsDirty {
+		t.Fatalf("expected clean version 3, got %v dirty %v", db.CurrentVersion, db.IsDirty)
+	}
+	if !db.EqualSequence([]string{"CREATE 1", "CREATE 3", "CREATE 4", "DROP 4"}) {
+		t.Fatalf("expected the down migration of version 4 to run again, got %v", db.MigrationSequence)
+	}
+}
+
+// resumableMock is a database persisting the resume token in the transaction
+// of the migration recording it
+type resumableMock struct {
+	*mock.Mock
+	token, txToken []byte
+	// disabled is a store not configured to persist resume tokens
+	disabled bool
+}
+
+func (r *resumableMock) Begin() error {
+	r.txToken = r.token
+	return r.Mock.Begin()
+}
+
+func (r *resumableMock) Rollback() error {
+	r.token = r.txToken
+	return r.Mock.Rollback()
+}
+
+func (r *resumableMock) SetResumeToken(token []byte) error {
+	if r.disabled {
+		return ErrNoResume
+	}
+	r.token = token
+	return nil
+}
+
+func (r *resumableMock) ResumeToken() ([]byte, error) {
+	if r.disabled {
+		return nil, ErrNoResume
+	}
+	return r.token, nil
+}
+
+func TestResume(t *testing.T) {
+	db := &resumableMock{Mock: mock.New()}
+	migrations := source.NewMigrations()
+	for v := uint(1); v <= 4; v++ {
+		migrations.Append(&source.Migration{Version: v, Direction: source.Up, Identifier: fmt.Sprintf("CREATE %v", v)})
+	}
+	srcDrv, _ := sStub.WithInstance(nil, &sStub.Config{})
+	srcDrv.(*sStub.Stub).Migrations = migrations
+	m, err := NewWithInstance("stub", srcDrv, "mock", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Resume(); !errors.Is(err, ErrNoChange) {
+		t.Fatalf("expected ErrNoChange without an interrupted run, got %v", err)
+	}
+
+	// the run is interrupted after migration 2
+	interrupted := errors.New("interrupted")
+	db.RunErr = func(migration string) error {
+		if migration == "CREATE 3" {
+			return interrupted
+		}
+		return nil
+	}
+	if err := m.Up(); !errors.Is(err, interrupted) {
+		t.Fatalf("expected the interruption, got %v", err)
+	}
+	var token ResumeToken
+	if err := json.Unmarshal(db.token, &token); err != nil {
+		t.Fatal(err)
+	}
+	if token.Version != 2 || token.Direction != "up" {
+		t.Fatalf("expected a resume token of version 2 up, got %+v", token)
+	}
+
+	db.RunErr = nil
+	db.Applied = nil
+	if err := m.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"CREATE 3", "CREATE 4"}; !reflect.DeepEqual(db.Applied, want) {
+		t.Fatalf("expected Resume to apply %v, got %v", want, db.Applied)
+	}
+	if db.token != nil {
+		t.Fatalf("expected the resume token cleared, got %s", db.token)
+	}
+	if err := m.Resume(); !errors.Is(err, ErrNoChange) {
+		t.Fatalf("expected ErrNoChange once resumed, got %v", err)
+	}
+}
+
+func TestResumeNotPersisted(t *testing.T) {
+	db := &resumableMock{Mock: mock.New(), disabled: true}
+	srcDrv, _ := sStub.WithInstance(nil, &sStub.Config{})
+	srcDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	m, err := NewWithInstance("stub", srcDrv, "mock", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// runs go on without resume tokens
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Resume(); !errors.Is(err, ErrNoResume) {
+		t.Fatalf("expected ErrNoResume, got %v", err)
+	}
+}
+
+// hashingMock is a database recording the digests of the statements of each
+// migration it runs with its version
+type hashingMock struct {
+	*mock.Mock
+	pending []string
+	hashes  map[uint][]string
+}
+
+func (h *hashingMock) Run(migration io.Reader) error {
+	var err error
+	h.pending, err = multistmt.HashStatements(migration)
+	return err
+}
+
+func (h *hashingMock) SetVersion(version int, dirty bool) error {
+	if !dirty && h.pending != nil {
+		h.hashes[uint(version)] = h.pending
+		h.pending = nil
+	}
+	return h.Mock.SetVersion(version, dirty)
+}
+
+func (h *hashingMock) StatementHashes(version uint) ([]string, error) {
+	return h.hashes[version], nil
+}
+
+func TestVerifyStatements(t *testing.T) {
+	db := &hashingMock{Mock: mock.New(), hashes: map[uint][]string{}}
+	srcDrv, _ := sStub.WithInstance(nil, &sStub.Config{})
+	stub := srcDrv.(*sStub.Stub)
+	stub.Migrations = source.NewMigrations()
+	stub.Migrations.Append(&source.Migration{Version: 1, Direction: source.Up,
+		Identifier: "CREATE TABLE users (id int);\nCREATE TABLE orders (id int);\nINSERT INTO users VALUES (1);"})
+	m, err := NewWithInstance("stub", srcDrv, "mock", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.VerifyStatements(1); err != nil {
+		t.Fatalf("expected the applied statements to match, got %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		migration string
+		wantIndex int
+	}{
+		{name: "reformatted", migration: "CREATE TABLE users (id int);\n\nCREATE TABLE orders\n  (id int);\nINSERT INTO users VALUES (1);", wantIndex: -1},
+		{name: "edited", migration: "CREATE TABLE users (id int);\nCREATE TABLE orders (id bigint);\nINSERT INTO users VALUES (1);", wantIndex: 1},
+		{name: "appended", migration: "CREATE TABLE users (id int);\nCREATE TABLE orders (id int);\nINSERT INTO users VALUES (1);\nINSERT INTO users VALUES (2);", wantIndex: 3},
+		{name: "removed", migration: "CREATE TABLE users (id int);\nCREATE TABLE orders (id int);", wantIndex: 2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stub.Migrations = source.NewMigrations()
+			stub.Migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: tc.migration})
+			err := m.VerifyStatements(1)
+			if tc.wantIndex < 0 {
+				if err != nil {
+					t.Fatalf("expected no drift, got %v", err)
+				}
+				return
+			}
+			var drift ErrStatementDrift
+			if !errors.As(err, &drift) {
+				t.Fatalf("expected an ErrStatementDrift, got %v", err)
+			}
+			if drift.Version != 1 || drift.Index != tc.wantIndex {
+				t.Fatalf("expected statement %v of version 1 to differ, got %+v", tc.wantIndex, drift)
+			}
+		})
+	}
+
+	if err := m.VerifyStatements(2); err == nil {
+		t.Fatal("expected an error for a version without statement hashes")
+	}
+}
+
+func TestRequireDown(t *testing.T) {
+	db := mock.New()
+	migrations := source.NewMigrations()
+	for _, v := range []uint{1, 2, 3, 4} {
+		migrations.Append(&source.Migration{Version: v, Direction: source.Up, Identifier: fmt.Sprintf("CREATE %v", v)})
+		if v != 2 && v != 4 {
+			migrations.Append(&source.Migration{Version: v, Direction: source.Down, Identifier: fmt.Sprintf("DROP %v", v)})
+		}
+	}
+	srcDrv, _ := sStub.WithInstance(nil, &sStub.Config{})
+	srcDrv.(*sStub.Stub).Migrations = migrations
+	m, err := NewWithInstance("stub", srcDrv, "mock", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.RequireDown = true
+
+	// the whole pending set is checked before any up runs
+	var missing ErrMissingDown
+	if err := m.Up(); !errors.As(err, &missing) {
+		t.Fatalf("expected ErrMissingDown, got %v", err)
+	}
+	if want := []uint{2, 4}; !reflect.DeepEqual(missing.Versions, want) {
+		t.Fatalf("expected versions %v without a down migration, got %v", want, missing.Versions)
+	}
+	if !strings.Contains(missing.Error(), "2, 4") {
+		t.Fatalf("expected the error to name versions 2 and 4, got %q", missing.Error())
+	}
+	if len(db.Applied) != 0 || db.CurrentVersion != database.NilVersion {
+		t.Fatalf("expected nothing applied, got %v up to version %v", db.Applied, db.CurrentVersion)
+	}
+
+	// only the migrations a run would apply are checked
+	if err := m.Steps(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Migrate(2); !errors.As(err, &missing) || !reflect.DeepEqual(missing.Versions, []uint{2}) {
+		t.Fatalf("expected ErrMissingDown for version 2, got %v", err)
+	}
+	if want := []string{"CREATE 1"}; !reflect.DeepEqual(db.Applied, want) {
+		t.Fatalf("expected %v applied, got %v", want, db.Applied)
+	}
+
+	m.RequireDown = false
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// retryingMock is a database failing each migration with a
+// database.RetryError the first retries times it's run
+type retryingMock struct {
+	*mock.Mock
+	retries int
+}
+
+func (r *retryingMock) Run(migration io.Reader) error {
+	body, err := io.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+	if r.retries > 0 {
+		r.retries--
+		return &database.RetryError{Err: errors.New("lock not available"), Migration: body}
+	}
+	return r.Mock.Run(bytes.NewReader(body))
+}
+
+func TestRetryError(t *testing.T) {
+	db := &retryingMock{Mock: mock.New(), retries: 2}
+	srcDrv, _ := sStub.WithInstance(nil, &sStub.Config{})
+	srcDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	m, err := NewWithInstance("stub", srcDrv, "mock", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Migrate(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// each retry rolls back and records the version dirty in a new
+	// transaction
+	want := []string{"Lock", "Version",
+		"Begin", "SetVersion(1, true)", "Rollback",
+		"Begin", "SetVersion(1, true)", "Rollback",
+		"Begin", "SetVersion(1, true)", "Run(CREATE 1)", "SetVersion(1, false)", "Commit", "Unlock"}
+	if !reflect.DeepEqual(db.Calls, want) {
+		t.Fatalf("expected calls %v, got %v", want, db.Calls)
+	}
+	if db.CurrentVersion != 1 || db.Dirty {
+		t.Fatalf("expected clean version 1, got %v dirty %v", db.CurrentVersion, db.Dirty)
+	}
+}
+
+// decliningMock is a database declining the migrations to the versions in
+// declined
+type decliningMock struct {
+	*mock.Mock
+	declined map[int]bool
+	err      error
+}
+
+func (s *decliningMock) ShouldApply(version int) (bool, error) {
+	return !s.declined[version], s.err
+}
+
+func TestShouldApply(t *testing.T) {
+	db := &decliningMock{Mock: mock.New(), declined: map[int]bool{3: true}}
+	srcDrv, _ := sStub.WithInstance(nil, &sStub.Config{})
+	srcDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	m, err := NewWithInstance("stub", srcDrv, "mock", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the declined migration is recorded without running
+	if err := m.Migrate(4); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"CREATE 1", "CREATE 4"}; !reflect.DeepEqual(db.Applied, want) {
+		t.Fatalf("expected %v applied, got %v", want, db.Applied)
+	}
+	if db.CurrentVersion != 4 || db.Dirty {
+		t.Fatalf("expected clean version 4, got %v dirty %v", db.CurrentVersion, db.Dirty)
+	}
+
+	// failing to decide fails the migration before its version is recorded,
+	// version 5 has no up migration to decide on
+	db.err = errors.New("undecided")
+	if err := m.Migrate(7); !errors.Is(err, db.err) {
+		t.Fatalf("expected the error deciding, got %v", err)
+	}
+	if db.CurrentVersion != 5 || db.Dirty {
+		t.Fatalf("expected clean version 5, got %v dirty %v", db.CurrentVersion, db.Dirty)
+	}
+}
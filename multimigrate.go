@@ -0,0 +1,117 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrMultiMigrate is returned by MultiMigrate when migrating some of its
+// databases failed.
+type ErrMultiMigrate struct {
+	// Errs are the errors migrating each database that failed, by the index of
+	// its instance in MultiMigrate.Instances.
+	Errs map[int]error
+}
+
+// Error implements the error interface.
+func (e ErrMultiMigrate) Error() string {
+	indexes := make([]int, 0, len(e.Errs))
+	for i := range e.Errs {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	msgs := make([]string, 0, len(indexes))
+	for _, i := range indexes {
+		msgs = append(msgs, fmt.Sprintf("database %v: %v", i, e.Errs[i]))
+	}
+	return fmt.Sprintf("migrating %v database(s) failed: %s", len(e.Errs), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the errors of the databases, for errors.Is and errors.As.
+func (e ErrMultiMigrate) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// MultiMigrate applies the same migrations to several databases, e.g. the
+// shards tenants are spread across. The databases are migrated one after
+// another, in the order of Instances.
+type MultiMigrate struct {
+	Instances []*Migrate
+
+	// BestEffort keeps migrating the remaining databases after migrating one
+	// of them failed. By default MultiMigrate stops at the first failure.
+	// Either way the errors are reported together with ErrMultiMigrate.
+	BestEffort bool
+}
+
+// NewMulti returns a new MultiMigrate instance applying the migrations of the
+// source URL to each of the database URLs.
+func NewMulti(sourceURL string, databaseURLs ...string) (*MultiMigrate, error) {
+	mm := &MultiMigrate{}
+	for _, databaseURL := range databaseURLs {
+		m, err := New(sourceURL, databaseURL)
+		if err != nil {
+			mm.Close()
+			return nil, err
+		}
+		mm.Instances = append(mm.Instances, m)
+	}
+	return mm, nil
+}
+
+// Close closes the sources and the databases of all instances, returning the
+// errors closing them joined.
+func (mm *MultiMigrate) Close() error {
+	var errs []error
+	for _, m := range mm.Instances {
+		srcErr, dbErr := m.Close()
+		errs = append(errs, srcErr, dbErr)
+	}
+	return errors.Join(errs...)
+}
+
+// Up applies all up migrations to every database. It returns ErrNoChange if
+// none of them changed.
+func (mm *MultiMigrate) Up() error {
+	return mm.each(func(m *Migrate) error { return m.Up() })
+}
+
+// Migrate migrates every database up or down to the specified version. It
+// returns ErrNoChange if none of them changed.
+func (mm *MultiMigrate) Migrate(version uint) error {
+	return mm.each(func(m *Migrate) error { return m.Migrate(version) })
+}
+
+// each runs migrate for every instance, stopping at the first failure unless
+// BestEffort is set
+func (mm *MultiMigrate) each(migrate func(m *Migrate) error) error {
+	errs := make(map[int]error)
+	changed := false
+	for i, m := range mm.Instances {
+		err := migrate(m)
+		if errors.Is(err, ErrNoChange) {
+			continue
+		}
+		if err != nil {
+			errs[i] = err
+			if !mm.BestEffort {
+				break
+			}
+			continue
+		}
+		changed = true
+	}
+	if len(errs) > 0 {
+		return ErrMultiMigrate{Errs: errs}
+	}
+	if !changed {
+		return ErrNoChange
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package migrate
+
+import (
+	"errors"
+	"testing"
+
+	dStub "github.com/getoutreach/migrate/v4/database/stub"
+	sStub "github.com/getoutreach/migrate/v4/source/stub"
+)
+
+func newMultiStub(t *testing.T, databases int) *MultiMigrate {
+	urls := make([]string, databases)
+	for i := range urls {
+		urls[i] = "stub://"
+	}
+	mm, err := NewMulti("stub://", urls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mm.Instances {
+		m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	}
+	return mm
+}
+
+func TestMultiMigrate(t *testing.T) {
+	mm := newMultiStub(t, 2)
+	defer func() {
+		if err := mm.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if err := mm.Migrate(4); err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range mm.Instances {
+		if v := m.databaseDrv.(*dStub.Stub).CurrentVersion; v != 4 {
+			t.Errorf("expected database %v at version 4, got %v", i, v)
+		}
+	}
+	if err := mm.Migrate(4); !errors.Is(err, ErrNoChange) {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+
+	if err := mm.Up(); err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range mm.Instances {
+		if v := m.databaseDrv.(*dStub.Stub).CurrentVersion; v != 7 {
+			t.Errorf("expected database %v at version 7, got %v", i, v)
+		}
+	}
+}
+
+func TestMultiMigrateFailure(t *testing.T) {
+	for _, bestEffort := range []bool{false, true} {
+		mm := newMultiStub(t, 3)
+		mm.BestEffort = bestEffort
+		// the first database is dirty, migrating it fails
+		if err := mm.Instances[0].databaseDrv.SetVersion(1, true); err != nil {
+			t.Fatal(err)
+		}
+
+		err := mm.Up()
+		var multiErr ErrMultiMigrate
+		if !errors.As(err, &multiErr) || len(multiErr.Errs) != 1 {
+			t.Fatalf("expected one database to fail, got %v", err)
+		}
+		if !errors.As(multiErr.Errs[0], new(ErrDirty)) || !errors.As(err, new(ErrDirty)) {
+			t.Errorf("expected the first database to be dirty, got %v", err)
+		}
+
+		// fail-fast doesn't migrate the databases after the failed one
+		want := -1
+		if bestEffort {
+			want = 7
+		}
+		for i, m := range mm.Instances[1:] {
+			if v := m.databaseDrv.(*dStub.Stub).CurrentVersion; v != want {
+				t.Errorf("best effort %v: expected database %v at version %v, got %v", bestEffort, i+1, want, v)
+			}
+		}
+		if err := mm.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Package database reads migrations from a table in a SQL database, e.g. one
+// managed by another service, through a *sql.DB given to WithInstance.
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+
+	"github.com/getoutreach/migrate/v4/source"
+)
+
+func init() {
+	source.Register("database", &Database{})
+}
+
+var (
+	DefaultTable         = "migration_scripts"
+	DefaultVersionColumn = "version"
+	DefaultNameColumn    = "name"
+	DefaultUpColumn      = "up_sql"
+	DefaultDownColumn    = "down_sql"
+)
+
+var (
+	ErrNilDB     = fmt.Errorf("no database")
+	ErrNilConfig = fmt.Errorf("no config")
+)
+
+// Config maps the table migrations are read from, every field defaults to
+// the matching Default value. Table may be qualified with its schema, e.g.
+// control.migration_scripts. The up and down columns are NULL for versions
+// without an up or down migration.
+type Config struct {
+	Table         string
+	VersionColumn string
+	NameColumn    string
+	UpColumn      string
+	DownColumn    string
+}
+
+type Database struct {
+	db         *sql.DB
+	config     *Config
+	migrations *source.Migrations
+}
+
+// Open isn't supported, the driver reads from a *sql.DB given to WithInstance
+func (d *Database) Open(url string) (source.Driver, error) {
+	return nil, fmt.Errorf("not yet implemented, use WithInstance")
+}
+
+// WithInstance lists the migrations in the configured table of db, their
+// contents are read when they're run.
+func WithInstance(db *sql.DB, config *Config) (source.Driver, error) {
+	if db == nil {
+		return nil, ErrNilDB
+	}
+	if config == nil {
+		return nil, ErrNilConfig
+	}
+	c := *config
+	for _, f := range []struct {
+		field    *string
+		fallback string
+	}{
+		{&c.Table, DefaultTable},
+		{&c.VersionColumn, DefaultVersionColumn},
+		{&c.NameColumn, DefaultNameColumn},
+		{&c.UpColumn, DefaultUpColumn},
+		{&c.DownColumn, DefaultDownColumn},
+	} {
+		if *f.field == "" {
+			*f.field = f.fallback
+		}
+	}
+
+	d := &Database{
+		db:         db,
+		config:     &c,
+		migrations: source.NewMigrations(),
+	}
+	query := fmt.Sprintf(`SELECT %s, %s, %s IS NOT NULL, %s IS NOT NULL FROM %s ORDER BY %s`,
+		pq.QuoteIdentifier(c.VersionColumn), pq.QuoteIdentifier(c.NameColumn),
+		pq.QuoteIdentifier(c.UpColumn), pq.QuoteIdentifier(c.DownColumn),
+		d.table(), pq.QuoteIdentifier(c.VersionColumn))
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("listing migrations in %s: %w", c.Table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			version      uint
+			name         string
+			hasUp, hasDn bool
+		)
+		if err := rows.Scan(&version, &name, &hasUp, &hasDn); err != nil {
+			return nil, err
+		}
+		if hasUp {
+			d.migrations.Append(&source.Migration{Version: version, Identifier: name, Direction: source.Up})
+		}
+		if hasDn {
+			d.migrations.Append(&source.Migration{Version: version, Identifier: name, Direction: source.Down})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// table returns the quoted, optionally schema qualified, table name
+func (d *Database) table() string {
+	parts := strings.Split(d.config.Table, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Close doesn't close the *sql.DB, which is owned by the caller
+func (d *Database) Close() error {
+	return nil
+}
+
+func (d *Database) First() (version uint, err error) {
+	if v, ok := d.migrations.First(); ok {
+		return v, nil
+	}
+	return 0, &os.PathError{Op: "first", Path: d.config.Table, Err: os.ErrNotExist}
+}
+
+func (d *Database) Prev(version uint) (prevVersion uint, err error) {
+	if v, ok := d.migrations.Prev(version); ok {
+		return v, nil
+	}
+	return 0, &os.PathError{Op: fmt.Sprintf("prev for version %v", version), Path: d.config.Table, Err: os.ErrNotExist}
+}
+
+func (d *Database) Next(version uint) (nextVersion uint, err error) {
+	if v, ok := d.migrations.Next(version); ok {
+		return v, nil
+	}
+	return 0, &os.PathError{Op: fmt.Sprintf("next for version %v", version), Path: d.config.Table, Err: os.ErrNotExist}
+}
+
+func (d *Database) ReadUp(version uint) (r io.ReadCloser, identifier string, err error) {
+	if m, ok := d.migrations.Up(version); ok {
+		r, err := d.read(version, d.config.UpColumn)
+		if err != nil {
+			return nil, "", err
+		}
+		return r, m.Identifier, nil
+	}
+	return nil, "", &os.PathError{Op: fmt.Sprintf("read version %v", version), Path: d.config.Table, Err: os.ErrNotExist}
+}
+
+func (d *Database) ReadDown(version uint) (r io.ReadCloser, identifier string, err error) {
+	if m, ok := d.migrations.Down(version); ok {
+		r, err := d.read(version, d.config.DownColumn)
+		if err != nil {
+			return nil, "", err
+		}
+		return r, m.Identifier, nil
+	}
+	return nil, "", &os.PathError{Op: fmt.Sprintf("read version %v", version), Path: d.config.Table, Err: os.ErrNotExist}
+}
+
+// read reads the SQL in column of the row of version
+func (d *Database) read(version uint, column string) (io.ReadCloser, error) {
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE %s = $1`,
+		pq.QuoteIdentifier(column), d.table(), pq.QuoteIdentifier(d.config.VersionColumn))
+	var body []byte
+	if err := d.db.QueryRow(query, version).Scan(&body); err != nil {
+		return nil, fmt.Errorf("reading version %v from %s: %w", version, d.config.Table, err)
+	}
+	return io.NopCloser(bytes.NewReader(body)), nil
+}
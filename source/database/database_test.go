@@ -0,0 +1,116 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/dhui/dktest"
+
+	"github.com/getoutreach/migrate/v4"
+	_ "github.com/getoutreach/migrate/v4/database/stub"
+	"github.com/getoutreach/migrate/v4/dktesting"
+	st "github.com/getoutreach/migrate/v4/source/testing"
+)
+
+const pgPassword = "postgres"
+
+var (
+	opts = dktest.Options{
+		Env:          map[string]string{"POSTGRES_PASSWORD": pgPassword},
+		PortRequired: true, ReadyFunc: isReady}
+	specs = []dktesting.ContainerSpec{
+		{ImageName: "postgres:13", Options: opts},
+	}
+)
+
+func pgConnectionString(host, port string) string {
+	return fmt.Sprintf("postgres://postgres:%s@%s:%s/postgres?sslmode=disable", pgPassword, host, port)
+}
+
+func isReady(ctx context.Context, c dktest.ContainerInfo) bool {
+	ip, port, err := c.FirstPort()
+	if err != nil {
+		return false
+	}
+	db, err := sql.Open("postgres", pgConnectionString(ip, port))
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	return db.PingContext(ctx) == nil
+}
+
+// openScripts creates a table with the migrations source/testing expects,
+// using the column mapping of config
+func openScripts(t *testing.T, c dktest.ContainerInfo, config *Config) *sql.DB {
+	ip, port, err := c.FirstPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("postgres", pgConnectionString(ip, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(fmt.Sprintf(`CREATE TABLE %s (%s bigint PRIMARY KEY, %s text NOT NULL, %s text, %s text);
+		INSERT INTO %[1]s VALUES
+			(1, 'one', 'CREATE 1', 'DROP 1'),
+			(3, 'three', 'CREATE 3', NULL),
+			(4, 'four', 'CREATE 4', 'DROP 4'),
+			(5, 'five', NULL, 'DROP 5'),
+			(7, 'seven', 'CREATE 7', 'DROP 7');`,
+		config.Table, config.VersionColumn, config.NameColumn, config.UpColumn, config.DownColumn)); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func Test(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		config := &Config{Table: DefaultTable, VersionColumn: DefaultVersionColumn,
+			NameColumn: DefaultNameColumn, UpColumn: DefaultUpColumn, DownColumn: DefaultDownColumn}
+		db := openScripts(t, c, config)
+		defer db.Close()
+
+		d, err := WithInstance(db, &Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.Test(t, d)
+	})
+}
+
+func TestColumnMapping(t *testing.T) {
+	dktesting.ParallelTest(t, specs, func(t *testing.T, c dktest.ContainerInfo) {
+		config := &Config{Table: "public.scripts", VersionColumn: "id",
+			NameColumn: "title", UpColumn: "apply", DownColumn: "revert"}
+		db := openScripts(t, c, config)
+		defer db.Close()
+
+		d, err := WithInstance(db, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := migrate.NewWithSourceInstance("database", d, "stub://")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Up(); err != nil {
+			t.Fatal(err)
+		}
+		v, err := m.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != 7 {
+			t.Fatalf("expected version 7, got %v", v.Version)
+		}
+	})
+}
+
+func TestOpen(t *testing.T) {
+	if _, err := (&Database{}).Open("database://"); err == nil {
+		t.Fatal("expected Open to fail")
+	}
+}
@@ -0,0 +1,10 @@
+package source
+
+// DefaultEncryptedSuffix is the file name suffix of encrypted migrations when
+// none is configured
+const DefaultEncryptedSuffix = ".enc"
+
+// Decryptor decrypts the contents of the encrypted migration file name, e.g.
+// to store migrations with sensitive seed data encrypted at rest. The
+// decrypted migration is then read like any other.
+type Decryptor func(name string, ciphertext []byte) ([]byte, error)
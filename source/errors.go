@@ -1,9 +1,17 @@
 package source
 
-import "os"
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
 
 // ErrDuplicateMigration is an error type for reporting duplicate migration
 // files.
+//
+// Deprecated: drivers report duplicate versions with ErrDuplicateVersion,
+// which names all the conflicting files. errors.As still matches it.
 type ErrDuplicateMigration struct {
 	Migration
 	os.FileInfo
@@ -13,3 +21,59 @@ type ErrDuplicateMigration struct {
 func (e ErrDuplicateMigration) Error() string {
 	return "duplicate migration file: " + e.Name()
 }
+
+// ErrDuplicateVersion is an error type for reporting migration files sharing
+// a version and direction, e.g. after a bad merge. Files lists all of them.
+type ErrDuplicateVersion struct {
+	Version   uint
+	Direction Direction
+	Files     []string
+}
+
+// Error implements error interface.
+func (e ErrDuplicateVersion) Error() string {
+	return fmt.Sprintf("duplicate %s migration version %d: %s", e.Direction, e.Version, strings.Join(e.Files, ", "))
+}
+
+// As makes errors.As(err, &ErrDuplicateMigration{}) true for
+// ErrDuplicateVersion, for callers of the drivers that returned it, with the
+// second of the files.
+func (e ErrDuplicateVersion) As(target interface{}) bool {
+	dup, ok := target.(*ErrDuplicateMigration)
+	if !ok || len(e.Files) < 2 {
+		return false
+	}
+	*dup = ErrDuplicateMigration{
+		Migration: Migration{Version: e.Version, Direction: e.Direction, Raw: e.Files[1]},
+		FileInfo:  duplicateFile(e.Files[1]),
+	}
+	return true
+}
+
+// duplicateFile is the os.FileInfo of ErrDuplicateMigration, of which only
+// the name is known
+type duplicateFile string
+
+func (f duplicateFile) Name() string       { return string(f) }
+func (f duplicateFile) Size() int64        { return 0 }
+func (f duplicateFile) Mode() os.FileMode  { return 0 }
+func (f duplicateFile) ModTime() time.Time { return time.Time{} }
+func (f duplicateFile) IsDir() bool        { return false }
+func (f duplicateFile) Sys() interface{}   { return nil }
+
+// ErrNoMigrations is returned by drivers whose location has no migrations at
+// all, e.g. an empty or nonexistent directory, where First would fail. It
+// matches os.ErrNotExist like the errors First returns otherwise.
+type ErrNoMigrations struct {
+	Path string
+}
+
+// Error implements error interface.
+func (e ErrNoMigrations) Error() string {
+	return "no migrations found in " + e.Path
+}
+
+// Is makes errors.Is(err, os.ErrNotExist) true for ErrNoMigrations.
+func (e ErrNoMigrations) Is(target error) bool {
+	return target == os.ErrNotExist
+}
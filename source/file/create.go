@@ -0,0 +1,122 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getoutreach/migrate/v4/source"
+)
+
+// VersionScheme returns the version of a new migration given the latest
+// version in the directory, 0 if there's none.
+type VersionScheme func(latest uint) uint
+
+// SequentialScheme numbers migrations 1, 2, 3...
+func SequentialScheme(latest uint) uint {
+	return latest + 1
+}
+
+// TimestampScheme numbers migrations with the UTC time they're created at,
+// e.g. 20240102150405, or the latest version plus one if that's later.
+func TimestampScheme(latest uint) uint {
+	v, _ := strconv.ParseUint(now().UTC().Format("20060102150405"), 10, 64)
+	if uint(v) <= latest {
+		return latest + 1
+	}
+	return uint(v)
+}
+
+// now is time.Now, swapped in tests
+var now = time.Now
+
+// Extension is the extension of the migrations created by Create
+var Extension = "sql"
+
+// NextVersion scans the migrations in dir, named like `123_name.up.ext`, and
+// returns the version of the next one according to scheme, SequentialScheme
+// if it's nil.
+func NextVersion(dir string, scheme VersionScheme) (uint, error) {
+	latest, _, err := latestVersion(dir)
+	if err != nil {
+		return 0, err
+	}
+	if scheme == nil {
+		scheme = SequentialScheme
+	}
+	return scheme(latest), nil
+}
+
+// Create writes empty up and down migrations for title in dir, numbered with
+// NextVersion, e.g. `4_add_users.up.sql` and `4_add_users.down.sql`.
+// Sequential versions are zero padded like the latest migration, if it is.
+// Neither is left behind if creating them fails.
+func Create(dir, title string, scheme VersionScheme) (upPath, downPath string, err error) {
+	if title == "" || strings.ContainsAny(title, `/\`) {
+		return "", "", fmt.Errorf("invalid migration title %q", title)
+	}
+	latest, digits, err := latestVersion(dir)
+	if err != nil {
+		return "", "", err
+	}
+	if scheme == nil {
+		scheme = SequentialScheme
+	}
+	version := scheme(latest)
+
+	paths := make([]string, 0, 2)
+	for _, direction := range []source.Direction{source.Up, source.Down} {
+		name := fmt.Sprintf("%0*d_%s.%s.%s", digits, version, title, direction, Extension)
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	for i, p := range paths {
+		if err := createEmpty(p); err != nil {
+			// remove the migrations created already
+			for _, created := range paths[:i] {
+				os.Remove(created)
+			}
+			return "", "", err
+		}
+	}
+	return paths[0], paths[1], nil
+}
+
+// createEmpty creates the empty file p, failing if it exists so existing
+// migrations aren't overwritten
+func createEmpty(p string) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(p)
+		return err
+	}
+	return nil
+}
+
+// latestVersion returns the latest version of the migrations in dir and the
+// number of digits it's written with
+func latestVersion(dir string) (latest uint, digits int, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		m, err := source.DefaultParse(e.Name())
+		if err != nil {
+			continue // ignore files that we can't parse
+		}
+		if m.Version >= latest {
+			latest = m.Version
+			digits = strings.Index(e.Name(), "_")
+		}
+	}
+	return latest, digits, nil
+}
@@ -0,0 +1,80 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreateSequential(t *testing.T) {
+	dir := t.TempDir()
+	version, err := NextVersion(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Fatalf("expected version 1 in an empty directory, got %v", version)
+	}
+
+	mustWriteFile(t, dir, "0001_users.up.sql", "")
+	mustWriteFile(t, dir, "0009_accounts.up.sql", "")
+	mustWriteFile(t, dir, "0009_accounts.down.sql", "")
+	mustWriteFile(t, dir, "README.md", "")
+	if version, err = NextVersion(dir, SequentialScheme); err != nil {
+		t.Fatal(err)
+	}
+	if version != 10 {
+		t.Fatalf("expected version 10, got %v", version)
+	}
+
+	up, down, err := Create(dir, "add_email", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up != filepath.Join(dir, "0010_add_email.up.sql") || down != filepath.Join(dir, "0010_add_email.down.sql") {
+		t.Fatalf("expected zero padded migrations, got %v and %v", up, down)
+	}
+	for _, p := range []string{up, down} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := Create(dir, "nested/title", nil); err == nil {
+		t.Fatal("expected a title with a path separator to be rejected")
+	}
+
+	// the up migration isn't left behind when the down one exists already
+	mustWriteFile(t, dir, "0011_add_name.down.sql", "")
+	if _, _, err := Create(dir, "add_name", func(uint) uint { return 11 }); err == nil {
+		t.Fatal("expected an existing migration to fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "0011_add_name.up.sql")); !os.IsNotExist(err) {
+		t.Fatalf("expected the up migration to be removed, got %v", err)
+	}
+}
+
+func TestCreateTimestamp(t *testing.T) {
+	defer func(n func() time.Time) { now = n }(now)
+	now = func() time.Time { return time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC) }
+
+	dir := t.TempDir()
+	mustWriteFile(t, dir, "20231231000000_users.up.sql", "")
+	up, _, err := Create(dir, "accounts", TimestampScheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up != filepath.Join(dir, "20240102150405_accounts.up.sql") {
+		t.Fatalf("expected a timestamp version, got %v", up)
+	}
+
+	// created within the same second
+	version, err := NextVersion(dir, TimestampScheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 20240102150406 {
+		t.Fatalf("expected the version after the latest, got %v", version)
+	}
+}
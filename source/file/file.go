@@ -1,6 +1,8 @@
 package file
 
 import (
+	"errors"
+	"io/fs"
 	nurl "net/url"
 	"os"
 	"path/filepath"
@@ -17,6 +19,36 @@ type File struct {
 	iofs.PartialDriver
 	url  string
 	path string
+
+	// VersionParser parses the migration file names, defaults to
+	// DefaultVersionParser. Set it before calling Open to support alternate
+	// naming schemes, e.g.
+	//  d, err := (&file.File{VersionParser: myParser}).Open("file://migrations")
+	VersionParser VersionParser
+
+	// Decryptor, if set, decrypts migration files with names ending in
+	// EncryptedSuffix, source.DefaultEncryptedSuffix by default, when they're
+	// read, e.g. `1_seed.up.sql.enc`.
+	Decryptor       source.Decryptor
+	EncryptedSuffix string
+
+	// ParseFrontMatter strips the YAML front matter between `---` lines at
+	// the top of migration files when they're read, FrontMatter returns it.
+	ParseFrontMatter bool
+}
+
+// VersionParser returns the version, title and direction of the migration
+// stored in filename. Files it returns an error for are ignored.
+type VersionParser func(filename string) (version uint, title string, direction source.Direction, err error)
+
+// DefaultVersionParser parses file names like `123_name.up.ext` with
+// source.DefaultParse.
+func DefaultVersionParser(filename string) (uint, string, source.Direction, error) {
+	m, err := source.DefaultParse(filename)
+	if err != nil {
+		return 0, "", "", err
+	}
+	return m.Version, m.Identifier, m.Direction, nil
 }
 
 func (f *File) Open(url string) (source.Driver, error) {
@@ -25,15 +57,66 @@ func (f *File) Open(url string) (source.Driver, error) {
 		return nil, err
 	}
 	nf := &File{
-		url:  url,
-		path: p,
+		url:              url,
+		path:             p,
+		VersionParser:    f.VersionParser,
+		Decryptor:        f.Decryptor,
+		EncryptedSuffix:  f.EncryptedSuffix,
+		ParseFrontMatter: f.ParseFrontMatter,
+	}
+	if nf.VersionParser == nil {
+		nf.VersionParser = DefaultVersionParser
+	}
+	if nf.Decryptor != nil {
+		nf.SetDecryptor(nf.EncryptedSuffix, nf.Decryptor)
 	}
-	if err := nf.Init(os.DirFS(p), "."); err != nil {
+	nf.SetFrontMatter(nf.ParseFrontMatter)
+	err = nf.InitWithParse(os.DirFS(p), ".", nf.parse)
+	if errors.Is(err, fs.ErrNotExist) {
+		// a missing directory has no migrations, First reports it
+		err = nf.InitWithParse(emptyDir{}, ".", nf.parse)
+	}
+	if err != nil {
 		return nil, err
 	}
 	return nf, nil
 }
 
+// First returns source.ErrNoMigrations naming the directory if it has no
+// migrations.
+func (f *File) First() (version uint, err error) {
+	version, err = f.PartialDriver.First()
+	if errors.As(err, new(source.ErrNoMigrations)) {
+		return 0, source.ErrNoMigrations{Path: f.path}
+	}
+	return version, err
+}
+
+// emptyDir is a directory without any files, standing in for a missing one
+type emptyDir struct{}
+
+func (emptyDir) Open(name string) (fs.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (emptyDir) ReadDir(name string) ([]fs.DirEntry, error) {
+	return nil, nil
+}
+
+// parse adapts f.VersionParser to a source.Migration
+func (f *File) parse(raw string) (*source.Migration, error) {
+	version, title, direction, err := f.VersionParser(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &source.Migration{
+		Version:    version,
+		Identifier: title,
+		Direction:  direction,
+		Raw:        raw,
+	}, nil
+}
+
 func parseURL(url string) (string, error) {
 	u, err := nurl.Parse(url)
 	if err != nil {
@@ -1,14 +1,22 @@
 package file
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/getoutreach/migrate/v4/source"
 	st "github.com/getoutreach/migrate/v4/source/testing"
 )
 
@@ -164,6 +172,37 @@ func TestOpenWithDuplicateVersion(t *testing.T) {
 	}
 }
 
+func TestOpenWithDuplicateVersionFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	mustWriteFile(t, tmpDir, "0005_foo.up.sql", "")   // 5 up
+	mustWriteFile(t, tmpDir, "0005_bar.up.sql", "")   // 5 up
+	mustWriteFile(t, tmpDir, "0005_foo.down.sql", "") // 5 down
+
+	f := &File{}
+	_, err := f.Open("file://" + tmpDir)
+	var dup source.ErrDuplicateVersion
+	if !errors.As(err, &dup) {
+		t.Fatalf("expected a duplicate version error, got %v", err)
+	}
+	want := source.ErrDuplicateVersion{
+		Version:   5,
+		Direction: source.Up,
+		Files:     []string{"0005_bar.up.sql", "0005_foo.up.sql"},
+	}
+	if !reflect.DeepEqual(dup, want) {
+		t.Fatalf("expected %v, got %v", want, dup)
+	}
+
+	// callers of the deprecated error still match it
+	var migration source.ErrDuplicateMigration
+	if !errors.As(err, &migration) {
+		t.Fatalf("expected the error to match ErrDuplicateMigration, got %v", err)
+	}
+	if migration.Version != 5 || migration.Name() != "0005_foo.up.sql" {
+		t.Fatalf("expected duplicate version 5 of 0005_foo.up.sql, got %v", migration)
+	}
+}
+
 func TestClose(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "TestOpen")
 	if err != nil {
@@ -186,6 +225,171 @@ func TestClose(t *testing.T) {
 	}
 }
 
+func TestVersionParser(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "TestVersionParser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	mustWriteFile(t, tmpDir, "1_foobar.up.sql", "1 up")
+	mustWriteFile(t, tmpDir, "V2024_01_15__add_users.sql", "2024_01_15 up")
+	mustWriteFile(t, tmpDir, "U2024_01_15__add_users.sql", "2024_01_15 down")
+	mustWriteFile(t, tmpDir, "V2024_02_01__add_orgs.sql", "2024_02_01 up")
+
+	// flyway style, V is a versioned (up) migration and U its undo (down)
+	flyway := regexp.MustCompile(`^([VU])(\d{4})_(\d{2})_(\d{2})__(.*)\.sql$`)
+	dateParser := func(filename string) (uint, string, source.Direction, error) {
+		m := flyway.FindStringSubmatch(filename)
+		if m == nil {
+			return 0, "", "", source.ErrParse
+		}
+		version, err := strconv.ParseUint(m[2]+m[3]+m[4], 10, 64)
+		if err != nil {
+			return 0, "", "", err
+		}
+		direction := source.Up
+		if m[1] == "U" {
+			direction = source.Down
+		}
+		return uint(version), m[5], direction, nil
+	}
+
+	testCases := []struct {
+		name          string
+		parser        VersionParser
+		wantVersions  []uint
+		wantUp        string
+		wantUpVersion uint
+	}{
+		{name: "default parser",
+			parser:        nil,
+			wantVersions:  []uint{1},
+			wantUp:        "1 up",
+			wantUpVersion: 1},
+		{name: "date based parser",
+			parser:        dateParser,
+			wantVersions:  []uint{20240115, 20240201},
+			wantUp:        "2024_01_15 up",
+			wantUpVersion: 20240115},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := (&File{VersionParser: tc.parser}).Open("file://" + tmpDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var versions []uint
+			v, err := d.First()
+			for err == nil {
+				versions = append(versions, v)
+				v, err = d.Next(v)
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(versions, tc.wantVersions) {
+				t.Fatalf("expected versions %v, got %v", tc.wantVersions, versions)
+			}
+
+			r, _, err := d.ReadUp(tc.wantUpVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			body, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tc.wantUp {
+				t.Fatalf("expected up migration %q, got %q", tc.wantUp, body)
+			}
+		})
+	}
+}
+
+func TestDecryptor(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "TestDecryptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the nonce is stored in front of the ciphertext
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := gcm.Seal(nonce, nonce, []byte("INSERT INTO tenants (api_key) VALUES ('secret');"), nil)
+
+	mustWriteFile(t, tmpDir, "1_seed.up.sql.enc", string(encrypted))
+	mustWriteFile(t, tmpDir, "1_seed.down.sql", "DELETE FROM tenants;")
+
+	var decrypted []string
+	decryptor := func(name string, ciphertext []byte) ([]byte, error) {
+		decrypted = append(decrypted, name)
+		if len(ciphertext) < gcm.NonceSize() {
+			return nil, errors.New("ciphertext too short")
+		}
+		return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+	}
+
+	d, err := (&File{Decryptor: decryptor}).Open("file://" + tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _, err := d.ReadUp(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(up) != "INSERT INTO tenants (api_key) VALUES ('secret');" {
+		t.Fatalf("expected decrypted up migration, got %q", up)
+	}
+
+	// files without the suffix are read as is
+	r, _, err = d.ReadDown(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	down, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(down) != "DELETE FROM tenants;" {
+		t.Fatalf("expected plain down migration, got %q", down)
+	}
+	if len(decrypted) != 1 || decrypted[0] != "1_seed.up.sql.enc" {
+		t.Fatalf("expected only the encrypted file to be decrypted, got %v", decrypted)
+	}
+}
+
 func mustWriteFile(t testing.TB, dir, file string, body string) {
 	if err := ioutil.WriteFile(path.Join(dir, file), []byte(body), 06444); err != nil {
 		t.Fatal(err)
@@ -242,3 +446,125 @@ func BenchmarkNext(b *testing.B) {
 	}
 	b.StopTimer()
 }
+
+func TestOpenEmptyDirectory(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, dir := range []string{tmpDir, filepath.Join(tmpDir, "missing")} {
+		d, err := (&File{}).Open("file://" + dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = d.First()
+		var noMigrations source.ErrNoMigrations
+		if !errors.As(err, &noMigrations) || noMigrations.Path != dir {
+			t.Fatalf("expected no migrations in %v, got %v", dir, err)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected %v to match os.ErrNotExist", err)
+		}
+	}
+}
+
+func TestOpenConfigMap(t *testing.T) {
+	// a mounted ConfigMap: the files live in a timestamped directory, `..data`
+	// links to it and each key is a link into `..data`
+	tmpDir := t.TempDir()
+	dataDir := "..2024_01_02_15_04_05.123456789"
+	if err := os.Mkdir(filepath.Join(tmpDir, dataDir), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	mustWriteFile(t, filepath.Join(tmpDir, dataDir), "1_foobar.up.sql", "1 up")
+	mustWriteFile(t, filepath.Join(tmpDir, dataDir), "1_foobar.down.sql", "1 down")
+	mustWriteFile(t, filepath.Join(tmpDir, dataDir), "2_foobar.up.sql", "2 up")
+	if err := os.Symlink(dataDir, filepath.Join(tmpDir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"1_foobar.up.sql", "1_foobar.down.sql", "2_foobar.up.sql"} {
+		if err := os.Symlink(filepath.Join("..data", name), filepath.Join(tmpDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// dangling links and links to directories aren't migrations
+	if err := os.Symlink("..data/3_foobar.up.sql", filepath.Join(tmpDir, "3_foobar.up.sql")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dataDir, filepath.Join(tmpDir, "4_foobar.up.sql")); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := (&File{}).Open("file://" + tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []uint
+	v, err := d.First()
+	for err == nil {
+		versions = append(versions, v)
+		v, err = d.Next(v)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(versions, []uint{1, 2}) {
+		t.Fatalf("expected versions [1 2], got %v", versions)
+	}
+	r, _, err := d.ReadDown(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "1 down" {
+		t.Fatalf("expected 1 down, got %q", body)
+	}
+}
+
+func TestParseFrontMatter(t *testing.T) {
+	tmpDir := t.TempDir()
+	mustWriteFile(t, tmpDir, "1_users.up.sql", "CREATE TABLE users (id int);")
+	mustWriteFile(t, tmpDir, "2_plan.up.sql",
+		"---\ndepends_on: [billing/12]\n---\nALTER TABLE users ADD COLUMN plan text;")
+	mustWriteFile(t, tmpDir, "3_broken.up.sql", "---\ndepends_on: [billing/12\n---\nSELECT 1;")
+
+	d, err := (&File{ParseFrontMatter: true}).Open("file://" + tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := d.(source.FrontMatterReader)
+
+	frontMatter, err := fm.FrontMatter(2, source.Up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"depends_on": []interface{}{"billing/12"}}
+	if !reflect.DeepEqual(frontMatter, want) {
+		t.Fatalf("expected front matter %v, got %v", want, frontMatter)
+	}
+	if frontMatter, err := fm.FrontMatter(1, source.Up); err != nil || frontMatter != nil {
+		t.Fatalf("expected no front matter, got %v, %v", frontMatter, err)
+	}
+	if _, err := fm.FrontMatter(1, source.Down); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a missing migration to fail, got %v", err)
+	}
+
+	r, _, err := d.ReadUp(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "ALTER TABLE users ADD COLUMN plan text;" {
+		t.Fatalf("expected the front matter to be stripped, got %q", body)
+	}
+
+	if _, _, err := d.ReadUp(3); err == nil || !strings.Contains(err.Error(), "3_broken.up.sql") {
+		t.Fatalf("expected the invalid front matter to name its file, got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/getoutreach/migrate/v4/source"
+)
+
+// Split reads up migrations from one directory and down migrations from
+// another, e.g. `migrations/up` and `migrations/down`, pairing them by version.
+// Versions can have a migration in only one of them.
+type Split struct {
+	up   source.Driver
+	down source.Driver
+	// migrations indexes the versions of both directories
+	migrations *source.Migrations
+	urls       string
+}
+
+// Open isn't supported, split sources need two URLs, use File.OpenSplit.
+func (s *Split) Open(url string) (source.Driver, error) {
+	return nil, fmt.Errorf("split sources are opened with File.OpenSplit")
+}
+
+// OpenSplit opens a source reading up migrations from the directory of upURL
+// and down migrations from the directory of downURL, which take the same form
+// as the URL of Open. Other migrations in either directory are ignored. The
+// options of f apply to both directories.
+func (f *File) OpenSplit(upURL, downURL string) (source.Driver, error) {
+	up, err := f.Open(upURL)
+	if err != nil {
+		return nil, err
+	}
+	down, err := f.Open(downURL)
+	if err != nil {
+		return nil, errors.Join(err, up.Close())
+	}
+	s := &Split{up: up, down: down, migrations: source.NewMigrations(), urls: upURL + " and " + downURL}
+	if err := s.index(up, source.Up); err != nil {
+		return nil, errors.Join(err, s.Close())
+	}
+	if err := s.index(down, source.Down); err != nil {
+		return nil, errors.Join(err, s.Close())
+	}
+	return s, nil
+}
+
+// index adds the versions of the migrations d has in direction to the index
+func (s *Split) index(d source.Driver, direction source.Direction) error {
+	version, err := d.First()
+	for err == nil {
+		s.migrations.Append(&source.Migration{Version: version, Direction: direction})
+		version, err = d.Next(version)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *Split) Close() error {
+	return errors.Join(s.up.Close(), s.down.Close())
+}
+
+func (s *Split) First() (version uint, err error) {
+	if version, ok := s.migrations.First(); ok {
+		return version, nil
+	}
+	return 0, source.ErrNoMigrations{Path: s.urls}
+}
+
+func (s *Split) Prev(version uint) (prevVersion uint, err error) {
+	if version, ok := s.migrations.Prev(version); ok {
+		return version, nil
+	}
+	return 0, &os.PathError{Op: "prev for version " + strconv.FormatUint(uint64(version), 10), Path: s.urls, Err: os.ErrNotExist}
+}
+
+func (s *Split) Next(version uint) (nextVersion uint, err error) {
+	if version, ok := s.migrations.Next(version); ok {
+		return version, nil
+	}
+	return 0, &os.PathError{Op: "next for version " + strconv.FormatUint(uint64(version), 10), Path: s.urls, Err: os.ErrNotExist}
+}
+
+func (s *Split) ReadUp(version uint) (r io.ReadCloser, identifier string, err error) {
+	return s.up.ReadUp(version)
+}
+
+func (s *Split) ReadDown(version uint) (r io.ReadCloser, identifier string, err error) {
+	return s.down.ReadDown(version)
+}
+
+// FrontMatter returns the front matter of the migration of version in
+// direction from the directory of the direction, see File.ParseFrontMatter.
+func (s *Split) FrontMatter(version uint, direction source.Direction) (map[string]interface{}, error) {
+	d := s.up
+	if direction == source.Down {
+		d = s.down
+	}
+	return d.(source.FrontMatterReader).FrontMatter(version, direction)
+}
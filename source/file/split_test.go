@@ -0,0 +1,108 @@
+package file
+
+import (
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	st "github.com/getoutreach/migrate/v4/source/testing"
+)
+
+func TestSplit(t *testing.T) {
+	upDir, downDir := t.TempDir(), t.TempDir()
+	// the migrations st.Test expects, split by direction
+	mustWriteFile(t, upDir, "1_foobar.up.sql", "1 up")
+	mustWriteFile(t, upDir, "3_foobar.up.sql", "3 up")
+	mustWriteFile(t, upDir, "4_foobar.up.sql", "4 up")
+	mustWriteFile(t, upDir, "7_foobar.up.sql", "7 up")
+	mustWriteFile(t, downDir, "1_foobar.down.sql", "1 down")
+	mustWriteFile(t, downDir, "4_foobar.down.sql", "4 down")
+	mustWriteFile(t, downDir, "5_foobar.down.sql", "5 down")
+	mustWriteFile(t, downDir, "7_foobar.down.sql", "7 down")
+	// down migrations among the up migrations are ignored
+	mustWriteFile(t, upDir, "3_foobar.down.sql", "misplaced")
+
+	d, err := (&File{}).OpenSplit("file://"+upDir, "file://"+downDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Test(t, d)
+
+	for _, tc := range []struct {
+		version  uint
+		up, down string
+	}{
+		{version: 1, up: "1 up", down: "1 down"},
+		{version: 3, up: "3 up"},
+		{version: 5, down: "5 down"},
+	} {
+		for _, m := range []struct {
+			read func(uint) (io.ReadCloser, string, error)
+			want string
+		}{{d.ReadUp, tc.up}, {d.ReadDown, tc.down}} {
+			r, _, err := m.read(tc.version)
+			if m.want == "" {
+				if !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("expected no migration for version %v, got %v", tc.version, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != m.want {
+				t.Errorf("expected %q for version %v, got %q", m.want, tc.version, body)
+			}
+		}
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSplitVersionsInOneDirectory(t *testing.T) {
+	upDir, downDir := t.TempDir(), t.TempDir()
+	for _, version := range []string{"1", "2", "4"} {
+		mustWriteFile(t, upDir, version+"_foobar.up.sql", version+" up")
+	}
+	for _, version := range []string{"1", "3", "4"} {
+		mustWriteFile(t, downDir, version+"_foobar.down.sql", version+" down")
+	}
+	d, err := (&File{}).OpenSplit("file://"+upDir, "file://"+downDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// versions only one of the directories has are walked both ways
+	var versions []uint
+	version, err := d.First()
+	for err == nil {
+		versions = append(versions, version)
+		version, err = d.Next(version)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	if want := []uint{1, 2, 3, 4}; !reflect.DeepEqual(versions, want) {
+		t.Fatalf("expected versions %v walking up, got %v", want, versions)
+	}
+	versions = nil
+	for version, err = uint(4), nil; err == nil; version, err = d.Prev(version) {
+		versions = append(versions, version)
+	}
+	if want := []uint{4, 3, 2, 1}; !reflect.DeepEqual(versions, want) {
+		t.Fatalf("expected versions %v walking down, got %v", want, versions)
+	}
+}
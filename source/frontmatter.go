@@ -0,0 +1,74 @@
+package source
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// frontMatterDelimiter is the line opening and closing the front matter of a
+// migration
+const frontMatterDelimiter = "---"
+
+// FrontMatterReader is implemented by source drivers that can parse the YAML
+// front matter of migrations, a block between `---` lines at the top of the
+// file, e.g.
+//
+//	---
+//	depends_on: [billing/12]
+//	online: true
+//	---
+//	ALTER TABLE ...
+//
+// Drivers parsing front matter strip it from the migrations they read.
+type FrontMatterReader interface {
+	// FrontMatter returns the front matter of the migration of version in
+	// direction, nil if it has none.
+	FrontMatter(version uint, direction Direction) (map[string]interface{}, error)
+}
+
+// ParseFrontMatter splits the YAML front matter off the migration r read from
+// the file name. It returns the front matter, nil if the migration has none,
+// and the rest of the migration. Invalid YAML is an error naming the file.
+func ParseFrontMatter(name string, r io.Reader) (map[string]interface{}, io.Reader, error) {
+	br := bufio.NewReader(r)
+	first, err := br.Peek(len(frontMatterDelimiter) + 2)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	if !bytes.HasPrefix(first, []byte(frontMatterDelimiter+"\n")) &&
+		!bytes.HasPrefix(first, []byte(frontMatterDelimiter+"\r\n")) {
+		return nil, br, nil
+	}
+	if _, err := br.ReadBytes('\n'); err != nil {
+		return nil, nil, fmt.Errorf("unterminated front matter in %s", name)
+	}
+
+	var block bytes.Buffer
+	for {
+		line, err := br.ReadBytes('\n')
+		if isFrontMatterDelimiter(line) {
+			break
+		}
+		if err == io.EOF {
+			return nil, nil, fmt.Errorf("unterminated front matter in %s", name)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		block.Write(line)
+	}
+	frontMatter := make(map[string]interface{})
+	if err := yaml.Unmarshal(block.Bytes(), &frontMatter); err != nil {
+		return nil, nil, fmt.Errorf("invalid front matter in %s: %w", name, err)
+	}
+	return frontMatter, br, nil
+}
+
+// isFrontMatterDelimiter reports whether line is a `---` line
+func isFrontMatterDelimiter(line []byte) bool {
+	return string(bytes.TrimRight(line, "\r\n")) == frontMatterDelimiter
+}
@@ -0,0 +1,77 @@
+package source
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFrontMatter(t *testing.T) {
+	tt := []struct {
+		name            string
+		migration       string
+		wantFrontMatter map[string]interface{}
+		wantBody        string
+		wantErr         string
+	}{
+		{
+			name:      "front matter",
+			migration: "---\ndepends_on:\n  - billing/12\nonline: true\n---\nALTER TABLE users ADD COLUMN plan text;\n",
+			wantFrontMatter: map[string]interface{}{
+				"depends_on": []interface{}{"billing/12"},
+				"online":     true,
+			},
+			wantBody: "ALTER TABLE users ADD COLUMN plan text;\n",
+		},
+		{
+			name:            "crlf line breaks",
+			migration:       "---\r\nowner: billing\r\n---\r\nSELECT 1;",
+			wantFrontMatter: map[string]interface{}{"owner": "billing"},
+			wantBody:        "SELECT 1;",
+		},
+		{
+			name:      "no front matter",
+			migration: "-- ---\nSELECT 1;",
+			wantBody:  "-- ---\nSELECT 1;",
+		},
+		{
+			name:      "empty migration",
+			migration: "",
+		},
+		{
+			name:      "invalid yaml",
+			migration: "---\ndepends_on: [billing/12\n---\nSELECT 1;",
+			wantErr:   "invalid front matter in 2_plan.up.sql",
+		},
+		{
+			name:      "unterminated",
+			migration: "---\nonline: true\nSELECT 1;",
+			wantErr:   "unterminated front matter in 2_plan.up.sql",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			frontMatter, body, err := ParseFrontMatter("2_plan.up.sql", strings.NewReader(tc.migration))
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(frontMatter, tc.wantFrontMatter) {
+				t.Errorf("expected front matter %v, got %v", tc.wantFrontMatter, frontMatter)
+			}
+			b, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.wantBody {
+				t.Errorf("expected body %q, got %q", tc.wantBody, b)
+			}
+		})
+	}
+}
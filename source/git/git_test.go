@@ -0,0 +1,140 @@
+package git
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func TestOpen(t *testing.T) {
+	workDir := t.TempDir()
+	repo, err := gogit.PlainInit(workDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := &object.Signature{Name: "migrate", Email: "migrate@example.com", When: time.Now()}
+	commit := func(files map[string]string) {
+		for name, body := range files {
+			mustWriteFile(t, workDir, name, body)
+			if _, err := wt.Add(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := wt.Commit("add migrations", &gogit.CommitOptions{Author: signature}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commit(map[string]string{
+		"README.md":                         "not a migration",
+		"migrations/1_foobar.up.sql":        "1 up",
+		"migrations/1_foobar.down.sql":      "1 down",
+		"migrations/2_foobar.up.sql":        "2 up",
+		"migrations/not_a_migration.txt":    "ignored",
+		"migrations/nested/3_foobar.up.sql": "nested",
+	})
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateTag("v1.0.0", head.Hash(), &gogit.CreateTagOptions{
+		Tagger: signature, Message: "v1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	// migrations committed after the tag aren't part of it
+	commit(map[string]string{"migrations/4_foobar.up.sql": "4 up"})
+
+	bareDir := t.TempDir()
+	if _, err := gogit.PlainClone(bareDir, true, &gogit.CloneOptions{URL: workDir}); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name         string
+		ref          string
+		wantVersions []uint
+	}{
+		{name: "tag", ref: "v1.0.0", wantVersions: []uint{1, 2}},
+		{name: "default ref", ref: "", wantVersions: []uint{1, 2, 4}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			url := "git+file://" + bareDir + "?path=migrations"
+			if tc.ref != "" {
+				url += "&ref=" + tc.ref
+			}
+			d, err := (&Git{}).Open(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := d.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			var versions []uint
+			v, err := d.First()
+			for err == nil {
+				versions = append(versions, v)
+				v, err = d.Next(v)
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(versions, tc.wantVersions) {
+				t.Fatalf("expected versions %v, got %v", tc.wantVersions, versions)
+			}
+
+			r, identifier, err := d.ReadUp(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != "1 up" || identifier != "foobar" {
+				t.Fatalf("expected 1 up migration foobar, got %q %q", identifier, body)
+			}
+			r, _, err = d.ReadDown(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body, err = io.ReadAll(r); err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != "1 down" {
+				t.Fatalf("expected 1 down migration, got %q", body)
+			}
+			if _, _, err := d.ReadDown(2); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("expected no down migration for version 2, got %v", err)
+			}
+		})
+	}
+
+	if _, err := (&Git{}).Open("git+file://" + bareDir + "?ref=v9.9.9"); err == nil {
+		t.Fatal("expected an unknown ref to fail")
+	}
+}
+
+func mustWriteFile(t testing.TB, dir, file string, body string) {
+	p := filepath.Join(dir, file)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
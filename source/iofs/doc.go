@@ -3,6 +3,11 @@ Package iofs provides the Go 1.16+ io/fs#FS driver.
 
 It can accept various file systems (like embed.FS, archive/zip#Reader) implementing io/fs#FS.
 
+Migrations are read from the files directly in the directory by default,
+named like {version}_{title}.{up|down}.{ext}. NewWithLayout reads other
+layouts of the directory's tree, e.g. a directory per version with
+VersionDirLayout.
+
 This driver cannot be used with Go versions 1.15 and below.
 
 Also, Opening with a URL scheme is not supported.
@@ -4,12 +4,14 @@
 package iofs
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"path"
 	"strconv"
+	"strings"
 
 	"github.com/getoutreach/migrate/v4/source"
 )
@@ -27,6 +29,16 @@ func New(fsys fs.FS, path string) (source.Driver, error) {
 	return &i, nil
 }
 
+// NewWithLayout is like New, but finds the migrations in the tree under path
+// with layout, e.g. VersionDirLayout. A nil layout is the flat layout of New.
+func NewWithLayout(fsys fs.FS, path string, layout Layout) (source.Driver, error) {
+	var i driver
+	if err := i.InitWithLayout(fsys, path, layout); err != nil {
+		return nil, fmt.Errorf("failed to init driver with path %s: %w", path, err)
+	}
+	return &i, nil
+}
+
 // Open is part of source.Driver interface implementation.
 // Open cannot be called on the iofs passthrough driver.
 func (d *driver) Open(url string) (source.Driver, error) {
@@ -39,39 +51,170 @@ func (d *driver) Open(url string) (source.Driver, error) {
 // method.
 //
 // To prepare PartialDriver for use Init() function.
+//
+// Only the names of the files are read to index the migrations, a file is
+// opened by ReadUp or ReadDown and stays open until the reader returned is
+// closed, so sources with many files don't hold their descriptors.
 type PartialDriver struct {
 	migrations *source.Migrations
 	fsys       fs.FS
 	path       string
+	// decrypt decrypts the migration files with names ending in encryptedSuffix
+	decrypt         source.Decryptor
+	encryptedSuffix string
+	// frontMatter makes the driver strip the YAML front matter of migrations
+	frontMatter bool
+}
+
+// SetDecryptor makes the driver decrypt migration files with names ending in
+// suffix with decrypt when reading them. suffix defaults to
+// source.DefaultEncryptedSuffix.
+func (d *PartialDriver) SetDecryptor(suffix string, decrypt source.Decryptor) {
+	if suffix == "" {
+		suffix = source.DefaultEncryptedSuffix
+	}
+	d.decrypt = decrypt
+	d.encryptedSuffix = suffix
+}
+
+// SetFrontMatter makes the driver parse the YAML front matter of migrations,
+// see source.ParseFrontMatter. ReadUp and ReadDown strip it, FrontMatter
+// returns it.
+func (d *PartialDriver) SetFrontMatter(enabled bool) {
+	d.frontMatter = enabled
 }
 
 // Init prepares not initialized IoFS instance to read migrations from a
 // io/fs#FS instance and a relative path.
 func (d *PartialDriver) Init(fsys fs.FS, path string) error {
+	return d.InitWithParse(fsys, path, source.DefaultParse)
+}
+
+// InitWithParse is like Init, but parses the migration file names with parse
+// instead of source.DefaultParse. Files parse fails for are ignored.
+func (d *PartialDriver) InitWithParse(fsys fs.FS, path string, parse func(raw string) (*source.Migration, error)) error {
 	entries, err := fs.ReadDir(fsys, path)
 	if err != nil {
 		return err
 	}
-
-	ms := source.NewMigrations()
+	var names []string
 	for _, e := range entries {
+		if isMigrationFile(fsys, path, e) {
+			names = append(names, e.Name())
+		}
+	}
+	return d.index(fsys, path, names, parse)
+}
+
+// Layout maps the name of a file in the tree of the migrations directory,
+// slash separated and relative to it like `0005/up.sql`, to the migration it
+// holds. Files it returns an error for are ignored.
+type Layout func(name string) (*source.Migration, error)
+
+// VersionDirLayout is the layout of migrations in a directory per version,
+// named after the version and optionally an identifier, holding the
+// `up.<ext>` and `down.<ext>` migrations, e.g.
+//
+//	0005/up.sql
+//	0005/down.sql
+//	0006_add_users/up.sql
+func VersionDirLayout(name string) (*source.Migration, error) {
+	dir, file := path.Split(name)
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" || strings.Contains(dir, "/") {
+		return nil, source.ErrParse
+	}
+	versionPart, identifier, _ := strings.Cut(dir, "_")
+	version, err := strconv.ParseUint(versionPart, 10, 64)
+	if err != nil {
+		return nil, source.ErrParse
+	}
+	if identifier == "" {
+		identifier = dir
+	}
+	direction, _, ok := strings.Cut(file, ".")
+	if !ok || (direction != string(source.Up) && direction != string(source.Down)) {
+		return nil, source.ErrParse
+	}
+	return &source.Migration{
+		Version:    uint(version),
+		Identifier: identifier,
+		Direction:  source.Direction(direction),
+		Raw:        name,
+	}, nil
+}
+
+// InitWithLayout is like Init, but finds the migrations in the tree under
+// path with layout instead of only the files directly in it. A nil layout is
+// the flat layout of Init.
+func (d *PartialDriver) InitWithLayout(fsys fs.FS, dir string, layout Layout) error {
+	if layout == nil {
+		return d.Init(fsys, dir)
+	}
+	var names []string
+	err := fs.WalkDir(fsys, dir, func(name string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == dir {
+			return nil
+		}
 		if e.IsDir() {
-			continue
+			if strings.HasPrefix(e.Name(), "..") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if isMigrationFile(fsys, path.Dir(name), e) {
+			names = append(names, strings.TrimPrefix(name, dir+"/"))
 		}
-		m, err := source.DefaultParse(e.Name())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return d.index(fsys, dir, names, func(name string) (*source.Migration, error) {
+		m, err := layout(name)
 		if err != nil {
-			continue
+			return nil, err
 		}
-		file, err := e.Info()
+		// the file is read by the name it was found by
+		m.Raw = name
+		return m, nil
+	})
+}
+
+// index indexes the migrations parse finds among the files names in path
+func (d *PartialDriver) index(fsys fs.FS, path string, names []string, parse func(raw string) (*source.Migration, error)) error {
+	ms := source.NewMigrations()
+	// dup is the first version found more than once, the remaining entries
+	// are still read to list all of its files
+	var dup *source.ErrDuplicateVersion
+	for _, name := range names {
+		m, err := parse(name)
 		if err != nil {
-			return err
+			continue
 		}
-		if !ms.Append(m) {
-			return source.ErrDuplicateMigration{
-				Migration: *m,
-				FileInfo:  file,
+		if ms.Append(m) {
+			continue
+		}
+		if dup == nil {
+			existing, _ := ms.Up(m.Version)
+			if m.Direction == source.Down {
+				existing, _ = ms.Down(m.Version)
+			}
+			dup = &source.ErrDuplicateVersion{
+				Version:   m.Version,
+				Direction: m.Direction,
+				Files:     []string{existing.Raw},
 			}
 		}
+		if m.Version == dup.Version && m.Direction == dup.Direction {
+			dup.Files = append(dup.Files, name)
+		}
+	}
+	if dup != nil {
+		return *dup
 	}
 
 	d.fsys = fsys
@@ -80,6 +223,22 @@ func (d *PartialDriver) Init(fsys fs.FS, path string) error {
 	return nil
 }
 
+// isMigrationFile reports whether the directory entry e in dir may be a
+// migration file. Symbolic links are followed, links to directories and
+// dangling ones are skipped, as are entries prefixed with `..`, which
+// Kubernetes uses for the timestamped directory and the `..data` link a
+// mounted ConfigMap's files point into.
+func isMigrationFile(fsys fs.FS, dir string, e fs.DirEntry) bool {
+	if strings.HasPrefix(e.Name(), "..") {
+		return false
+	}
+	if e.Type()&fs.ModeSymlink == 0 {
+		return !e.IsDir()
+	}
+	info, err := fs.Stat(fsys, path.Join(dir, e.Name()))
+	return err == nil && !info.IsDir()
+}
+
 // Close is part of source.Driver interface implementation.
 // Closes the file system if possible.
 func (d *PartialDriver) Close() error {
@@ -95,11 +254,7 @@ func (d *PartialDriver) First() (version uint, err error) {
 	if version, ok := d.migrations.First(); ok {
 		return version, nil
 	}
-	return 0, &fs.PathError{
-		Op:   "first",
-		Path: d.path,
-		Err:  fs.ErrNotExist,
-	}
+	return 0, source.ErrNoMigrations{Path: d.path}
 }
 
 // Prev is part of source.Driver interface implementation.
@@ -158,9 +313,57 @@ func (d *PartialDriver) ReadDown(version uint) (r io.ReadCloser, identifier stri
 	}
 }
 
-func (d *PartialDriver) open(path string) (fs.File, error) {
+// FrontMatter returns the YAML front matter of the migration of version in
+// direction, nil if it has none or the driver doesn't parse front matter. It
+// implements source.FrontMatterReader.
+func (d *PartialDriver) FrontMatter(version uint, direction source.Direction) (map[string]interface{}, error) {
+	m, ok := d.migrations.Up(version)
+	if direction == source.Down {
+		m, ok = d.migrations.Down(version)
+	}
+	if !ok {
+		return nil, &fs.PathError{
+			Op:   "read " + string(direction) + " front matter for version " + strconv.FormatUint(uint64(version), 10),
+			Path: d.path,
+			Err:  fs.ErrNotExist,
+		}
+	}
+	if !d.frontMatter {
+		return nil, nil
+	}
+	p := path.Join(d.path, m.Raw)
+	f, err := d.openFile(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	frontMatter, _, err := source.ParseFrontMatter(p, f)
+	return frontMatter, err
+}
+
+func (d *PartialDriver) open(path string) (io.ReadCloser, error) {
+	f, err := d.openFile(path)
+	if err != nil || !d.frontMatter {
+		return f, err
+	}
+	_, body, err := source.ParseFrontMatter(path, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{body, f}, nil
+}
+
+// openFile opens the migration file path, decrypting it if it's encrypted
+func (d *PartialDriver) openFile(path string) (io.ReadCloser, error) {
 	f, err := d.fsys.Open(path)
 	if err == nil {
+		if d.decrypt != nil && strings.HasSuffix(path, d.encryptedSuffix) {
+			return d.decryptFile(path, f)
+		}
 		return f, nil
 	}
 	// Some non-standard file systems may return errors that don't include the path, that
@@ -174,3 +377,21 @@ func (d *PartialDriver) open(path string) (fs.File, error) {
 	}
 	return nil, err
 }
+
+// decryptFile reads and decrypts the encrypted migration f
+func (d *PartialDriver) decryptFile(path string, f fs.File) (io.ReadCloser, error) {
+	defer f.Close()
+	ciphertext, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := d.decrypt(path, ciphertext)
+	if err != nil {
+		return nil, &fs.PathError{
+			Op:   "decrypt",
+			Path: path,
+			Err:  err,
+		}
+	}
+	return io.NopCloser(bytes.NewReader(plaintext)), nil
+}
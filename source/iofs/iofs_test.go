@@ -5,7 +5,11 @@ package iofs_test
 
 import (
 	"embed"
+	"fmt"
+	"io"
+	stdfs "io/fs"
 	"testing"
+	"testing/fstest"
 
 	"github.com/getoutreach/migrate/v4/source/iofs"
 	st "github.com/getoutreach/migrate/v4/source/testing"
@@ -23,3 +27,131 @@ func Test(t *testing.T) {
 
 	st.Test(t, d)
 }
+
+// countingFS counts the files opened through it and how many of them are open
+// at once
+type countingFS struct {
+	stdfs.ReadDirFS
+	opened, open, maxOpen int
+}
+
+func (c *countingFS) Open(name string) (stdfs.File, error) {
+	f, err := c.ReadDirFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if !isDir(f) {
+		c.opened++
+		if c.open++; c.open > c.maxOpen {
+			c.maxOpen = c.open
+		}
+		return &countedFile{File: f, fs: c}, nil
+	}
+	return f, nil
+}
+
+func isDir(f stdfs.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.IsDir()
+}
+
+type countedFile struct {
+	stdfs.File
+	fs *countingFS
+}
+
+func (f *countedFile) Close() error {
+	f.fs.open--
+	return f.File.Close()
+}
+
+func TestLazyOpen(t *testing.T) {
+	files := fstest.MapFS{}
+	for v := 1; v <= 500; v++ {
+		files[fmt.Sprintf("migrations/%d_foobar.up.sql", v)] = &fstest.MapFile{Data: []byte("up")}
+		files[fmt.Sprintf("migrations/%d_foobar.down.sql", v)] = &fstest.MapFile{Data: []byte("down")}
+	}
+	fsys := &countingFS{ReadDirFS: files}
+	d, err := iofs.New(fsys, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// indexing only reads the names of the files
+	var versions []uint
+	for v, err := d.First(); err == nil; v, err = d.Next(v) {
+		versions = append(versions, v)
+	}
+	if len(versions) != 500 || fsys.opened != 0 {
+		t.Fatalf("expected 500 versions indexed without opening files, got %d versions, %d files opened",
+			len(versions), fsys.opened)
+	}
+
+	// each read opens its file until it's closed
+	for _, v := range versions {
+		for _, read := range []func(uint) (io.ReadCloser, string, error){d.ReadUp, d.ReadDown} {
+			r, _, err := read(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(r); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if fsys.opened != 1000 || fsys.maxOpen != 1 {
+		t.Fatalf("expected 1000 files opened one at a time, got %d opened, %d at once", fsys.opened, fsys.maxOpen)
+	}
+}
+
+func TestVersionDirLayout(t *testing.T) {
+	files := fstest.MapFS{
+		"migrations/0001/up.sql":              &fstest.MapFile{Data: []byte("1 up")},
+		"migrations/0001/down.sql":            &fstest.MapFile{Data: []byte("1 down")},
+		"migrations/0003/up.sql":              &fstest.MapFile{Data: []byte("3 up")},
+		"migrations/0004/up.sql":              &fstest.MapFile{Data: []byte("4 up")},
+		"migrations/0004/down.sql":            &fstest.MapFile{Data: []byte("4 down")},
+		"migrations/0005/down.sql":            &fstest.MapFile{Data: []byte("5 down")},
+		"migrations/0007_add_users/up.sql":    &fstest.MapFile{Data: []byte("7 up")},
+		"migrations/0007_add_users/down.sql":  &fstest.MapFile{Data: []byte("7 down")},
+		"migrations/0007_add_users/notes.txt": &fstest.MapFile{Data: []byte("ignored")},
+		"migrations/README.md":                &fstest.MapFile{Data: []byte("ignored")},
+		"migrations/1_foobar.up.sql":          &fstest.MapFile{Data: []byte("not this layout")},
+	}
+	d, err := iofs.NewWithLayout(files, "migrations", iofs.VersionDirLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Test(t, d)
+
+	testCases := []struct {
+		version        uint
+		read           func(uint) (io.ReadCloser, string, error)
+		wantBody       string
+		wantIdentifier string
+	}{
+		{version: 1, read: d.ReadUp, wantBody: "1 up", wantIdentifier: "0001"},
+		{version: 1, read: d.ReadDown, wantBody: "1 down", wantIdentifier: "0001"},
+		{version: 5, read: d.ReadDown, wantBody: "5 down", wantIdentifier: "0005"},
+		{version: 7, read: d.ReadUp, wantBody: "7 up", wantIdentifier: "add_users"},
+		{version: 7, read: d.ReadDown, wantBody: "7 down", wantIdentifier: "add_users"},
+	}
+	for _, tc := range testCases {
+		r, identifier, err := tc.read(tc.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		if string(body) != tc.wantBody || identifier != tc.wantIdentifier {
+			t.Fatalf("expected %q of %q for version %v, got %q of %q",
+				tc.wantBody, tc.wantIdentifier, tc.version, body, identifier)
+		}
+	}
+}
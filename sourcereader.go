@@ -0,0 +1,164 @@
+package migrate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/getoutreach/migrate/v4/source"
+)
+
+// SourceReader reads migrations from a source without a database, e.g. for
+// tools that lint migrations.
+type SourceReader struct {
+	sourceDrv source.Driver
+}
+
+// NewSourceOnly returns a new SourceReader from a source URL. The URL scheme is
+// defined by each driver.
+func NewSourceOnly(sourceURL string) (*SourceReader, error) {
+	sourceDrv, err := source.Open(sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	return &SourceReader{sourceDrv: sourceDrv}, nil
+}
+
+// NewSourceOnlyWithInstance returns a new SourceReader from an existing
+// source instance. You are responsible for closing the underlying source
+// client if necessary.
+func NewSourceOnlyWithInstance(sourceInstance source.Driver) *SourceReader {
+	return &SourceReader{sourceDrv: sourceInstance}
+}
+
+// Each calls fn with the contents of the up and down migration of every
+// version in the source, in version order. up or down is nil if the version
+// has no migration in that direction. Each stops at and returns the first
+// error fn returns.
+func (r *SourceReader) Each(fn func(version uint, up, down []byte) error) error {
+	v, err := r.sourceDrv.First()
+	for err == nil {
+		up, readErr := readMigration(v, r.sourceDrv.ReadUp)
+		if readErr != nil {
+			return readErr
+		}
+		down, readErr := readMigration(v, r.sourceDrv.ReadDown)
+		if readErr != nil {
+			return readErr
+		}
+		if err := fn(v, up, down); err != nil {
+			return err
+		}
+		v, err = r.sourceDrv.Next(v)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Close closes the source.
+func (r *SourceReader) Close() error {
+	return r.sourceDrv.Close()
+}
+
+// readMigration reads the migration for version with read, returning nil if
+// it doesn't exist
+func readMigration(version uint, read func(uint) (io.ReadCloser, string, error)) ([]byte, error) {
+	rc, _, err := read(version)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// SourceDiff is a migration that differs between two sources compared by
+// DiffSources. It's missing from the source InA or InB is false for, or its
+// contents differ if both are true.
+type SourceDiff struct {
+	Version   uint
+	Direction source.Direction
+	InA, InB  bool
+}
+
+// String describes the difference to humans.
+func (d SourceDiff) String() string {
+	switch {
+	case !d.InA:
+		return fmt.Sprintf("%v/%v missing in a", d.Version, d.Direction)
+	case !d.InB:
+		return fmt.Sprintf("%v/%v missing in b", d.Version, d.Direction)
+	}
+	return fmt.Sprintf("%v/%v contents differ", d.Version, d.Direction)
+}
+
+// DiffSources compares the migrations of the sources at the URLs a and b,
+// e.g. to check migrations copied elsewhere are byte-identical, and returns
+// the ones that differ in version and direction order, none if the sources
+// are the same.
+func DiffSources(a, b string) ([]SourceDiff, error) {
+	migrationsA, err := readSource(a)
+	if err != nil {
+		return nil, err
+	}
+	migrationsB, err := readSource(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []SourceDiff
+	for key, bodyA := range migrationsA {
+		bodyB, ok := migrationsB[key]
+		if !ok || !bytes.Equal(bodyA, bodyB) {
+			diffs = append(diffs, SourceDiff{Version: key.version, Direction: key.direction, InA: true, InB: ok})
+		}
+	}
+	for key := range migrationsB {
+		if _, ok := migrationsA[key]; !ok {
+			diffs = append(diffs, SourceDiff{Version: key.version, Direction: key.direction, InB: true})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Version != diffs[j].Version {
+			return diffs[i].Version < diffs[j].Version
+		}
+		return diffs[i].Direction == source.Up && diffs[j].Direction == source.Down
+	})
+	return diffs, nil
+}
+
+// migrationKey identifies a migration of a source
+type migrationKey struct {
+	version   uint
+	direction source.Direction
+}
+
+// readSource reads the contents of every migration of the source at url
+func readSource(url string) (map[migrationKey][]byte, error) {
+	r, err := NewSourceOnly(url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	migrations := make(map[migrationKey][]byte)
+	if err := r.Each(func(version uint, up, down []byte) error {
+		if up != nil {
+			migrations[migrationKey{version, source.Up}] = up
+		}
+		if down != nil {
+			migrations[migrationKey{version, source.Down}] = down
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("reading %v: %w", url, err)
+	}
+	return migrations, nil
+}
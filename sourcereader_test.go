@@ -0,0 +1,107 @@
+package migrate
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/getoutreach/migrate/v4/source"
+	_ "github.com/getoutreach/migrate/v4/source/file"
+)
+
+func TestSourceReaderEach(t *testing.T) {
+	r, err := NewSourceOnly("file://./source/iofs/testdata/migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	type migration struct {
+		up, down []byte
+	}
+	got := map[uint]migration{}
+	var versions []uint
+	if err := r.Each(func(version uint, up, down []byte) error {
+		versions = append(versions, version)
+		got[version] = migration{up: up, down: down}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedVersions := []uint{1, 3, 4, 5, 7}
+	if !reflect.DeepEqual(versions, expectedVersions) {
+		t.Fatalf("expected versions %v, got %v", expectedVersions, versions)
+	}
+	expected := map[uint]migration{
+		1: {up: []byte("1 up\n"), down: []byte("1 down\n")},
+		3: {up: []byte("3 up\n")},
+		4: {up: []byte("4 up\n"), down: []byte("4 down\n")},
+		5: {down: []byte("5 down\n")},
+		7: {up: []byte("7 up\n"), down: []byte("7 down\n")},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected migrations %q, got %q", expected, got)
+	}
+
+	// errors returned by fn stop the iteration
+	stop := errors.New("stop")
+	calls := 0
+	err = r.Each(func(version uint, up, down []byte) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Fatalf("expected Each to stop at the first error, got %v after %d calls", err, calls)
+	}
+}
+
+func TestDiffSources(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	for dir, files := range map[string]map[string]string{
+		a: {
+			"1_init.up.sql":   "CREATE TABLE t (id int);",
+			"1_init.down.sql": "DROP TABLE t;",
+			"2_index.up.sql":  "CREATE INDEX ON t (id);",
+			"3_column.up.sql": "ALTER TABLE t ADD c text;",
+			"4_seed.down.sql": "DELETE FROM t;",
+			"not_a_migration": "ignored",
+		},
+		b: {
+			"1_init.up.sql":   "CREATE TABLE t (id int);",
+			"1_init.down.sql": "DROP TABLE t;",
+			"2_index.up.sql":  "CREATE INDEX ON t (id) ;",
+			"4_seed.down.sql": "DELETE FROM t;",
+			"5_later.up.sql":  "SELECT 1;",
+		},
+	} {
+		for name, body := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	diffs, err := DiffSources("file://"+a, "file://"+b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SourceDiff{
+		{Version: 2, Direction: source.Up, InA: true, InB: true},
+		{Version: 3, Direction: source.Up, InA: true},
+		{Version: 5, Direction: source.Up, InB: true},
+	}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Fatalf("expected diffs %v, got %v", expected, diffs)
+	}
+
+	if diffs, err := DiffSources("file://"+a, "file://"+a); err != nil || len(diffs) != 0 {
+		t.Fatalf("expected no diffs comparing a source with itself, got %v %v", diffs, err)
+	}
+}
@@ -0,0 +1,73 @@
+package migrate
+
+import (
+	"errors"
+	"os"
+
+	"github.com/getoutreach/migrate/v4/database"
+	"github.com/hashicorp/go-multierror"
+)
+
+// Status is the migration status of a database, e.g. for a health check.
+type Status struct {
+	// Version is the version the database is at, database.NilVersion if no
+	// migration has been applied.
+	Version int
+	// Dirty is true if the migration to Version failed or is in progress.
+	Dirty bool
+	// Pending is the number of migrations in the source after Version.
+	Pending int
+	// SourceReachable is true if the source could be read.
+	SourceReachable bool
+}
+
+// Status returns the migration status of the database. It populates what it
+// can: if reading the version or the source fails, the fields depending on it
+// are left zero and the errors are returned along with the status.
+func (m *Migrate) Status() (Status, error) {
+	status := Status{Version: database.NilVersion}
+	var result error
+
+	v, err := m.databaseDrv.Version()
+	if err != nil {
+		result = multierror.Append(result, err)
+	} else {
+		status.Version, status.Dirty = v.Version, v.Dirty
+	}
+
+	if _, err := m.sourceDrv.First(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return status, multierror.Append(result, err)
+	}
+	status.SourceReachable = true
+
+	if result == nil {
+		pending, err := m.Pending()
+		if err != nil {
+			return status, err
+		}
+		status.Pending = len(pending)
+	}
+	return status, result
+}
+
+// Pending returns the versions in the source after the version the database
+// is at, i.e. the migrations Up would apply.
+func (m *Migrate) Pending() ([]uint, error) {
+	curVersion, err := m.databaseDrv.Version()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []uint
+	v, err := m.sourceDrv.First()
+	for err == nil {
+		if int(v) > curVersion.Version {
+			pending = append(pending, v)
+		}
+		v, err = m.sourceDrv.Next(v)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return pending, nil
+}
@@ -0,0 +1,52 @@
+package migrate
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/getoutreach/migrate/v4/source"
+	sStub "github.com/getoutreach/migrate/v4/source/stub"
+)
+
+// unreachableSource is a source that fails to be read
+type unreachableSource struct {
+	source.Driver
+}
+
+func (s unreachableSource) First() (uint, error) {
+	return 0, errors.New("connection refused")
+}
+
+func TestStatus(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+
+	status, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Status{Version: -1, Pending: 5, SourceReachable: true}); status != want {
+		t.Fatalf("expected %+v, got %+v", want, status)
+	}
+
+	if err := m.Migrate(3); err != nil {
+		t.Fatal(err)
+	}
+	status, err = m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Status{Version: 3, Pending: 3, SourceReachable: true}); status != want {
+		t.Fatalf("expected %+v, got %+v", want, status)
+	}
+
+	// the version is still reported when the source can't be read
+	m.sourceDrv = unreachableSource{m.sourceDrv}
+	status, err = m.Status()
+	if err == nil {
+		t.Fatal("expected an error reading the source")
+	}
+	if want := (Status{Version: 3}); status != want {
+		t.Fatalf("expected %+v, got %+v", want, status)
+	}
+}